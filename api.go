@@ -6,13 +6,14 @@ import (
 	"net/http"
 	"net/http/pprof"
 	_ "net/http/pprof"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/perlin-network/noise/skademlia"
 
 	"github.com/json-iterator/go"
 
+	"github.com/nokusukun/particles/config"
 	"github.com/nokusukun/particles/satellite"
 )
 
@@ -23,9 +24,15 @@ type WriteRequest struct {
 	Destination string      `json:"destination"`
 	Namespace   string      `json:"namespace"`
 	Content     interface{} `json:"content"`
+	// TTL floods the broadcast through the network for the specified amount of hops
+	TTL int `json:"ttl"`
+	// Reliable waits until the handler of the destination acknowledges the message, retrying if it doesn't
+	Reliable bool `json:"reliable"`
+	// ExpiresIn is how many seconds the message stays in the outbox if the destination can't be reached
+	ExpiresIn int `json:"expires_in"`
 }
 
-func generateAPI(sat *satellite.Satellite) *mux.Router {
+func generateAPI(sat *satellite.Satellite, outbox *Outbox) *mux.Router {
 	router := mux.NewRouter()
 
 	router.HandleFunc("/debug/pprof/", pprof.Index)
@@ -39,6 +46,24 @@ func generateAPI(sat *satellite.Satellite) *mux.Router {
 	router.Handle("/debug/pprof/threadcreate", pprof.Handler("threadcreate"))
 	router.Handle("/debug/pprof/block", pprof.Handler("block"))
 
+	router.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := sat.Metrics().WritePrometheus(w); err != nil {
+			log.Debugf("failed to write metrics: %v", err)
+		}
+	})
+
+	router.HandleFunc("/node", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":      sat.ID(),
+			"address": sat.AdvertisedAddress(),
+			// every address the node is bound to, and the ones it gives out for them
+			"listening":  sat.ListenAddresses(),
+			"advertised": sat.AdvertisedAddresses(),
+			"nat":        sat.NATInfo(),
+		})
+	}).Methods("GET")
+
 	router.HandleFunc("/peers", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Println("Retieving Peers")
 		var ids []string
@@ -56,24 +81,135 @@ func generateAPI(sat *satellite.Satellite) *mux.Router {
 		_ = json.NewDecoder(r.Body).Decode(&request)
 
 		var errCode string
-		p, exists := sat.Peers[request.Destination]
-		if exists {
-			err := p.SendMessage(satellite.Packet{
-				PacketType: satellite.PType_Message,
-				Namespace:  request.Namespace,
-				Payload:    request.Content,
+		var queued uint64
+		var err error
+		if request.Reliable {
+			err = sat.SendReliable(request.Destination, request.Namespace, request.Content)
+		} else {
+			err = sat.SendByID(request.Destination, request.Namespace, request.Content)
+		}
+
+		// Keep the message for later if the destination couldn't be reached,
+		// a reliable message that got an error back did reach its handler.
+		unreachable := err == satellite.ErrNotAcknowledged || (err != nil && !request.Reliable)
+		if unreachable && outbox != nil {
+			expiry := time.Duration(request.ExpiresIn) * time.Second
+			queued, err = outbox.Queue(request.Destination, request.Namespace, request.Content, expiry)
+			if err != nil {
+				err = fmt.Errorf("destination unreachable and %v", err)
+			}
+		}
+		if err != nil {
+			errCode = fmt.Sprintf("failed to write: %v", err)
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"queued": queued,
+			"error":  errCode,
+		})
+	})
+
+	if outbox != nil {
+		router.HandleFunc("/outbox", func(w http.ResponseWriter, r *http.Request) {
+			var errCode string
+			queues, err := outbox.Queues()
+			if err != nil {
+				errCode = fmt.Sprintf("failed to read outbox: %v", err)
+			}
+
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"queues": queues,
+				"error":  errCode,
 			})
+		}).Methods("GET")
+
+		router.HandleFunc("/outbox/{peer}", func(w http.ResponseWriter, r *http.Request) {
+			var errCode string
+			messages, err := outbox.Messages(mux.Vars(r)["peer"])
 			if err != nil {
-				errCode = fmt.Sprintf("failed to write: %v", err)
+				errCode = fmt.Sprintf("failed to read outbox: %v", err)
 			}
-		} else {
-			errCode = fmt.Sprintf("peer does not exist: %v", request.Destination)
+
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"messages": messages,
+				"error":    errCode,
+			})
+		}).Methods("GET")
+
+		router.HandleFunc("/outbox/{peer}", func(w http.ResponseWriter, r *http.Request) {
+			var errCode string
+			if err := outbox.Purge(mux.Vars(r)["peer"]); err != nil {
+				errCode = fmt.Sprintf("failed to purge outbox: %v", err)
+			}
+
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"error": errCode,
+			})
+		}).Methods("DELETE")
+
+		router.HandleFunc("/outbox/{peer}/{id}", func(w http.ResponseWriter, r *http.Request) {
+			vars := mux.Vars(r)
+			var errCode string
+			id, err := strconv.ParseUint(vars["id"], 10, 64)
+			if err == nil {
+				err = outbox.Remove(vars["peer"], id)
+			}
+			if err != nil {
+				errCode = fmt.Sprintf("failed to remove message: %v", err)
+			}
+
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"error": errCode,
+			})
+		}).Methods("DELETE")
+	}
+
+	router.HandleFunc("/acl", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"acl": sat.ACL(),
+		})
+	}).Methods("GET")
+
+	router.HandleFunc("/acl", func(w http.ResponseWriter, r *http.Request) {
+		acl := config.ACL{}
+		err := json.NewDecoder(r.Body).Decode(&acl)
+		if err == nil {
+			err = updateACL(sat, acl)
 		}
 
+		var errCode string
+		if err != nil {
+			errCode = fmt.Sprintf("failed to set acl: %v", err)
+		}
 		_ = json.NewEncoder(w).Encode(map[string]interface{}{
 			"error": errCode,
 		})
-	})
+	}).Methods("PUT")
+
+	// Adds or removes a peer from the list of the ACL mode
+	router.HandleFunc("/acl/peers/{peer}", func(w http.ResponseWriter, r *http.Request) {
+		peer := mux.Vars(r)["peer"]
+		acl := sat.ACL()
+
+		var peers []string
+		for _, id := range acl.Peers {
+			if id != peer {
+				peers = append(peers, id)
+			}
+		}
+		if r.Method == "POST" {
+			peers = append(peers, peer)
+		}
+		acl.Peers = peers
+
+		var errCode string
+		if err := updateACL(sat, acl); err != nil {
+			errCode = fmt.Sprintf("failed to set acl: %v", err)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": errCode,
+		})
+	}).Methods("POST", "DELETE")
 
 	router.HandleFunc("/broadcast", func(w http.ResponseWriter, r *http.Request) {
 		request := WriteRequest{}
@@ -82,11 +218,12 @@ func generateAPI(sat *satellite.Satellite) *mux.Router {
 
 		var errCode string
 
-		err := skademlia.Broadcast(sat.Node, satellite.Packet{
-			PacketType: satellite.PType_Broadcast,
-			Namespace:  request.Namespace,
-			Payload:    request.Content,
-		})
+		var err []error
+		if request.TTL > 0 {
+			err = sat.BroadcastFlood(request.Namespace, request.Content, request.TTL)
+		} else {
+			err = sat.Broadcast(request.Namespace, request.Content)
+		}
 		if err != nil {
 			errCode = fmt.Sprintf("failed to write: %v", err)
 		}
@@ -96,6 +233,23 @@ func generateAPI(sat *satellite.Satellite) *mux.Router {
 		})
 	})
 
+	router.HandleFunc("/publish", func(w http.ResponseWriter, r *http.Request) {
+		request := WriteRequest{}
+
+		_ = json.NewDecoder(r.Body).Decode(&request)
+
+		var errCode string
+
+		err := sat.Publish(request.Namespace, request.Content)
+		if err != nil {
+			errCode = fmt.Sprintf("failed to publish: %v", err)
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": errCode,
+		})
+	})
+
 	router.HandleFunc("/broadcast_rating", func(w http.ResponseWriter, r *http.Request) {
 		rat := Rating{}
 
@@ -111,11 +265,7 @@ func generateAPI(sat *satellite.Satellite) *mux.Router {
 			log.Debugf("failed to marshal json: %v\n%v", err, string(b))
 			errCode = fmt.Sprintf("failed to marshal json: %v", err)
 		} else {
-			err := skademlia.Broadcast(sat.Node, satellite.Packet{
-				PacketType: satellite.PType_Broadcast,
-				Namespace:  "new_rating",
-				Payload:    rat,
-			})
+			err := sat.Broadcast("new_rating", rat)
 			if err != nil {
 				log.Debugf("failed to broadcast: %v", err)
 				errCode = fmt.Sprintf("failed to broadcast: %v", err)
@@ -133,22 +283,107 @@ func generateAPI(sat *satellite.Satellite) *mux.Router {
 		var errCode string
 		var ratings []interface{}
 
-		p, exists := sat.Peers[vars["peer"]]
-		if exists {
-			start := time.Now()
+		start := time.Now()
+		rs, err := sat.RequestByID(vars["peer"], "get_rating", RatingRequest{vars["ids"]})
+		if err != nil {
+			log.Errorf("failed to write: %v", err)
+			errCode = fmt.Sprintf("failed to write: %v", err)
+		} else {
+			log.Debug("Waiting for streams")
+			for inbound := range rs.Stream {
+				ratings = append(ratings, inbound.Payload)
+			}
+		}
+		log.Debug("Waiting for streams is complete: ", time.Now().Sub(start))
+
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"ratings": ratings,
+			"error":   errCode,
+		})
+	})
+
+	router.HandleFunc("/dht/{key}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		var errCode string
+
+		rec, err := sat.Get(vars["key"])
+		if err != nil {
+			errCode = fmt.Sprintf("failed to get: %v", err)
+		}
+
+		var value interface{}
+		if rec != nil {
+			_ = rec.As(&value)
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"record": rec,
+			"value":  value,
+			"error":  errCode,
+		})
+	}).Methods("GET")
+
+	router.HandleFunc("/dht/{key}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		var errCode string
+		var value interface{}
+
+		_ = json.NewDecoder(r.Body).Decode(&value)
+
+		var err error
+		if r.URL.Query().Get("sign") != "" {
+			err = sat.PutSigned(vars["key"], value)
+		} else {
+			err = sat.Put(vars["key"], value)
+		}
+		if err != nil {
+			errCode = fmt.Sprintf("failed to put: %v", err)
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": errCode,
+		})
+	}).Methods("POST")
+
+	router.HandleFunc("/providers/{namespace}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		var errCode string
+		var ids []string
+
+		peers, err := sat.FindProviders(vars["namespace"])
+		if err != nil {
+			errCode = fmt.Sprintf("failed to find providers: %v", err)
+		}
+		for _, p := range peers {
+			ids = append(ids, satellite.GetPeerID(p))
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"providers": ids,
+			"error":     errCode,
+		})
+	}).Methods("GET")
+
+	router.HandleFunc("/findratings/{ids}", func(w http.ResponseWriter, r *http.Request) {
+
+		vars := mux.Vars(r)
+		var errCode string
+		var ratings []interface{}
+
+		providers, err := sat.FindProviders("get_rating")
+		if err != nil {
+			errCode = fmt.Sprintf("failed to find providers: %v", err)
+		}
+
+		for _, p := range providers {
 			rs, err := sat.Request(p, "get_rating", RatingRequest{vars["ids"]})
 			if err != nil {
 				log.Errorf("failed to write: %v", err)
-				errCode = fmt.Sprintf("failed to write: %v", err)
-			} else {
-				log.Debug("Waiting for streams")
-				for inbound := range rs.Stream {
-					ratings = append(ratings, inbound.Payload)
-				}
+				continue
+			}
+			for inbound := range rs.Stream {
+				ratings = append(ratings, inbound.Payload)
 			}
-			log.Debug("Waiting for streams is complete: ", time.Now().Sub(start))
-		} else {
-			errCode = fmt.Sprintf("peer does not exist: %v", vars["peer"])
 		}
 
 		_ = json.NewEncoder(w).Encode(map[string]interface{}{
@@ -163,11 +398,33 @@ func generateAPI(sat *satellite.Satellite) *mux.Router {
 		var errCode string
 		var ratings []interface{}
 
-		rs, err := sat.Seek("get_rating", RatingRequest{vars["ids"]})
+		// Seeks only reach the connected peers unless a ttl floods them further
+		ttl := 0
+		if v := r.URL.Query().Get("ttl"); v != "" {
+			var err error
+			ttl, err = strconv.Atoi(v)
+			if err != nil || ttl < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{
+					"error": fmt.Sprintf("invalid ttl %q, expected a non-negative amount of hops", v),
+				})
+				return
+			}
+		}
+
+		var trace string
+		var rs *satellite.ResponseStream
+		var err error
+		if ttl > 0 {
+			rs, err = sat.SeekFlood("get_rating", RatingRequest{vars["ids"]}, ttl)
+		} else {
+			rs, err = sat.Seek("get_rating", RatingRequest{vars["ids"]})
+		}
 		if err != nil {
 			log.Errorf("failed to broadcast: %v", err)
 			errCode = fmt.Sprintf("failed to write: %v", err)
 		} else {
+			trace = rs.Trace.TraceID
 			log.Debug("Waiting for streams")
 			for inbound := range rs.Stream {
 				ratings = append(ratings, inbound.Payload)
@@ -176,9 +433,26 @@ func generateAPI(sat *satellite.Satellite) *mux.Router {
 
 		_ = json.NewEncoder(w).Encode(map[string]interface{}{
 			"ratings": ratings,
+			"trace":   trace,
 			"error":   errCode,
 		})
 	})
 
 	return router
 }
+
+// updateACL replaces the ACL of the satellite and saves it to the ACL file if there's one
+func updateACL(sat *satellite.Satellite, acl config.ACL) error {
+	if err := sat.SetACL(acl); err != nil {
+		return err
+	}
+	if cdae.ACLPath == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(acl, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cdae.ACLPath, b, 0600)
+}
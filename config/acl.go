@@ -0,0 +1,34 @@
+package config
+
+// ACL modes
+const (
+	// ACLOpen lets every peer in, only the rules apply
+	ACLOpen = ""
+	// ACLAllowlist only lets in the listed peers
+	ACLAllowlist = "allow"
+	// ACLDenylist lets in every peer but the listed ones
+	ACLDenylist = "deny"
+)
+
+// ACL decides which peers the satellite handles the packets of, peers are hex encoded IDs
+type ACL struct {
+	Mode  string    `json:"mode"`
+	Peers []string  `json:"peers"`
+	Rules []ACLRule `json:"rules"`
+	// Authorities are the keys trusted to issue capabilities, a request carrying a valid capability
+	// for its namespace is let in whatever the mode and the rules say
+	Authorities []string `json:"authorities,omitempty"`
+}
+
+// ACLRule restricts the packets of a namespace, on top of the mode of the ACL.
+// Type is the packet type the rule applies to, "request", "broadcast", "message", "seek" or "internal",
+// every type if it's empty.
+type ACLRule struct {
+	Namespace string `json:"namespace"`
+	Type      string `json:"type,omitempty"`
+	// Allow lists the only peers allowed, every peer is if it's empty
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+	// Capability makes the requests to the namespace need a capability from one of the authorities
+	Capability bool `json:"capability,omitempty"`
+}
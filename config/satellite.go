@@ -1,16 +1,70 @@
 package config
 
+import (
+	"time"
+
+	"github.com/perlin-network/noise/transport"
+)
+
 type Satellite struct {
-	Host        string
-	Port        uint
+	Host string
+	Port uint
+	// Listen are more addresses in host:port form to listen on next to Host and Port, IPv6 hosts go in brackets.
+	// Every address gets advertised to the DHT.
+	Listen []string
+	// NAT is the strategy used to map the port on the gateway, "upnp" or "pmp". The port isn't mapped if it's empty,
+	// the advertised address still gets corrected from the addresses the peers see the satellite from.
+	NAT string
+	// Deprecated: DisableUPNP maps the port with UPnP when it's set and NAT is empty, like it always did
+	// despite its name. Set NAT to "upnp" instead.
 	DisableUPNP bool
+	// DisableBootstrap stops the satellite from looking up the s/kad network whenever a peer connects,
+	// the satellite only connects to the peers that are dialed.
+	DisableBootstrap bool
+	// Compression lists the codecs offered to peers in order of preference, "snappy" and "gzip" are supported.
+	// `satellite.DefaultCompression` is offered if it's empty.
+	Compression        []string
+	DisableCompression bool
+	// Relay forwards circuits between peers that can't reach each other directly, see `Satellite.DialVia`
+	Relay bool
+	// RelayMaxCircuits is the amount of circuits relayed at the same time, `satellite.RelayMaxCircuits` if it's 0
+	RelayMaxCircuits int
+	// RelayBandwidth is the amount of bytes per second forwarded across every circuit, 0 is unlimited
+	RelayBandwidth int
+	// SwarmKey is the pre-shared key of a private network, peers have to prove they know it when they connect.
+	// Satellites without a key only connect to the satellites without one.
+	SwarmKey []byte `json:"-"`
+	// ACL decides which peers the satellite handles the packets of, see `Satellite.SetACL`
+	ACL ACL
+	// Transport is the layer the satellite listens and dials through, TCP is used if it's not set
+	Transport transport.Layer `json:"-"`
+	// Clock replaces the real time for the timeouts of response streams and the expiry of flooded packets,
+	// satellite/sim runs satellites on a virtual clock through it
+	Clock Clock `json:"-"`
+}
+
+// Clock tells the time to a satellite
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
 }
 
 type Daemon struct {
 	DialTo          string
 	ApiListen       string
 	KeyPath         string
+	PassphrasePath  string
+	HandoverPath    string
+	SwarmKeyPath    string
+	ACLPath         string
 	GenerateNewKeys bool
 	ShowHelp        bool
 	DatabasePath    string
+	ProvideRatings  bool
+	// OutboxMaxQueue is the amount of messages kept for a peer that can't be reached, 0 is unlimited
+	OutboxMaxQueue int
+	// OutboxExpiry is how long a message stays in the outbox if the sender didn't give it an expiry
+	OutboxExpiry time.Duration
+	// TraceFile is the file the spans of the satellite get appended to as JSON lines
+	TraceFile string
 }
@@ -13,6 +13,16 @@ func makeId(source, dest, nextSeq string) []byte {
 	return []byte(fmt.Sprint(source, nextSeq, dest))
 }
 
+// ratesIdentity returns true if the key of a rating has one of the identities as its source or destination
+func ratesIdentity(k []byte, identities [][]byte) bool {
+	for _, id := range identities {
+		if bytes.HasPrefix(k, id) || bytes.HasSuffix(k, id) {
+			return true
+		}
+	}
+	return false
+}
+
 func bootstrapEvents(sat *satellite.Satellite, db *bolt.DB) {
 	log := log.Sub("events")
 
@@ -41,7 +51,7 @@ func bootstrapEvents(sat *satellite.Satellite, db *bolt.DB) {
 				return err
 			}
 
-			return b.Put(makeId(rating.Source, rating.Destination, string(id)), bRat)
+			return b.Put(makeId(rating.Source, rating.Destination, string(rune(id))), bRat)
 		})
 
 		if err != nil {
@@ -49,7 +59,7 @@ func bootstrapEvents(sat *satellite.Satellite, db *bolt.DB) {
 		}
 	})
 
-	sat.Event(satellite.PType_Seek, "get_rating", func(i *satellite.Inbound) {
+	getRating := func(i *satellite.Inbound) {
 		// A pretty ugly oneliner to cast the payload as a struct
 		req := i.As(&RatingRequest{}).(*RatingRequest)
 		log.Debugf("SEEK RECEIVE: %v", i.Message.ReturnTag())
@@ -62,10 +72,15 @@ func bootstrapEvents(sat *satellite.Satellite, db *bolt.DB) {
 			b := tx.Bucket([]byte("ratings"))
 			cur := b.Cursor()
 
-			r := []byte(req.Identity)
+			// Ratings of the previous keys of the identity are attributed to it as well
+			current := sat.Successor(req.Identity)
+			var identities [][]byte
+			for _, id := range append([]string{current}, sat.Predecessors(current)...) {
+				identities = append(identities, []byte(id))
+			}
 
 			for k, v := cur.First(); k != nil; k, v = cur.Next() {
-				if bytes.HasPrefix(k, r) || bytes.HasSuffix(k, r) {
+				if ratesIdentity(k, identities) {
 					// Unmarshal the data into a Rating struct
 					rat := Rating{}
 					err := json.Unmarshal(v, &rat)
@@ -86,5 +101,9 @@ func bootstrapEvents(sat *satellite.Satellite, db *bolt.DB) {
 			log.Error("failed to respond to request", err)
 		}
 
-	})
+	}
+
+	sat.Event(satellite.PType_Seek, "get_rating", getRating)
+	// Providers of get_rating are requested directly
+	sat.Event(satellite.PType_Request, "get_rating", getRating)
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/perlin-network/noise/skademlia"
+
+	"github.com/nokusukun/particles/keys"
+	"github.com/nokusukun/particles/satellite"
+	"github.com/nokusukun/particles/satellite/satellitetest"
+)
+
+func keyID(k *skademlia.Keypair) string {
+	return hex.EncodeToString(k.PublicKey())
+}
+
+func TestRatesIdentity(t *testing.T) {
+	a, b, other := randomID(), randomID(), randomID()
+	identities := [][]byte{[]byte(a), []byte(b)}
+
+	tests := []struct {
+		name  string
+		key   []byte
+		rates bool
+	}{
+		{"source", makeId(a, other, "\x01"), true},
+		{"destination", makeId(other, b, "\x02"), true},
+		{"unrelated", makeId(other, other, "\x03"), false},
+	}
+	for _, tt := range tests {
+		if rates := ratesIdentity(tt.key, identities); rates != tt.rates {
+			t.Errorf("%v: ratesIdentity returned %v", tt.name, rates)
+		}
+	}
+}
+
+// TestRatingsFollowHandover asks for the ratings of an identity after its key got handed over,
+// the ratings of the old key are attributed to the new one.
+func TestRatingsFollowHandover(t *testing.T) {
+	c, err := satellitetest.StartInMemory(3, satellitetest.Star)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	db, closeDB := openTestDB(t)
+	defer closeDB()
+	bootstrapEvents(c.Sat(0), db)
+
+	oldKeys, other := skademlia.RandomKeys(), randomID()
+	old, current := keyID(oldKeys), c.ID(2)
+	ratings := []Rating{
+		{Source: old, Destination: other, Content: "by the old key"},
+		{Source: other, Destination: old, Content: "of the old key"},
+		{Source: current, Destination: other, Content: "by the new key"},
+		{Source: other, Destination: other, Content: "unrelated"},
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("ratings"))
+		if err != nil {
+			return err
+		}
+		for n, rating := range ratings {
+			bRat, err := json.Marshal(rating)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(makeId(rating.Source, rating.Destination, string(rune(n+1))), bRat); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := keys.SignHandover(oldKeys, c.Keys[2], time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Sat(2).AnnounceHandover(h); err != nil {
+		t.Fatal(err)
+	}
+	err = satellitetest.WaitUntil(5*time.Second, func() bool { return c.Sat(0).Successor(old) == current })
+	if err != nil {
+		t.Fatal("the handover never reached the satellite: ", err)
+	}
+
+	for _, identity := range []string{old, current} {
+		got := requestRatings(t, c, identity)
+		if len(got) != 3 || got["unrelated"] {
+			t.Errorf("ratings of %v: %v", identity, got)
+		}
+	}
+}
+
+// requestRatings requests the ratings of the identity from satellite 0, keyed by their content
+func requestRatings(t *testing.T, c *satellitetest.Cluster, identity string) map[interface{}]bool {
+	t.Helper()
+	peer, err := c.Sat(1).WaitForPeer(c.ID(0), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := c.Sat(1).Request(peer, "get_rating", RatingRequest{Identity: identity})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[interface{}]bool{}
+	for in := range rs.Stream {
+		got[in.As(&Rating{}).(*Rating).Content] = true
+	}
+	if end := <-rs.Done; end != satellite.StreamEndOK {
+		t.Fatalf("get_rating ended with %v", end)
+	}
+	return got
+}
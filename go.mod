@@ -5,12 +5,14 @@ go 1.12
 require (
 	github.com/boltdb/bolt v1.3.1
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b // indirect
+	github.com/golang/snappy v0.0.1
 	github.com/google/glog v0.4.0 // indirect
 	github.com/gorilla/mux v1.7.3
 	github.com/huin/goupnp v1.0.0
 	github.com/json-iterator/go v1.1.7
 	github.com/kr/pretty v0.1.0 // indirect
 	github.com/mitchellh/mapstructure v1.1.2
+	github.com/modern-go/reflect2 v1.0.2 // indirect
 	github.com/nokusukun/stemp v0.0.0-20190721151213-e6029a1e4f9a
 	github.com/perlin-network/noise v0.0.0-20190219190757-3c13535b725d
 	github.com/rs/zerolog v1.11.0
@@ -18,7 +20,7 @@ require (
 	github.com/vbatts/gogololcat v0.0.0-20140616194347-236b66e87b84 // indirect
 	golang.org/x/crypto v0.0.0-20191002192127-34f69633bfdc
 	golang.org/x/net v0.0.0-20191009170851-d66e71096ffb // indirect
-	golang.org/x/sys v0.0.0-20191009170203-06d7bd2c5f4f // indirect
+	golang.org/x/sys v0.0.0-20191009170203-06d7bd2c5f4f
 	golang.org/x/text v0.3.2 // indirect
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
 	gopkg.in/yaml.v2 v2.2.4 // indirect
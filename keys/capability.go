@@ -0,0 +1,186 @@
+package keys
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/perlin-network/noise/skademlia"
+)
+
+// MaxCapabilityChain is the most links a delegated capability can have, the root included
+const MaxCapabilityChain = 8
+
+// capabilityDomain separates the signatures of capabilities from anything else signed with the same keys
+const capabilityDomain = "particles/capability/v1"
+
+// Capability is a token signed by the issuer that grants the grantee the namespaces until it expires.
+// Keys are hex encoded public keys, the same as the IDs of the satellites. A grantee can delegate the
+// capability to another key while the depth is above 0, the delegated capability carries its parent.
+type Capability struct {
+	Issuer     string      `json:"iss"`
+	Grantee    string      `json:"sub"`
+	Namespaces []string    `json:"ns"`
+	Expires    int64       `json:"exp"`
+	Depth      int         `json:"depth,omitempty"`
+	Parent     *Capability `json:"parent,omitempty"`
+	Signature  []byte      `json:"sig"`
+}
+
+// IssueCapability signs a capability from the authority to the grantee. Depth is how many times it can be delegated further.
+func IssueCapability(authority *skademlia.Keypair, grantee string, namespaces []string, expires time.Time, depth int) (*Capability, error) {
+	if depth < 0 {
+		return nil, fmt.Errorf("negative delegation depth")
+	}
+	return sign(authority, &Capability{
+		Grantee:    grantee,
+		Namespaces: namespaces,
+		Expires:    expires.Unix(),
+		Depth:      depth,
+	})
+}
+
+// Delegate signs a capability from the grantee of c to another key, narrowed down to the namespaces and expiry.
+// The namespaces default to the ones of c, they and the expiry can't go beyond what c grants.
+func (c *Capability) Delegate(holder *skademlia.Keypair, grantee string, namespaces []string, expires time.Time) (*Capability, error) {
+	if c.Grantee != hex.EncodeToString(holder.PublicKey()) {
+		return nil, fmt.Errorf("capability isn't granted to the key")
+	}
+	if c.Depth < 1 {
+		return nil, fmt.Errorf("capability can't be delegated")
+	}
+	if namespaces == nil {
+		namespaces = c.Namespaces
+	}
+
+	child := &Capability{
+		Grantee:    grantee,
+		Namespaces: namespaces,
+		Expires:    expires.Unix(),
+		Depth:      c.Depth - 1,
+		Parent:     c,
+	}
+	if err := child.narrows(c); err != nil {
+		return nil, err
+	}
+	return sign(holder, child)
+}
+
+// VerifyCapability checks that the capability grants the namespace to the grantee at the time, and that its chain
+// of delegations is properly signed and goes back to one of the authorities.
+func VerifyCapability(c *Capability, authorities []string, grantee, namespace string, now time.Time) error {
+	if c == nil {
+		return fmt.Errorf("no capability")
+	}
+	if c.Grantee != grantee {
+		return fmt.Errorf("capability is granted to %v", c.Grantee)
+	}
+	if !contains(c.Namespaces, namespace) {
+		return fmt.Errorf("capability doesn't grant %v", namespace)
+	}
+
+	links := 0
+	for link := c; link != nil; link = link.Parent {
+		if links++; links > MaxCapabilityChain {
+			return fmt.Errorf("capability chain is longer than %v", MaxCapabilityChain)
+		}
+		if now.Unix() >= link.Expires {
+			return fmt.Errorf("capability expired")
+		}
+		if err := link.verifySignature(); err != nil {
+			return err
+		}
+
+		if link.Parent == nil {
+			if !contains(authorities, link.Issuer) {
+				return fmt.Errorf("capability isn't issued by an authority")
+			}
+			continue
+		}
+		if link.Issuer != link.Parent.Grantee {
+			return fmt.Errorf("capability is delegated by %v which isn't its grantee", link.Issuer)
+		}
+		if link.Depth >= link.Parent.Depth {
+			return fmt.Errorf("capability delegated beyond its depth")
+		}
+		if err := link.narrows(link.Parent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ReadCapability(path string) (*Capability, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := new(Capability)
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("invalid capability: %v", err)
+	}
+	return c, nil
+}
+
+// narrows checks that the capability doesn't grant more than its parent
+func (c *Capability) narrows(parent *Capability) error {
+	for _, ns := range c.Namespaces {
+		if !contains(parent.Namespaces, ns) {
+			return fmt.Errorf("delegated capability grants %v which its parent doesn't", ns)
+		}
+	}
+	if c.Expires > parent.Expires {
+		return fmt.Errorf("delegated capability outlives its parent")
+	}
+	return nil
+}
+
+func (c *Capability) verifySignature() error {
+	pub, err := hex.DecodeString(c.Issuer)
+	if err != nil {
+		return fmt.Errorf("invalid issuer: %v", err)
+	}
+	if err := new(skademlia.Keypair).Verify(pub, c.signingBytes(), c.Signature); err != nil {
+		return fmt.Errorf("invalid capability signature by %v", c.Issuer)
+	}
+	return nil
+}
+
+// signingBytes is what the issuer signs, the signature of the parent binds the capability to its chain
+func (c *Capability) signingBytes() []byte {
+	var parent []byte
+	if c.Parent != nil {
+		parent = c.Parent.Signature
+	}
+	b, _ := json.Marshal(struct {
+		Domain     string
+		Issuer     string
+		Grantee    string
+		Namespaces []string
+		Expires    int64
+		Depth      int
+		Parent     []byte
+	}{capabilityDomain, c.Issuer, c.Grantee, c.Namespaces, c.Expires, c.Depth, parent})
+	return b
+}
+
+func sign(issuer *skademlia.Keypair, c *Capability) (*Capability, error) {
+	c.Issuer = hex.EncodeToString(issuer.PublicKey())
+	sig, err := issuer.Sign(c.signingBytes())
+	if err != nil {
+		return nil, err
+	}
+	c.Signature = sig
+	return c, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
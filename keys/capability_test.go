@@ -0,0 +1,133 @@
+package keys
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perlin-network/noise/skademlia"
+)
+
+func TestVerifyCapability(t *testing.T) {
+	authority, admin, operator := skademlia.RandomKeys(), skademlia.RandomKeys(), skademlia.RandomKeys()
+	authorities := []string{keyID(authority)}
+	now := time.Now()
+	expires := now.Add(time.Hour)
+
+	root, err := IssueCapability(authority, keyID(admin), []string{"admin", "stats"}, expires, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delegated, err := root.Delegate(admin, keyID(operator), []string{"stats"}, expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// resign builds a link on top of the root that Delegate would refuse
+	resign := func(child *Capability) *Capability {
+		child.Parent = root
+		signed, err := sign(admin, child)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	tampered := *delegated
+	tampered.Namespaces = []string{"stats", "admin"}
+
+	tests := []struct {
+		name       string
+		capability *Capability
+		grantee    string
+		namespace  string
+		now        time.Time
+		err        string
+	}{
+		{"root", root, keyID(admin), "admin", now, ""},
+		{"delegated", delegated, keyID(operator), "stats", now, ""},
+		{"not granted", delegated, keyID(operator), "admin", now, "doesn't grant admin"},
+		{"other grantee", delegated, keyID(admin), "stats", now, "is granted to"},
+		{"broken signature", &tampered, keyID(operator), "admin", now, "invalid capability signature"},
+		{"widening namespace", resign(&Capability{Grantee: keyID(operator), Namespaces: []string{"stats", "logs"}, Expires: expires.Unix()}),
+			keyID(operator), "logs", now, "which its parent doesn't"},
+		{"outliving parent", resign(&Capability{Grantee: keyID(operator), Namespaces: []string{"stats"}, Expires: expires.Add(time.Hour).Unix()}),
+			keyID(operator), "stats", now, "outlives its parent"},
+		{"expired link", delegated, keyID(operator), "stats", expires, "expired"},
+		{"depth overflow", resign(&Capability{Grantee: keyID(operator), Namespaces: []string{"stats"}, Expires: expires.Unix(), Depth: 1}),
+			keyID(operator), "stats", now, "beyond its depth"},
+		{"unknown authority", mustIssue(t, admin, keyID(operator), expires, 0), keyID(operator), "stats", now, "isn't issued by an authority"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyCapability(tt.capability, authorities, tt.grantee, tt.namespace, tt.now)
+			if tt.err == "" && err != nil {
+				t.Errorf("valid capability got refused: %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestDelegateCapability(t *testing.T) {
+	authority, admin, operator := skademlia.RandomKeys(), skademlia.RandomKeys(), skademlia.RandomKeys()
+	expires := time.Now().Add(time.Hour)
+
+	root := mustIssue(t, authority, keyID(admin), expires, 0)
+	if _, err := root.Delegate(admin, keyID(operator), nil, expires); err == nil {
+		t.Error("delegated a capability without depth left")
+	}
+
+	root = mustIssue(t, authority, keyID(admin), expires, 1)
+	if _, err := root.Delegate(operator, keyID(operator), nil, expires); err == nil {
+		t.Error("delegated a capability granted to another key")
+	}
+	if _, err := root.Delegate(admin, keyID(operator), []string{"stats", "admin"}, expires); err == nil {
+		t.Error("delegated a namespace the capability doesn't grant")
+	}
+	if _, err := root.Delegate(admin, keyID(operator), nil, expires.Add(time.Hour)); err == nil {
+		t.Error("delegated a capability outliving its parent")
+	}
+}
+
+// TestMaxCapabilityChain delegates a capability down a chain of keys, it's only valid up to MaxCapabilityChain links
+func TestMaxCapabilityChain(t *testing.T) {
+	authority := skademlia.RandomKeys()
+	expires := time.Now().Add(time.Hour)
+
+	holder := skademlia.RandomKeys()
+	c := mustIssue(t, authority, keyID(holder), expires, MaxCapabilityChain)
+	for links := 1; links <= MaxCapabilityChain+1; links++ {
+		err := VerifyCapability(c, []string{keyID(authority)}, keyID(holder), "stats", time.Now())
+		if links <= MaxCapabilityChain && err != nil {
+			t.Fatalf("chain of %v links got refused: %v", links, err)
+		}
+		if links > MaxCapabilityChain && (err == nil || !strings.Contains(err.Error(), "chain is longer")) {
+			t.Fatalf("chain of %v links got %v", links, err)
+		}
+		if links > MaxCapabilityChain {
+			break
+		}
+
+		next := skademlia.RandomKeys()
+		delegated, err := c.Delegate(holder, keyID(next), nil, expires)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, holder = delegated, next
+	}
+}
+
+func mustIssue(t *testing.T, authority *skademlia.Keypair, grantee string, expires time.Time, depth int) *Capability {
+	c, err := IssueCapability(authority, grantee, []string{"stats"}, expires, depth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func keyID(keys *skademlia.Keypair) string {
+	return hex.EncodeToString(keys.PublicKey())
+}
@@ -0,0 +1,206 @@
+package keys
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/perlin-network/noise/skademlia"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// KeyFileMode is the permission key files are written with, only the owner can read them
+const KeyFileMode os.FileMode = 0600
+
+// EncryptedKeyVersion is the version of the encrypted key format written by SerializeEncrypted
+const EncryptedKeyVersion = 1
+
+// Parameters of scrypt for new key files, they're stored in the file so they can be raised later on
+var (
+	ScryptN = 1 << 15
+	ScryptR = 8
+	ScryptP = 1
+)
+
+// scryptMaxMemory keeps a tampered key file from making scrypt allocate gigabytes,
+// scrypt needs 128*N*R bytes which is 32MiB for the defaults
+const scryptMaxMemory = 256 << 20
+
+var (
+	// ErrWrongPassphrase is returned when an encrypted key doesn't decrypt with the passphrase
+	ErrWrongPassphrase = errors.New("wrong passphrase or corrupted key")
+	// ErrKeyEncrypted is returned when encrypted keys are read without a passphrase
+	ErrKeyEncrypted = errors.New("key is encrypted, a passphrase is needed")
+)
+
+// EncryptedKeyExport is a KeyExport encrypted with a key derived from a passphrase with scrypt,
+// then sealed with XChaCha20-Poly1305.
+type EncryptedKeyExport struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	Salt       []byte `json:"salt"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// SerializeEncrypted encrypts the keys with the passphrase
+func SerializeEncrypted(keys *skademlia.Keypair, passphrase []byte) ([]byte, error) {
+	plain, err := Serialize(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	e := EncryptedKeyExport{
+		Version: EncryptedKeyVersion,
+		KDF:     "scrypt",
+		Salt:    make([]byte, 32),
+		N:       ScryptN,
+		R:       ScryptR,
+		P:       ScryptP,
+		Nonce:   make([]byte, chacha20poly1305.NonceSizeX),
+	}
+	if _, err := rand.Read(e.Salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(e.Nonce); err != nil {
+		return nil, err
+	}
+
+	aead, err := e.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	e.Ciphertext = aead.Seal(nil, e.Nonce, plain, e.additionalData())
+	return json.Marshal(e)
+}
+
+// DeserializeEncrypted decrypts keys serialized by SerializeEncrypted
+func DeserializeEncrypted(b []byte, passphrase []byte) (*skademlia.Keypair, error) {
+	var e EncryptedKeyExport
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, err
+	}
+	if e.Version != EncryptedKeyVersion {
+		return nil, fmt.Errorf("unsupported key version %v", e.Version)
+	}
+	if e.KDF != "scrypt" {
+		return nil, fmt.Errorf("unsupported key derivation %q", e.KDF)
+	}
+	if e.N < 1 || e.R < 1 || e.P < 1 {
+		return nil, fmt.Errorf("invalid scrypt parameters")
+	}
+	if e.N > scryptMaxMemory/128/e.R || e.R*e.P > 64 {
+		return nil, fmt.Errorf("scrypt parameters are too expensive")
+	}
+	if len(e.Nonce) != chacha20poly1305.NonceSizeX {
+		return nil, fmt.Errorf("invalid nonce")
+	}
+
+	aead, err := e.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, e.Nonce, e.Ciphertext, e.additionalData())
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return Deserialize(plain)
+}
+
+// IsEncrypted returns true if the serialized keys are encrypted, plaintext ones come from Serialize
+func IsEncrypted(b []byte) bool {
+	var v struct {
+		Version int `json:"version"`
+	}
+	return json.Unmarshal(b, &v) == nil && v.Version != 0
+}
+
+// ReadKeysWithPassphrase reads plaintext and encrypted key files, the passphrase is only asked for encrypted ones
+func ReadKeysWithPassphrase(keyPath string, passphrase func() ([]byte, error)) (*skademlia.Keypair, error) {
+	b, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	if !IsEncrypted(b) {
+		return Deserialize(b)
+	}
+
+	pass, err := passphrase()
+	if err != nil {
+		return nil, err
+	}
+	return DeserializeEncrypted(b, pass)
+}
+
+// WriteKeys saves the keys to the file readable by the owner only, encrypted unless the passphrase is empty
+func WriteKeys(keyPath string, keys *skademlia.Keypair, passphrase []byte) error {
+	var b []byte
+	var err error
+	if len(passphrase) == 0 {
+		b, err = Serialize(keys)
+	} else {
+		b, err = SerializeEncrypted(keys, passphrase)
+	}
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(keyPath, b, KeyFileMode)
+}
+
+// writeFileAtomic writes the file next to the path then renames it over the path, a crash leaves
+// either the previous file or the new one but never a truncated key.
+func writeFileAtomic(path string, b []byte, mode os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	err = f.Chmod(mode)
+	if err == nil {
+		_, err = f.Write(b)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	// The rename only survives a crash once the directory is synced as well
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+func (e EncryptedKeyExport) aead(passphrase []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, e.Salt, e.N, e.R, e.P, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %v", err)
+	}
+	return chacha20poly1305.NewX(key)
+}
+
+// additionalData binds the parameters of the file to the ciphertext so they can't be tampered with
+func (e EncryptedKeyExport) additionalData() []byte {
+	return []byte(fmt.Sprintf("particles/key/v%v/%v/%v/%v/%v", e.Version, e.KDF, e.N, e.R, e.P))
+}
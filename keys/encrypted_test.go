@@ -0,0 +1,145 @@
+package keys
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/perlin-network/noise/skademlia"
+)
+
+// fastScrypt lowers the cost of scrypt for the duration of a test
+func fastScrypt() func() {
+	n := ScryptN
+	ScryptN = 1 << 10
+	return func() { ScryptN = n }
+}
+
+func tempKeyPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "node.key"), func() { os.RemoveAll(dir) }
+}
+
+func TestEncryptedKeysRoundTrip(t *testing.T) {
+	defer fastScrypt()()
+	path, cleanup := tempKeyPath(t)
+	defer cleanup()
+
+	// An existing file readable by others gets replaced by one that isn't
+	if err := ioutil.WriteFile(path, []byte("previous"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	k := skademlia.RandomKeys()
+	if err := WriteKeys(path, k, []byte("hunter2")); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != KeyFileMode {
+		t.Errorf("key file is written with %v", info.Mode().Perm())
+	}
+	files, _ := ioutil.ReadDir(filepath.Dir(path))
+	if len(files) != 1 {
+		t.Errorf("writing the key left %v files behind", len(files))
+	}
+
+	b, _ := ioutil.ReadFile(path)
+	if !IsEncrypted(b) || bytes.Contains(b, []byte(`"PK"`)) {
+		t.Fatalf("key file isn't encrypted: %s", b)
+	}
+	if _, err := ReadKeys(path); err != ErrKeyEncrypted {
+		t.Errorf("read an encrypted key without a passphrase: %v", err)
+	}
+
+	read, err := ReadKeysWithPassphrase(path, func() ([]byte, error) { return []byte("hunter2"), nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read.PrivateKey(), k.PrivateKey()) {
+		t.Error("decrypted another key")
+	}
+}
+
+func TestDeserializeEncryptedTampered(t *testing.T) {
+	defer fastScrypt()()
+	b, err := SerializeEncrypted(skademlia.RandomKeys(), []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tamper := func(edit func(e *EncryptedKeyExport)) []byte {
+		var e EncryptedKeyExport
+		if err := json.Unmarshal(b, &e); err != nil {
+			t.Fatal(err)
+		}
+		edit(&e)
+		tampered, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tampered
+	}
+
+	tests := []struct {
+		name       string
+		b          []byte
+		passphrase string
+	}{
+		{"wrong passphrase", b, "hunter3"},
+		{"ciphertext", tamper(func(e *EncryptedKeyExport) { e.Ciphertext[0] ^= 1 }), "hunter2"},
+		{"nonce", tamper(func(e *EncryptedKeyExport) { e.Nonce[0] ^= 1 }), "hunter2"},
+		{"additional data", tamper(func(e *EncryptedKeyExport) { e.R++ }), "hunter2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DeserializeEncrypted(tt.b, []byte(tt.passphrase)); err != ErrWrongPassphrase {
+				t.Errorf("expected %v, got %v", ErrWrongPassphrase, err)
+			}
+		})
+	}
+
+	// A large r makes scrypt allocate as much as a large N does, 8GiB here
+	expensive := map[string][]byte{
+		"N": tamper(func(e *EncryptedKeyExport) { e.N = scryptMaxMemory / 128 / e.R * 2 }),
+		"r": tamper(func(e *EncryptedKeyExport) { e.N, e.R, e.P = 1<<20, 64, 1 }),
+	}
+	for name, b := range expensive {
+		if _, err := DeserializeEncrypted(b, []byte("hunter2")); err == nil || err == ErrWrongPassphrase {
+			t.Errorf("ran scrypt with a tampered %v: %v", name, err)
+		}
+	}
+}
+
+func TestReadLegacyKeys(t *testing.T) {
+	path, cleanup := tempKeyPath(t)
+	defer cleanup()
+
+	k := skademlia.RandomKeys()
+	b, err := Serialize(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := ReadKeysWithPassphrase(path, func() ([]byte, error) {
+		t.Error("asked for a passphrase for a plaintext key")
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read.PrivateKey(), k.PrivateKey()) {
+		t.Error("read another key")
+	}
+}
@@ -0,0 +1,92 @@
+package keys
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/perlin-network/noise/skademlia"
+)
+
+// handoverDomain separates the signatures of handovers from anything else signed with the same keys
+const handoverDomain = "particles/handover/v1"
+
+// Handover is a record of an identity moving from an old key to a new one. The old key signs it to
+// hand its identity over, the new key countersigns it so an identity can't be handed to a key that didn't ask for it.
+type Handover struct {
+	Old       string `json:"old"`
+	New       string `json:"new"`
+	Timestamp int64  `json:"ts"`
+	Signature []byte `json:"sig"`
+	// Countersignature is the signature of the new key over the same content
+	Countersignature []byte `json:"csig"`
+}
+
+// SignHandover hands the identity of the old keys over to the new keys
+func SignHandover(oldKeys, newKeys *skademlia.Keypair, at time.Time) (*Handover, error) {
+	h := &Handover{
+		Old:       hex.EncodeToString(oldKeys.PublicKey()),
+		New:       hex.EncodeToString(newKeys.PublicKey()),
+		Timestamp: at.Unix(),
+	}
+	if h.Old == h.New {
+		return nil, fmt.Errorf("keys are the same")
+	}
+
+	var err error
+	if h.Signature, err = oldKeys.Sign(h.signingBytes()); err != nil {
+		return nil, err
+	}
+	if h.Countersignature, err = newKeys.Sign(h.signingBytes()); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// VerifyHandover checks that the handover is signed by both of its keys
+func VerifyHandover(h *Handover) error {
+	if h == nil {
+		return fmt.Errorf("no handover")
+	}
+	if h.Old == h.New {
+		return fmt.Errorf("handover to the same key")
+	}
+
+	for _, k := range []struct {
+		id  string
+		sig []byte
+	}{{h.Old, h.Signature}, {h.New, h.Countersignature}} {
+		pub, err := hex.DecodeString(k.id)
+		if err != nil {
+			return fmt.Errorf("invalid key %v: %v", k.id, err)
+		}
+		if err := new(skademlia.Keypair).Verify(pub, h.signingBytes(), k.sig); err != nil {
+			return fmt.Errorf("invalid handover signature by %v", k.id)
+		}
+	}
+	return nil
+}
+
+func ReadHandover(path string) (*Handover, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	h := new(Handover)
+	if err := json.Unmarshal(b, h); err != nil {
+		return nil, fmt.Errorf("invalid handover: %v", err)
+	}
+	return h, nil
+}
+
+func (h *Handover) signingBytes() []byte {
+	b, _ := json.Marshal(struct {
+		Domain    string
+		Old       string
+		New       string
+		Timestamp int64
+	}{handoverDomain, h.Old, h.New, h.Timestamp})
+	return b
+}
@@ -0,0 +1,102 @@
+package keys
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/perlin-network/noise/skademlia"
+)
+
+func TestVerifyHandover(t *testing.T) {
+	oldKeys, newKeys, other := skademlia.RandomKeys(), skademlia.RandomKeys(), skademlia.RandomKeys()
+	h, err := SignHandover(oldKeys, newKeys, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyHandover(h); err != nil {
+		t.Fatalf("valid handover got refused: %v", err)
+	}
+	if h.Old != keyID(oldKeys) || h.New != keyID(newKeys) {
+		t.Errorf("handover goes from %v to %v", h.Old, h.New)
+	}
+
+	if _, err := SignHandover(oldKeys, oldKeys, time.Now()); err == nil {
+		t.Error("signed a handover to the same key")
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(h *Handover)
+	}{
+		{"other new key", func(h *Handover) { h.New = keyID(other) }},
+		{"other old key", func(h *Handover) { h.Old = keyID(other) }},
+		{"timestamp", func(h *Handover) { h.Timestamp++ }},
+		{"missing countersignature", func(h *Handover) { h.Countersignature = nil }},
+		{"swapped signatures", func(h *Handover) { h.Signature, h.Countersignature = h.Countersignature, h.Signature }},
+		{"same keys", func(h *Handover) { h.New = h.Old }},
+		{"invalid key", func(h *Handover) { h.New = "not hex" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := *h
+			tt.tamper(&tampered)
+			if err := VerifyHandover(&tampered); err == nil {
+				t.Error("tampered handover got verified")
+			}
+		})
+	}
+
+	if err := VerifyHandover(nil); err == nil {
+		t.Error("verified a missing handover")
+	}
+}
+
+// TestHandoverSignedByOtherKey has another key sign over a handover, it can't stand in for either key
+func TestHandoverSignedByOtherKey(t *testing.T) {
+	oldKeys, newKeys, other := skademlia.RandomKeys(), skademlia.RandomKeys(), skademlia.RandomKeys()
+	h, err := SignHandover(oldKeys, newKeys, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forged := *h
+	if forged.Signature, err = other.Sign(h.signingBytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyHandover(&forged); err == nil {
+		t.Error("handover signed by another key than the old one got verified")
+	}
+}
+
+func TestReadHandover(t *testing.T) {
+	h, err := SignHandover(skademlia.RandomKeys(), skademlia.RandomKeys(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "handover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "handover.json")
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := ReadHandover(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyHandover(read); err != nil {
+		t.Errorf("handover read from the file doesn't verify: %v", err)
+	}
+}
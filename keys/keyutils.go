@@ -22,6 +22,10 @@ func Serialize(keys *skademlia.Keypair) ([]byte, error) {
 }
 
 func Deserialize(b []byte) (*skademlia.Keypair, error) {
+	if IsEncrypted(b) {
+		return nil, ErrKeyEncrypted
+	}
+
 	var k KeyExport
 	err := json.Unmarshal(b, &k)
 	if err != nil {
@@ -0,0 +1,54 @@
+package keys
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// PassphraseEnv is the environment variable the passphrase of the key is read from when there's no passphrase file
+const PassphraseEnv = "PARTICLES_PASSPHRASE"
+
+// Passphrase returns the passphrase of a key file, read from the file if one is given, then from the
+// PassphraseEnv environment variable, then prompted for on the terminal. A prompted passphrase has to
+// be entered twice when confirm is true.
+func Passphrase(file string, confirm bool) ([]byte, error) {
+	if file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(b, "\r\n"), nil
+	}
+
+	if pass, ok := os.LookupEnv(PassphraseEnv); ok {
+		return []byte(pass), nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return nil, fmt.Errorf("no passphrase, give a passphrase file or set %v", PassphraseEnv)
+	}
+
+	fmt.Fprint(os.Stderr, "Key passphrase: ")
+	pass, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil || !confirm {
+		return pass, err
+	}
+
+	fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+	again, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(pass, again) {
+		return nil, errors.New("passphrases don't match")
+	}
+	return pass, nil
+}
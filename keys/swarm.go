@@ -0,0 +1,52 @@
+package keys
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+)
+
+// SwarmKeySize is the size of a pre-shared swarm key in bytes
+const SwarmKeySize = 32
+
+// GenerateSwarmKey returns a random pre-shared key for a private network
+func GenerateSwarmKey() ([]byte, error) {
+	key := make([]byte, SwarmKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// SerializeSwarmKey encodes the swarm key as hex, which is how swarm key files are stored
+func SerializeSwarmKey(key []byte) []byte {
+	return []byte(hex.EncodeToString(key) + "\n")
+}
+
+func DeserializeSwarmKey(b []byte) ([]byte, error) {
+	key, err := hex.DecodeString(string(bytes.TrimSpace(b)))
+	if err != nil {
+		return nil, fmt.Errorf("swarm key isn't hex encoded: %v", err)
+	}
+	if len(key) != SwarmKeySize {
+		return nil, fmt.Errorf("swarm key should be %v bytes, got %v", SwarmKeySize, len(key))
+	}
+	return key, nil
+}
+
+func ReadSwarmKey(keyPath string) ([]byte, error) {
+	b, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return DeserializeSwarmKey(b)
+}
+
+// SwarmKeyFingerprint identifies a swarm key without revealing it, so operators can compare the keys of their nodes
+func SwarmKeyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
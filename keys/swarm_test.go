@@ -0,0 +1,45 @@
+package keys
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSwarmKeyFile(t *testing.T) {
+	key, err := GenerateSwarmKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "swarm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "swarm.key")
+	if err := ioutil.WriteFile(path, SerializeSwarmKey(key), 0600); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadSwarmKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, key) {
+		t.Error("the key read from the file isn't the one written to it")
+	}
+	if SwarmKeyFingerprint(read) != SwarmKeyFingerprint(key) {
+		t.Error("the same key has different fingerprints")
+	}
+}
+
+func TestDeserializeInvalidSwarmKey(t *testing.T) {
+	for _, b := range []string{"", "not hex", "abcd", string(bytes.Repeat([]byte("ab"), SwarmKeySize+1))} {
+		if _, err := DeserializeSwarmKey([]byte(b)); err == nil {
+			t.Errorf("deserialized %q", b)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/nokusukun/particles/satellite"
+)
+
+var outboxBucket = []byte("outbox")
+
+// outboxPruneInterval is how often the expired messages get removed from the outbox
+var outboxPruneInterval = time.Minute
+
+// OutboxMessage is a message waiting for its recipient to connect
+type OutboxMessage struct {
+	ID        uint64      `json:"id"`
+	Namespace string      `json:"namespace"`
+	Content   interface{} `json:"content"`
+	Queued    time.Time   `json:"queued"`
+	Expires   time.Time   `json:"expires"`
+}
+
+// Outbox keeps the messages of peers that aren't reachable in the database, keyed by the hex encoded
+// public key of the recipient, and delivers them once the recipient connects.
+type Outbox struct {
+	db  *bolt.DB
+	sat *satellite.Satellite
+
+	maxQueue int
+	expiry   time.Duration
+
+	// flushing stops a recipient that reconnects quickly from being flushed twice at the same time
+	flushing map[string]bool
+	lock     *sync.Mutex
+}
+
+func newOutbox(sat *satellite.Satellite, db *bolt.DB, maxQueue int, expiry time.Duration) (*Outbox, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(outboxBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	o := &Outbox{
+		db:       db,
+		sat:      sat,
+		maxQueue: maxQueue,
+		expiry:   expiry,
+		flushing: map[string]bool{},
+		lock:     &sync.Mutex{},
+	}
+
+	sat.OnPeerConnected(o.Flush)
+	sat.OnHandover(o.follow)
+	go o.prune(outboxPruneInterval)
+	return o, nil
+}
+
+// canonicalRecipient returns the lowercase hex encoding of the public key, the form the satellite
+// reports connecting peers in, so messages queued under any spelling of the key get flushed.
+func canonicalRecipient(recipient string) (string, error) {
+	pub, err := hex.DecodeString(recipient)
+	if err != nil {
+		return "", fmt.Errorf("invalid recipient %v: %v", recipient, err)
+	}
+	if len(pub) != 32 {
+		return "", fmt.Errorf("invalid recipient %v: public key should be 32 bytes, got %v", recipient, len(pub))
+	}
+	return hex.EncodeToString(pub), nil
+}
+
+// Queue stores the message until the recipient connects, an expiry of 0 uses the default of the outbox
+func (o *Outbox) Queue(recipient, namespace string, content interface{}, expiry time.Duration) (uint64, error) {
+	recipient, err := canonicalRecipient(recipient)
+	if err != nil {
+		return 0, err
+	}
+	if expiry <= 0 {
+		expiry = o.expiry
+	}
+
+	var id uint64
+	err = o.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(outboxBucket).CreateBucketIfNotExists([]byte(recipient))
+		if err != nil {
+			return err
+		}
+
+		// Expired messages don't take up room, they're only waiting to be pruned
+		now := time.Now()
+		if o.maxQueue > 0 && countQueued(b, now) >= o.maxQueue {
+			return fmt.Errorf("outbox of %v is full", recipient)
+		}
+
+		id, err = b.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		bMsg, err := json.Marshal(OutboxMessage{
+			ID:        id,
+			Namespace: namespace,
+			Content:   content,
+			Queued:    now,
+			Expires:   now.Add(expiry),
+		})
+		if err != nil {
+			return err
+		}
+		return b.Put(outboxKey(id), bMsg)
+	})
+
+	if err == nil {
+		log.Debugf("queued %v for %v", id, recipient)
+	}
+	return id, err
+}
+
+// Messages returns the queued messages of the recipient that haven't expired
+func (o *Outbox) Messages(recipient string) ([]OutboxMessage, error) {
+	recipient, err := canonicalRecipient(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []OutboxMessage{}
+	err = o.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxBucket).Bucket([]byte(recipient))
+		if b == nil {
+			return nil
+		}
+
+		now := time.Now()
+		return b.ForEach(func(k, v []byte) error {
+			msg := OutboxMessage{}
+			if err := json.Unmarshal(v, &msg); err != nil {
+				log.Error("failed to read outbox message ", recipient, "/", k, ": ", err)
+				return nil
+			}
+			if now.Before(msg.Expires) {
+				messages = append(messages, msg)
+			}
+			return nil
+		})
+	})
+	return messages, err
+}
+
+// Queues returns the amount of messages queued for every recipient that haven't expired
+func (o *Outbox) Queues() (map[string]int, error) {
+	queues := map[string]int{}
+	now := time.Now()
+	err := o.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxBucket).ForEach(func(k, v []byte) error {
+			if b := tx.Bucket(outboxBucket).Bucket(k); b != nil {
+				queues[string(k)] = countQueued(b, now)
+			}
+			return nil
+		})
+	})
+	return queues, err
+}
+
+// Purge removes every queued message of the recipient
+func (o *Outbox) Purge(recipient string) error {
+	recipient, err := canonicalRecipient(recipient)
+	if err != nil {
+		return err
+	}
+	return o.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(outboxBucket).DeleteBucket([]byte(recipient))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+// Remove removes a single queued message of the recipient
+func (o *Outbox) Remove(recipient string, id uint64) error {
+	recipient, err := canonicalRecipient(recipient)
+	if err != nil {
+		return err
+	}
+	return o.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxBucket).Bucket([]byte(recipient))
+		if b == nil {
+			return nil
+		}
+		return b.Delete(outboxKey(id))
+	})
+}
+
+// follow moves the queued messages of a key that got handed over to the new key, after the ones already queued for it
+func (o *Outbox) follow(oldID, newID string) {
+	err := o.db.Update(func(tx *bolt.Tx) error {
+		outbox := tx.Bucket(outboxBucket)
+		old := outbox.Bucket([]byte(oldID))
+		if old == nil {
+			return nil
+		}
+		b, err := outbox.CreateBucketIfNotExists([]byte(newID))
+		if err != nil {
+			return err
+		}
+
+		err = old.ForEach(func(k, v []byte) error {
+			msg := OutboxMessage{}
+			if err := json.Unmarshal(v, &msg); err != nil {
+				return err
+			}
+			if msg.ID, err = b.NextSequence(); err != nil {
+				return err
+			}
+			bMsg, err := json.Marshal(msg)
+			if err != nil {
+				return err
+			}
+			return b.Put(outboxKey(msg.ID), bMsg)
+		})
+		if err != nil {
+			return err
+		}
+		return outbox.DeleteBucket([]byte(oldID))
+	})
+
+	if err != nil {
+		log.Error("Failed to move the outbox of a handed over key: ", err)
+	}
+}
+
+// Flush delivers the queued messages of the recipient in the order they were queued. Delivery stops at
+// the first message that doesn't get acknowledged, the rest stays queued until the recipient connects again.
+func (o *Outbox) Flush(recipient string) {
+	o.lock.Lock()
+	if o.flushing[recipient] {
+		o.lock.Unlock()
+		return
+	}
+	o.flushing[recipient] = true
+	o.lock.Unlock()
+
+	defer func() {
+		o.lock.Lock()
+		delete(o.flushing, recipient)
+		o.lock.Unlock()
+	}()
+
+	messages, err := o.Messages(recipient)
+	if err != nil {
+		log.Error("failed to read the outbox of ", recipient, ": ", err)
+		return
+	}
+	if len(messages) == 0 {
+		return
+	}
+
+	log.Infof("delivering %v queued messages to %v", len(messages), recipient)
+	for _, msg := range messages {
+		err := o.sat.SendReliable(recipient, msg.Namespace, msg.Content)
+		if err == satellite.ErrNotAcknowledged {
+			log.Errorf("failed to deliver %v to %v, keeping the rest queued", msg.ID, recipient)
+			return
+		}
+		if err != nil {
+			// The recipient received the message but its handler failed, retrying won't change that
+			log.Errorf("%v failed to handle %v: %v", recipient, msg.ID, err)
+		}
+
+		if err := o.Remove(recipient, msg.ID); err != nil {
+			log.Error("failed to remove delivered message: ", err)
+		}
+	}
+}
+
+// prune removes the expired messages and the empty queues every interval until the satellite shuts down
+func (o *Outbox) prune(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-o.sat.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := o.removeExpired(); err != nil {
+			log.Error("failed to prune the outbox: ", err)
+		}
+	}
+}
+
+func (o *Outbox) removeExpired() error {
+	return o.db.Update(func(tx *bolt.Tx) error {
+		outbox := tx.Bucket(outboxBucket)
+		var empty [][]byte
+
+		now := time.Now()
+		err := outbox.ForEach(func(recipient, v []byte) error {
+			b := outbox.Bucket(recipient)
+			if b == nil {
+				return nil
+			}
+
+			var expired [][]byte
+			total := 0
+			err := b.ForEach(func(k, v []byte) error {
+				total++
+				if !queued(v, now) {
+					expired = append(expired, k)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, k := range expired {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			if total == len(expired) {
+				empty = append(empty, recipient)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, recipient := range empty {
+			if err := outbox.DeleteBucket(recipient); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// queued returns true if the stored message is readable and hasn't expired
+func queued(v []byte, now time.Time) bool {
+	msg := OutboxMessage{}
+	return json.Unmarshal(v, &msg) == nil && now.Before(msg.Expires)
+}
+
+// countQueued returns the amount of messages in the queue that haven't expired
+func countQueued(b *bolt.Bucket, now time.Time) int {
+	n := 0
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if queued(v, now) {
+			n++
+		}
+	}
+	return n
+}
+
+func outboxKey(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/perlin-network/noise/skademlia"
+
+	"github.com/nokusukun/particles/satellite"
+	"github.com/nokusukun/particles/satellite/satellitetest"
+)
+
+// newTestOutbox starts unconnected satellites with an outbox on the first one, the returned function shuts them down
+func newTestOutbox(t *testing.T, satellites int, maxQueue int, expiry time.Duration) (*Outbox, *satellitetest.Cluster, func()) {
+	c, err := satellitetest.StartInMemory(satellites, satellitetest.None)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, closeDB := openTestDB(t)
+	o, err := newOutbox(c.Sat(0), db, maxQueue, expiry)
+	if err != nil {
+		c.Close()
+		closeDB()
+		t.Fatal(err)
+	}
+	return o, c, func() {
+		c.Close()
+		closeDB()
+	}
+}
+
+func randomID() string {
+	return keyID(skademlia.RandomKeys())
+}
+
+// TestOutboxFollow moves the queue of a handed over key after the messages already queued for the new key
+func TestOutboxFollow(t *testing.T) {
+	o, _, done := newTestOutbox(t, 1, 0, time.Hour)
+	defer done()
+
+	oldID, newID := randomID(), randomID()
+	for _, q := range []struct{ recipient, content string }{{newID, "new"}, {oldID, "old 1"}, {oldID, "old 2"}} {
+		if _, err := o.Queue(q.recipient, "ns", q.content, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	o.follow(oldID, newID)
+
+	messages, err := o.Messages(newID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents []interface{}
+	for _, msg := range messages {
+		contents = append(contents, msg.Content)
+	}
+	if len(contents) != 3 || contents[0] != "new" || contents[1] != "old 1" || contents[2] != "old 2" {
+		t.Errorf("the new key got %v", contents)
+	}
+	for i := 1; i < len(messages); i++ {
+		if messages[i].ID <= messages[i-1].ID {
+			t.Errorf("moved messages kept their old IDs: %v after %v", messages[i].ID, messages[i-1].ID)
+		}
+	}
+
+	queues, err := o.Queues()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := queues[oldID]; exists {
+		t.Error("the queue of the old key is still there")
+	}
+}
+
+// contents returns the contents of the queued messages of the recipient in order
+func contents(t *testing.T, o *Outbox, recipient string) []interface{} {
+	t.Helper()
+	messages, err := o.Messages(recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents []interface{}
+	for _, msg := range messages {
+		contents = append(contents, msg.Content)
+	}
+	return contents
+}
+
+// TestOutboxQueue queues under any spelling of the key, the message expires after the default expiry of the outbox
+func TestOutboxQueue(t *testing.T) {
+	o, _, done := newTestOutbox(t, 1, 0, time.Hour)
+	defer done()
+
+	recipient := randomID()
+	if _, err := o.Queue(strings.ToUpper(recipient), "ns", "hello", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.Queue("not a key", "ns", "hello", 0); err == nil {
+		t.Error("queued a message for an invalid key")
+	}
+
+	messages, err := o.Messages(recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].Namespace != "ns" || messages[0].Content != "hello" {
+		t.Fatalf("queued %v", messages)
+	}
+	if expiry := messages[0].Expires.Sub(messages[0].Queued); expiry != time.Hour {
+		t.Errorf("the message expires after %v", expiry)
+	}
+}
+
+// TestOutboxMaxQueue fills the queue of a recipient, expired messages don't count toward the limit
+func TestOutboxMaxQueue(t *testing.T) {
+	o, _, done := newTestOutbox(t, 1, 2, time.Hour)
+	defer done()
+
+	recipient := randomID()
+	if _, err := o.Queue(recipient, "ns", "short", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.Queue(recipient, "ns", "long", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.Queue(recipient, "ns", "full", 0); err == nil {
+		t.Error("queued more messages than the limit")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, err := o.Queue(recipient, "ns", "replaces the expired one", 0); err != nil {
+		t.Errorf("the expired message still took up room: %v", err)
+	}
+	if queues, err := o.Queues(); err != nil || queues[recipient] != 2 {
+		t.Errorf("the queues are %v (%v)", queues, err)
+	}
+	if got := contents(t, o, recipient); len(got) != 2 || got[0] != "long" {
+		t.Errorf("queued %v", got)
+	}
+}
+
+// TestOutboxPrune removes the expired messages and the queues left empty
+func TestOutboxPrune(t *testing.T) {
+	defer func(interval time.Duration) { outboxPruneInterval = interval }(outboxPruneInterval)
+	outboxPruneInterval = 50 * time.Millisecond
+
+	o, _, done := newTestOutbox(t, 1, 0, time.Hour)
+	defer done()
+
+	expired, kept := randomID(), randomID()
+	o.Queue(expired, "ns", "expired", time.Millisecond)
+	o.Queue(kept, "ns", "expired", time.Millisecond)
+	o.Queue(kept, "ns", "kept", 0)
+
+	err := satellitetest.WaitUntil(time.Second, func() bool {
+		// The stored messages, expired or not, of every queue
+		stored := map[string]int{}
+		o.db.View(func(tx *bolt.Tx) error {
+			outbox := tx.Bucket(outboxBucket)
+			return outbox.ForEach(func(k, v []byte) error {
+				if b := outbox.Bucket(k); b != nil {
+					stored[string(k)] = b.Stats().KeyN
+				}
+				return nil
+			})
+		})
+		return len(stored) == 1 && stored[kept] == 1
+	})
+	if err != nil {
+		t.Error("the expired messages never got pruned")
+	}
+	if got := contents(t, o, kept); len(got) != 1 || got[0] != "kept" {
+		t.Errorf("pruned the queue to %v", got)
+	}
+}
+
+// TestOutboxFlush queues messages for a satellite that isn't connected, they get delivered in order once it connects
+func TestOutboxFlush(t *testing.T) {
+	o, c, done := newTestOutbox(t, 2, 0, time.Hour)
+	defer done()
+
+	for n := 0; n < 3; n++ {
+		if _, err := o.Queue(c.ID(1), "inbox", n, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inbox := c.Capture(1, satellite.PType_Message, "inbox")
+	if err := c.Connect(1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var received []interface{}
+	for _, in := range satellitetest.Collect(inbox, time.Second) {
+		received = append(received, in.Payload)
+	}
+	if fmt.Sprint(received) != "[0 1 2]" {
+		t.Errorf("delivered %v", received)
+	}
+	err := satellitetest.WaitUntil(time.Second, func() bool {
+		return len(contents(t, o, c.ID(1))) == 0
+	})
+	if err != nil {
+		t.Error("the delivered messages are still queued")
+	}
+}
+
+// TestOutboxFlushUnreachable flushes to a satellite that can't be reached, the messages stay queued
+func TestOutboxFlushUnreachable(t *testing.T) {
+	defer func(attempts int, timeout time.Duration) {
+		satellite.ReliableAttempts, satellite.LookupTimeout = attempts, timeout
+	}(satellite.ReliableAttempts, satellite.LookupTimeout)
+	satellite.ReliableAttempts = 1
+	satellite.LookupTimeout = 100 * time.Millisecond
+
+	o, _, done := newTestOutbox(t, 1, 0, time.Hour)
+	defer done()
+
+	recipient := randomID()
+	o.Queue(recipient, "inbox", 1, 0)
+	o.Queue(recipient, "inbox", 2, 0)
+	o.Flush(recipient)
+
+	if got := contents(t, o, recipient); fmt.Sprint(got) != "[1 2]" {
+		t.Errorf("kept %v queued", got)
+	}
+}
+
+// TestOutboxAPI queues a write to an unreachable satellite and manages it through /outbox
+func TestOutboxAPI(t *testing.T) {
+	defer func(attempts int, timeout time.Duration) {
+		satellite.ReliableAttempts, satellite.LookupTimeout = attempts, timeout
+	}(satellite.ReliableAttempts, satellite.LookupTimeout)
+	satellite.ReliableAttempts = 1
+	satellite.LookupTimeout = 100 * time.Millisecond
+
+	o, c, done := newTestOutbox(t, 1, 0, time.Hour)
+	defer done()
+	server := httptest.NewServer(generateAPI(c.Sat(0), o))
+	defer server.Close()
+
+	call := func(method, path, body string) map[string]interface{} {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		response := map[string]interface{}{}
+		if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	recipient := randomID()
+	for n := 1; n <= 2; n++ {
+		written := call("POST", "/write", fmt.Sprintf(`{"destination": %q, "namespace": "inbox", "content": %v}`, recipient, n))
+		if written["error"] != "" || written["queued"] != float64(n) {
+			t.Fatalf("write %v returned %v", n, written)
+		}
+	}
+
+	queues := call("GET", "/outbox", "")["queues"].(map[string]interface{})
+	if len(queues) != 1 || queues[recipient] != float64(2) {
+		t.Errorf("/outbox returned %v", queues)
+	}
+	messages := call("GET", "/outbox/"+recipient, "")["messages"].([]interface{})
+	if len(messages) != 2 || messages[0].(map[string]interface{})["content"] != float64(1) {
+		t.Errorf("/outbox/%v returned %v", recipient, messages)
+	}
+
+	if removed := call("DELETE", "/outbox/"+recipient+"/1", ""); removed["error"] != "" {
+		t.Fatal(removed["error"])
+	}
+	if got := contents(t, o, recipient); fmt.Sprint(got) != "[2]" {
+		t.Errorf("removing a message left %v", got)
+	}
+	if purged := call("DELETE", "/outbox/"+recipient, ""); purged["error"] != "" {
+		t.Fatal(purged["error"])
+	}
+	if got := contents(t, o, recipient); len(got) != 0 {
+		t.Errorf("purging left %v", got)
+	}
+	if invalid := call("GET", "/outbox/invalid", ""); invalid["error"] == "" {
+		t.Error("reading the outbox of an invalid key didn't fail")
+	}
+}
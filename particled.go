@@ -9,6 +9,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/perlin-network/noise/skademlia"
@@ -24,18 +26,48 @@ var log = roggy.Printer("particled")
 var csat = config.Satellite{}
 var cdae = config.Daemon{}
 
+// addressList collects the values of a repeated flag
+type addressList []string
+
+func (l *addressList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *addressList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func init() {
 	flag.UintVar(&csat.Port, "port", 3000, "Listen for peers in specified port")
-	flag.StringVar(&csat.Host, "host", "127.0.0.1", "Listen for peers in this host")
-	flag.BoolVar(&csat.DisableUPNP, "noupnp", false, "disable UPNP")
+	flag.StringVar(&csat.Host, "host", "0.0.0.0", "Listen for peers in this host")
+	flag.Var((*addressList)(&csat.Listen), "listen", "Also listen for peers on this host:port, repeatable, [::]:3000 for IPv6")
+	flag.StringVar(&csat.NAT, "nat", "", "Map the port on the gateway with this strategy: upnp or pmp")
+	flag.BoolVar(&csat.DisableUPNP, "noupnp", false, "Deprecated: same as -nat upnp")
+	flag.BoolVar(&csat.DisableCompression, "nocompress", false, "Send packets to peers uncompressed")
+	flag.BoolVar(&csat.Relay, "relay", false, "Relay circuits for peers that can't reach each other")
+	flag.IntVar(&csat.RelayMaxCircuits, "relay-circuits", 64, "Amount of circuits relayed at the same time")
+	flag.IntVar(&csat.RelayBandwidth, "relay-bandwidth", 0, "Bytes per second relayed across every circuit, 0 is unlimited")
 
 	flag.StringVar(&cdae.DialTo, "dial", "", "Bootstrap s/kad from this peer")
 	flag.StringVar(&cdae.ApiListen, "api", "", "Enable the api and serve to this address")
 	flag.StringVar(&cdae.DatabasePath, "dbpath", "", "Database Path")
 	flag.StringVar(&cdae.KeyPath, "key", "", "Read/write key from/to path")
+	flag.StringVar(&cdae.PassphrasePath, "passfile", "", "Read the passphrase of the key from this file instead of "+keys.PassphraseEnv+" or a prompt")
+	flag.StringVar(&cdae.ACLPath, "acl", "", "Load the ACL from this JSON file, changes made through the API are saved to it")
+	flag.StringVar(&cdae.HandoverPath, "handover", "", "Announce the handover of a previous key to -key from this file, sign one with pkgen -handover")
+	flag.StringVar(&cdae.SwarmKeyPath, "swarmkey", "", "Only connect to peers with the swarm key at this path, generate one with pkgen -swarm")
 	flag.BoolVar(&cdae.GenerateNewKeys, "generate", false, "Generate new keys")
+	flag.BoolVar(&cdae.ProvideRatings, "provide", false, "Announce this node as a get_rating provider")
+	flag.IntVar(&cdae.OutboxMaxQueue, "outbox-max", 100, "Amount of messages kept for an unreachable peer")
+	flag.DurationVar(&cdae.OutboxExpiry, "outbox-expiry", 24*time.Hour, "How long messages for unreachable peers are kept")
+	flag.StringVar(&cdae.TraceFile, "trace", "", "Append the spans of traced operations to this file as JSON")
 	flag.BoolVar(&cdae.ShowHelp, "h", false, "Show help")
 	flag.IntVar(&roggy.LogLevel, "log", 2, "log level 0~5")
+}
+
+func main() {
+	// Flags are parsed here rather than in init, the test binary has flags of its own
 	flag.Parse()
 
 	if cdae.ShowHelp {
@@ -46,9 +78,7 @@ func init() {
 	zerolog.SetGlobalLevel(zerolog.Disabled)
 	printSplash()
 	//roggy.LogLevel = 5
-}
 
-func main() {
 	log.Info("Starting Particle Daemon")
 	// notices
 
@@ -73,9 +103,40 @@ func main() {
 	if err != nil {
 		log.Error("Failed to get keyPair:", err)
 		log.Error("Your key might not exist, try with the -generate flag")
+		roggy.Wait()
+		os.Exit(1)
+	}
+
+	if cdae.SwarmKeyPath != "" {
+		csat.SwarmKey, err = keys.ReadSwarmKey(cdae.SwarmKeyPath)
+		if err != nil {
+			log.Error("Failed to read swarm key: ", err)
+			roggy.Wait()
+			os.Exit(1)
+		}
+		log.Infof("Joining private network %v", keys.SwarmKeyFingerprint(csat.SwarmKey))
+	}
+
+	if cdae.ACLPath != "" {
+		if err := readACL(cdae.ACLPath, &csat.ACL); err != nil {
+			log.Error("Failed to read ACL: ", err)
+			roggy.Wait()
+			os.Exit(1)
+		}
 	}
 	sat := satellite.BuildNetwork(&csat, keyPair)
 
+	if cdae.TraceFile != "" {
+		exporter, err := satellite.NewJSONFileExporter(cdae.TraceFile)
+		if err != nil {
+			log.Error("Failed to open trace file: ", err)
+		} else {
+			log.Info("Writing spans to ", cdae.TraceFile)
+			sat.AddSpanExporter(exporter)
+			defer exporter.Close()
+		}
+	}
+
 	if cdae.DialTo != "" {
 		log.Info("Connecting s/kad bootstrap at ", cdae.DialTo)
 		peer, err := sat.Node.Dial(cdae.DialTo)
@@ -88,10 +149,46 @@ func main() {
 	}
 	bootstrapEvents(sat, db)
 
+	if cdae.ACLPath != "" {
+		// The ACL follows handed over keys, the file has to as well
+		sat.OnHandover(func(oldID, newID string) {
+			if err := updateACL(sat, sat.ACL()); err != nil {
+				log.Error("Failed to save the ACL: ", err)
+			}
+		})
+	}
+
+	if cdae.HandoverPath != "" {
+		h, err := keys.ReadHandover(cdae.HandoverPath)
+		if err == nil {
+			err = sat.AnnounceHandover(h)
+		}
+		if err != nil {
+			log.Error("Failed to announce handover: ", err)
+		} else {
+			log.Infof("Announced the handover of %v to this key", h.Old)
+		}
+	}
+
+	outbox, err := newOutbox(sat, db, cdae.OutboxMaxQueue, cdae.OutboxExpiry)
+	if err != nil {
+		log.Error("Failed to open the outbox: ", err)
+	}
+
+	if cdae.ProvideRatings {
+		go func() {
+			if err := sat.Provide("get_rating"); err != nil {
+				log.Error("Failed to announce as a get_rating provider: ", err)
+				return
+			}
+			log.Info("Announced as a get_rating provider")
+		}()
+	}
+
 	// API
 	if cdae.ApiListen != "" {
 		log.Notice("Starting API on:", cdae.ApiListen)
-		router := generateAPI(sat)
+		router := generateAPI(sat, outbox)
 		log.Error(http.ListenAndServe(cdae.ApiListen, router))
 	} else {
 		log.Notice("No API port provided")
@@ -110,6 +207,19 @@ func main() {
 	select {}
 }
 
+// readACL reads the ACL file, a missing file leaves the ACL open until it gets set through the API
+func readACL(path string, acl *config.ACL) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Noticef("ACL file %v doesn't exist yet, it gets created once the ACL is set", path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, acl)
+}
+
 func getKeys(path string) (*skademlia.Keypair, error) {
 	_, err := os.Stat(path)
 	if err == nil {
@@ -120,10 +230,6 @@ func getKeys(path string) (*skademlia.Keypair, error) {
 
 		log.Info("Generating new keys...")
 		newkeys := skademlia.RandomKeys()
-		kb, err := keys.Serialize(newkeys)
-		if err != nil {
-			panic(err)
-		}
 
 		if path == "" {
 			reader := bufio.NewReader(os.Stdin)
@@ -135,15 +241,26 @@ func getKeys(path string) (*skademlia.Keypair, error) {
 		}
 
 		log.Infof("New key generated: %v", hex.EncodeToString(newkeys.PublicKey()))
-		err = ioutil.WriteFile(path, kb, os.ModePerm)
+		pass, err := keys.Passphrase(cdae.PassphrasePath, true)
 		if err != nil {
-			panic(err)
+			return nil, err
+		}
+		if len(pass) == 0 {
+			log.Notice("No passphrase given, the key is saved unencrypted")
+		}
+		if err := keys.WriteKeys(path, newkeys, pass); err != nil {
+			return nil, err
 		}
 
 		log.Infof("Key saved to: %v", path)
 	}
 
-	return keys.ReadKeys(path)
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0077 != 0 {
+		log.Noticef("%v can be read by other users, restrict it with chmod 600", path)
+	}
+	return keys.ReadKeysWithPassphrase(path, func() ([]byte, error) {
+		return keys.Passphrase(cdae.PassphrasePath, false)
+	})
 }
 
 func printSplash() {
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/nokusukun/particles/roggy"
+	"github.com/nokusukun/particles/satellite"
+	"github.com/nokusukun/particles/satellite/sim"
+)
+
+type Params struct {
+	Satellites int
+	Operations int
+	Seed       int64
+
+	Latency time.Duration
+	Jitter  time.Duration
+	Loss    float64
+	Burst   bool
+	Fail    float64
+
+	TTL        int
+	Responders float64
+}
+
+var parameters = new(Params)
+var log = roggy.Printer("particlesim")
+
+func init() {
+	flag.IntVar(&parameters.Satellites, "n", 100, "amount of simulated satellites")
+	flag.IntVar(&parameters.Operations, "ops", 20, "amount of operations of each kind")
+	flag.Int64Var(&parameters.Seed, "seed", 1, "seed of the simulation")
+	flag.DurationVar(&parameters.Latency, "latency", 50*time.Millisecond, "mean packet latency")
+	flag.DurationVar(&parameters.Jitter, "jitter", 20*time.Millisecond, "standard deviation of the packet latency")
+	flag.Float64Var(&parameters.Loss, "loss", 0, "packet loss probability, lost packets get retransmitted")
+	flag.BoolVar(&parameters.Burst, "burst", false, "lose packets in bursts instead of independently")
+	flag.Float64Var(&parameters.Fail, "fail", 0, "fraction of satellites that go offline after bootstrapping")
+	flag.IntVar(&parameters.TTL, "ttl", satellite.FloodTTL, "hops of flooded broadcasts and seeks")
+	flag.Float64Var(&parameters.Responders, "responders", 0.05, "fraction of satellites that respond to seeks")
+	flag.Parse()
+}
+
+func main() {
+	var loss sim.Loss = sim.Bernoulli(parameters.Loss)
+	if parameters.Burst {
+		loss = &sim.GilbertElliott{GoodToBad: 0.01, BadToGood: 0.25, BadLoss: 0.5, GoodLoss: parameters.Loss}
+	}
+
+	net := sim.NewNetwork(parameters.Seed, sim.Normal{Mean: parameters.Latency, StdDev: parameters.Jitter}, loss)
+	net.AddNodes(parameters.Satellites)
+	net.Bootstrap()
+	if parameters.Fail > 0 {
+		log.Infof("%v satellites went offline", len(net.FailRandom(parameters.Fail)))
+	}
+
+	online := net.Online()
+	for i, node := range online {
+		if float64(i) < float64(len(online))*parameters.Responders {
+			index := node.Index
+			node.Event(satellite.PType_Seek, "sim", func(i *satellite.Inbound) {
+				i.Reply(index)
+				i.EndReply()
+			})
+		}
+	}
+
+	pick := func(i int) *sim.Node {
+		return online[(i*7919)%len(online)]
+	}
+
+	var broadcasts, floods, seeks, floodSeeks, puts, gets []*sim.Report
+	for i := 0; i < parameters.Operations; i++ {
+		broadcasts = append(broadcasts, pick(i).Broadcast("sim", i))
+		floods = append(floods, pick(i).BroadcastFlood("sim", i, parameters.TTL))
+		seeks = append(seeks, pick(i).Seek("sim", i, 0))
+		floodSeeks = append(floodSeeks, pick(i).Seek("sim", i, parameters.TTL))
+	}
+	net.Run()
+
+	for i := 0; i < parameters.Operations; i++ {
+		puts = append(puts, pick(i).Put(keyName(i), i))
+	}
+	net.Run()
+
+	for i := 0; i < parameters.Operations; i++ {
+		gets = append(gets, pick(i+parameters.Operations).Get(keyName(i)))
+	}
+	net.Run()
+
+	log.Infof("broadcast: %v", sim.Summarize(broadcasts))
+	log.Infof("flood: %v", sim.Summarize(floods))
+	log.Infof("seek: %v", sim.Summarize(seeks))
+	log.Infof("flooded seek: %v", sim.Summarize(floodSeeks))
+	log.Infof("dht put: %v", sim.Summarize(puts))
+	log.Infof("dht get: %v", sim.Summarize(gets))
+	log.Infof("%v packets sent, %v lost, simulated %v", net.Sent, net.Lost, net.Clock.Elapsed())
+	net.Close()
+	roggy.Wait()
+}
+
+func keyName(i int) string {
+	return "sim/" + string(rune('a'+i%26)) + string(rune('a'+i/26%26))
+}
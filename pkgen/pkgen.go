@@ -1,10 +1,16 @@
 package main
 
 import (
+	"encoding/base32"
 	"encoding/hex"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"runtime"
+	"strings"
+	"time"
 
 	"github.com/perlin-network/noise/skademlia"
 
@@ -13,8 +19,24 @@ import (
 )
 
 type Params struct {
-	OutFile string
-	ReadKey bool
+	OutFile  string
+	ReadKey  bool
+	SwarmKey bool
+	PassFile string
+	Migrate  bool
+	Handover string
+
+	C1       int
+	C2       int
+	Prefix   string
+	Encoding string
+	Workers  int
+
+	Grant      string
+	Namespaces string
+	TTL        time.Duration
+	Depth      int
+	Parent     string
 }
 
 var parameters = new(Params)
@@ -23,47 +45,240 @@ var log = roggy.Printer("pkgen")
 func init() {
 	flag.StringVar(&parameters.OutFile, "f", "mykey.key", "destination file name")
 	flag.BoolVar(&parameters.ReadKey, "r", false, "read key")
-	flag.Parse()
+	flag.BoolVar(&parameters.SwarmKey, "swarm", false, "generate a swarm key for a private network instead")
+	flag.IntVar(&parameters.C1, "c1", skademlia.DefaultC1, "difficulty of the static s/kad puzzle, peers reject keys below the default")
+	flag.IntVar(&parameters.C2, "c2", skademlia.DefaultC2, "difficulty of the dynamic s/kad puzzle, peers reject keys below the default")
+	flag.StringVar(&parameters.Prefix, "prefix", "", "search for a key whose ID starts with this prefix")
+	flag.StringVar(&parameters.Encoding, "encoding", "hex", "encoding of the ID the prefix is matched against, hex or base32")
+	flag.IntVar(&parameters.Workers, "workers", runtime.NumCPU(), "amount of keys tried at the same time")
+	flag.StringVar(&parameters.PassFile, "passfile", "", "read the passphrase of the key from this file instead of "+keys.PassphraseEnv+" or a prompt")
+	flag.BoolVar(&parameters.Migrate, "migrate", false, "encrypt an existing key with a new passphrase and restrict its permissions")
+	flag.StringVar(&parameters.Handover, "handover", "", "sign the handover of the key of -f to the key at this path, printed to stdout")
+	flag.StringVar(&parameters.Grant, "grant", "", "issue a capability signed by the key of -f to this public key, printed to stdout")
+	flag.StringVar(&parameters.Namespaces, "ns", "", "comma separated namespaces the capability grants, defaults to the ones of -parent")
+	flag.DurationVar(&parameters.TTL, "ttl", 24*time.Hour, "how long the capability is valid for")
+	flag.IntVar(&parameters.Depth, "depth", 0, "how many times the capability can be delegated")
+	flag.StringVar(&parameters.Parent, "parent", "", "delegate this capability file instead of issuing a new one")
 }
 
 func main() {
+	flag.Parse()
+
+	if parameters.SwarmKey {
+		if parameters.ReadKey {
+			readSwarmKey(parameters.OutFile)
+		} else {
+			generateSwarmKey(parameters.OutFile)
+		}
+		return
+	}
+
+	if parameters.Grant != "" {
+		grantCapability(parameters.OutFile)
+		return
+	}
+
+	if parameters.Handover != "" {
+		signHandover(parameters.OutFile, parameters.Handover)
+		return
+	}
+
+	if parameters.Migrate {
+		migrateKeys(parameters.OutFile)
+		return
+	}
 
 	if parameters.ReadKey {
 		readKeys(parameters.OutFile)
 		return
 	}
 
-	log.Info("Generating Keys....")
-	newkeys := skademlia.RandomKeys()
-	kb, err := keys.Serialize(newkeys)
+	search, err := newKeySearch(parameters.C1, parameters.C2, parameters.Prefix, parameters.Encoding, parameters.Workers)
 	if err != nil {
+		log.Error("Invalid key search", err)
 		panic(err)
 	}
+	if parameters.C1 < skademlia.DefaultC1 || parameters.C2 < skademlia.DefaultC2 {
+		log.Noticef("Peers reject keys below C1=%v C2=%v", skademlia.DefaultC1, skademlia.DefaultC2)
+	}
 
+	log.Infof("Generating Keys with C1=%v C2=%v on %v workers, %.0f attempts expected....", parameters.C1, parameters.C2, parameters.Workers, search.expected())
+	newkeys := search.run()
 	log.Infof("New key generated: %v", hex.EncodeToString(newkeys.PublicKey()))
-	err = ioutil.WriteFile(parameters.OutFile, kb, os.ModePerm)
+
+	pass, err := keys.Passphrase(parameters.PassFile, true)
+	if err != nil {
+		log.Error("Failed to get passphrase", err)
+		panic(err)
+	}
+	if len(pass) == 0 {
+		log.Notice("No passphrase given, the key is saved unencrypted")
+	}
+
+	err = keys.WriteKeys(parameters.OutFile, newkeys, pass)
 	if err != nil {
 		panic(err)
 	}
 
 	log.Infof("Key saved to: %v", parameters.OutFile)
+	roggy.Wait()
+}
+
+// loadKeys reads the key file, asking for the passphrase if it's encrypted
+func loadKeys(file string) (*skademlia.Keypair, error) {
+	return keys.ReadKeysWithPassphrase(file, func() ([]byte, error) {
+		return keys.Passphrase(parameters.PassFile, false)
+	})
 }
 
 func readKeys(file string) {
 	log.Infof("Reading Key: %v", file)
 
-	b, err := ioutil.ReadFile(file)
+	k, err := loadKeys(file)
 	if err != nil {
 		log.Error("Failed to read key", err)
 		panic(err)
 	}
 
-	k, err := keys.Deserialize(b)
+	log.Infof("Public Key: %v", hex.EncodeToString(k.PublicKey()))
+	log.Infof("Base32 ID: %v", base32.StdEncoding.EncodeToString(k.PublicKey()))
+
+	// The key file holds no nonce, loading it already checked the static puzzle and solved the dynamic one
+	// for the difficulties it was saved with. What's left to check is the nonce against the difficulties of peers.
+	log.Infof("Saved with C1=%v C2=%v", k.C1, k.C2)
+	if skademlia.VerifyPuzzle(k.PublicKey(), k.ID(), k.Nonce, skademlia.DefaultC1, skademlia.DefaultC2) {
+		log.Infof("Peers accept the key, it solves the default C1=%v C2=%v", skademlia.DefaultC1, skademlia.DefaultC2)
+	} else {
+		log.Noticef("Peers reject the key, it doesn't solve the default C1=%v C2=%v", skademlia.DefaultC1, skademlia.DefaultC2)
+	}
+	roggy.Wait()
+}
+
+// migrateKeys rewrites a key file encrypted with a new passphrase, plaintext keys get encrypted and
+// encrypted ones get their passphrase changed. The file is left readable by the owner only.
+func migrateKeys(file string) {
+	log.Infof("Migrating Key: %v", file)
+
+	k, err := loadKeys(file)
 	if err != nil {
-		log.Error("Failed to deserialize key", err)
+		log.Error("Failed to read key", err)
 		panic(err)
 	}
 
-	log.Infof("Public Key: %v", hex.EncodeToString(k.PublicKey()))
+	log.Info("Enter the new passphrase of the key")
+	pass, err := keys.Passphrase(parameters.PassFile, true)
+	if err != nil {
+		log.Error("Failed to get passphrase", err)
+		panic(err)
+	}
+	if len(pass) == 0 {
+		log.Error("Migrating needs a passphrase to encrypt the key with")
+		roggy.Wait()
+		os.Exit(1)
+	}
+
+	if err := keys.WriteKeys(file, k, pass); err != nil {
+		log.Error("Failed to write key", err)
+		panic(err)
+	}
+
+	log.Infof("Key %v encrypted and saved to: %v", hex.EncodeToString(k.PublicKey()), file)
+	roggy.Wait()
+}
+
+func generateSwarmKey(file string) {
+	log.Info("Generating Swarm Key....")
+	key, err := keys.GenerateSwarmKey()
+	if err != nil {
+		panic(err)
+	}
+
+	// Anyone holding the swarm key can join the network, it stays readable by the owner only
+	err = ioutil.WriteFile(file, keys.SerializeSwarmKey(key), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	log.Infof("Swarm key fingerprint: %v", keys.SwarmKeyFingerprint(key))
+	log.Infof("Swarm key saved to: %v", file)
+	roggy.Wait()
+}
+
+func readSwarmKey(file string) {
+	log.Infof("Reading Swarm Key: %v", file)
+
+	key, err := keys.ReadSwarmKey(file)
+	if err != nil {
+		log.Error("Failed to read swarm key", err)
+		panic(err)
+	}
+
+	log.Infof("Swarm key fingerprint: %v", keys.SwarmKeyFingerprint(key))
 	roggy.Wait()
 }
+
+// grantCapability prints a capability signed by the key, nothing else is logged so it can be redirected to a file
+func grantCapability(file string) {
+	k, err := loadKeys(file)
+	if err != nil {
+		log.Error("Failed to read key", err)
+		panic(err)
+	}
+
+	var namespaces []string
+	if parameters.Namespaces != "" {
+		namespaces = strings.Split(parameters.Namespaces, ",")
+	}
+	expires := time.Now().Add(parameters.TTL)
+
+	var c *keys.Capability
+	if parameters.Parent != "" {
+		parent, err := keys.ReadCapability(parameters.Parent)
+		if err == nil {
+			c, err = parent.Delegate(k, parameters.Grant, namespaces, expires)
+		}
+		if err != nil {
+			log.Error("Failed to delegate capability", err)
+			panic(err)
+		}
+	} else {
+		c, err = keys.IssueCapability(k, parameters.Grant, namespaces, expires, parameters.Depth)
+		if err != nil {
+			log.Error("Failed to issue capability", err)
+			panic(err)
+		}
+	}
+
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(b))
+}
+
+// signHandover prints the handover of the old key to the new one signed by both, nothing else is logged so it
+// can be redirected to a file and given to particled -handover
+func signHandover(oldFile, newFile string) {
+	oldKeys, err := loadKeys(oldFile)
+	if err != nil {
+		log.Error("Failed to read key", err)
+		panic(err)
+	}
+	newKeys, err := loadKeys(newFile)
+	if err != nil {
+		log.Error("Failed to read key", err)
+		panic(err)
+	}
+
+	h, err := keys.SignHandover(oldKeys, newKeys, time.Now())
+	if err != nil {
+		log.Error("Failed to sign handover", err)
+		panic(err)
+	}
+
+	b, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(b))
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/perlin-network/noise/skademlia"
+	"golang.org/x/crypto/ed25519"
+)
+
+// searchProgressInterval is how often the progress of a key search gets logged
+var searchProgressInterval = 2 * time.Second
+
+// keySearch looks for a key solving the s/kad puzzles whose ID starts with the prefix, on several workers
+type keySearch struct {
+	c1, c2   int
+	prefix   string
+	encoding string
+	workers  int
+
+	attempts uint64
+}
+
+func newKeySearch(c1, c2 int, prefix, encoding string, workers int) (*keySearch, error) {
+	s := &keySearch{c1: c1, c2: c2, encoding: encoding, workers: workers}
+
+	switch encoding {
+	case "hex":
+		s.prefix = strings.ToLower(prefix)
+		if strings.Trim(s.prefix, "0123456789abcdef") != "" {
+			return nil, fmt.Errorf("%q isn't a hex prefix", prefix)
+		}
+	case "base32":
+		s.prefix = strings.ToUpper(prefix)
+		if strings.Trim(s.prefix, "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567") != "" {
+			return nil, fmt.Errorf("%q isn't a base32 prefix", prefix)
+		}
+	default:
+		return nil, fmt.Errorf("unknown encoding %q, use hex or base32", encoding)
+	}
+
+	if c1 < 0 || c2 < 0 || c1 > 256 {
+		return nil, fmt.Errorf("puzzle difficulties should be within 0 and 256")
+	}
+	// s/kad gives up on the dynamic puzzle after MaxPuzzleIterations nonces
+	if math.Pow(2, float64(c2)) > float64(skademlia.MaxPuzzleIterations) {
+		return nil, fmt.Errorf("C2 of %v can't be solved within the %v attempts s/kad makes", c2, skademlia.MaxPuzzleIterations)
+	}
+	if workers < 1 {
+		return nil, fmt.Errorf("at least one worker is needed")
+	}
+	return s, nil
+}
+
+// expected is the average amount of keys tried before one matches, the static puzzle and the prefix both have to
+func (s *keySearch) expected() float64 {
+	bitsPerChar := 4.0
+	if s.encoding == "base32" {
+		bitsPerChar = 5
+	}
+	return math.Pow(2, float64(s.c1)+bitsPerChar*float64(len(s.prefix)))
+}
+
+func (s *keySearch) run() *skademlia.Keypair {
+	found := make(chan *skademlia.Keypair, 1)
+	done := make(chan struct{})
+	var stop sync.Once
+
+	for i := 0; i < s.workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				if k := s.try(); k != nil {
+					select {
+					case found <- k:
+					default:
+					}
+					stop.Do(func() { close(done) })
+					return
+				}
+			}
+		}()
+	}
+
+	start := time.Now()
+	ticker := time.NewTicker(searchProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case k := <-found:
+			log.Infof("Found a key after %v attempts in %v", atomic.LoadUint64(&s.attempts), time.Since(start).Round(time.Millisecond))
+			return k
+		case <-ticker.C:
+			s.progress(time.Since(start))
+		}
+	}
+}
+
+func (s *keySearch) progress(elapsed time.Duration) {
+	attempts := float64(atomic.LoadUint64(&s.attempts))
+	rate := attempts / elapsed.Seconds()
+	expected := s.expected()
+
+	log.Infof("Tried %.0f keys (%.0f/s), %.1f%% of the %.0f expected, ETA %v", attempts, rate, 100*attempts/expected, expected, eta(expected-attempts, rate))
+}
+
+// searchMaxETA is the longest ETA spelled out, long prefixes are expected to take longer than a Duration holds
+const searchMaxETA = 100 * 365 * 24 * time.Hour
+
+// eta returns how long the remaining attempts take at the rate of attempts per second
+func eta(remaining, rate float64) string {
+	if remaining <= 0 || rate <= 0 {
+		return "any moment now"
+	}
+	seconds := remaining / rate
+	if seconds >= searchMaxETA.Seconds() {
+		return "over 100 years"
+	}
+	return time.Duration(seconds * float64(time.Second)).Round(time.Second).String()
+}
+
+// try generates a key and returns it if its ID has the prefix and it solves both puzzles
+func (s *keySearch) try() *skademlia.Keypair {
+	atomic.AddUint64(&s.attempts, 1)
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil
+	}
+	if !s.matches(public) {
+		return nil
+	}
+
+	// LoadKeys checks the static puzzle and solves the dynamic one
+	k, err := skademlia.LoadKeys(private, s.c1, s.c2)
+	if err != nil {
+		return nil
+	}
+	return k
+}
+
+// matches tells if the ID of the public key starts with the prefix
+func (s *keySearch) matches(public []byte) bool {
+	return strings.HasPrefix(encodeID(public, s.encoding), s.prefix)
+}
+
+// encodeID encodes the public key the way satellite IDs are shown, hex in the API and base32 in the logs
+func encodeID(public []byte, encoding string) string {
+	if encoding == "base32" {
+		return base32.StdEncoding.EncodeToString(public)
+	}
+	return hex.EncodeToString(public)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/perlin-network/noise/skademlia"
+)
+
+func TestNewKeySearch(t *testing.T) {
+	tests := []struct {
+		c1, c2   int
+		prefix   string
+		encoding string
+		workers  int
+		want     string
+		valid    bool
+	}{
+		{8, 8, "", "hex", 1, "", true},
+		{8, 8, "BeEf", "hex", 4, "beef", true},
+		{8, 8, "beef", "base32", 1, "BEEF", true},
+		{8, 8, "ab2", "base32", 1, "AB2", true},
+		{8, 8, "xyz", "hex", 1, "", false},
+		{8, 8, "ab1", "base32", 1, "", false},
+		{8, 8, "ab", "base64", 1, "", false},
+		{-1, 8, "", "hex", 1, "", false},
+		{257, 8, "", "hex", 1, "", false},
+		{8, 64, "", "hex", 1, "", false},
+		{8, 8, "", "hex", 0, "", false},
+	}
+
+	for _, test := range tests {
+		s, err := newKeySearch(test.c1, test.c2, test.prefix, test.encoding, test.workers)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%+v: expected an error", test)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: %v", test, err)
+			continue
+		}
+		if s.prefix != test.want {
+			t.Errorf("%+v: prefix is %q, expected %q", test, s.prefix, test.want)
+		}
+	}
+}
+
+func TestEncodeID(t *testing.T) {
+	public := bytes.Repeat([]byte{0xff}, 32)
+	public[0], public[1] = 0x0b, 0xee
+
+	tests := []struct {
+		encoding string
+		want     string
+	}{
+		{"hex", "0bee" + string(bytes.Repeat([]byte("ff"), 30))},
+		{"base32", "BPXP77777777777777777777777777777777777777777777777Q===="},
+	}
+
+	for _, test := range tests {
+		if id := encodeID(public, test.encoding); id != test.want {
+			t.Errorf("%v: got %v, expected %v", test.encoding, id, test.want)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	public := bytes.Repeat([]byte{0xff}, 32)
+	public[0], public[1] = 0x0b, 0xee
+
+	tests := []struct {
+		prefix   string
+		encoding string
+		match    bool
+	}{
+		{"", "hex", true},
+		{"0bee", "hex", true},
+		{"0BEE", "hex", true},
+		{"bee", "hex", false},
+		{"bpxp", "base32", true},
+		{"BPXP", "base32", true},
+		{"AAAA", "base32", false},
+	}
+
+	for _, test := range tests {
+		s, err := newKeySearch(0, 0, test.prefix, test.encoding, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.matches(public) != test.match {
+			t.Errorf("%v %q: expected match to be %v", test.encoding, test.prefix, test.match)
+		}
+	}
+}
+
+func TestETA(t *testing.T) {
+	tests := []struct {
+		remaining float64
+		rate      float64
+		want      string
+	}{
+		{0, 1000, "any moment now"},
+		{1000, 0, "any moment now"},
+		{90000, 1000, "1m30s"},
+		{1500, 1000, "2s"},
+		// A 16 character base32 prefix takes 2^80 attempts, more than a Duration holds
+		{math.Pow(2, 80), 1e6, "over 100 years"},
+	}
+
+	for _, test := range tests {
+		if got := eta(test.remaining, test.rate); got != test.want {
+			t.Errorf("%v at %v/s: got %v, expected %v", test.remaining, test.rate, got, test.want)
+		}
+	}
+}
+
+func TestRunFindsMatchingKey(t *testing.T) {
+	s, err := newKeySearch(0, 0, "a", "hex", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := s.run()
+	if !s.matches(k.PublicKey()) {
+		t.Errorf("%x doesn't match the prefix", k.PublicKey())
+	}
+	if !skademlia.VerifyPuzzle(k.PublicKey(), k.ID(), k.Nonce, 0, 0) {
+		t.Error("the key doesn't solve its puzzles")
+	}
+}
+
+// TestRunStopsWorkers checks that no worker keeps trying keys once one got found
+func TestRunStopsWorkers(t *testing.T) {
+	s, err := newKeySearch(0, 0, "", "hex", 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.run()
+
+	// Workers finish the key they're on before noticing
+	time.Sleep(50 * time.Millisecond)
+	attempts := atomic.LoadUint64(&s.attempts)
+	time.Sleep(100 * time.Millisecond)
+	if now := atomic.LoadUint64(&s.attempts); now != attempts {
+		t.Errorf("workers kept going after the key was found, %v attempts became %v", attempts, now)
+	}
+}
@@ -0,0 +1,271 @@
+package satellite
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nokusukun/particles/config"
+	"github.com/nokusukun/particles/keys"
+)
+
+const (
+	// ErrAccessDenied is the reason given to peers whose packets the ACL refuses
+	ErrAccessDenied = "access denied"
+	// ErrCapabilityRequired is the reason given to peers requesting a namespace that needs a capability without one
+	ErrCapabilityRequired = "capability required"
+)
+
+// aclGuard enforces the ACL of the satellite in the dispatcher
+type aclGuard struct {
+	acl   config.ACL
+	peers map[string]bool
+	rules []aclRule
+
+	lock *sync.RWMutex
+}
+
+type aclRule struct {
+	namespace string
+	types     map[PType]bool
+	allow     map[string]bool
+	deny      map[string]bool
+	// capability makes the requests to the namespace need a capability
+	capability bool
+}
+
+func newACLGuard(acl config.ACL) (*aclGuard, error) {
+	g := &aclGuard{lock: &sync.RWMutex{}}
+	if err := g.set(acl); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// set validates the ACL and replaces the current one
+func (g *aclGuard) set(acl config.ACL) error {
+	switch acl.Mode {
+	case config.ACLOpen, config.ACLAllowlist, config.ACLDenylist:
+	default:
+		return fmt.Errorf("unknown ACL mode %q", acl.Mode)
+	}
+
+	for _, authority := range acl.Authorities {
+		if b, err := hex.DecodeString(authority); err != nil || len(b) != 32 {
+			return fmt.Errorf("invalid capability authority %q", authority)
+		}
+	}
+
+	var rules []aclRule
+	for _, r := range acl.Rules {
+		if r.Namespace == "" {
+			return fmt.Errorf("ACL rule without a namespace")
+		}
+		rule := aclRule{namespace: r.Namespace, allow: stringSet(r.Allow), deny: stringSet(r.Deny), capability: r.Capability}
+		if r.Type != "" {
+			t, err := parsePType(r.Type)
+			if err != nil {
+				return err
+			}
+			rule.types = map[PType]bool{t: true}
+		}
+		rules = append(rules, rule)
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.acl = acl
+	g.peers = stringSet(acl.Peers)
+	g.rules = rules
+	return nil
+}
+
+func (g *aclGuard) get() config.ACL {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	acl := config.ACL{
+		Mode:        g.acl.Mode,
+		Peers:       append([]string{}, g.acl.Peers...),
+		Authorities: append([]string(nil), g.acl.Authorities...),
+	}
+	for _, r := range g.acl.Rules {
+		r.Allow = append([]string(nil), r.Allow...)
+		r.Deny = append([]string(nil), r.Deny...)
+		acl.Rules = append(acl.Rules, r)
+	}
+	return acl
+}
+
+// check returns why the ACL refuses the packet, or an empty string if it lets it in. Stream packets always pass,
+// they answer our own requests. Flooded packets are only checked for the peer that relayed them, their Origin isn't
+// signed so any relay could claim someone else's. The deny lists apply first, a request carrying a valid capability
+// then gets past the allow lists and the rules that need one. An invalid capability counts as none.
+func (g *aclGuard) check(in *Inbound) string {
+	msg := in.Message
+	switch msg.PacketType {
+	case PType_Response, PType_ResponseEnd, PType_NotImplemented, PType_Error:
+		return ""
+	}
+	// Handovers are signed by both keys, they have to reach us from keys the ACL doesn't know about yet
+	if msg.Namespace == nsHandover {
+		return ""
+	}
+
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	id := in.PeerID()
+	if g.deniesPeer(id, msg) {
+		return ErrAccessDenied
+	}
+
+	var capErr error
+	if msg.PacketType == PType_Request && msg.Capability != nil {
+		capErr = keys.VerifyCapability(msg.Capability, g.acl.Authorities, id, msg.Namespace, time.Now())
+		if capErr == nil {
+			return ""
+		}
+	}
+
+	if !g.allowsPeer(id, msg) {
+		return ErrAccessDenied
+	}
+	if msg.PacketType == PType_Request && g.needsCapability(msg.Namespace) {
+		if capErr != nil {
+			return "invalid capability: " + capErr.Error()
+		}
+		return ErrCapabilityRequired
+	}
+	return ""
+}
+
+// deniesPeer returns true if the mode or a rule of the namespace lists the peer as denied, g.lock should be held
+func (g *aclGuard) deniesPeer(id string, msg Packet) bool {
+	if g.acl.Mode == config.ACLDenylist && g.peers[id] {
+		return true
+	}
+	for _, rule := range g.matching(msg) {
+		if rule.deny[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsPeer returns false if the mode or a rule of the namespace only allows other peers, g.lock should be held
+func (g *aclGuard) allowsPeer(id string, msg Packet) bool {
+	if g.acl.Mode == config.ACLAllowlist && !g.peers[id] {
+		return false
+	}
+	for _, rule := range g.matching(msg) {
+		if len(rule.allow) != 0 && !rule.allow[id] {
+			return false
+		}
+	}
+	return true
+}
+
+// matching returns the rules that apply to the packet, g.lock should be held
+func (g *aclGuard) matching(msg Packet) []aclRule {
+	var rules []aclRule
+	for _, rule := range g.rules {
+		if rule.namespace == msg.Namespace && (rule.types == nil || rule.types[msg.PacketType]) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// needsCapability returns true if a rule makes the requests to the namespace need a capability, g.lock should be held
+func (g *aclGuard) needsCapability(namespace string) bool {
+	for _, rule := range g.rules {
+		if rule.capability && rule.namespace == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// deny answers the refused packet, requests and seeks end with a PType_Error carrying the reason
+// and reliable messages get a failed acknowledgement.
+func (g *aclGuard) deny(s *Satellite, in *Inbound, reason string) {
+	log.Debugf("ACL denied %v %v from %v: %v", ptypeLabel(in.Message.PacketType), in.Message.Namespace, in.PeerID(), reason)
+	s.metrics.inboundDropped(DropDenied)
+
+	switch in.Message.PacketType {
+	case PType_Request, PType_Seek:
+		in.fail(reason)
+	case PType_Message:
+		s.reliable.complete(in, reason)
+	}
+}
+
+// follow moves the entries of the old key to the new one after a handover. The lists that let peers in
+// lose the old key, the ones that keep peers out keep it next to the new one.
+func (g *aclGuard) follow(oldID, newID string) {
+	acl := g.get()
+	changed := false
+	swap := func(list []string, keepOld bool) []string {
+		var swapped []string
+		found := false
+		for _, id := range list {
+			if id == oldID {
+				found = true
+				if keepOld {
+					swapped = append(swapped, id)
+				}
+				continue
+			}
+			if id != newID {
+				swapped = append(swapped, id)
+			}
+		}
+		if !found {
+			return list
+		}
+		changed = true
+		return append(swapped, newID)
+	}
+
+	acl.Peers = swap(acl.Peers, acl.Mode == config.ACLDenylist)
+	acl.Authorities = swap(acl.Authorities, false)
+	for i := range acl.Rules {
+		acl.Rules[i].Allow = swap(acl.Rules[i].Allow, false)
+		acl.Rules[i].Deny = swap(acl.Rules[i].Deny, true)
+	}
+
+	if changed {
+		if err := g.set(acl); err != nil {
+			log.Error("failed to update the ACL after a handover: ", err)
+		}
+	}
+}
+
+// ACL returns a copy of the access control list of the satellite
+func (s *Satellite) ACL() config.ACL {
+	return s.acl.get()
+}
+
+// SetACL replaces the access control list of the satellite, it applies to the packets processed from now on
+func (s *Satellite) SetACL(acl config.ACL) error {
+	return s.acl.set(acl)
+}
+
+func parsePType(label string) (PType, error) {
+	for t := PType_Internal; t <= PType_Error; t++ {
+		if ptypeLabel(t) == label {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown packet type %q", label)
+}
+
+func stringSet(values []string) map[string]bool {
+	set := map[string]bool{}
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
@@ -0,0 +1,202 @@
+package satellite_test
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/perlin-network/noise/skademlia"
+
+	"github.com/nokusukun/particles/config"
+	"github.com/nokusukun/particles/keys"
+	"github.com/nokusukun/particles/satellite"
+	"github.com/nokusukun/particles/satellite/satellitetest"
+)
+
+// TestACLModes has two satellites request a third one under every mode of the ACL
+func TestACLModes(t *testing.T) {
+	c, err := satellitetest.StartInMemory(3, satellitetest.Star)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	handleEcho(c, 0)
+
+	tests := []struct {
+		name    string
+		acl     config.ACL
+		allowed [2]bool
+	}{
+		{"open", config.ACL{}, [2]bool{true, true}},
+		{"allow", config.ACL{Mode: config.ACLAllowlist, Peers: []string{c.ID(1)}}, [2]bool{true, false}},
+		{"closed", config.ACL{Mode: config.ACLAllowlist}, [2]bool{false, false}},
+		{"deny", config.ACL{Mode: config.ACLDenylist, Peers: []string{c.ID(1)}}, [2]bool{false, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := c.Sat(0).SetACL(tt.acl); err != nil {
+				t.Fatal(err)
+			}
+			for n, allowed := range tt.allowed {
+				assertACL(t, c, n+1, 0, "echo", allowed)
+			}
+		})
+	}
+}
+
+// TestACLRules restricts namespaces to an allow list and away from a deny list on top of the mode
+func TestACLRules(t *testing.T) {
+	c, err := satellitetest.StartInMemory(3, satellitetest.Star)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, namespace := range []string{"echo", "allowed", "denied"} {
+		c.Sat(0).Event(satellite.PType_Request, namespace, func(i *satellite.Inbound) {
+			i.EndReply()
+		})
+	}
+
+	err = c.Sat(0).SetACL(config.ACL{Rules: []config.ACLRule{
+		{Namespace: "allowed", Type: "request", Allow: []string{c.ID(1)}},
+		{Namespace: "denied", Deny: []string{c.ID(1)}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertACL(t, c, 1, 0, "allowed", true)
+	assertACL(t, c, 2, 0, "allowed", false)
+	assertACL(t, c, 1, 0, "denied", false)
+	assertACL(t, c, 2, 0, "denied", true)
+	assertACL(t, c, 1, 0, "echo", true)
+	assertACL(t, c, 2, 0, "echo", true)
+}
+
+// TestACLCapability checks requests carrying capabilities, the deny lists apply before them
+// and an invalid one counts as none.
+func TestACLCapability(t *testing.T) {
+	c, err := satellitetest.StartInMemory(3, satellitetest.Star)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	handleEcho(c, 0)
+	c.Sat(0).Event(satellite.PType_Request, "admin", func(i *satellite.Inbound) {
+		i.EndReply()
+	})
+
+	authority := skademlia.RandomKeys()
+	grant := func(i int, namespaces ...string) *keys.Capability {
+		capability, err := keys.IssueCapability(authority, c.ID(i), namespaces, time.Now().Add(time.Hour), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return capability
+	}
+	forged := grant(1, "echo")
+	forged.Signature = grant(2, "echo").Signature
+
+	tests := []struct {
+		name       string
+		acl        config.ACL
+		from       int
+		namespace  string
+		capability *keys.Capability
+		reason     string
+	}{
+		{"open without", config.ACL{}, 1, "echo", nil, ""},
+		{"open invalid", config.ACL{}, 1, "echo", forged, ""},
+		{"closed valid", config.ACL{Mode: config.ACLAllowlist}, 1, "echo", grant(1, "echo"), ""},
+		{"closed invalid", config.ACL{Mode: config.ACLAllowlist}, 1, "echo", forged, satellite.ErrAccessDenied},
+		{"rule allow valid", config.ACL{Rules: []config.ACLRule{{Namespace: "echo", Allow: []string{c.ID(2)}}}}, 1, "echo", grant(1, "echo"), ""},
+		{"denied valid", config.ACL{Mode: config.ACLDenylist, Peers: []string{c.ID(1)}}, 1, "echo", grant(1, "echo"), satellite.ErrAccessDenied},
+		{"rule deny valid", config.ACL{Rules: []config.ACLRule{{Namespace: "echo", Deny: []string{c.ID(1)}}}}, 1, "echo", grant(1, "echo"), satellite.ErrAccessDenied},
+		{"required without", config.ACL{Rules: []config.ACLRule{{Namespace: "admin", Capability: true}}}, 1, "admin", nil, satellite.ErrCapabilityRequired},
+		{"required valid", config.ACL{Rules: []config.ACLRule{{Namespace: "admin", Capability: true}}}, 1, "admin", grant(1, "admin"), ""},
+		{"required other namespace", config.ACL{Rules: []config.ACLRule{{Namespace: "admin", Capability: true}}}, 1, "admin", grant(1, "echo"), "invalid capability: capability doesn't grant admin"},
+		{"required other grantee", config.ACL{Rules: []config.ACLRule{{Namespace: "admin", Capability: true}}}, 2, "admin", grant(1, "admin"), "invalid capability: capability is granted to " + c.ID(1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.acl.Authorities = []string{hex.EncodeToString(authority.PublicKey())}
+			if err := c.Sat(0).SetACL(tt.acl); err != nil {
+				t.Fatal(err)
+			}
+
+			end, reason := requestACL(t, c, tt.from, 0, tt.namespace, tt.capability)
+			if tt.reason == "" && end != satellite.StreamEndOK {
+				t.Errorf("refused: %v %v", end, reason)
+			}
+			if tt.reason != "" && (end != satellite.StreamEndError || reason != tt.reason) {
+				t.Errorf("ended with %v %q instead of %q", end, reason, tt.reason)
+			}
+		})
+	}
+}
+
+// TestACLFloodOrigin floods broadcasts through a line, the ACL checks the satellite that relayed them
+// instead of the origin they claim.
+func TestACLFloodOrigin(t *testing.T) {
+	c, err := satellitetest.StartInMemory(3, satellitetest.Line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	news := c.Capture(2, satellite.PType_Broadcast, "news")
+
+	if err := c.Sat(2).SetACL(config.ACL{Mode: config.ACLAllowlist, Peers: []string{c.ID(1)}}); err != nil {
+		t.Fatal(err)
+	}
+	c.Sat(0).BroadcastFlood("news", "through an allowed relay", 2)
+	in, err := satellitetest.WaitFor(news, 5*time.Second)
+	if err != nil {
+		t.Fatal("the broadcast of an unlisted origin relayed by an allowed peer got dropped: ", err)
+	}
+	if in.Message.Origin != c.ID(0) {
+		t.Errorf("the broadcast came from %v instead of %v", in.Message.Origin, c.ID(0))
+	}
+
+	if err := c.Sat(2).SetACL(config.ACL{Mode: config.ACLAllowlist, Peers: []string{c.ID(0)}}); err != nil {
+		t.Fatal(err)
+	}
+	c.Sat(0).BroadcastFlood("news", "through an unlisted relay", 2)
+	if in, err := satellitetest.WaitFor(news, 500*time.Millisecond); err == nil {
+		t.Errorf("the origin let %v in through an unlisted relay", in.Message.Payload)
+	}
+}
+
+func handleEcho(c *satellitetest.Cluster, i int) {
+	c.Sat(i).Event(satellite.PType_Request, "echo", func(in *satellite.Inbound) {
+		in.Reply(in.PeerID())
+		in.EndReply()
+	})
+}
+
+// assertACL requests the namespace of satellite to from satellite from, checking if the ACL let it in
+func assertACL(t *testing.T, c *satellitetest.Cluster, from, to int, namespace string, allowed bool) {
+	t.Helper()
+	end, reason := requestACL(t, c, from, to, namespace, nil)
+	switch {
+	case allowed && end != satellite.StreamEndOK:
+		t.Errorf("%v got refused %v: %v %v", from, namespace, end, reason)
+	case !allowed && (end != satellite.StreamEndError || reason != satellite.ErrAccessDenied):
+		t.Errorf("%v got %v through the ACL: %v %v", from, namespace, end, reason)
+	}
+}
+
+// requestACL requests the namespace with the capability, returning how the stream ended and the reason it got refused
+func requestACL(t *testing.T, c *satellitetest.Cluster, from, to int, namespace string, capability *keys.Capability) (satellite.CStreamReturn, string) {
+	t.Helper()
+	peer, err := c.Sat(from).WaitForPeer(c.ID(to), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := c.Sat(from).RequestWithCapability(peer, namespace, nil, capability)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range rs.Stream {
+	}
+	return <-rs.Done, rs.Error
+}
@@ -0,0 +1,327 @@
+package satellite
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/perlin-network/noise"
+	"github.com/perlin-network/noise/transport"
+)
+
+var (
+	_ transport.Layer = (*circuitTransport)(nil)
+	_ net.Listener    = (*circuitListener)(nil)
+	_ net.Conn        = (*circuitConn)(nil)
+
+	errCircuitClosed = errors.New("circuit closed")
+)
+
+const circuitPrefix = "circuit/"
+
+// circuitAddr is the address of a circuit, it is only dialable by the satellite that opened the circuit
+type circuitAddr struct {
+	relay   string
+	circuit string
+}
+
+func (a circuitAddr) Network() string {
+	return "circuit"
+}
+
+func (a circuitAddr) String() string {
+	return circuitPrefix + a.relay + "/" + a.circuit
+}
+
+// circuitTransport wraps the transport of the satellite so circuits through a relay get dialed and accepted
+// like any other connection. The noise handshake runs over the circuit, the relay only sees encrypted frames.
+type circuitTransport struct {
+	transport.Layer
+
+	// endpoints are the circuits ending at the satellite, keyed by their address
+	endpoints map[string]*circuitConn
+	accept    chan *circuitConn
+	// accepted is the circuit last returned by the listener, the node creates its peer right after
+	accepted *circuitConn
+
+	lock *sync.Mutex
+}
+
+func newCircuitTransport(inner transport.Layer) *circuitTransport {
+	return &circuitTransport{
+		Layer:     inner,
+		endpoints: map[string]*circuitConn{},
+		accept:    make(chan *circuitConn),
+		lock:      &sync.Mutex{},
+	}
+}
+
+// Listen listens with the wrapped transport, the listener accepts the incoming circuits as well
+func (t *circuitTransport) Listen(host string, port uint16) (net.Listener, error) {
+	inner, err := t.Layer.Listen(host, port)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &circuitListener{
+		Listener:  inner,
+		transport: t,
+		incoming:  make(chan acceptResult),
+		done:      make(chan struct{}),
+	}
+	go l.acceptInner()
+	return l, nil
+}
+
+// Dial returns the circuit registered to the address, other addresses are dialed with the wrapped transport
+func (t *circuitTransport) Dial(address string) (net.Conn, error) {
+	if !strings.HasPrefix(address, circuitPrefix) {
+		return t.Layer.Dial(address)
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	conn, exists := t.endpoints[address]
+	if !exists {
+		return nil, fmt.Errorf("no circuit opened for %v", address)
+	}
+	return conn, nil
+}
+
+// IP returns nil for circuits, the address of the remote peer isn't known
+func (t *circuitTransport) IP(address net.Addr) net.IP {
+	if _, ok := address.(circuitAddr); ok {
+		return nil
+	}
+	return t.Layer.IP(address)
+}
+
+func (t *circuitTransport) Port(address net.Addr) uint16 {
+	if _, ok := address.(circuitAddr); ok {
+		return 0
+	}
+	return t.Layer.Port(address)
+}
+
+func (t *circuitTransport) register(conn *circuitConn) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.endpoints[conn.addr.String()] = conn
+}
+
+func (t *circuitTransport) remove(conn *circuitConn) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.endpoints[conn.addr.String()] == conn {
+		delete(t.endpoints, conn.addr.String())
+	}
+}
+
+func (t *circuitTransport) endpoint(addr circuitAddr) *circuitConn {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.endpoints[addr.String()]
+}
+
+// takeAccepted returns the circuit of the peer the node just accepted, nil if it came through the wrapped transport.
+// Only called from the OnPeerConnected callback which runs on the goroutine accepting the connections.
+func (t *circuitTransport) takeAccepted() *circuitConn {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	conn := t.accepted
+	t.accepted = nil
+	return conn
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+type circuitListener struct {
+	net.Listener
+	transport *circuitTransport
+
+	incoming  chan acceptResult
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *circuitListener) acceptInner() {
+	for {
+		conn, err := l.Listener.Accept()
+		select {
+		case l.incoming <- acceptResult{conn, err}:
+		case <-l.done:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+	}
+}
+
+func (l *circuitListener) Accept() (net.Conn, error) {
+	select {
+	case res := <-l.incoming:
+		l.setAccepted(nil)
+		return res.conn, res.err
+	case conn := <-l.transport.accept:
+		l.setAccepted(conn)
+		return conn, nil
+	case <-l.done:
+		return nil, errCircuitClosed
+	}
+}
+
+func (l *circuitListener) setAccepted(conn *circuitConn) {
+	l.transport.lock.Lock()
+	l.transport.accepted = conn
+	l.transport.lock.Unlock()
+}
+
+func (l *circuitListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = l.Listener.Close()
+	})
+	return err
+}
+
+// circuitConn is the end of a circuit, the written bytes are sent to the relay in frames
+// and the frames the relay forwards are read back.
+type circuitConn struct {
+	addr circuitAddr
+	// remote is the ID of the satellite at the other end of the circuit
+	remote string
+
+	sat   *Satellite
+	relay *noise.Peer
+	in    *memoryBuffer
+
+	// peer runs over the circuit, it gets disconnected once the circuit closes
+	peer   *noise.Peer
+	closed bool
+	lock   *sync.Mutex
+}
+
+func newCircuitConn(sat *Satellite, relay *noise.Peer, circuit, remote string) *circuitConn {
+	return &circuitConn{
+		addr:   circuitAddr{relay: GetPeerID(relay), circuit: circuit},
+		remote: remote,
+		sat:    sat,
+		relay:  relay,
+		in:     newMemoryBuffer(nil),
+		lock:   &sync.Mutex{},
+	}
+}
+
+func (c *circuitConn) Read(p []byte) (int, error) {
+	return c.in.read(p)
+}
+
+func (c *circuitConn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		if c.in.isClosed() {
+			return written, errCircuitClosed
+		}
+
+		end := written + RelayFrameSize
+		if end > len(p) {
+			end = len(p)
+		}
+
+		err := c.sat.sendPacket(c.relay, Packet{
+			PacketType: PType_Internal,
+			Namespace:  nsRelayData,
+			Payload:    relayFrame{Circuit: c.addr.circuit, Data: p[written:end]},
+		})
+		if err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+// Close closes the circuit and lets the relay know
+func (c *circuitConn) Close() error {
+	if !c.shut() {
+		return nil
+	}
+
+	c.sat.sendPacketAsync(c.relay, Packet{
+		PacketType: PType_Internal,
+		Namespace:  nsRelayClose,
+		Payload:    relayFrame{Circuit: c.addr.circuit},
+	})
+	return nil
+}
+
+// remoteClosed closes the circuit after the relay or the other end closed it, disconnecting the peer running over it.
+// The peer can't find out by itself, a noise peer disconnecting from its own receive worker deadlocks.
+func (c *circuitConn) remoteClosed() {
+	if !c.shut() {
+		return
+	}
+
+	c.lock.Lock()
+	peer := c.peer
+	c.lock.Unlock()
+	if peer != nil {
+		go peer.Disconnect()
+	}
+}
+
+// shut marks the circuit as closed, returns false if it already was
+func (c *circuitConn) shut() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return false
+	}
+	c.closed = true
+	c.in.close()
+	c.sat.relay.transport.remove(c)
+	return true
+}
+
+func (c *circuitConn) setPeer(peer *noise.Peer) {
+	c.lock.Lock()
+	c.peer = peer
+	closed := c.closed
+	c.lock.Unlock()
+
+	// The circuit closed before the peer got created
+	if closed {
+		go peer.Disconnect()
+	}
+}
+
+func (c *circuitConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *circuitConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *circuitConn) SetDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	return nil
+}
+
+func (c *circuitConn) SetReadDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline does nothing, writes are bound by the send timeout of the relay peer
+func (c *circuitConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
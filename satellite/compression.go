@@ -0,0 +1,291 @@
+package satellite
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/perlin-network/noise"
+	"github.com/perlin-network/noise/payload"
+)
+
+var (
+	// DefaultCompression are the codecs offered to peers in order of preference if the config doesn't list any
+	DefaultCompression = []string{"snappy", "gzip"}
+	// CompressionThreshold is the encoded size in bytes a packet needs to reach before it gets compressed
+	CompressionThreshold = 512
+	// CompressionNegotiationTimeout is how long a connecting peer gets to send its compression offer,
+	// packets are sent uncompressed while waiting and to peers that don't send one.
+	CompressionNegotiationTimeout = 3 * time.Second
+	// MaxDecompressedPacket limits the size a compressed packet can expand to
+	MaxDecompressedPacket = 32 << 20
+
+	_ noise.Message = (*compressionOffer)(nil)
+
+	errDecompressedTooLarge = errors.New("decompressed packet is too large")
+)
+
+const keyCompression = "particles.compression"
+
+// keyLegacy marks a peer that never sent a compression offer. Peers from before the offer also don't know about
+// request nonces, they'd reply under a return tag computed without the nonce which we'd never match.
+const keyLegacy = "particles.legacy"
+
+// codec compresses packets, the ID prefixes compressed packets so the receiver knows how to decompress them.
+// IDs can't be '{' since uncompressed packets are plain JSON objects.
+type codec struct {
+	id         byte
+	name       string
+	compress   func(b []byte) ([]byte, error)
+	decompress func(b []byte) ([]byte, error)
+}
+
+var codecs = []*codec{
+	{id: 1, name: "gzip", compress: gzipCompress, decompress: gzipDecompress},
+	{id: 2, name: "snappy", compress: snappyCompress, decompress: snappyDecompress},
+}
+
+func codecByName(name string) *codec {
+	for _, c := range codecs {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func codecByID(id byte) *codec {
+	for _, c := range codecs {
+		if c.id == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// CompressionStats are the byte counts of the packets a satellite compressed and decompressed
+type CompressionStats struct {
+	// SentRaw and SentCompressed are the sizes of the packets before and after getting compressed
+	SentRaw        uint64
+	SentCompressed uint64
+	// ReceivedRaw and ReceivedCompressed are the sizes of the packets after and before getting decompressed
+	ReceivedRaw        uint64
+	ReceivedCompressed uint64
+}
+
+// CompressionStats returns the byte counts of the packets the satellite compressed and decompressed
+func (s *Satellite) CompressionStats() CompressionStats {
+	return CompressionStats{
+		SentRaw:            atomic.LoadUint64(&s.compression.SentRaw),
+		SentCompressed:     atomic.LoadUint64(&s.compression.SentCompressed),
+		ReceivedRaw:        atomic.LoadUint64(&s.compression.ReceivedRaw),
+		ReceivedCompressed: atomic.LoadUint64(&s.compression.ReceivedCompressed),
+	}
+}
+
+// Saved returns the amount of bytes compression kept off the wire, in both directions
+func (s CompressionStats) Saved() uint64 {
+	return s.SentRaw - s.SentCompressed + s.ReceivedRaw - s.ReceivedCompressed
+}
+
+// received counts the packet if it arrived compressed, Packet.Read doesn't know the satellite it belongs to
+func (s *CompressionStats) received(p Packet) {
+	if p.compressedSize == 0 {
+		return
+	}
+	atomic.AddUint64(&s.ReceivedRaw, uint64(p.rawSize))
+	atomic.AddUint64(&s.ReceivedCompressed, uint64(p.compressedSize))
+}
+
+// compressPacket compresses the encoded packet with the codec, packets below the threshold or that
+// don't get any smaller are sent as they are.
+func compressPacket(c *codec, stats *CompressionStats, b []byte) []byte {
+	if c == nil || len(b) < CompressionThreshold {
+		return b
+	}
+
+	compressed, err := c.compress(b)
+	if err != nil {
+		log.Error("failed to compress packet: ", err)
+		return b
+	}
+	if len(compressed)+1 >= len(b) {
+		return b
+	}
+
+	if stats != nil {
+		atomic.AddUint64(&stats.SentRaw, uint64(len(b)))
+		atomic.AddUint64(&stats.SentCompressed, uint64(len(compressed)+1))
+	}
+	return append([]byte{c.id}, compressed...)
+}
+
+// decompressPacket returns the JSON of the packet, compressed packets start with the ID of their codec
+func decompressPacket(b []byte) ([]byte, error) {
+	if len(b) == 0 || b[0] == '{' {
+		return b, nil
+	}
+
+	c := codecByID(b[0])
+	if c == nil {
+		return nil, fmt.Errorf("unknown compression codec %v", b[0])
+	}
+
+	raw, err := c.decompress(b[1:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress %v packet: %v", c.name, err)
+	}
+	return raw, nil
+}
+
+// compressionOffer lists the codecs a satellite accepts, both ends send theirs when they connect
+type compressionOffer struct {
+	Codecs []string
+}
+
+func (o compressionOffer) Read(reader payload.Reader) (noise.Message, error) {
+	count, err := reader.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+	if count > 64 {
+		return nil, fmt.Errorf("compression offer lists too many codecs: %v", count)
+	}
+
+	o.Codecs = make([]string, 0, count)
+	for i := uint32(0); i < count; i++ {
+		name, err := reader.ReadString()
+		if err != nil {
+			return nil, err
+		}
+		o.Codecs = append(o.Codecs, name)
+	}
+	return o, nil
+}
+
+func (o compressionOffer) Write() []byte {
+	w := payload.NewWriter(nil).WriteUint32(uint32(len(o.Codecs)))
+	for _, name := range o.Codecs {
+		w.WriteString(name)
+	}
+	return w.Bytes()
+}
+
+// compressionPreference returns the codecs the satellite offers
+func (s *Satellite) compressionPreference() []string {
+	if s.conf.DisableCompression {
+		return []string{}
+	}
+	if len(s.conf.Compression) != 0 {
+		return s.conf.Compression
+	}
+	return DefaultCompression
+}
+
+// negotiateCompression sends our compression offer and picks the first codec of our preference the peer
+// accepts once its offer arrives. Packets go out uncompressed until then, peers that never send an offer
+// keep getting uncompressed packets. Each end picks on its own, which is fine since every compressed packet
+// names its codec.
+func (b *SatPlug) negotiateCompression(peer *noise.Peer) {
+	preference := b.Satellite.compressionPreference()
+	if err := peer.SendMessage(compressionOffer{Codecs: preference}); err != nil {
+		log.Debug("failed to send compression offer: ", err)
+		return
+	}
+
+	go func() {
+		var offer compressionOffer
+		select {
+		case msg := <-peer.Receive(b.offerOp):
+			offer = msg.(compressionOffer)
+		case <-time.After(CompressionNegotiationTimeout):
+			log.Debug("peer didn't send a compression offer, sending packets uncompressed and without nonces")
+			peer.Set(keyLegacy, true)
+			return
+		case <-b.Satellite.done:
+			return
+		}
+
+		accepted := map[string]bool{}
+		for _, name := range offer.Codecs {
+			accepted[name] = true
+		}
+		for _, name := range preference {
+			if c := codecByName(name); c != nil && accepted[name] {
+				log.Debugf("compressing packets to %v with %v", GetPeerID(peer), name)
+				peer.Set(keyCompression, c)
+				return
+			}
+		}
+	}()
+}
+
+// isLegacy returns true if the peer is known to predate the compression offer and request nonces
+func isLegacy(peer *noise.Peer) bool {
+	legacy, _ := peer.Get(keyLegacy).(bool)
+	return legacy
+}
+
+// peerCodec returns the codec negotiated with the peer, nil if the packets are sent uncompressed
+func peerCodec(peer *noise.Peer) *codec {
+	c, _ := peer.Get(keyCompression).(*codec)
+	return c
+}
+
+func gzipCompress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gzipDecompress(b []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	raw, err := ioutil.ReadAll(io.LimitReader(r, int64(MaxDecompressedPacket)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > MaxDecompressedPacket {
+		return nil, errDecompressedTooLarge
+	}
+	return raw, nil
+}
+
+func snappyCompress(b []byte) ([]byte, error) {
+	return snappy.Encode(nil, b), nil
+}
+
+// snappyMaxExpansion is the most a snappy block can expand, a 3 byte copy produces at most 64 bytes
+const snappyMaxExpansion = 22
+
+// snappyDecompress decodes a snappy block, the decoded length in the header gets checked against the
+// size of the block before snappy allocates it so peers can't make us allocate more than they send.
+func snappyDecompress(b []byte) ([]byte, error) {
+	size, err := snappy.DecodedLen(b)
+	if err != nil {
+		return nil, err
+	}
+	if size > MaxDecompressedPacket {
+		return nil, errDecompressedTooLarge
+	}
+	if size > len(b)*snappyMaxExpansion {
+		return nil, fmt.Errorf("snappy block of %v bytes claims to decode to %v bytes", len(b), size)
+	}
+	return snappy.Decode(nil, b)
+}
@@ -0,0 +1,186 @@
+package satellite_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nokusukun/particles/satellite"
+	"github.com/nokusukun/particles/satellite/satellitetest"
+)
+
+func TestCompressionStatsPerSatellite(t *testing.T) {
+	c, err := satellitetest.StartInMemory(3, satellitetest.Line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	large := strings.Repeat("compressible ", 200)
+	received := c.Capture(1, satellite.PType_Message, "large")
+	err = satellitetest.WaitUntil(5*time.Second, func() bool {
+		// Packets go out uncompressed until the offer of the peer arrived
+		if err := c.Sat(0).SendByID(c.ID(1), "large", large); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := satellitetest.WaitFor(received, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		return c.Sat(0).CompressionStats().SentCompressed > 0
+	})
+	if err != nil {
+		t.Fatal("packets never got compressed: ", err)
+	}
+
+	sent, got := c.Sat(0).CompressionStats(), c.Sat(1).CompressionStats()
+	if sent.SentCompressed >= sent.SentRaw || sent.ReceivedCompressed != 0 {
+		t.Errorf("sender counted %+v", sent)
+	}
+	if got.ReceivedCompressed == 0 || got.SentCompressed != 0 {
+		t.Errorf("receiver counted %+v", got)
+	}
+	if other := c.Sat(2).CompressionStats(); other.Saved() != 0 {
+		t.Errorf("uninvolved satellite counted %+v", other)
+	}
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var inputs [][]byte
+	for n := 0; n < 200; n++ {
+		// Random bytes don't compress, repeated words do
+		raw := make([]byte, rng.Intn(8<<10))
+		rng.Read(raw)
+		inputs = append(inputs, raw)
+
+		var words bytes.Buffer
+		for words.Len() < rng.Intn(16<<10)+satellite.CompressionThreshold {
+			fmt.Fprintf(&words, "word%v ", rng.Intn(50))
+		}
+		inputs = append(inputs, words.Bytes())
+	}
+
+	for _, name := range []string{"snappy", "gzip"} {
+		for _, in := range inputs {
+			packet := append([]byte("{"), in...)
+			compressed := satellite.CompressWith(name, packet)
+			out, err := satellite.DecompressPacket(compressed)
+			if err != nil {
+				t.Fatalf("%v: failed to decompress %v bytes: %v", name, len(packet), err)
+			}
+			if !bytes.Equal(out, packet) {
+				t.Fatalf("%v: %v bytes came back as %v bytes", name, len(packet), len(out))
+			}
+		}
+
+		words := []byte("{" + strings.Repeat("compressible ", 200))
+		if compressed := satellite.CompressWith(name, words); len(compressed) >= len(words) || compressed[0] == '{' {
+			t.Errorf("%v didn't compress %v repeated bytes", name, len(words))
+		}
+	}
+}
+
+func TestDecompressMalformed(t *testing.T) {
+	words := []byte("{" + strings.Repeat("compressible ", 200))
+	snappy, gzip := satellite.CompressWith("snappy", words), satellite.CompressWith("gzip", words)
+
+	// A snappy header claiming the largest allowed packet for a block of a few bytes
+	huge := make([]byte, binary.MaxVarintLen64)
+	huge = append([]byte{snappy[0]}, huge[:binary.PutUvarint(huge, uint64(satellite.MaxDecompressedPacket))]...)
+	huge = append(huge, 0, 'x')
+
+	cases := map[string][]byte{
+		"unknown codec":       {0x7f, 1, 2, 3},
+		"empty snappy":        {snappy[0]},
+		"truncated snappy":    snappy[:len(snappy)/2],
+		"garbage snappy":      append([]byte{snappy[0]}, bytes.Repeat([]byte{0xff}, 64)...),
+		"oversized snappy":    huge,
+		"empty gzip":          {gzip[0]},
+		"truncated gzip":      gzip[:len(gzip)/2],
+		"garbage gzip":        append([]byte{gzip[0]}, bytes.Repeat([]byte{0xff}, 64)...),
+		"snappy in gzip":      append([]byte{gzip[0]}, snappy[1:]...),
+		"corrupted snappy":    append(append([]byte{}, snappy[:len(snappy)-4]...), 0xfe, 0xff, 0xff, 0xff),
+		"corrupted gzip tail": append(append([]byte{}, gzip[:len(gzip)-4]...), 0, 0, 0, 0),
+	}
+	for name, b := range cases {
+		if out, err := satellite.DecompressPacket(b); err == nil {
+			t.Errorf("%v: decompressed to %v bytes", name, len(out))
+		}
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	defer func(limit int) { satellite.MaxDecompressedPacket = limit }(satellite.MaxDecompressedPacket)
+
+	zeros := append([]byte("{"), make([]byte, 64<<10)...)
+	for _, name := range []string{"snappy", "gzip"} {
+		compressed := satellite.CompressWith(name, zeros)
+
+		satellite.MaxDecompressedPacket = len(zeros)
+		if _, err := satellite.DecompressPacket(compressed); err != nil {
+			t.Errorf("%v: packet at the limit got refused: %v", name, err)
+		}
+		satellite.MaxDecompressedPacket = len(zeros) - 1
+		if _, err := satellite.DecompressPacket(compressed); err == nil {
+			t.Errorf("%v: packet over the limit got decompressed", name)
+		}
+	}
+}
+
+// TestLegacyPeerNonce requests from a legacy peer, which gets the request without a nonce and still gets its replies matched
+func TestLegacyPeerNonce(t *testing.T) {
+	c, err := satellitetest.StartInMemory(3, satellitetest.Star)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	nonces := make(chan string, 4)
+	for n := 1; n < 3; n++ {
+		c.Sat(n).Event(satellite.PType_Request, "nonce", func(i *satellite.Inbound) {
+			nonces <- i.Message.Nonce
+			i.Reply(true)
+			i.EndReply()
+		})
+	}
+	if err := c.Sat(0).MarkLegacy(c.ID(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	for n, legacy := range map[int]bool{1: true, 2: false} {
+		rs, err := c.Sat(0).RequestByID(c.ID(n), "nonce", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if end := <-rs.Done; end != satellite.StreamEndOK {
+			t.Errorf("the request to %v ended with %v", n, end)
+		}
+		if nonce := <-nonces; (nonce == "") != legacy {
+			t.Errorf("the request to %v carried the nonce %q", n, nonce)
+		}
+	}
+
+	// A seek reaching a legacy peer goes out without a nonce to every peer
+	for n := 1; n < 3; n++ {
+		c.Sat(n).Event(satellite.PType_Seek, "nonce", func(i *satellite.Inbound) {
+			nonces <- i.Message.Nonce
+		})
+	}
+	if _, err := c.Sat(0).Seek("nonce", nil); err != nil {
+		t.Fatal(err)
+	}
+	for n := 1; n < 3; n++ {
+		select {
+		case nonce := <-nonces:
+			if nonce != "" {
+				t.Errorf("the seek carried the nonce %q", nonce)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the seek never arrived")
+		}
+	}
+}
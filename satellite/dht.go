@@ -0,0 +1,466 @@
+package satellite
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/perlin-network/noise/skademlia"
+)
+
+var (
+	// DHTReplication is the amount of closest satellites a record gets stored on
+	DHTReplication = skademlia.BucketSize()
+	// DHTRecordLifetime is the default lifetime of a record
+	DHTRecordLifetime = 1 * time.Hour
+	// DHTRepublishInterval is how often the records published by the satellite gets replicated again,
+	// this keeps records alive on the network while the closest satellites join and leave.
+	DHTRepublishInterval = 10 * time.Minute
+	// DHTMaxRecordLifetime is the longest a stored record can live, records expiring later are refused
+	DHTMaxRecordLifetime = 24 * time.Hour
+	// DHTMaxRecords is the most records the satellite stores
+	DHTMaxRecords = 10000
+	// DHTMaxRecordsPerPeer is the most records a single peer can store on the satellite
+	DHTMaxRecordsPerPeer = 500
+)
+
+const (
+	nsDHTStore = "__INTERNAL_DHT_STORE"
+	nsDHTFind  = "__INTERNAL_DHT_FIND"
+)
+
+// Record is a value stored in the DHT. Value contains the JSON encoded value, use `Record.As`
+// to decode it.
+type Record struct {
+	Key   string `json:"k"`
+	Value []byte `json:"v"`
+	// Timestamp is in milliseconds, payloads pass through float64 which can't hold nanoseconds
+	Timestamp int64 `json:"ts"`
+	Expires   int64 `json:"exp"`
+
+	// Publisher and Signature are only set on signed records, a signed record can only be
+	// replaced by a newer record signed by the same publisher.
+	Publisher string `json:"pub,omitempty"`
+	Signature []byte `json:"sig,omitempty"`
+}
+
+// As decodes the record value into `in`
+func (r *Record) As(in interface{}) error {
+	return json.Unmarshal(r.Value, in)
+}
+
+func (r *Record) Expired() bool {
+	return time.Now().Unix() > r.Expires
+}
+
+func (r *Record) IsSigned() bool {
+	return r.Publisher != ""
+}
+
+// signingBytes returns the content covered by the record signature
+func (r *Record) signingBytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(r.Key)
+	buf.WriteByte(0)
+	buf.Write(r.Value)
+	buf.WriteByte(0)
+	buf.WriteString(strconv.FormatInt(r.Timestamp, 10))
+	buf.WriteByte(0)
+	buf.WriteString(strconv.FormatInt(r.Expires, 10))
+	buf.WriteByte(0)
+	buf.WriteString(r.Publisher)
+	return buf.Bytes()
+}
+
+type dhtStore struct {
+	sat *Satellite
+
+	records   map[string]*Record
+	published map[string]*Record
+	// owners are the peers that stored each record, records of the satellite itself have none
+	owners map[string]string
+	// perPeer is the amount of records stored by each peer
+	perPeer map[string]int
+
+	lock *sync.RWMutex
+}
+
+func newDHTStore(s *Satellite) *dhtStore {
+	d := &dhtStore{
+		sat:       s,
+		records:   map[string]*Record{},
+		published: map[string]*Record{},
+		owners:    map[string]string{},
+		perPeer:   map[string]int{},
+		lock:      &sync.RWMutex{},
+	}
+
+	s.Event(PType_Request, nsDHTStore, func(i *Inbound) {
+		defer i.EndReply()
+		rec := i.As(&Record{}).(*Record)
+		if err := d.store(rec, i.PeerID()); err != nil {
+			log.Debugf("refused to store %v from %v: %v", rec.Key, i.PeerID(), err)
+			i.Reply(err.Error())
+			return
+		}
+		i.Reply("")
+	})
+
+	s.Event(PType_Request, nsDHTFind, func(i *Inbound) {
+		defer i.EndReply()
+		var key string
+		i.As(&key)
+		if rec, exists := d.local(key); exists {
+			i.Reply(rec)
+		}
+	})
+
+	go d.maintain(DHTRepublishInterval)
+	return d
+}
+
+// verify checks the validity of the record and its signature
+func (d *dhtStore) verify(rec *Record) error {
+	if rec.Expired() {
+		return fmt.Errorf("record %v has expired", rec.Key)
+	}
+	if time.Unix(rec.Expires, 0).After(time.Now().Add(DHTMaxRecordLifetime)) {
+		return fmt.Errorf("record %v lives longer than %v", rec.Key, DHTMaxRecordLifetime)
+	}
+
+	if !rec.IsSigned() {
+		return nil
+	}
+
+	pub, err := hex.DecodeString(rec.Publisher)
+	if err != nil {
+		return fmt.Errorf("invalid publisher: %v", err)
+	}
+
+	if err := d.sat.Node.Keys.Verify(pub, rec.signingBytes(), rec.Signature); err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	return nil
+}
+
+// store saves a record locally, replacing the old record unless it is a signed record
+// from another publisher or is newer than the new record. `from` is the peer that asked to store it,
+// empty for the records of the satellite itself which aren't limited.
+func (d *dhtStore) store(rec *Record, from string) error {
+	if err := d.verify(rec); err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if old, exists := d.records[rec.Key]; exists && !old.Expired() {
+		if old.IsSigned() && old.Publisher != rec.Publisher {
+			return fmt.Errorf("record %v is owned by %v", rec.Key, old.Publisher)
+		}
+		if old.Timestamp > rec.Timestamp {
+			return fmt.Errorf("record %v is older than the stored record", rec.Key)
+		}
+	}
+
+	if from != "" {
+		if err := d.admit(rec.Key, from); err != nil {
+			return err
+		}
+	}
+
+	d.setOwner(rec.Key, from)
+	d.records[rec.Key] = rec
+	return nil
+}
+
+// admit checks that the peer can store another record under the key, the lock has to be held
+func (d *dhtStore) admit(key, from string) error {
+	if d.owners[key] == from {
+		return nil
+	}
+
+	_, replacing := d.records[key]
+	full := func() bool {
+		return d.perPeer[from] >= DHTMaxRecordsPerPeer || (!replacing && len(d.records) >= DHTMaxRecords)
+	}
+	if full() {
+		d.removeExpired()
+	}
+
+	if d.perPeer[from] >= DHTMaxRecordsPerPeer {
+		return fmt.Errorf("peer already stores %v records", d.perPeer[from])
+	}
+	if !replacing && len(d.records) >= DHTMaxRecords {
+		return fmt.Errorf("store is full")
+	}
+	return nil
+}
+
+// setOwner moves the record under the key to the peer, the lock has to be held
+func (d *dhtStore) setOwner(key, from string) {
+	if previous, exists := d.owners[key]; exists {
+		d.perPeer[previous]--
+		if d.perPeer[previous] <= 0 {
+			delete(d.perPeer, previous)
+		}
+		delete(d.owners, key)
+	}
+	if from != "" {
+		d.owners[key] = from
+		d.perPeer[from]++
+	}
+}
+
+// removeExpired drops the expired records, the lock has to be held
+func (d *dhtStore) removeExpired() {
+	for key, rec := range d.records {
+		if rec.Expired() {
+			d.setOwner(key, "")
+			delete(d.records, key)
+		}
+	}
+}
+
+func (d *dhtStore) local(key string) (*Record, bool) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	rec, exists := d.records[key]
+	if !exists || rec.Expired() {
+		return nil, false
+	}
+	return rec, true
+}
+
+func (d *dhtStore) maintain(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.sat.done:
+			return
+		case <-ticker.C:
+		}
+
+		d.lock.Lock()
+		var republish []*Record
+		d.removeExpired()
+		for _, rec := range d.published {
+			republish = append(republish, rec)
+		}
+		d.lock.Unlock()
+
+		for _, rec := range republish {
+			log.Debugf("republishing record %v", rec.Key)
+			if err := d.republish(rec); err != nil {
+				log.Error("failed to republish record: ", err)
+			}
+		}
+	}
+}
+
+// closest returns the IDs of the satellites closest to the key in terms of XOR distance
+func (d *dhtStore) closest(key string) []skademlia.ID {
+	return skademlia.FindNode(d.sat.Node, keyID(key), DHTReplication, 8)
+}
+
+// replicate stores the record on the satellites closest to its key
+func (d *dhtStore) replicate(rec *Record) error {
+	ids := d.closest(rec.Key)
+
+	var wait sync.WaitGroup
+	var lock sync.Mutex
+	stored := 0
+	for _, id := range ids {
+		wait.Add(1)
+		go func(id skademlia.ID) {
+			defer wait.Done()
+			if err := d.sendStore(id, rec); err != nil {
+				log.Debugf("failed to store %v on %v: %v", rec.Key, hex.EncodeToString(id.PublicKey()), err)
+				return
+			}
+			lock.Lock()
+			stored++
+			lock.Unlock()
+		}(id)
+	}
+	wait.Wait()
+
+	log.Debugf("record %v stored on %v/%v satellites", rec.Key, stored, len(ids))
+	if stored == 0 && len(ids) > 0 {
+		return fmt.Errorf("failed to store %v on any of the %v closest satellites", rec.Key, len(ids))
+	}
+	return nil
+}
+
+func (d *dhtStore) sendStore(id skademlia.ID, rec *Record) error {
+	peer, err := d.sat.dialID(id)
+	if err != nil {
+		return err
+	}
+
+	rs, err := d.sat.Request(peer, nsDHTStore, rec)
+	if err != nil {
+		return err
+	}
+
+	for in := range rs.Stream {
+		if reason, ok := in.Payload.(string); ok && reason != "" {
+			return fmt.Errorf("remote refused: %v", reason)
+		}
+	}
+
+	if end := <-rs.Done; end != StreamEndOK {
+		return fmt.Errorf("store request ended with %v", end)
+	}
+	return nil
+}
+
+func (d *dhtStore) sendFind(id skademlia.ID, key string) []*Record {
+	peer, err := d.sat.dialID(id)
+	if err != nil {
+		return nil
+	}
+
+	rs, err := d.sat.Request(peer, nsDHTFind, key)
+	if err != nil {
+		return nil
+	}
+
+	var records []*Record
+	for in := range rs.Stream {
+		records = append(records, in.As(&Record{}).(*Record))
+	}
+	return records
+}
+
+func (d *dhtStore) put(key string, value interface{}, sign bool) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode value: %v", err)
+	}
+
+	rec := &Record{Key: key, Value: b}
+	if sign {
+		rec.Publisher = d.sat.ID()
+	}
+	if err := d.stamp(rec, DHTRecordLifetime); err != nil {
+		return err
+	}
+	if err := d.store(rec, ""); err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	d.published[key] = rec
+	d.lock.Unlock()
+
+	return d.replicate(rec)
+}
+
+// republish replicates a copy of the published record with the lifetime it got put with, unless it got replaced by a put
+func (d *dhtStore) republish(published *Record) error {
+	rec := *published
+	// Expires is in seconds, rounding up keeps the lifetime from shrinking with every republish
+	lifetime := time.Unix(rec.Expires, 0).Sub(time.Unix(0, rec.Timestamp*int64(time.Millisecond)))
+	lifetime = (lifetime + time.Second - 1).Truncate(time.Second)
+	if err := d.stamp(&rec, lifetime); err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	if d.published[rec.Key] != published {
+		d.lock.Unlock()
+		return nil
+	}
+	d.published[rec.Key] = &rec
+	d.lock.Unlock()
+
+	if err := d.store(&rec, ""); err != nil {
+		return err
+	}
+	return d.replicate(&rec)
+}
+
+// stamp sets the timestamp of the record to now and its expiry after the lifetime, signed records get signed again
+func (d *dhtStore) stamp(rec *Record, lifetime time.Duration) error {
+	now := time.Now()
+	rec.Timestamp = now.UnixNano() / int64(time.Millisecond)
+	rec.Expires = now.Add(lifetime).Unix()
+
+	if rec.IsSigned() {
+		sig, err := d.sat.Node.Keys.Sign(rec.signingBytes())
+		if err != nil {
+			return fmt.Errorf("failed to sign record: %v", err)
+		}
+		rec.Signature = sig
+	}
+	return nil
+}
+
+func (d *dhtStore) get(key string) (*Record, error) {
+	var best *Record
+	consider := func(rec *Record) {
+		if rec == nil || rec.Key != key || d.verify(rec) != nil {
+			return
+		}
+		if best == nil || rec.Timestamp > best.Timestamp {
+			best = rec
+		}
+	}
+
+	if rec, exists := d.local(key); exists {
+		consider(rec)
+	}
+
+	var wait sync.WaitGroup
+	var lock sync.Mutex
+	for _, id := range d.closest(key) {
+		wait.Add(1)
+		go func(id skademlia.ID) {
+			defer wait.Done()
+			records := d.sendFind(id, key)
+			lock.Lock()
+			for _, rec := range records {
+				consider(rec)
+			}
+			lock.Unlock()
+		}(id)
+	}
+	wait.Wait()
+
+	if best == nil {
+		return nil, fmt.Errorf("record not found: %v", key)
+	}
+
+	// Cache the record locally, the closest satellites will still hold the authoritative copy
+	_ = d.store(best, "")
+	return best, nil
+}
+
+// Put stores the value on the satellites closest to the key, the record expires after `DHTRecordLifetime`.
+// The satellite republishes it with a fresh lifetime every `DHTRepublishInterval` for as long as it runs.
+func (s *Satellite) Put(key string, value interface{}) error {
+	return s.dht.put(key, value, false)
+}
+
+// PutSigned works like `Satellite.Put` but signs the record with the satellite key,
+// satellites refuse to replace a signed record with one from another publisher.
+func (s *Satellite) PutSigned(key string, value interface{}) error {
+	return s.dht.put(key, value, true)
+}
+
+// Get finds the newest valid record for the key from the satellites closest to it
+func (s *Satellite) Get(key string) (*Record, error) {
+	return s.dht.get(key)
+}
+
+// keyID returns an s/kad ID which shares its hash with the blake2b hash of the key,
+// which lets us use the s/kad lookups to find the satellites closest to it.
+func keyID(key string) skademlia.ID {
+	return skademlia.NewID("", []byte(key), nil)
+}
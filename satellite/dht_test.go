@@ -0,0 +1,111 @@
+package satellite_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nokusukun/particles/satellite"
+	"github.com/nokusukun/particles/satellite/satellitetest"
+)
+
+func TestDHTParallelPutGet(t *testing.T) {
+	c, err := satellitetest.StartInMemory(4, satellitetest.FullMesh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var wait sync.WaitGroup
+	for n := 0; n < 8; n++ {
+		wait.Add(1)
+		go func(n int) {
+			defer wait.Done()
+			key := fmt.Sprintf("/test/%v", n)
+			if err := c.Sat(n%4).Put(key, n); err != nil {
+				t.Errorf("put %v: %v", key, err)
+				return
+			}
+
+			rec, err := c.Sat((n + 1) % 4).Get(key)
+			if err != nil {
+				t.Errorf("get %v: %v", key, err)
+				return
+			}
+			var v int
+			if err := rec.As(&v); err != nil || v != n {
+				t.Errorf("get %v returned %v (%v)", key, v, err)
+			}
+		}(n)
+	}
+	wait.Wait()
+}
+
+func TestDHTLimits(t *testing.T) {
+	c, err := satellitetest.StartInMemory(2, satellitetest.Line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	defer func(perPeer int) { satellite.DHTMaxRecordsPerPeer = perPeer }(satellite.DHTMaxRecordsPerPeer)
+	satellite.DHTMaxRecordsPerPeer = 2
+
+	for n := 0; n < 2; n++ {
+		if err := c.Sat(0).Put(fmt.Sprintf("/limit/%v", n), n); err != nil {
+			t.Fatalf("put %v: %v", n, err)
+		}
+	}
+	if err := c.Sat(0).Put("/limit/0", "replaced"); err != nil {
+		t.Errorf("replacing a record of the peer was refused: %v", err)
+	}
+	if err := c.Sat(0).Put("/limit/2", 2); err == nil {
+		t.Error("peer stored more records than DHTMaxRecordsPerPeer")
+	}
+
+	defer func(lifetime time.Duration) { satellite.DHTRecordLifetime = lifetime }(satellite.DHTRecordLifetime)
+	satellite.DHTRecordLifetime = 2 * satellite.DHTMaxRecordLifetime
+	if err := c.Sat(1).Put("/limit/forever", 0); err == nil {
+		t.Error("record living longer than DHTMaxRecordLifetime was stored")
+	}
+}
+
+// TestDHTRepublish republishes a record past its lifetime, every republish stamps it with a new expiry
+// so it outlives the lifetime it was put with.
+func TestDHTRepublish(t *testing.T) {
+	defer func(interval, lifetime time.Duration) {
+		satellite.DHTRepublishInterval, satellite.DHTRecordLifetime = interval, lifetime
+	}(satellite.DHTRepublishInterval, satellite.DHTRecordLifetime)
+	satellite.DHTRepublishInterval = 200 * time.Millisecond
+	satellite.DHTRecordLifetime = 2 * time.Second
+
+	c, err := satellitetest.StartInMemory(2, satellitetest.Line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Sat(0).PutSigned("/republished", "still here"); err != nil {
+		t.Fatal(err)
+	}
+	first, err := c.Sat(1).Get("/republished")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(3 * time.Second)
+	rec, err := c.Sat(1).Get("/republished")
+	if err != nil {
+		t.Fatal("the record expired even though it got republished: ", err)
+	}
+	if rec.Expires <= first.Expires || rec.Timestamp <= first.Timestamp {
+		t.Errorf("the record got republished with its old stamp: %v %v", rec.Timestamp, rec.Expires)
+	}
+	if rec.Publisher != c.ID(0) {
+		t.Errorf("the republished record is signed by %v", rec.Publisher)
+	}
+	if lifetime := time.Duration(rec.Expires-rec.Timestamp/1000) * time.Second; lifetime < time.Second || lifetime > 2*time.Second {
+		t.Errorf("the record got republished with a lifetime of %v", lifetime)
+	}
+}
@@ -0,0 +1,255 @@
+package satellite
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/perlin-network/noise"
+	"github.com/perlin-network/noise/payload"
+	"github.com/perlin-network/noise/protocol"
+	"github.com/perlin-network/noise/skademlia"
+)
+
+var (
+	// LookupAlpha is the amount of peers queried at once while looking up a peer
+	LookupAlpha = 3
+	// LookupDisjointPaths is the amount of disjoint paths `skademlia.FindNode` looks up a peer through
+	LookupDisjointPaths = 8
+	// LookupTimeout is how long the peers closest to a looked up peer get to return its ID
+	LookupTimeout = 3 * time.Second
+)
+
+const (
+	nsLookupID = "__INTERNAL_LOOKUP_ID"
+)
+
+// PeerByID returns the connected peer with the hex encoded ID. If the peer isn't connected, its address
+// is looked up through s/kad and the peer gets dialed. An ID that got handed over to a new key resolves to
+// the newest key, the handovers are looked up in the DHT if the peer can't be found.
+func (s *Satellite) PeerByID(peerID string) (*noise.Peer, error) {
+	peerID = s.Successor(peerID)
+	peer, err := s.peerByID(peerID)
+	if err == nil {
+		return peer, nil
+	}
+	if next := s.handovers.resolve(peerID); next != peerID {
+		return s.peerByID(next)
+	}
+	return nil, err
+}
+
+func (s *Satellite) peerByID(peerID string) (*noise.Peer, error) {
+	if peer, err := s.WaitForPeer(peerID, 0); err == nil {
+		return peer, nil
+	}
+
+	s.dialLock.Lock()
+	defer s.dialLock.Unlock()
+	// The peer might have been dialed by the lookup that held the lock
+	if peer, err := s.WaitForPeer(peerID, 0); err == nil {
+		return peer, nil
+	}
+
+	pub, err := hex.DecodeString(peerID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer id %v: %v", peerID, err)
+	}
+
+	id, err := s.lookupID(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	// The address of the s/kad ID is tried last if the satellite can't reach its IP family
+	address := idAddress(id)
+	if !addressReachable(address) {
+		if peer, err := s.dialAnnounced(peerID, address); err == nil {
+			return peer, nil
+		}
+		return s.dialID(id)
+	}
+
+	peer, err := s.dialID(id)
+	if err == nil {
+		return peer, nil
+	}
+	if peer, announcedErr := s.dialAnnounced(peerID, address); announcedErr == nil {
+		return peer, nil
+	}
+	return nil, err
+}
+
+// dialAnnounced dials the addresses the peer announced to the DHT except the one of its s/kad ID,
+// the addresses in the IP families the satellite can reach go first.
+func (s *Satellite) dialAnnounced(peerID string, skip string) (*noise.Peer, error) {
+	addresses, err := s.lookupAddresses(peerID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fmt.Errorf("no other address announced by %v", peerID)
+	for _, address := range preferReachable(addresses) {
+		if address == skip {
+			continue
+		}
+
+		var peer *noise.Peer
+		peer, err = s.Node.Dial(address)
+		if err != nil {
+			continue
+		}
+		skademlia.WaitUntilAuthenticated(peer)
+		if peer, err = s.WaitForPeer(peerID, ResponseStreamLifetime); err == nil {
+			return peer, nil
+		}
+	}
+	return nil, err
+}
+
+// RequestByID works like `Satellite.Request` but dials the peer if it isn't connected yet
+func (s *Satellite) RequestByID(peerID string, namespace string, value interface{}) (*ResponseStream, error) {
+	peer, err := s.PeerByID(peerID)
+	if err != nil {
+		return nil, err
+	}
+	return s.Request(peer, namespace, value)
+}
+
+// SendByID sends a message packet to the peer, dialing the peer if it isn't connected yet
+func (s *Satellite) SendByID(peerID string, namespace string, value interface{}) error {
+	peer, err := s.PeerByID(peerID)
+	if err != nil {
+		return err
+	}
+
+	return s.sendPacket(peer, Packet{
+		PacketType: PType_Message,
+		Namespace:  namespace,
+		Payload:    value,
+	})
+}
+
+// lookupID finds the s/kad ID, which carries the address of the peer, of the public key.
+// `skademlia.FindNode` never returns the target itself, it finds the satellites closest to it
+// which get asked for the ID they know the target by.
+func (s *Satellite) lookupID(pub []byte) (skademlia.ID, error) {
+	if id, found := s.knownID(pub); found {
+		return id, nil
+	}
+
+	target := skademlia.NewID("", pub, nil)
+	closest := skademlia.FindNode(s.Node, target, LookupAlpha, LookupDisjointPaths)
+
+	found := make(chan skademlia.ID, len(closest))
+	for _, id := range closest {
+		go func(id skademlia.ID) {
+			if known, err := s.askID(id, pub); err == nil {
+				found <- known
+			}
+		}(id)
+	}
+
+	select {
+	case id := <-found:
+		return id, nil
+	case <-time.After(LookupTimeout):
+		return skademlia.ID{}, fmt.Errorf("failed to find the address of %x after asking %v peers", pub, len(closest))
+	}
+}
+
+// knownID returns the s/kad ID of the public key if it's in the routing table or connected
+func (s *Satellite) knownID(pub []byte) (skademlia.ID, bool) {
+	target := skademlia.NewID("", pub, nil)
+	for _, id := range skademlia.FindClosestPeers(skademlia.Table(s.Node), target.Hash(), skademlia.BucketSize()) {
+		if bytes.Equal(id.PublicKey(), pub) {
+			return id.(skademlia.ID), true
+		}
+	}
+
+	peer, connected := s.connectedPeers()[hex.EncodeToString(pub)]
+	if !connected {
+		return skademlia.ID{}, false
+	}
+	id, ok := protocol.PeerID(peer).(skademlia.ID)
+	return id, ok
+}
+
+// askID asks the satellite for the s/kad ID it knows the public key by
+func (s *Satellite) askID(id skademlia.ID, pub []byte) (skademlia.ID, error) {
+	peer, err := s.dialID(id)
+	if err != nil {
+		return skademlia.ID{}, err
+	}
+
+	rs, err := s.Request(peer, nsLookupID, hex.EncodeToString(pub))
+	if err != nil {
+		return skademlia.ID{}, err
+	}
+
+	err = fmt.Errorf("%v doesn't know %x", hex.EncodeToString(id.PublicKey()), pub)
+	for in := range rs.Stream {
+		var encoded string
+		in.As(&encoded)
+		b, decodeErr := hex.DecodeString(encoded)
+		if decodeErr != nil {
+			continue
+		}
+		known, readErr := skademlia.ID{}.Read(payload.NewReader(b))
+		if readErr != nil || !bytes.Equal(known.(skademlia.ID).PublicKey(), pub) {
+			continue
+		}
+		return known.(skademlia.ID), nil
+	}
+	return skademlia.ID{}, err
+}
+
+func (s *Satellite) registerLookupEvents() {
+	// Returns the s/kad ID of a public key, which carries its address, if the satellite knows it
+	s.Event(PType_Request, nsLookupID, func(i *Inbound) {
+		defer i.EndReply()
+		var key string
+		i.As(&key)
+
+		pub, err := hex.DecodeString(key)
+		if err != nil {
+			return
+		}
+		if id, found := s.knownID(pub); found {
+			i.Reply(hex.EncodeToString(id.Write()))
+		}
+	})
+}
+
+// dialID returns the connected peer with the ID, dialing the address of the ID if it isn't connected yet
+func (s *Satellite) dialID(id skademlia.ID) (*noise.Peer, error) {
+	pid := hex.EncodeToString(id.PublicKey())
+	if pid == s.ID() {
+		return nil, fmt.Errorf("attempted to dial self")
+	}
+
+	s.pMap.RLock()
+	peer, exists := s.Peers[pid]
+	s.pMap.RUnlock()
+	if exists {
+		return peer, nil
+	}
+
+	// The peer is still connecting to the satellite
+	if protocol.Peer(s.Node, id) != nil {
+		return s.WaitForPeer(pid, ResponseStreamLifetime)
+	}
+
+	address := idAddress(id)
+	if address == "" {
+		return nil, fmt.Errorf("no address known for %v", pid)
+	}
+
+	peer, err := s.Node.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	skademlia.WaitUntilAuthenticated(peer)
+	return s.WaitForPeer(pid, ResponseStreamLifetime)
+}
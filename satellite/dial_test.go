@@ -0,0 +1,104 @@
+package satellite_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nokusukun/particles/satellite"
+	"github.com/nokusukun/particles/satellite/satellitetest"
+)
+
+// TestRequestByID looks up and dials satellites that are two hops away from several goroutines, run it with -race
+func TestRequestByID(t *testing.T) {
+	c, err := satellitetest.StartInMemory(5, satellitetest.Star)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for n := 1; n < 5; n++ {
+		n := n
+		c.Sat(n).Event(satellite.PType_Request, "whoami", func(i *satellite.Inbound) {
+			i.Reply(n)
+			i.EndReply()
+		})
+	}
+
+	var wait sync.WaitGroup
+	for n := 2; n < 5; n++ {
+		wait.Add(1)
+		go func(n int) {
+			defer wait.Done()
+			rs, err := c.Sat(1).RequestByID(c.ID(n), "whoami", nil)
+			if err != nil {
+				t.Errorf("request to %v: %v", n, err)
+				return
+			}
+			var replies []interface{}
+			for in := range rs.Stream {
+				replies = append(replies, in.Payload)
+			}
+			if fmt.Sprint(replies) != fmt.Sprintf("[%v]", n) {
+				t.Errorf("request to %v got %v", n, replies)
+			}
+		}(n)
+	}
+	wait.Wait()
+
+	if _, err := c.Sat(1).PeerByID("00" + c.ID(2)[2:]); err == nil {
+		t.Error("found a satellite that isn't in the network")
+	}
+}
+
+// TestSimultaneousDial has two satellites dial each other at the same time, both have to settle on one
+// connection that carries requests both ways.
+func TestSimultaneousDial(t *testing.T) {
+	for round := 0; round < 5; round++ {
+		c, err := satellitetest.StartInMemory(2, satellitetest.None)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for n := 0; n < 2; n++ {
+			n := n
+			c.Sat(n).Event(satellite.PType_Request, "whoami", func(i *satellite.Inbound) {
+				i.Reply(n)
+				i.EndReply()
+			})
+		}
+
+		var wait sync.WaitGroup
+		for n := 0; n < 2; n++ {
+			wait.Add(1)
+			go func(from, to int) {
+				defer wait.Done()
+				if _, err := c.Sat(from).Node.Dial(c.Sat(to).Node.ExternalAddress()); err != nil {
+					t.Errorf("dial from %v: %v", from, err)
+				}
+			}(n, 1-n)
+		}
+		wait.Wait()
+
+		if err := satellitetest.WaitUntil(satellitetest.ConnectTimeout, func() bool { return c.Connected(0, 1) }); err != nil {
+			t.Fatal("the satellites never registered each other: ", err)
+		}
+
+		for n := 0; n < 2; n++ {
+			start := time.Now()
+			rs, err := c.Sat(n).RequestByID(c.ID(1-n), "whoami", nil)
+			if err != nil {
+				t.Fatalf("round %v, request from %v: %v", round, n, err)
+			}
+			var replies []interface{}
+			for in := range rs.Stream {
+				replies = append(replies, in.Payload)
+			}
+			if fmt.Sprint(replies) != fmt.Sprintf("[%v]", 1-n) || time.Since(start) > 2*time.Second {
+				t.Errorf("round %v, request from %v got %v after %v", round, n, replies, time.Since(start))
+			}
+		}
+		c.Close()
+	}
+}
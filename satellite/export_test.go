@@ -0,0 +1,76 @@
+package satellite
+
+import "github.com/perlin-network/noise/transport"
+
+// Exposes internals to the tests in satellite_test
+
+// CompressWith compresses an encoded packet with the named codec like it would be sent to a peer
+func CompressWith(name string, b []byte) []byte {
+	return compressPacket(codecByName(name), nil, b)
+}
+
+var DecompressPacket = decompressPacket
+
+var PriorityOf = priorityOf
+
+// Lanes are the inbound lanes of a satellite without the satellite
+type Lanes struct {
+	lanes *inboundLanes
+}
+
+func NewLanes() *Lanes {
+	return &Lanes{lanes: newInboundLanes()}
+}
+
+// Push queues a packet, returns false if it got dropped
+func (l *Lanes) Push(msg Packet) bool {
+	return l.lanes.push(&Inbound{Message: msg})
+}
+
+// Next returns the next packet to process, nil once every lane is empty
+func (l *Lanes) Next() *Packet {
+	done := make(chan struct{})
+	close(done)
+	in := l.lanes.next(done)
+	if in == nil {
+		return nil
+	}
+	return &in.Message
+}
+
+const ReusePortSupported = reusePortSupported
+
+// NewTCPTransport returns the TCP transport satellites use when the config has none
+func NewTCPTransport() transport.Layer {
+	return newTCPTransport()
+}
+
+var CurvePublicKey = curvePublicKey
+
+func (s *Satellite) CurvePrivateKey() *[32]byte {
+	return s.curvePrivateKey()
+}
+
+// SendPacket sends the packet as is to the connected peer
+func (s *Satellite) SendPacket(peerID string, msg Packet) error {
+	peer, err := s.WaitForPeer(peerID, 0)
+	if err != nil {
+		return err
+	}
+	return s.sendPacket(peer, msg)
+}
+
+// Seal encrypts the value for the recipient like `Satellite.SendSealed` does
+func (s *Satellite) Seal(recipientID string, namespace string, value interface{}) (*SealedBox, error) {
+	return s.seal(recipientID, namespace, value)
+}
+
+// MarkLegacy makes the satellite treat the connected peer as one that never sent a compression offer
+func (s *Satellite) MarkLegacy(peerID string) error {
+	peer, err := s.WaitForPeer(peerID, 0)
+	if err != nil {
+		return err
+	}
+	peer.Set(keyLegacy, true)
+	return nil
+}
@@ -0,0 +1,199 @@
+package satellite
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/perlin-network/noise"
+)
+
+var (
+	// FloodTTL is the default amount of hops a flooded broadcast or seek travels
+	FloodTTL = 8
+	// FloodSeenLifetime is how long the return tag of a flooded packet is remembered
+	FloodSeenLifetime = 2 * SeekStreamLifetime
+)
+
+// floodRoute is the peer where a flooded seek came from, responses addressed to the
+// seek gets relayed back through it until they reach the origin.
+type floodRoute struct {
+	peer    *noise.Peer
+	expires time.Time
+}
+
+type floodRouter struct {
+	sat *Satellite
+
+	seen   map[string]time.Time
+	routes map[string]floodRoute
+
+	lock *sync.Mutex
+}
+
+func newFloodRouter(s *Satellite) *floodRouter {
+	f := &floodRouter{
+		sat:    s,
+		seen:   map[string]time.Time{},
+		routes: map[string]floodRoute{},
+		lock:   &sync.Mutex{},
+	}
+
+	go f.prune()
+	return f
+}
+
+func (f *floodRouter) prune() {
+	ticker := time.NewTicker(FloodSeenLifetime / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.sat.done:
+			return
+		case <-ticker.C:
+		}
+
+		f.lock.Lock()
+		now := f.sat.clock.Now()
+		for tag, seenAt := range f.seen {
+			if now.Sub(seenAt) > FloodSeenLifetime {
+				delete(f.seen, tag)
+			}
+		}
+		for tag, route := range f.routes {
+			if now.After(route.expires) {
+				delete(f.routes, tag)
+			}
+		}
+		f.lock.Unlock()
+	}
+}
+
+// markSeen returns true if the return tag has already been seen
+func (f *floodRouter) markSeen(tag string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, seen := f.seen[tag]; seen {
+		return true
+	}
+	f.seen[tag] = f.sat.clock.Now()
+	return false
+}
+
+func (f *floodRouter) route(tag string) (*noise.Peer, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	route, exists := f.routes[tag]
+	if !exists || f.sat.clock.Now().After(route.expires) {
+		return nil, false
+	}
+	return route.peer, true
+}
+
+// send writes the packet to every connected peer except the excluded ones
+func (f *floodRouter) send(msg Packet, exclude map[string]bool) (errs []error) {
+	var errorChannels []<-chan error
+	for id, peer := range f.sat.connectedPeers() {
+		if exclude[id] {
+			continue
+		}
+		errorChannels = append(errorChannels, f.sat.sendPacketAsync(peer, msg))
+	}
+
+	for _, ch := range errorChannels {
+		if err := <-ch; err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return
+}
+
+// intercept relays flooded packets and the responses addressed to flooded seeks.
+// Returns true if the inbound has been consumed and shouldn't be dispatched to the events.
+func (f *floodRouter) intercept(in *Inbound) bool {
+	msg := in.Message
+
+	switch msg.PacketType {
+	case PType_Broadcast, PType_Seek:
+		if msg.Origin == "" {
+			return false
+		}
+
+		tag := msg.ReturnTag()
+		if msg.Origin == f.sat.ID() || f.markSeen(tag) {
+			log.Debugf("flooded packet %v already seen, disposing", tag)
+			f.sat.metrics.inboundDropped(DropDuplicate)
+			return true
+		}
+
+		if msg.PacketType == PType_Seek {
+			f.lock.Lock()
+			f.routes[tag] = floodRoute{peer: in.Peer, expires: f.sat.clock.Now().Add(SeekStreamLifetime)}
+			f.lock.Unlock()
+		}
+
+		if msg.TTL > 1 {
+			forward := msg
+			forward.TTL--
+			go f.send(forward, map[string]bool{msg.Origin: true, in.PeerID(): true})
+		}
+
+		return false
+
+	case PType_Response, PType_ResponseEnd, PType_NotImplemented, PType_Error:
+		if f.sat.hasEvent(msg.PacketType, msg.Namespace) {
+			return false
+		}
+
+		peer, exists := f.route(msg.Namespace)
+		if !exists {
+			return false
+		}
+
+		log.Debugf("relaying %v back to the seek origin", msg.Namespace)
+		if err := f.sat.sendPacket(peer, msg); err != nil {
+			log.Error("failed to relay seek response: ", err)
+		}
+		return true
+	}
+
+	return false
+}
+
+// BroadcastFlood sends a broadcast that gets relayed by every satellite that receives it until
+// it travels `ttl` hops, duplicates are suppressed by the return tag of the packet.
+func (s *Satellite) BroadcastFlood(namespace string, value interface{}, ttl int) []error {
+	span := s.StartSpan("broadcast "+namespace, SpanContext{})
+	span.SetAttribute("namespace", namespace)
+	span.SetAttribute("ttl", fmt.Sprint(ttl))
+	defer span.Finish()
+
+	// The nonce keeps identical broadcasts sent within the same second from being disposed as duplicates
+	nonce, err := newMessageID()
+	if err != nil {
+		return []error{fmt.Errorf("failed to generate nonce: %v", err)}
+	}
+
+	msg := Packet{
+		PacketType: PType_Broadcast,
+		Namespace:  namespace,
+		Payload:    value,
+		Timestamp:  s.clock.Now().Unix(),
+		Origin:     s.ID(),
+		TTL:        ttl,
+		Nonce:      nonce,
+		Trace:      span.Context().ref(),
+	}
+
+	s.flood.markSeen(msg.ReturnTag())
+	log.Debugf("flooding broadcast: %v as %v", msg, msg.ReturnTag())
+	return s.flood.send(msg, nil)
+}
+
+// SeekFlood works like `Satellite.Seek` but the seek packet gets relayed through the network
+// until it travels `ttl` hops, replies gets routed back through the path the packet came from.
+func (s *Satellite) SeekFlood(namespace string, value interface{}, ttl int) (*ResponseStream, error) {
+	return s.seek(SpanContext{}, namespace, value, ttl)
+}
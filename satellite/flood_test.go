@@ -0,0 +1,124 @@
+package satellite_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nokusukun/particles/satellite"
+	"github.com/nokusukun/particles/satellite/satellitetest"
+)
+
+// TestFloodTTL floods a broadcast down a line, it stops after travelling its TTL in hops
+func TestFloodTTL(t *testing.T) {
+	c, err := satellitetest.StartInMemory(4, satellitetest.Line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var captured []<-chan *satellite.Inbound
+	for i := 1; i < 4; i++ {
+		captured = append(captured, c.Capture(i, satellite.PType_Broadcast, "news"))
+	}
+	if errs := c.Sat(0).BroadcastFlood("news", "hello", 2); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	for hops, ch := range captured[:2] {
+		in, err := satellitetest.WaitFor(ch, 5*time.Second)
+		if err != nil {
+			t.Fatalf("the broadcast never travelled %v hops: %v", hops+1, err)
+		}
+		if in.Message.Origin != c.ID(0) {
+			t.Errorf("the broadcast came from %v instead of %v", in.Message.Origin, c.ID(0))
+		}
+	}
+	if in, err := satellitetest.WaitFor(captured[2], 500*time.Millisecond); err == nil {
+		t.Errorf("the broadcast travelled past its TTL with %v hops left", in.Message.TTL)
+	}
+}
+
+// TestFloodDuplicates floods a broadcast through a full mesh, every satellite handles it once
+// even though it reaches them from every peer.
+func TestFloodDuplicates(t *testing.T) {
+	c, err := satellitetest.StartInMemory(4, satellitetest.FullMesh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var captured []<-chan *satellite.Inbound
+	for i := 0; i < 4; i++ {
+		captured = append(captured, c.Capture(i, satellite.PType_Broadcast, "news"))
+	}
+	if errs := c.Sat(0).BroadcastFlood("news", "hello", 3); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	if received := satellitetest.Collect(captured[0], 500*time.Millisecond); len(received) != 0 {
+		t.Errorf("the origin handled its own broadcast %v times", len(received))
+	}
+	for i, ch := range captured[1:] {
+		if received := satellitetest.Collect(ch, 500*time.Millisecond); len(received) != 1 {
+			t.Errorf("satellite %v handled the broadcast %v times", i+1, len(received))
+		}
+	}
+}
+
+// TestFloodIdenticalBroadcasts floods the same value twice within a second, both broadcasts reach
+// the end of the line instead of the second being disposed as a duplicate.
+func TestFloodIdenticalBroadcasts(t *testing.T) {
+	c, err := satellitetest.StartInMemory(3, satellitetest.Line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	news := c.Capture(2, satellite.PType_Broadcast, "news")
+	for n := 0; n < 2; n++ {
+		if errs := c.Sat(0).BroadcastFlood("news", "hello", 2); len(errs) != 0 {
+			t.Fatal(errs)
+		}
+	}
+
+	if received := satellitetest.Collect(news, time.Second); len(received) != 2 {
+		t.Errorf("received %v of 2 broadcasts", len(received))
+	}
+}
+
+// TestSeekFlood floods a seek down a line, the replies get routed back through the satellites it came from
+func TestSeekFlood(t *testing.T) {
+	c, err := satellitetest.StartInMemory(3, satellitetest.Line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 1; i < 3; i++ {
+		i := i
+		c.Sat(i).Event(satellite.PType_Seek, "whois", func(in *satellite.Inbound) {
+			defer in.EndReply()
+			in.Reply(i)
+		})
+	}
+
+	rs, err := c.Sat(0).SeekFlood("whois", nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origins := map[string]bool{}
+	deadline := time.After(5 * time.Second)
+	for len(origins) < 2 {
+		select {
+		case in := <-rs.Stream:
+			origins[in.Message.Origin] = true
+		case <-deadline:
+			t.Fatalf("got replies from %v of 2 satellites", len(origins))
+		}
+	}
+	for i := 1; i < 3; i++ {
+		if !origins[c.ID(i)] {
+			t.Errorf("satellite %v never replied", i)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package satellite
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/nokusukun/particles/keys"
+)
+
+var (
+	// MaxHandoverChain is the most handovers followed from a key to its newest one
+	MaxHandoverChain = 16
+)
+
+const (
+	nsHandover = "__INTERNAL_HANDOVER"
+)
+
+// handoverBook keeps the handovers the satellite learned of, keyed by the old key. The first valid
+// handover of a key is kept, a compromised key can't hand its identity over a second time.
+type handoverBook struct {
+	sat *Satellite
+
+	handovers map[string]*keys.Handover
+	// own are the handovers to the key of the satellite, sent to the peers as they connect
+	own   []*ownHandover
+	hooks []func(oldID, newID string)
+
+	lock *sync.Mutex
+}
+
+type ownHandover struct {
+	handover *keys.Handover
+	// stored is false until the handover gets stored in the DHT, which needs peers to store it on
+	stored bool
+}
+
+func newHandoverBook(s *Satellite) *handoverBook {
+	b := &handoverBook{
+		sat:       s,
+		handovers: map[string]*keys.Handover{},
+		lock:      &sync.Mutex{},
+	}
+
+	receive := func(i *Inbound) {
+		h := new(keys.Handover)
+		i.As(h)
+		if err := b.learn(h); err != nil {
+			log.Debugf("ignored handover from %v: %v", i.PeerID(), err)
+		}
+	}
+	// Handovers get flooded when they're announced, and sent to every peer that connects afterwards
+	s.Event(PType_Broadcast, nsHandover, receive)
+	s.Event(PType_Internal, nsHandover, receive)
+
+	s.OnPeerConnected(b.announceTo)
+	return b
+}
+
+// learn verifies the handover and makes the satellite follow it, unless the old key has already been handed over
+func (b *handoverBook) learn(h *keys.Handover) error {
+	if err := keys.VerifyHandover(h); err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	if known, exists := b.handovers[h.Old]; exists {
+		b.lock.Unlock()
+		if known.New != h.New {
+			return fmt.Errorf("%v has already been handed over to %v", h.Old, known.New)
+		}
+		return nil
+	}
+	// The bans and the ACL follow before anyone can resolve the new key
+	b.sat.follow(h.Old, h.New)
+	b.handovers[h.Old] = h
+	hooks := b.hooks
+	b.lock.Unlock()
+
+	log.Infof("%v has been handed over to %v", h.Old, h.New)
+	for _, hook := range hooks {
+		go hook(h.Old, h.New)
+	}
+	return nil
+}
+
+// announceTo sends the handovers of the satellite to the peer, and stores the ones that aren't in the DHT yet
+func (b *handoverBook) announceTo(peerID string) {
+	b.lock.Lock()
+	own := append([]*ownHandover(nil), b.own...)
+	b.lock.Unlock()
+
+	peer, connected := b.sat.connectedPeers()[peerID]
+	if !connected {
+		return
+	}
+	for _, o := range own {
+		if err := b.sat.sendPacket(peer, Packet{PacketType: PType_Internal, Namespace: nsHandover, Payload: o.handover}); err != nil {
+			log.Debugf("failed to send handover to %v: %v", peerID, err)
+			return
+		}
+		b.store(o)
+	}
+}
+
+func (b *handoverBook) store(o *ownHandover) {
+	b.lock.Lock()
+	stored := o.stored
+	o.stored = true
+	b.lock.Unlock()
+	if stored {
+		return
+	}
+
+	if err := b.sat.dht.put(handoverKey(o.handover.Old), o.handover, true); err != nil {
+		log.Debug("failed to store handover: ", err)
+		b.lock.Lock()
+		o.stored = false
+		b.lock.Unlock()
+	}
+}
+
+// successor follows the known handovers from the key to the newest one
+func (b *handoverBook) successor(id string) string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for hops := 0; hops < MaxHandoverChain; hops++ {
+		h, exists := b.handovers[id]
+		if !exists {
+			break
+		}
+		id = h.New
+	}
+	return id
+}
+
+// resolve finds the handovers of the key in the DHT and returns the newest key, or the key itself if it hasn't been handed over
+func (b *handoverBook) resolve(id string) string {
+	for hops := 0; hops < MaxHandoverChain; hops++ {
+		if next := b.successor(id); next != id {
+			id = next
+			continue
+		}
+
+		h, err := b.sat.lookupHandover(id)
+		if err != nil {
+			break
+		}
+		if err := b.learn(h); err != nil {
+			log.Debugf("ignored handover of %v: %v", id, err)
+			break
+		}
+	}
+	return id
+}
+
+// follow carries the bans and the ACL entries of the old key over to the new one. The old key stays
+// banned and denied since it may be compromised, it's removed from the lists that let it in.
+func (s *Satellite) follow(oldID, newID string) {
+	s.pMap.RLock()
+	banned := false
+	for _, ban := range s.bans {
+		banned = banned || ban == oldID
+	}
+	s.pMap.RUnlock()
+	if banned {
+		s.BanID(newID)
+		// Bans are checked as peers connect, the new key may have connected before its handover
+		if peer, connected := s.connectedPeers()[newID]; connected {
+			peer.Disconnect()
+		}
+	}
+
+	s.acl.follow(oldID, newID)
+}
+
+// AnnounceHandover publishes a handover from a previous key to the key of the satellite. It gets stored in the DHT,
+// flooded through the network and sent to the peers that connect afterwards, so they follow the identity to the new key.
+// Storing it is retried as peers connect if the satellite has none to store it on yet, once stored it gets republished
+// like every record the satellite puts so it doesn't expire while the satellite runs.
+func (s *Satellite) AnnounceHandover(h *keys.Handover) error {
+	if err := keys.VerifyHandover(h); err != nil {
+		return err
+	}
+	if h.New != s.ID() {
+		return fmt.Errorf("handover is to %v, not to the key of the satellite", h.New)
+	}
+	if known, err := s.lookupHandover(h.Old); err == nil && known.New != h.New {
+		return fmt.Errorf("%v has already been handed over to %v", h.Old, known.New)
+	}
+	if err := s.handovers.learn(h); err != nil {
+		return err
+	}
+
+	o := &ownHandover{handover: h}
+	s.handovers.lock.Lock()
+	s.handovers.own = append(s.handovers.own, o)
+	s.handovers.lock.Unlock()
+
+	s.BroadcastFlood(nsHandover, h, FloodTTL)
+	s.handovers.store(o)
+	return nil
+}
+
+// OnHandover runs the function whenever the satellite learns that a key got handed over to a new one
+func (s *Satellite) OnHandover(f func(oldID, newID string)) {
+	s.handovers.lock.Lock()
+	defer s.handovers.lock.Unlock()
+	s.handovers.hooks = append(s.handovers.hooks, f)
+}
+
+// Successor returns the newest key the identity of the hex encoded ID was handed over to, or the ID itself
+func (s *Satellite) Successor(id string) string {
+	return s.handovers.successor(id)
+}
+
+// Predecessors returns the previous keys of the identity of the ID, the most recent first
+func (s *Satellite) Predecessors(id string) []string {
+	s.handovers.lock.Lock()
+	defer s.handovers.lock.Unlock()
+
+	var previous []string
+	seen := map[string]bool{id: true}
+	for len(previous) < MaxHandoverChain {
+		found := false
+		for old, h := range s.handovers.handovers {
+			if h.New == id && !seen[old] {
+				previous = append(previous, old)
+				seen[old] = true
+				id = old
+				found = true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return previous
+}
+
+// lookupHandover finds the handover of the key in the DHT
+func (s *Satellite) lookupHandover(id string) (*keys.Handover, error) {
+	rec, err := s.dht.get(handoverKey(id))
+	if err != nil {
+		return nil, err
+	}
+
+	h := new(keys.Handover)
+	if err := rec.As(h); err != nil {
+		return nil, err
+	}
+	// The record is published by the new key, the handover itself is checked by learn
+	if h.Old != id || rec.Publisher != h.New {
+		return nil, fmt.Errorf("handover of %v is published by %v", id, rec.Publisher)
+	}
+	return h, nil
+}
+
+// handoverKey is the key the handover of a satellite key is stored under
+func handoverKey(id string) string {
+	return "/handover/" + id
+}
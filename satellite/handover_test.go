@@ -0,0 +1,136 @@
+package satellite_test
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/perlin-network/noise/skademlia"
+
+	"github.com/nokusukun/particles/config"
+	"github.com/nokusukun/particles/keys"
+	"github.com/nokusukun/particles/satellite"
+	"github.com/nokusukun/particles/satellite/satellitetest"
+)
+
+// TestHandoverFollowsBansAndACL hands a key over while the satellites list it, the new key replaces it in
+// the lists that let it in and joins it in the lists and bans that keep it out.
+func TestHandoverFollowsBansAndACL(t *testing.T) {
+	c, err := satellitetest.StartInMemory(2, satellitetest.None)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	oldKeys := skademlia.RandomKeys()
+	old := keyID(oldKeys)
+	allowing, denying := c.Sat(0), c.Sat(1)
+	err = allowing.SetACL(config.ACL{
+		Mode:  config.ACLAllowlist,
+		Peers: []string{old},
+		Rules: []config.ACLRule{
+			{Namespace: "allowed", Allow: []string{old}},
+			{Namespace: "denied", Deny: []string{old}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := denying.SetACL(config.ACL{Mode: config.ACLDenylist, Peers: []string{old}}); err != nil {
+		t.Fatal(err)
+	}
+	denying.BanID(old)
+
+	n := c.Add()
+	for i := 0; i < 2; i++ {
+		if err := c.Connect(n, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	announceHandover(t, c, oldKeys, n)
+	err = satellitetest.WaitUntil(5*time.Second, func() bool {
+		return allowing.Successor(old) == c.ID(n) && denying.Successor(old) == c.ID(n)
+	})
+	if err != nil {
+		t.Fatal("the handover never reached the satellites: ", err)
+	}
+
+	acl := allowing.ACL()
+	if !equal(acl.Peers, c.ID(n)) || !equal(acl.Rules[0].Allow, c.ID(n)) {
+		t.Errorf("the allow lists didn't swap the old key for the new one: %v %v", acl.Peers, acl.Rules[0].Allow)
+	}
+	if !equal(acl.Rules[1].Deny, old, c.ID(n)) {
+		t.Errorf("the deny list of the rule didn't keep the old key next to the new one: %v", acl.Rules[1].Deny)
+	}
+	if acl := denying.ACL(); !equal(acl.Peers, old, c.ID(n)) {
+		t.Errorf("the deny list didn't keep the old key next to the new one: %v", acl.Peers)
+	}
+
+	err = satellitetest.WaitUntil(5*time.Second, func() bool { return !denying.HasPeer(c.ID(n)) })
+	if err != nil {
+		t.Error("the new key of a banned key stayed connected: ", err)
+	}
+	if !allowing.HasPeer(c.ID(n)) {
+		t.Error("the new key of an allowed key got disconnected")
+	}
+}
+
+// TestHandoverRecordOutlivesLifetime resolves a handed over key past the lifetime of DHT records,
+// the handover stays in the DHT since the new key keeps republishing it.
+func TestHandoverRecordOutlivesLifetime(t *testing.T) {
+	defer func(interval, lifetime time.Duration) {
+		satellite.DHTRepublishInterval, satellite.DHTRecordLifetime = interval, lifetime
+	}(satellite.DHTRepublishInterval, satellite.DHTRecordLifetime)
+	satellite.DHTRepublishInterval = 200 * time.Millisecond
+	satellite.DHTRecordLifetime = 2 * time.Second
+
+	c, err := satellitetest.StartInMemory(2, satellitetest.Line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	oldKeys := skademlia.RandomKeys()
+	announceHandover(t, c, oldKeys, 1)
+	time.Sleep(3 * time.Second)
+
+	// A satellite that joins afterwards only finds the handover in the DHT
+	late := c.Add()
+	if err := c.Connect(late, 0); err != nil {
+		t.Fatal(err)
+	}
+	peer, err := c.Sat(late).PeerByID(keyID(oldKeys))
+	if err != nil {
+		t.Fatal("the handed over key didn't resolve: ", err)
+	}
+	if id := satellite.GetPeerID(peer); id != c.ID(1) {
+		t.Errorf("the handed over key resolved to %v instead of %v", id, c.ID(1))
+	}
+}
+
+func announceHandover(t *testing.T, c *satellitetest.Cluster, oldKeys *skademlia.Keypair, to int) {
+	t.Helper()
+	h, err := keys.SignHandover(oldKeys, c.Keys[to], time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Sat(to).AnnounceHandover(h); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func keyID(k *skademlia.Keypair) string {
+	return hex.EncodeToString(k.PublicKey())
+}
+
+func equal(values []string, want ...string) bool {
+	if len(values) != len(want) {
+		return false
+	}
+	for i := range values {
+		if values[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
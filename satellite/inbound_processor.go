@@ -2,35 +2,59 @@ package satellite
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/perlin-network/noise"
 	"github.com/perlin-network/noise/protocol"
 	"github.com/perlin-network/noise/skademlia"
 )
 
+// keyDialed marks the connections the satellite dialed itself
+const keyDialed = "particles.dialed"
+
 var (
 	logInbound                = "Inbound"
 	_          protocol.Block = (*SatPlug)(nil)
 	_          noise.Message  = (*Packet)(nil)
 )
 
+// errNoReplyPeer is returned when replying to an inbound that didn't arrive from a peer, such as a publication
+var errNoReplyPeer = errors.New("the inbound has no peer to reply to")
+
 type Inbound struct {
 	Peer    *noise.Peer
 	Message Packet
 	Payload interface{}
+	// Trace is the span of the handler the inbound is given to, pass it to `Satellite.RequestTraced`
+	// or `Satellite.StartSpan` to trace further work under it. Stream packets carry the span of the replying handler.
+	Trace SpanContext
+	// Sealed is true if the payload was encrypted for us, see `Satellite.SendSealed`
+	Sealed bool
 
+	sat          *Satellite
 	totalReplies int
 }
 
 func (i *Inbound) PeerID() string {
-	return hex.EncodeToString(protocol.PeerID(i.Peer).(skademlia.ID).PublicKey())
+	// Inbounds without a peer are delivered by the satellite to itself
+	if i.Peer == nil {
+		return i.Message.Origin
+	}
+	// The ID is gone if the peer disconnected before the inbound got processed
+	id, ok := protocol.PeerID(i.Peer).(skademlia.ID)
+	if !ok {
+		return ""
+	}
+	return hex.EncodeToString(id.PublicKey())
 }
 
 func (i *Inbound) As(in interface{}) interface{} {
 	// TODO: Change this into something more elegant, !IMPORTANT
 	// Todo: Using As results in a memory leak apparently lol.
-	b, err := json.Marshal(i.Message.Payload)
+	b, err := json.Marshal(i.Payload)
 	if err != nil {
 		log.Error(err)
 	}
@@ -42,42 +66,83 @@ func (i *Inbound) As(in interface{}) interface{} {
 	return in
 }
 
+// send sends the packet back to the peer the inbound came from
+func (i *Inbound) send(msg Packet) error {
+	if i.Peer == nil {
+		return errNoReplyPeer
+	}
+	if i.sat == nil {
+		return i.Peer.SendMessage(msg)
+	}
+	return i.sat.sendPacket(i.Peer, msg)
+}
+
 func (i *Inbound) Reply(value interface{}) {
 	tag := i.Message.ReturnTag()
 	log.Debugf("Starting response stream to: %v / %v", i.PeerID(), tag)
-	err := i.Peer.SendMessage(&Packet{
+	err := i.send(Packet{
 		PacketType: PType_Response,
 		Namespace:  tag,
 		Payload:    value,
+		Origin:     i.replyOrigin(),
+		Trace:      i.Trace.ref(),
 	})
 
 	if err != nil {
-		log.Error("Failed to respond")
+		log.Error("Failed to respond: ", err)
+		return
 	}
 	i.totalReplies++
 }
 
+// replyOrigin marks replies to flooded packets with our ID, since the replies of several satellites
+// arrive through the same relaying peer.
+func (i *Inbound) replyOrigin() string {
+	if i.Message.Origin == "" || i.Peer == nil {
+		return ""
+	}
+	return hex.EncodeToString(protocol.NodeID(i.Peer.Node()).(skademlia.ID).PublicKey())
+}
+
 func (i *Inbound) EndReply() {
 	tag := i.Message.ReturnTag()
 	log.Debug("Ending response stream to:", i.PeerID(), tag)
-	err := i.Peer.SendMessage(&Packet{
+	err := i.send(Packet{
 		PacketType: PType_ResponseEnd,
 		Namespace:  tag,
 		Payload:    i.totalReplies,
+		Origin:     i.replyOrigin(),
+		Trace:      i.Trace.ref(),
+	})
+
+	if err != nil {
+		log.Error("Failed to terminate response: ", err)
+	}
+}
+
+// fail ends the response stream of the request with a PType_Error carrying the reason
+func (i *Inbound) fail(reason string) {
+	err := i.send(Packet{
+		PacketType: PType_Error,
+		Namespace:  i.Message.ReturnTag(),
+		Payload:    reason,
+		Origin:     i.replyOrigin(),
+		Trace:      i.Trace.ref(),
 	})
 
 	if err != nil {
-		log.Error("Failed to terminate response")
+		log.Error("Failed to send error response")
 	}
 }
 
 func (i *Inbound) failNotImplemented() {
 	tag := i.Message.ReturnTag()
 	log.Debug("Ending response stream to:", i.PeerID(), tag)
-	err2 := i.Peer.SendMessage(&Packet{
+	err2 := i.send(Packet{
 		PacketType: PType_NotImplemented,
 		Namespace:  tag,
 		Payload:    "",
+		Trace:      i.Trace.ref(),
 	})
 
 	if err2 != nil {
@@ -88,10 +153,14 @@ func (i *Inbound) failNotImplemented() {
 type SatPlug struct {
 	Satellite *Satellite
 
-	Inbounds      chan *Inbound
+	// lanes holds the received inbounds by priority until they get processed
+	lanes         *inboundLanes
 	inOp          noise.Opcode
+	offerOp       noise.Opcode
 	registeredSat chan interface{}
 	rseKill       map[string]chan interface{}
+	// killLock guards rseKill, peers connect and disconnect from their own goroutines
+	killLock *sync.Mutex
 }
 
 func (b *SatPlug) OnBegin(p *protocol.Protocol, peer *noise.Peer) error {
@@ -101,23 +170,32 @@ func (b *SatPlug) OnBegin(p *protocol.Protocol, peer *noise.Peer) error {
 
 	if b.Satellite.IsBanned(peer) {
 		log.Debugf("banned peer (%v) trying to connect, disconnecting", id)
+		b.Satellite.metrics.connectionBanned()
 		return protocol.DisconnectPeer
 	}
 
-	if oldPeer, exists := b.Satellite.Peers[id]; exists {
-		acceptNewPeer := false
-		rs, err := b.Satellite.Request(oldPeer, "__INTERNAL_PING", 0)
+	// Both ends send their offer right away, the peer's offer is picked up in the background
+	b.negotiateCompression(peer)
 
-		if err != nil {
-			// assume that having an errored request means that the old Peer is already dead
-			log.Debug("ping request failed ", id)
-			acceptNewPeer = true
-		} else {
-			if <-rs.Done != StreamEndOK {
-				// assume that the request hasn't been fulfilled due to an error,
-				// disconnect to be safe.
-				log.Debug("ping request stream failed ", id)
+	if oldPeer, exists := b.Satellite.connectedPeers()[id]; exists {
+		// When both ends dial each other at the same time, each end may have registered the connection the
+		// other end is still setting up, pings over it go unanswered. The connection dialed by the lower ID
+		// gets accepted right away so both ends settle on the same one.
+		acceptNewPeer := dialed(peer) != dialed(oldPeer) && dialed(peer) == (b.Satellite.ID() < id)
+		if !acceptNewPeer {
+			rs, err := b.Satellite.Request(oldPeer, "__INTERNAL_PING", 0)
+
+			if err != nil {
+				// assume that having an errored request means that the old Peer is already dead
+				log.Debug("ping request failed ", id)
 				acceptNewPeer = true
+			} else {
+				if <-rs.Done != StreamEndOK {
+					// assume that the request hasn't been fulfilled due to an error,
+					// disconnect to be safe.
+					log.Debug("ping request stream failed ", id)
+					acceptNewPeer = true
+				}
 			}
 		}
 
@@ -135,8 +213,26 @@ func (b *SatPlug) OnBegin(p *protocol.Protocol, peer *noise.Peer) error {
 	log.Infof("%v has connected", id)
 
 	// Setup message receiver killswitch
-	b.rseKill[id] = make(chan interface{}, 1)
-	go b.ReceiveSatelliteEvents(peer, b.rseKill[id])
+	kill := make(chan interface{}, 1)
+	b.killLock.Lock()
+	b.rseKill[id] = kill
+	b.killLock.Unlock()
+	go b.ReceiveSatelliteEvents(peer, kill)
+
+	// OnEnd only gets called for peers that fail the protocol, peers that completed it
+	// gets cleaned up through the disconnect callback.
+	peer.OnDisconnect(func(node *noise.Node, peer *noise.Peer) error {
+		b.teardown(peer)
+		return nil
+	})
+
+	// Let the peer know which topics we're subscribed to
+	b.Satellite.pubsub.announceTo(peer)
+	b.Satellite.peerConnected(id)
+
+	if b.Satellite.conf.DisableBootstrap {
+		return nil
+	}
 
 	//Bootstrap to s/kad
 	peers := skademlia.FindNode(
@@ -168,24 +264,86 @@ func (b *SatPlug) ReceiveSatelliteEvents(peer *noise.Peer, kill chan interface{}
 		case msg := <-peer.Receive(b.inOp):
 			log.Sub(logInbound).Info("Received Inbound: ", msg.(Packet).PacketType)
 			log.Sub(logInbound).Debug(msg.(Packet))
-			b.Inbounds <- &Inbound{
+			b.Satellite.metrics.packetReceived(msg.(Packet))
+			b.Satellite.compression.received(msg.(Packet))
+			in := &Inbound{
+				sat:     b.Satellite,
 				Peer:    peer,
 				Message: msg.(Packet),
 				Payload: msg.(Packet).Payload,
 			}
+			// Circuit frames skip the lanes, they have to be forwarded in the order they arrived
+			if b.Satellite.relay.intercept(in) {
+				continue
+			}
+			if !b.lanes.push(in) {
+				log.Sub(logInbound).Debugf("%v lane is full, dropping inbound", priorityOf(in.Message))
+				b.Satellite.metrics.inboundDropped(DropQueueFull)
+			}
 		}
 	}
 }
 
 func (b *SatPlug) OnEnd(p *protocol.Protocol, peer *noise.Peer) error {
-	log.Info("Disconnecting peer")
-	id := hex.EncodeToString(protocol.PeerID(peer).(skademlia.ID).PublicKey())
-	b.rseKill[id] <- 1
+	b.teardown(peer)
 	return nil
 }
 
+// dialed reports if the connection to the peer was dialed by the satellite rather than accepted
+func dialed(peer *noise.Peer) bool {
+	return peer.Has(keyDialed)
+}
+
+// teardown removes a disconnected peer from the satellite
+func (b *SatPlug) teardown(peer *noise.Peer) {
+	log.Info("Disconnecting peer")
+	pid, ok := protocol.PeerID(peer).(skademlia.ID)
+	if !ok {
+		return
+	}
+	id := hex.EncodeToString(pid.PublicKey())
+
+	// A duplicate connection that got rejected shouldn't tear down the active one
+	b.Satellite.pMap.RLock()
+	current, exists := b.Satellite.Peers[id]
+	b.Satellite.pMap.RUnlock()
+	if !exists || current != peer {
+		log.Debugf("%v is not the active connection, skipping teardown", id)
+		// s/kad registered the duplicate as the connection of the ID, lookups and dials would keep using it
+		if exists && protocol.Peer(b.Satellite.Node, pid) == peer {
+			protocol.SetPeerID(current, pid)
+		}
+		return
+	}
+
+	b.Satellite.pMap.Lock()
+	delete(b.Satellite.Peers, id)
+	b.Satellite.pMap.Unlock()
+
+	// Forget the peer in s/kad as well, its OnEnd never gets called after the protocol completes
+	skademlia.Table(b.Satellite.Node).Delete(pid)
+	if protocol.Peer(b.Satellite.Node, pid) == peer {
+		protocol.DeletePeerID(peer)
+	}
+
+	b.killLock.Lock()
+	kill, exists := b.rseKill[id]
+	delete(b.rseKill, id)
+	b.killLock.Unlock()
+	if exists {
+		kill <- 1
+	}
+	b.Satellite.pubsub.removePeer(id)
+	b.Satellite.relay.removePeer(id)
+}
+
 func (b *SatPlug) OnRegister(p *protocol.Protocol, node *noise.Node) {
+	node.OnPeerDialed(func(node *noise.Node, peer *noise.Peer) error {
+		peer.Set(keyDialed, true)
+		return nil
+	})
 	b.inOp = noise.RegisterMessage(noise.NextAvailableOpcode(), (*Packet)(nil))
+	b.offerOp = noise.RegisterMessage(noise.NextAvailableOpcode(), (*compressionOffer)(nil))
 	log.Sub(logInbound).Debugf("Message Opcode: %v", b.inOp)
 }
 
@@ -193,24 +351,74 @@ func (b *SatPlug) ProcessSatelliteEvents() {
 	// wait for a satellite to be registered to start processing the satellite events
 	<-b.registeredSat
 	log.Sub(logInbound).Info("Event Processor started")
-	for in := range b.Inbounds {
+	for {
+		in := b.lanes.next(b.Satellite.done)
+		if in == nil {
+			log.Sub(logInbound).Info("Event Processor stopped")
+			return
+		}
+
+		if reason := b.Satellite.acl.check(in); reason != "" {
+			b.Satellite.acl.deny(b.Satellite, in, reason)
+			continue
+		}
+
+		if b.Satellite.flood.intercept(in) || b.Satellite.reliable.intercept(in) {
+			continue
+		}
+
+		if in.Message.Sealed != nil {
+			if err := b.Satellite.unseal(in); err != nil {
+				log.Debugf("failed to open sealed %v from %v: %v", in.Message.Namespace, in.PeerID(), err)
+				b.Satellite.metrics.inboundDropped(DropUnsealable)
+				b.Satellite.reliable.complete(in, "failed to open sealed payload")
+				continue
+			}
+		}
+
 		eventSig := fmt.Sprintf("%v/%v", in.Message.PacketType, in.Message.Namespace)
-		ev, exists := b.Satellite.Events[eventSig]
+		ev, exists := b.Satellite.event(eventSig)
 		if exists {
 			log.Debug("calling event sig: ", eventSig)
-			go ev(in)
+			go b.call(ev, in)
 		} else {
 			log.Error("Received foreign event signature: ", eventSig)
+			b.Satellite.metrics.inboundDropped(DropNoEvent)
+			b.Satellite.reliable.complete(in, "not implemented")
 			//in.failNotImplemented()
 		}
 
 	}
 }
 
+// call runs the event under a span continuing the trace of the packet and records how long it took
+func (b *SatPlug) call(ev SatEvent, in *Inbound) {
+	var span *Span
+	if in.Message.Trace != nil {
+		in.Trace = *in.Message.Trace
+	}
+	if tracesHandler(in.Message) {
+		span = b.Satellite.StartSpan(fmt.Sprintf("handle %v %v", ptypeLabel(in.Message.PacketType), in.Message.Namespace), in.Trace)
+		span.SetAttribute("namespace", in.Message.Namespace)
+		span.SetAttribute("peer", in.PeerID())
+		in.Trace = span.Context()
+	}
+
+	start := time.Now()
+	ev(in)
+	b.Satellite.metrics.handled(in.Message, time.Since(start))
+	b.Satellite.reliable.complete(in, "")
+
+	if span != nil {
+		span.SetAttribute("replies", fmt.Sprint(in.totalReplies))
+		span.Finish()
+	}
+}
+
 func (b *SatPlug) RegisterSatellite(s *Satellite) {
 	b.Satellite = s
 	// Setting up internal satellite events
-	s.Event(PType_Internal, "__INTERNAL_PING", func(i *Inbound) {
+	s.Event(PType_Request, "__INTERNAL_PING", func(i *Inbound) {
 		i.Reply(0)
 		i.EndReply()
 	})
@@ -219,12 +427,12 @@ func (b *SatPlug) RegisterSatellite(s *Satellite) {
 }
 
 func NewInboundProcessor() *SatPlug {
-	c := make(chan *Inbound, 1000)
 	plug := SatPlug{
-		Inbounds:      c,
+		lanes:         newInboundLanes(),
 		inOp:          0,
 		registeredSat: make(chan interface{}),
 		rseKill:       make(map[string]chan interface{}),
+		killLock:      &sync.Mutex{},
 	}
 
 	go plug.ProcessSatelliteEvents()
@@ -0,0 +1,157 @@
+package satellite
+
+// Priority is the lane an inbound waits in before it gets processed
+type Priority int
+
+const (
+	// PriorityControl is for internal packets and requests to the namespaces in ControlNamespaces
+	PriorityControl Priority = iota
+	// PriorityResponse is for packets that end up in a response stream
+	PriorityResponse
+	PriorityRequest
+	PriorityMessage
+	PriorityBroadcast
+)
+
+var (
+	// LaneBuffer is the amount of inbounds each lane holds, inbounds arriving at a full lane get dropped
+	LaneBuffer = 1000
+	// LaneWeights is the amount of inbounds taken from each lane, in the order of the priorities, per round.
+	// Higher lanes go first but every lane gets its share of a round so a flood of control traffic
+	// can't starve the broadcasts.
+	LaneWeights = []int{8, 8, 4, 2, 1}
+
+	// ControlNamespaces are the namespaces whose internal packets and requests skip ahead to the control lane:
+	// pings, acks and the subscription sets of the topic meshes. Other internal packets wait in the message
+	// lane, publications in the broadcast lane and requests to other internal namespaces such as DHT lookups
+	// in the request lane.
+	ControlNamespaces = map[string]bool{
+		"__INTERNAL_PING":     true,
+		nsAck:                 true,
+		nsPubSubSubscriptions: true,
+	}
+
+	laneNames = []string{"control", "response", "request", "message", "broadcast"}
+)
+
+func (p Priority) String() string {
+	if int(p) < len(laneNames) {
+		return laneNames[p]
+	}
+	return "unknown"
+}
+
+func priorityOf(msg Packet) Priority {
+	if ControlNamespaces[msg.Namespace] && (msg.PacketType == PType_Internal || msg.PacketType == PType_Request) {
+		return PriorityControl
+	}
+
+	switch msg.PacketType {
+	case PType_Response, PType_ResponseEnd, PType_NotImplemented, PType_Error:
+		return PriorityResponse
+	case PType_Request, PType_Seek:
+		return PriorityRequest
+	case PType_Message:
+		return PriorityMessage
+	case PType_Internal:
+		if msg.Namespace == nsPubSubPublish {
+			return PriorityBroadcast
+		}
+		return PriorityMessage
+	}
+	return PriorityBroadcast
+}
+
+// inboundLanes queues the inbounds by priority and hands them out by weighted round robin
+type inboundLanes struct {
+	lanes   []chan *Inbound
+	credits []int
+	// signal wakes up the processor once something gets queued
+	signal chan struct{}
+}
+
+func newInboundLanes() *inboundLanes {
+	l := &inboundLanes{
+		lanes:   make([]chan *Inbound, len(laneNames)),
+		credits: make([]int, len(laneNames)),
+		signal:  make(chan struct{}, 1),
+	}
+	for i := range l.lanes {
+		l.lanes[i] = make(chan *Inbound, LaneBuffer)
+	}
+	l.refill()
+	return l
+}
+
+// push queues the inbound in the lane of its priority, returns false if the lane is full and the inbound
+// got dropped. Waiting for room would stall the receive loop of the peer and its packets for the other lanes.
+func (l *inboundLanes) push(in *Inbound) bool {
+	select {
+	case l.lanes[priorityOf(in.Message)] <- in:
+	default:
+		return false
+	}
+
+	select {
+	case l.signal <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (l *inboundLanes) refill() {
+	for i := range l.credits {
+		l.credits[i] = 1
+		if i < len(LaneWeights) && LaneWeights[i] > 0 {
+			l.credits[i] = LaneWeights[i]
+		}
+	}
+}
+
+// next returns the next inbound to process, only a single goroutine should call it.
+// Returns nil once done gets closed.
+func (l *inboundLanes) next(done <-chan struct{}) *Inbound {
+	for {
+		// Take from the highest lane that still has credits left in this round
+		for i, lane := range l.lanes {
+			if l.credits[i] == 0 {
+				continue
+			}
+			select {
+			case in := <-lane:
+				l.credits[i]--
+				return in
+			default:
+			}
+		}
+
+		// The lanes with credits are empty, start a new round if the others have something queued
+		if l.queued() > 0 {
+			l.refill()
+			continue
+		}
+
+		select {
+		case <-l.signal:
+		case <-done:
+			return nil
+		}
+	}
+}
+
+func (l *inboundLanes) queued() int {
+	total := 0
+	for _, lane := range l.lanes {
+		total += len(lane)
+	}
+	return total
+}
+
+// QueueDepths returns the amount of inbounds waiting in each lane
+func (b *SatPlug) QueueDepths() map[string]int {
+	depths := map[string]int{}
+	for i, lane := range b.lanes.lanes {
+		depths[Priority(i).String()] = len(lane)
+	}
+	return depths
+}
@@ -0,0 +1,127 @@
+package satellite_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nokusukun/particles/satellite"
+)
+
+func TestPriorityOf(t *testing.T) {
+	cases := []struct {
+		ptype     satellite.PType
+		namespace string
+		want      satellite.Priority
+	}{
+		{satellite.PType_Request, "__INTERNAL_PING", satellite.PriorityControl},
+		{satellite.PType_Internal, "__INTERNAL_ACK", satellite.PriorityControl},
+		{satellite.PType_Internal, "__INTERNAL_SUBS", satellite.PriorityControl},
+		{satellite.PType_Internal, "__INTERNAL_PUBLISH", satellite.PriorityBroadcast},
+		{satellite.PType_Internal, "__INTERNAL_HANDOVER", satellite.PriorityMessage},
+		{satellite.PType_Response, "tag", satellite.PriorityResponse},
+		{satellite.PType_ResponseEnd, "tag", satellite.PriorityResponse},
+		{satellite.PType_Request, "__INTERNAL_DHT_FIND", satellite.PriorityRequest},
+		{satellite.PType_Seek, "ratings", satellite.PriorityRequest},
+		{satellite.PType_Message, "chat", satellite.PriorityMessage},
+		{satellite.PType_Broadcast, "news", satellite.PriorityBroadcast},
+		// Control namespaces only count for internal packets and requests
+		{satellite.PType_Broadcast, "__INTERNAL_PING", satellite.PriorityBroadcast},
+		{satellite.PType_Message, "__INTERNAL_ACK", satellite.PriorityMessage},
+	}
+
+	for _, c := range cases {
+		got := satellite.PriorityOf(satellite.Packet{PacketType: c.ptype, Namespace: c.namespace})
+		if got != c.want {
+			t.Errorf("%v to %v went to the %v lane instead of %v", c.ptype, c.namespace, got, c.want)
+		}
+	}
+}
+
+// packetOf returns a packet that lands in the lane of the priority
+func packetOf(p satellite.Priority, n int) satellite.Packet {
+	switch p {
+	case satellite.PriorityControl:
+		return satellite.Packet{PacketType: satellite.PType_Request, Namespace: "__INTERNAL_PING", Payload: n}
+	case satellite.PriorityResponse:
+		return satellite.Packet{PacketType: satellite.PType_Response, Payload: n}
+	case satellite.PriorityRequest:
+		return satellite.Packet{PacketType: satellite.PType_Request, Payload: n}
+	case satellite.PriorityMessage:
+		return satellite.Packet{PacketType: satellite.PType_Message, Payload: n}
+	}
+	return satellite.Packet{PacketType: satellite.PType_Broadcast, Payload: n}
+}
+
+func TestLaneOrder(t *testing.T) {
+	lanes := satellite.NewLanes()
+	priorities := []satellite.Priority{satellite.PriorityControl, satellite.PriorityResponse,
+		satellite.PriorityRequest, satellite.PriorityMessage, satellite.PriorityBroadcast}
+	for _, p := range priorities {
+		for n := 0; n < 20; n++ {
+			lanes.Push(packetOf(p, n))
+		}
+	}
+
+	// Every round takes the weight of each lane, higher lanes first
+	var round []string
+	for _, p := range priorities {
+		for n := 0; n < satellite.LaneWeights[p]; n++ {
+			round = append(round, p.String())
+		}
+	}
+	for r := 0; r < 2; r++ {
+		for i, want := range round {
+			got := satellite.PriorityOf(*lanes.Next())
+			if got.String() != want {
+				t.Fatalf("round %v, inbound %v came from the %v lane instead of %v", r, i, got, want)
+			}
+		}
+	}
+
+	total := 2 * len(round)
+	for lanes.Next() != nil {
+		total++
+	}
+	if total != 20*len(priorities) {
+		t.Errorf("got %v inbounds back out of %v", total, 20*len(priorities))
+	}
+}
+
+// TestLaneStarvation floods the control lane, the broadcasts still get their share of every round
+// and a full lane drops inbounds instead of holding up the others.
+func TestLaneStarvation(t *testing.T) {
+	defer func(buffer int) { satellite.LaneBuffer = buffer }(satellite.LaneBuffer)
+	satellite.LaneBuffer = 100
+
+	lanes := satellite.NewLanes()
+	for n := 0; n < satellite.LaneBuffer; n++ {
+		if !lanes.Push(packetOf(satellite.PriorityControl, n)) {
+			t.Fatalf("control inbound %v got dropped before the lane was full", n)
+		}
+	}
+	for n := 0; n < 3; n++ {
+		lanes.Push(packetOf(satellite.PriorityBroadcast, n))
+	}
+
+	if lanes.Push(packetOf(satellite.PriorityControl, -1)) {
+		t.Error("a full lane accepted another inbound")
+	}
+	if !lanes.Push(packetOf(satellite.PriorityResponse, 0)) {
+		t.Error("a full control lane held back a response")
+	}
+
+	// A round is 8 controls, then a broadcast, the first one takes the response as well
+	var order []string
+	for i := 0; i < 1+3*(satellite.LaneWeights[satellite.PriorityControl]+1); i++ {
+		order = append(order, satellite.PriorityOf(*lanes.Next()).String())
+	}
+	broadcasts := 0
+	for _, lane := range order {
+		if lane == "broadcast" {
+			broadcasts++
+		}
+	}
+	if broadcasts != 3 {
+		t.Errorf("the broadcasts got starved: %v", fmt.Sprint(order))
+	}
+}
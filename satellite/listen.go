@@ -0,0 +1,311 @@
+package satellite
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/perlin-network/noise/transport"
+)
+
+var (
+	_ transport.Layer = (*listenTransport)(nil)
+	_ net.Listener    = (*multiListener)(nil)
+
+	errListenerClosed = errors.New("listener closed")
+
+	// AddressRefreshInterval is how often the addresses of the satellite are published again, it has
+	// to be shorter than `DHTRecordLifetime` so the record doesn't expire while the addresses stay the same
+	AddressRefreshInterval = 20 * time.Minute
+)
+
+// listenTransport wraps the transport of the satellite so it listens on the addresses of `Listen` in the config
+// next to its host and port. Noise only knows about the first listener, the others feed it their connections.
+type listenTransport struct {
+	transport.Layer
+
+	extra []string
+	// bound are the addresses of the listeners, the first one is the host and port of the config
+	bound []net.Addr
+
+	lock *sync.Mutex
+}
+
+func newListenTransport(inner transport.Layer, extra []string) *listenTransport {
+	return &listenTransport{
+		Layer: inner,
+		extra: extra,
+		lock:  &sync.Mutex{},
+	}
+}
+
+func (t *listenTransport) Listen(host string, port uint16) (net.Listener, error) {
+	primary, err := t.Layer.Listen(host, port)
+	if err != nil {
+		return nil, err
+	}
+
+	listeners := []net.Listener{primary}
+	for _, address := range t.extra {
+		h, p, err := parseListenAddress(address)
+		if err == nil {
+			var l net.Listener
+			l, err = t.Layer.Listen(h, p)
+			listeners = append(listeners, l)
+		}
+		if err != nil {
+			for _, l := range listeners {
+				if l != nil {
+					l.Close()
+				}
+			}
+			return nil, fmt.Errorf("failed to listen on %v: %v", address, err)
+		}
+	}
+
+	t.lock.Lock()
+	t.bound = nil
+	for _, l := range listeners {
+		t.bound = append(t.bound, l.Addr())
+	}
+	t.lock.Unlock()
+
+	if len(listeners) == 1 {
+		return primary, nil
+	}
+	return newMultiListener(listeners), nil
+}
+
+func (t *listenTransport) addresses() []net.Addr {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return append([]net.Addr(nil), t.bound...)
+}
+
+func parseListenAddress(address string) (string, uint16, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port %v", port)
+	}
+	return host, uint16(p), nil
+}
+
+// multiListener accepts the connections of several listeners, its address is the one of the first
+type multiListener struct {
+	listeners []net.Listener
+
+	incoming  chan acceptResult
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newMultiListener(listeners []net.Listener) *multiListener {
+	l := &multiListener{
+		listeners: listeners,
+		incoming:  make(chan acceptResult),
+		done:      make(chan struct{}),
+	}
+	for _, inner := range listeners {
+		go l.acceptInner(inner)
+	}
+	return l
+}
+
+func (l *multiListener) acceptInner(inner net.Listener) {
+	for {
+		conn, err := inner.Accept()
+		select {
+		case l.incoming <- acceptResult{conn, err}:
+		case <-l.done:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+	}
+}
+
+func (l *multiListener) Accept() (net.Conn, error) {
+	select {
+	case res := <-l.incoming:
+		return res.conn, res.err
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *multiListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		for _, inner := range l.listeners {
+			if e := inner.Close(); e != nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
+
+func (l *multiListener) Addr() net.Addr {
+	return l.listeners[0].Addr()
+}
+
+// ListenAddresses returns the addresses the satellite is listening on, unspecified hosts included
+func (s *Satellite) ListenAddresses() []string {
+	var addresses []string
+	for _, addr := range s.listen.addresses() {
+		addresses = append(addresses, addr.String())
+	}
+	return addresses
+}
+
+// AdvertisedAddresses returns the addresses the satellite can be dialed on, starting with the one of its s/kad ID.
+// The listen addresses with an unspecified host are advertised with an IP of the interfaces of the same family.
+func (s *Satellite) AdvertisedAddresses() []string {
+	addresses := []string{s.AdvertisedAddress()}
+	seen := map[string]bool{addresses[0]: true}
+
+	bound := s.listen.addresses()
+	for _, addr := range bound[1:] {
+		host, port := splitAddress(addr.String())
+		ip := net.ParseIP(host)
+		if ip == nil {
+			continue
+		}
+		if ip.IsUnspecified() {
+			ip = defaultLocalIP(ip.To4() == nil)
+		}
+
+		address := net.JoinHostPort(ip.String(), port)
+		if !seen[address] {
+			seen[address] = true
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// announceAddresses publishes the addresses of the satellite to the DHT once a peer connects, again
+// whenever they change and every `AddressRefreshInterval` until the satellite shuts down.
+// The s/kad ID only carries one address, the others are only found through the DHT.
+func (s *Satellite) announceAddresses() {
+	var announced []string
+	var lock sync.Mutex
+
+	announce := func(refresh bool) {
+		addresses := s.AdvertisedAddresses()
+		if len(addresses) < 2 {
+			return
+		}
+
+		lock.Lock()
+		if !refresh && equalStrings(addresses, announced) {
+			lock.Unlock()
+			return
+		}
+		announced = addresses
+		lock.Unlock()
+
+		if err := s.dht.put(addressesKey(s.ID()), addresses, true); err != nil {
+			log.Debug("failed to announce addresses: ", err)
+			lock.Lock()
+			announced = nil
+			lock.Unlock()
+		}
+	}
+
+	s.OnPeerConnected(func(peerID string) {
+		announce(false)
+	})
+
+	go func(interval time.Duration) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+				announce(true)
+			}
+		}
+	}(AddressRefreshInterval)
+}
+
+// lookupAddresses finds the addresses the peer announced to the DHT
+func (s *Satellite) lookupAddresses(peerID string) ([]string, error) {
+	rec, err := s.dht.get(addressesKey(peerID))
+	if err != nil {
+		return nil, err
+	}
+	// Anyone can store a record under the key first, only the peer itself is trusted
+	if rec.Publisher != peerID {
+		return nil, fmt.Errorf("addresses of %v are published by %v", peerID, rec.Publisher)
+	}
+
+	var addresses []string
+	if err := rec.As(&addresses); err != nil {
+		return nil, err
+	}
+	return addresses, nil
+}
+
+// addressesKey is the key the addresses of a satellite are stored under
+func addressesKey(peerID string) string {
+	return "/addresses/" + peerID
+}
+
+// preferReachable orders the addresses so the ones in the IP families the satellite can reach come first
+func preferReachable(addresses []string) []string {
+	reachable := map[string]bool{}
+	for _, address := range addresses {
+		reachable[address] = addressReachable(address)
+	}
+
+	sorted := append([]string(nil), addresses...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return reachable[sorted[i]] && !reachable[sorted[j]]
+	})
+	return sorted
+}
+
+// addressReachable returns false if none of the interfaces has a routable IP in the family of the address
+func addressReachable(address string) bool {
+	host, _ := splitAddress(address)
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() {
+		return true
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return true
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() && (ipNet.IP.To4() == nil) == (ip.To4() == nil) {
+			return true
+		}
+	}
+	return false
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,167 @@
+package satellite_test
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nokusukun/particles/config"
+	"github.com/nokusukun/particles/satellite"
+	"github.com/nokusukun/particles/satellite/satellitetest"
+)
+
+// TestDialSecondListenAddress listens on an IPv4 and an IPv6 address, peers can connect through either
+func TestDialSecondListenAddress(t *testing.T) {
+	c, err := satellitetest.StartInMemory(1, satellitetest.None)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	s := c.AddWith(func(conf *config.Satellite) {
+		conf.Listen = []string{"[fd00::1]:0"}
+	})
+	c.Sat(s).Event(satellite.PType_Request, "whoami", func(i *satellite.Inbound) {
+		i.Reply(i.PeerID())
+		i.EndReply()
+	})
+
+	addresses := c.Sat(s).ListenAddresses()
+	if len(addresses) != 2 {
+		t.Fatalf("listening on %v", addresses)
+	}
+	host, _, _ := net.SplitHostPort(addresses[1])
+	if ip := net.ParseIP(host); ip == nil || ip.To4() != nil {
+		t.Fatalf("second listen address %v isn't IPv6", addresses[1])
+	}
+	if advertised := c.Sat(s).AdvertisedAddresses(); len(advertised) != 2 || advertised[1] != addresses[1] {
+		t.Errorf("advertising %v while listening on %v", advertised, addresses)
+	}
+
+	if _, err := c.Sat(0).Node.Dial(addresses[1]); err != nil {
+		t.Fatal(err)
+	}
+	peer, err := c.Sat(0).WaitForPeer(c.ID(s), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs, err := c.Sat(0).Request(peer, "whoami", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replies []interface{}
+	for in := range rs.Stream {
+		replies = append(replies, in.Payload)
+	}
+	if len(replies) != 1 || replies[0] != c.ID(0) {
+		t.Errorf("request over the second address got %v", replies)
+	}
+}
+
+// TestAddressesRefreshed keeps the addresses of a satellite unchanged past the lifetime of DHT records,
+// they're still found since the satellite publishes them again every `AddressRefreshInterval`.
+func TestAddressesRefreshed(t *testing.T) {
+	defer func(refresh, lifetime time.Duration) {
+		satellite.AddressRefreshInterval, satellite.DHTRecordLifetime = refresh, lifetime
+	}(satellite.AddressRefreshInterval, satellite.DHTRecordLifetime)
+	satellite.AddressRefreshInterval = 200 * time.Millisecond
+	satellite.DHTRecordLifetime = 2 * time.Second
+
+	c, err := satellitetest.StartInMemory(1, satellitetest.None)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	s := c.AddWith(func(conf *config.Satellite) {
+		conf.Listen = []string{"[fd00::1]:0"}
+	})
+	if err := c.Connect(s, 0); err != nil {
+		t.Fatal(err)
+	}
+	key := "/addresses/" + c.ID(s)
+	var first *satellite.Record
+	err = satellitetest.WaitUntil(5*time.Second, func() bool {
+		first, err = c.Sat(0).Get(key)
+		return err == nil
+	})
+	if err != nil {
+		t.Fatal("the addresses never got announced: ", err)
+	}
+
+	time.Sleep(3 * time.Second)
+	rec, err := c.Sat(0).Get(key)
+	if err != nil {
+		t.Fatal("the addresses expired: ", err)
+	}
+	if rec.Expires <= first.Expires {
+		t.Errorf("the addresses weren't published again, they expire at %v", rec.Expires)
+	}
+	var addresses []string
+	if err := rec.As(&addresses); err != nil || !reflect.DeepEqual(addresses, c.Sat(s).AdvertisedAddresses()) {
+		t.Errorf("the refreshed record holds %v (%v)", addresses, err)
+	}
+}
+
+// TestListenPortInUse listens twice on the same port, the port isn't shared with the second listener
+func TestListenPortInUse(t *testing.T) {
+	l, err := satellite.NewTCPTransport().Listen("127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	port := l.Addr().(*net.TCPAddr).Port
+	if second, err := satellite.NewTCPTransport().Listen("127.0.0.1", uint16(port)); err == nil {
+		second.Close()
+		t.Fatalf("listened on port %v while it's in use", port)
+	}
+}
+
+// TestDialFromListenPort dials over TCP, the connection leaves from the listening port so NATs that keep
+// the port map it to the address peers see the satellite listen on.
+func TestDialFromListenPort(t *testing.T) {
+	if !satellite.ReusePortSupported {
+		t.Skip("the listening port can't be shared on this platform")
+	}
+	tcp := satellite.NewTCPTransport()
+	l, err := tcp.Listen("127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	remote, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := remote.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	conn, err := tcp.Dial(remote.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	want := l.Addr().(*net.TCPAddr).Port
+	if port := conn.LocalAddr().(*net.TCPAddr).Port; port != want {
+		t.Errorf("dialed from port %v instead of the listening port %v", port, want)
+	}
+	select {
+	case in := <-accepted:
+		if port := in.RemoteAddr().(*net.TCPAddr).Port; port != want {
+			t.Errorf("the remote end saw port %v instead of %v", port, want)
+		}
+		in.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection never got accepted")
+	}
+}
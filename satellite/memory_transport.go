@@ -0,0 +1,540 @@
+package satellite
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/perlin-network/noise/transport"
+)
+
+var (
+	_ transport.Layer = (*MemoryTransport)(nil)
+	_ transport.Layer = (*memoryNATHost)(nil)
+	_ net.Listener    = (*memoryListener)(nil)
+	_ net.Conn        = (*memoryConn)(nil)
+
+	errMemoryClosed  = errors.New("memory connection closed")
+	errMemoryTimeout = &memoryTimeoutError{}
+)
+
+// MemoryTransport connects satellites living in the same process without touching the network.
+// Satellites built with the same MemoryTransport can dial each other through their addresses,
+// the connections still go through the s/kad handshake and carry the same packets as TCP.
+type MemoryTransport struct {
+	// NewLink creates the link carrying each direction of a new connection, from the writing end to the reading end.
+	// Writes reach the reading end right away if it's nil.
+	NewLink func(from, to net.Addr) MemoryLink
+
+	listeners map[string]*memoryListener
+	nextPort  uint16
+	// nats are the simulated NATs keyed by their external IP
+	nats map[string]*MemoryNAT
+	// pending is the amount of bytes that reached the connections and haven't been read yet
+	pending *int64
+
+	lock *sync.Mutex
+}
+
+// MemoryLink carries the writes of one direction of a memory connection, satellite/sim delays them on its virtual clock
+type MemoryLink interface {
+	// Send is called for every write in the order they're written, deliver hands the bytes to the reading end.
+	// deliver has to be called in the same order for the bytes to arrive intact.
+	Send(p []byte, deliver func())
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{
+		listeners: map[string]*memoryListener{},
+		nextPort:  10000,
+		nats:      map[string]*MemoryNAT{},
+		pending:   new(int64),
+		lock:      &sync.Mutex{},
+	}
+}
+
+// Pending returns the amount of bytes that reached the connections and haven't been read yet
+func (t *MemoryTransport) Pending() int64 {
+	return atomic.LoadInt64(t.pending)
+}
+
+func (t *MemoryTransport) String() string {
+	return "memory"
+}
+
+// allocatePort returns the next free port of the host, t.lock should be held
+func (t *MemoryTransport) allocatePort(host string) uint16 {
+	for {
+		t.nextPort++
+		if t.nextPort == 0 {
+			t.nextPort = 10001
+		}
+		if _, used := t.listeners[memoryAddr{host, t.nextPort}.String()]; !used {
+			return t.nextPort
+		}
+	}
+}
+
+// Listen listens on the host and port, a port of 0 gets a free port assigned
+func (t *MemoryTransport) Listen(host string, port uint16) (net.Listener, error) {
+	return t.listen(host, port, nil)
+}
+
+// listen listens on the host and port of a host behind the NAT, nil for hosts that aren't behind one
+func (t *MemoryTransport) listen(host string, port uint16, nat *MemoryNAT) (*memoryListener, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if port == 0 {
+		port = t.allocatePort(host)
+	}
+
+	addr := memoryAddr{host, port}
+	if _, used := t.listeners[addr.String()]; used {
+		return nil, fmt.Errorf("memory address %v is already in use", addr)
+	}
+
+	l := &memoryListener{
+		transport: t,
+		addr:      addr,
+		nat:       nat,
+		accept:    make(chan net.Conn),
+		done:      make(chan struct{}),
+	}
+	t.listeners[addr.String()] = l
+	return l, nil
+}
+
+// Dial connects to the listener on the address, the dialing end gets a free port of the listening host assigned
+func (t *MemoryTransport) Dial(address string) (net.Conn, error) {
+	t.lock.Lock()
+	host := "127.0.0.1"
+	if l, exists := t.listeners[address]; exists {
+		host = l.addr.host
+	}
+	local := memoryAddr{host, t.allocatePort(host)}
+	t.lock.Unlock()
+
+	return t.connect(local, address, nil)
+}
+
+// connect dials the address from the local address of a host behind the NAT, nil for hosts that aren't behind one.
+// Addresses behind a NAT can only be reached from behind the same NAT or through the external address of the NAT.
+func (t *MemoryTransport) connect(local memoryAddr, address string, nat *MemoryNAT) (net.Conn, error) {
+	remote, err := parseMemoryAddr(address)
+	if err != nil {
+		return nil, err
+	}
+
+	t.lock.Lock()
+	l, exists := t.listeners[address]
+	if exists && l.nat != nil && l.nat != nat {
+		exists = false
+	}
+
+	// The remote end sees the connection coming from the NAT unless both ends are behind it
+	source := local
+	if nat != nil && !(exists && l.nat == nat) {
+		source = nat.outbound(local, address)
+	}
+
+	if target, isNAT := t.nats[remote.host]; isNAT && !exists {
+		if internal, allowed := target.inbound(remote.port, source); allowed {
+			l, exists = t.listeners[internal.String()]
+		}
+	}
+	t.lock.Unlock()
+
+	if !exists {
+		return nil, fmt.Errorf("nothing is listening on memory address %v", address)
+	}
+
+	a, b := t.newPipe(local, remote, l.addr, source)
+	select {
+	case l.accept <- b:
+		return a, nil
+	case <-l.done:
+		return nil, fmt.Errorf("memory listener on %v closed", address)
+	}
+}
+
+func (t *MemoryTransport) IP(address net.Addr) net.IP {
+	host, _, err := net.SplitHostPort(address.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func (t *MemoryTransport) Port(address net.Addr) uint16 {
+	_, port, err := net.SplitHostPort(address.String())
+	if err != nil {
+		return 0
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return 0
+	}
+	return uint16(p)
+}
+
+type memoryAddr struct {
+	host string
+	port uint16
+}
+
+func (a memoryAddr) Network() string {
+	return "memory"
+}
+
+func (a memoryAddr) String() string {
+	return net.JoinHostPort(a.host, strconv.Itoa(int(a.port)))
+}
+
+func parseMemoryAddr(address string) (memoryAddr, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return memoryAddr{}, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return memoryAddr{}, fmt.Errorf("invalid memory address %v: %v", address, err)
+	}
+	return memoryAddr{host, uint16(p)}, nil
+}
+
+type memoryListener struct {
+	transport *MemoryTransport
+	addr      memoryAddr
+	nat       *MemoryNAT
+	accept    chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accept:
+		return conn, nil
+	case <-l.done:
+		return nil, errMemoryClosed
+	}
+}
+
+// Close stops accepting connections and frees the address, established connections stay open
+func (l *memoryListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.transport.lock.Lock()
+		delete(l.transport.listeners, l.addr.String())
+		l.transport.lock.Unlock()
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return l.addr
+}
+
+// memoryBuffer is one direction of a memory connection, writes never block
+type memoryBuffer struct {
+	data []byte
+	// pending counts the unread bytes of every buffer of the transport, nil if they aren't counted
+	pending  *int64
+	closed   bool
+	deadline time.Time
+	timer    *time.Timer
+
+	lock *sync.Mutex
+	cond *sync.Cond
+}
+
+func newMemoryBuffer(pending *int64) *memoryBuffer {
+	b := &memoryBuffer{pending: pending, lock: &sync.Mutex{}}
+	b.cond = sync.NewCond(b.lock)
+	return b
+}
+
+func (b *memoryBuffer) read(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for len(b.data) == 0 {
+		if b.closed {
+			return 0, io.EOF
+		}
+		if !b.deadline.IsZero() && !time.Now().Before(b.deadline) {
+			return 0, errMemoryTimeout
+		}
+		b.cond.Wait()
+	}
+
+	n := copy(p, b.data)
+	b.data = b.data[n:]
+	b.count(-n)
+	return n, nil
+}
+
+func (b *memoryBuffer) write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed {
+		return 0, errMemoryClosed
+	}
+	b.data = append(b.data, p...)
+	b.count(len(p))
+	b.cond.Broadcast()
+	return len(p), nil
+}
+
+// close stops the buffer from taking writes, the unread bytes are discarded since nothing reads them anymore
+func (b *memoryBuffer) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.count(-len(b.data))
+	b.data = nil
+	b.closed = true
+	b.cond.Broadcast()
+}
+
+func (b *memoryBuffer) count(n int) {
+	if b.pending != nil {
+		atomic.AddInt64(b.pending, int64(n))
+	}
+}
+
+func (b *memoryBuffer) isClosed() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.closed
+}
+
+func (b *memoryBuffer) setDeadline(t time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.deadline = t
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if !t.IsZero() {
+		// Wake up the pending reads once the deadline passes
+		b.timer = time.AfterFunc(time.Until(t), func() {
+			b.lock.Lock()
+			b.cond.Broadcast()
+			b.lock.Unlock()
+		})
+	}
+	b.cond.Broadcast()
+}
+
+// memoryConn is one end of a memory connection
+type memoryConn struct {
+	local, remote memoryAddr
+	in, out       *memoryBuffer
+	// link carries the writes to the remote end, nil if they go straight into its buffer
+	link MemoryLink
+}
+
+// newPipe connects the dialer to the listener, the addresses differ between the ends if there's a NAT in between
+func (t *MemoryTransport) newPipe(local, remote, accepted, source memoryAddr) (*memoryConn, *memoryConn) {
+	ab, ba := newMemoryBuffer(t.pending), newMemoryBuffer(t.pending)
+	a := &memoryConn{local: local, remote: remote, in: ba, out: ab}
+	b := &memoryConn{local: accepted, remote: source, in: ab, out: ba}
+	if t.NewLink != nil {
+		a.link, b.link = t.NewLink(a.local, a.remote), t.NewLink(b.local, b.remote)
+	}
+	return a, b
+}
+
+func (c *memoryConn) Read(p []byte) (int, error) {
+	return c.in.read(p)
+}
+
+func (c *memoryConn) Write(p []byte) (int, error) {
+	if c.in.isClosed() {
+		return 0, errMemoryClosed
+	}
+	if c.link == nil {
+		return c.out.write(p)
+	}
+
+	if c.out.isClosed() {
+		return 0, errMemoryClosed
+	}
+	// The link holds on to the bytes after the write returns
+	buf := append([]byte(nil), p...)
+	c.link.Send(buf, func() {
+		c.out.write(buf)
+	})
+	return len(p), nil
+}
+
+// Close only closes our end. A noise peer whose connection gets closed by the remote end deadlocks
+// in Peer.Disconnect, the remote end finds out through failing requests instead, like a dropped TCP connection.
+func (c *memoryConn) Close() error {
+	c.in.close()
+	return nil
+}
+
+func (c *memoryConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *memoryConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *memoryConn) SetDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	return nil
+}
+
+func (c *memoryConn) SetReadDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline does nothing since writes never block
+func (c *memoryConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type memoryTimeoutError struct{}
+
+func (e *memoryTimeoutError) Error() string   { return "memory connection deadline exceeded" }
+func (e *memoryTimeoutError) Timeout() bool   { return true }
+func (e *memoryTimeoutError) Temporary() bool { return true }
+
+// MemoryNAT simulates a NAT in front of the satellites using its transport. Connections from the same endpoint
+// get the same external port whatever their destination, unless the NAT is symmetric, and the NAT only lets in
+// connections from the addresses the endpoint dialed before, like a port restricted cone NAT.
+type MemoryNAT struct {
+	IP        string
+	Symmetric bool
+
+	transport *MemoryTransport
+	mappings  map[string]*memoryMapping
+	ports     map[uint16]*memoryMapping
+	nextPort  uint16
+
+	lock *sync.Mutex
+}
+
+type memoryMapping struct {
+	internal memoryAddr
+	external memoryAddr
+	// allowed are the addresses the internal endpoint dialed through the mapping
+	allowed map[string]bool
+}
+
+// NewNAT creates a NAT with the external IP, satellites behind it use `MemoryNAT.Transport`
+func (t *MemoryTransport) NewNAT(ip string, symmetric bool) *MemoryNAT {
+	n := &MemoryNAT{
+		IP:        ip,
+		Symmetric: symmetric,
+		transport: t,
+		mappings:  map[string]*memoryMapping{},
+		ports:     map[uint16]*memoryMapping{},
+		nextPort:  20000,
+		lock:      &sync.Mutex{},
+	}
+
+	t.lock.Lock()
+	t.nats[ip] = n
+	t.lock.Unlock()
+	return n
+}
+
+// Transport returns the transport for a satellite behind the NAT, it listens on the private host of
+// the satellite config and dials from its listening address.
+func (n *MemoryNAT) Transport() transport.Layer {
+	return &memoryNATHost{nat: n, lock: &sync.Mutex{}}
+}
+
+// outbound returns the external address the connection from local to the remote address leaves the NAT from
+func (n *MemoryNAT) outbound(local memoryAddr, remote string) memoryAddr {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	key := local.String()
+	if n.Symmetric {
+		key += ">" + remote
+	}
+
+	m, exists := n.mappings[key]
+	if !exists {
+		n.nextPort++
+		m = &memoryMapping{
+			internal: local,
+			external: memoryAddr{n.IP, n.nextPort},
+			allowed:  map[string]bool{},
+		}
+		n.mappings[key] = m
+		n.ports[m.external.port] = m
+	}
+	m.allowed[remote] = true
+	return m.external
+}
+
+// inbound returns the internal address a connection from source to the external port goes to
+func (n *MemoryNAT) inbound(port uint16, source memoryAddr) (memoryAddr, bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	m, exists := n.ports[port]
+	if !exists || !m.allowed[source.String()] {
+		return memoryAddr{}, false
+	}
+	return m.internal, true
+}
+
+// memoryNATHost is the transport of a satellite behind a MemoryNAT
+type memoryNATHost struct {
+	nat    *MemoryNAT
+	listen memoryAddr
+	lock   *sync.Mutex
+}
+
+func (h *memoryNATHost) String() string {
+	return "memory"
+}
+
+func (h *memoryNATHost) Listen(host string, port uint16) (net.Listener, error) {
+	l, err := h.nat.transport.listen(host, port, h.nat)
+	if err != nil {
+		return nil, err
+	}
+
+	h.lock.Lock()
+	h.listen = l.addr
+	h.lock.Unlock()
+	return l, nil
+}
+
+// Dial dials from the listening address so the NAT maps every connection of the satellite the same way
+func (h *memoryNATHost) Dial(address string) (net.Conn, error) {
+	h.lock.Lock()
+	local := h.listen
+	h.lock.Unlock()
+
+	if local.port == 0 {
+		return nil, fmt.Errorf("memory host behind %v isn't listening", h.nat.IP)
+	}
+	return h.nat.transport.connect(local, address, h.nat)
+}
+
+func (h *memoryNATHost) IP(address net.Addr) net.IP {
+	return h.nat.transport.IP(address)
+}
+
+func (h *memoryNATHost) Port(address net.Addr) uint16 {
+	return h.nat.transport.Port(address)
+}
@@ -0,0 +1,292 @@
+package satellite
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// HandlerLatencyBuckets are the upper bounds of the handler latency histogram, in seconds
+	HandlerLatencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+)
+
+const (
+	// Reasons for dropping an inbound
+	DropNoEvent      = "no_event"
+	DropDuplicate    = "duplicate"
+	DropClosedStream = "closed_stream"
+	DropDenied       = "denied"
+	DropUnsealable   = "unsealable"
+	DropInvalid      = "invalid"
+	DropQueueFull    = "queue_full"
+)
+
+// ptypeLabel names packet types in metric labels
+func ptypeLabel(t PType) string {
+	switch t {
+	case PType_Internal:
+		return "internal"
+	case PType_Message:
+		return "message"
+	case PType_Broadcast:
+		return "broadcast"
+	case PType_Seek:
+		return "seek"
+	case PType_Request:
+		return "request"
+	case PType_Response:
+		return "response"
+	case PType_ResponseEnd:
+		return "response_end"
+	case PType_NotImplemented:
+		return "not_implemented"
+	case PType_Error:
+		return "error"
+	}
+	return fmt.Sprintf("ptype_%d", int(t))
+}
+
+// streamEndLabel names stream outcomes in metric labels
+func streamEndLabel(r CStreamReturn) string {
+	switch r {
+	case StreamEndOK:
+		return "ok"
+	case StreamEndError:
+		return "error"
+	case StreamEndTimeout:
+		return "timeout"
+	case StreamEndNotImplemented:
+		return "not_implemented"
+	}
+	return fmt.Sprintf("end_%d", int(r))
+}
+
+// Metrics counts the traffic of a satellite, `Metrics.WritePrometheus` writes them in the Prometheus text format
+type Metrics struct {
+	sat *Satellite
+
+	packetsIn         map[[2]string]uint64
+	packetsOut        map[[2]string]uint64
+	handlers          map[[2]string]*histogram
+	streams           map[[2]string]uint64
+	dropped           map[string]uint64
+	bannedConnections uint64
+	// rejectedConnections are the peers that didn't know the swarm key
+	rejectedConnections uint64
+
+	lock *sync.Mutex
+}
+
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func newMetrics(s *Satellite) *Metrics {
+	return &Metrics{
+		sat:        s,
+		packetsIn:  map[[2]string]uint64{},
+		packetsOut: map[[2]string]uint64{},
+		handlers:   map[[2]string]*histogram{},
+		streams:    map[[2]string]uint64{},
+		dropped:    map[string]uint64{},
+		lock:       &sync.Mutex{},
+	}
+}
+
+// Metrics returns the metrics of the satellite
+func (s *Satellite) Metrics() *Metrics {
+	return s.metrics
+}
+
+// packetLabels returns the type and namespace labels of a packet, the namespace of stream packets is
+// a return tag which would create a new series for every request so they're grouped together.
+// Peers can send any namespace, unless the packet comes from the satellite itself only the namespaces
+// with a registered event get their own label and the rest are counted as "other".
+func (m *Metrics) packetLabels(msg Packet, local bool) [2]string {
+	switch msg.PacketType {
+	case PType_Response, PType_ResponseEnd, PType_NotImplemented, PType_Error:
+		return [2]string{ptypeLabel(msg.PacketType), "stream"}
+	}
+	if !local && !m.sat.hasEvent(msg.PacketType, msg.Namespace) {
+		return [2]string{ptypeLabel(msg.PacketType), "other"}
+	}
+	return [2]string{ptypeLabel(msg.PacketType), msg.Namespace}
+}
+
+func (m *Metrics) packetReceived(msg Packet) {
+	labels := m.packetLabels(msg, false)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.packetsIn[labels]++
+}
+
+func (m *Metrics) packetSent(msg Packet) {
+	// Relayed floods carry the namespace of the peer that started them
+	labels := m.packetLabels(msg, msg.Origin == "" || msg.Origin == m.sat.ID())
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.packetsOut[labels]++
+}
+
+func (m *Metrics) handled(msg Packet, took time.Duration) {
+	labels := m.packetLabels(msg, false)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	h, exists := m.handlers[labels]
+	if !exists {
+		h = &histogram{buckets: make([]uint64, len(HandlerLatencyBuckets))}
+		m.handlers[labels] = h
+	}
+
+	seconds := took.Seconds()
+	for i, bound := range HandlerLatencyBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+func (m *Metrics) streamEnded(packetType PType, end CStreamReturn) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.streams[[2]string{ptypeLabel(packetType), streamEndLabel(end)}]++
+}
+
+func (m *Metrics) inboundDropped(reason string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.dropped[reason]++
+}
+
+func (m *Metrics) connectionBanned() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.bannedConnections++
+}
+
+func (m *Metrics) connectionRejected() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.rejectedConnections++
+}
+
+// WritePrometheus writes the metrics in the Prometheus text exposition format
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	m.sat.pMap.RLock()
+	peers, bans := len(m.sat.Peers), len(m.sat.bans)
+	m.sat.pMap.RUnlock()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	b := bufio.NewWriter(w)
+
+	writeHeader(b, "particles_packets_received_total", "counter", "Packets received by type and namespace.")
+	writeCounters(b, "particles_packets_received_total", []string{"type", "namespace"}, m.packetsIn)
+
+	writeHeader(b, "particles_packets_sent_total", "counter", "Packets sent by type and namespace.")
+	writeCounters(b, "particles_packets_sent_total", []string{"type", "namespace"}, m.packetsOut)
+
+	writeHeader(b, "particles_handler_duration_seconds", "histogram", "Time spent in event handlers by type and namespace.")
+	var handlers [][2]string
+	for labels := range m.handlers {
+		handlers = append(handlers, labels)
+	}
+	sortLabels(handlers)
+	for _, labels := range handlers {
+		h := m.handlers[labels]
+		base := fmt.Sprintf(`type="%v",namespace="%v"`, escapeLabel(labels[0]), escapeLabel(labels[1]))
+		for i, bound := range HandlerLatencyBuckets {
+			fmt.Fprintf(b, "particles_handler_duration_seconds_bucket{%v,le=\"%v\"} %v\n", base, bound, h.buckets[i])
+		}
+		fmt.Fprintf(b, "particles_handler_duration_seconds_bucket{%v,le=\"+Inf\"} %v\n", base, h.count)
+		fmt.Fprintf(b, "particles_handler_duration_seconds_sum{%v} %v\n", base, h.sum)
+		fmt.Fprintf(b, "particles_handler_duration_seconds_count{%v} %v\n", base, h.count)
+	}
+
+	writeHeader(b, "particles_response_streams_total", "counter", "Ended response streams by request type and outcome.")
+	writeCounters(b, "particles_response_streams_total", []string{"type", "outcome"}, m.streams)
+
+	writeHeader(b, "particles_inbounds_dropped_total", "counter", "Inbounds dropped before reaching an event by reason.")
+	var reasons []string
+	for reason := range m.dropped {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(b, "particles_inbounds_dropped_total{reason=\"%v\"} %v\n", escapeLabel(reason), m.dropped[reason])
+	}
+
+	writeHeader(b, "particles_banned_connections_total", "counter", "Connections refused from banned peers.")
+	fmt.Fprintf(b, "particles_banned_connections_total %v\n", m.bannedConnections)
+	writeHeader(b, "particles_rejected_connections_total", "counter", "Connections refused from peers without the swarm key.")
+	fmt.Fprintf(b, "particles_rejected_connections_total %v\n", m.rejectedConnections)
+
+	stats := m.sat.CompressionStats()
+	writeHeader(b, "particles_compression_raw_bytes_total", "counter", "Size of the compressed packets before compression.")
+	fmt.Fprintf(b, "particles_compression_raw_bytes_total{direction=\"sent\"} %v\n", stats.SentRaw)
+	fmt.Fprintf(b, "particles_compression_raw_bytes_total{direction=\"received\"} %v\n", stats.ReceivedRaw)
+	writeHeader(b, "particles_compression_compressed_bytes_total", "counter", "Size of the compressed packets on the wire.")
+	fmt.Fprintf(b, "particles_compression_compressed_bytes_total{direction=\"sent\"} %v\n", stats.SentCompressed)
+	fmt.Fprintf(b, "particles_compression_compressed_bytes_total{direction=\"received\"} %v\n", stats.ReceivedCompressed)
+	writeHeader(b, "particles_compression_saved_bytes_total", "counter", "Bytes kept off the wire by compression.")
+	fmt.Fprintf(b, "particles_compression_saved_bytes_total %v\n", stats.Saved())
+
+	writeHeader(b, "particles_inbound_queue_depth", "gauge", "Inbounds waiting to be processed by priority lane.")
+	for i := range laneNames {
+		fmt.Fprintf(b, "particles_inbound_queue_depth{lane=\"%v\"} %v\n", Priority(i), len(m.sat.InboundProcessor.lanes.lanes[i]))
+	}
+
+	writeHeader(b, "particles_peers", "gauge", "Connected peers.")
+	fmt.Fprintf(b, "particles_peers %v\n", peers)
+
+	writeHeader(b, "particles_bans", "gauge", "Banned peer IDs.")
+	fmt.Fprintf(b, "particles_bans %v\n", bans)
+
+	writeHeader(b, "particles_relay_circuits", "gauge", "Circuits relayed for other peers.")
+	fmt.Fprintf(b, "particles_relay_circuits %v\n", m.sat.RelayedCircuits())
+
+	return b.Flush()
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+}
+
+func writeCounters(w io.Writer, name string, labelNames []string, counters map[[2]string]uint64) {
+	var keys [][2]string
+	for labels := range counters {
+		keys = append(keys, labels)
+	}
+	sortLabels(keys)
+
+	for _, labels := range keys {
+		fmt.Fprintf(w, "%v{%v=\"%v\",%v=\"%v\"} %v\n", name,
+			labelNames[0], escapeLabel(labels[0]), labelNames[1], escapeLabel(labels[1]), counters[labels])
+	}
+}
+
+func sortLabels(labels [][2]string) {
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i][0] == labels[j][0] {
+			return labels[i][1] < labels[j][1]
+		}
+		return labels[i][0] < labels[j][0]
+	})
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
@@ -0,0 +1,69 @@
+package satellite_test
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nokusukun/particles/satellite"
+	"github.com/nokusukun/particles/satellite/satellitetest"
+)
+
+func TestMetricsNamespaceLabels(t *testing.T) {
+	c, err := satellitetest.StartInMemory(2, satellitetest.Line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	echoes := c.Capture(1, satellite.PType_Request, "echo")
+	peer, err := c.Sat(0).WaitForPeer(c.ID(1), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 3; n++ {
+		c.Sat(0).Request(peer, fmt.Sprintf("junk-%v", n), nil)
+	}
+	c.Sat(0).Request(peer, "echo", nil)
+	if _, err := satellitetest.WaitFor(echoes, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := c.Sat(1).Metrics().WritePrometheus(&b); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, want := range []string{
+		`particles_packets_received_total{type="request",namespace="echo"} 1`,
+		`particles_packets_received_total{type="request",namespace="other"} 3`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics are missing %v", want)
+		}
+	}
+	if strings.Contains(out, "junk-") {
+		t.Error("namespaces without an event got their own label")
+	}
+}
+
+// metric returns the value of the metric with the labels, -1 if the satellite doesn't export it
+func metric(t *testing.T, sat *satellite.Satellite, name string) int {
+	var b bytes.Buffer
+	if err := sat.Metrics().WritePrometheus(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(b.String(), "\n") {
+		if strings.HasPrefix(line, name+" ") {
+			n, err := strconv.Atoi(strings.TrimPrefix(line, name+" "))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return n
+		}
+	}
+	return -1
+}
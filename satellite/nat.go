@@ -0,0 +1,392 @@
+package satellite
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/perlin-network/noise/nat"
+	"github.com/perlin-network/noise/protocol"
+	"github.com/perlin-network/noise/skademlia"
+)
+
+var (
+	// ObservedAddressQuorum is the amount of peers that have to see the satellite from the same IP
+	// before the NAT status is decided and the advertised address gets corrected
+	ObservedAddressQuorum = 2
+	// ObservedAddressPeers is the amount of observations kept, the oldest get replaced
+	ObservedAddressPeers = 16
+	// NATMappingLifetime is the lifetime of the UPnP and NAT-PMP port mappings, they get renewed halfway through
+	NATMappingLifetime = 1 * time.Hour
+)
+
+const nsObservedAddr = "__INTERNAL_OBSERVED_ADDR"
+
+// Port mapping strategies, set through `NAT` in the config
+const (
+	NATNone = ""
+	NATUPnP = "upnp"
+	NATPMP  = "pmp"
+)
+
+type NATStatus string
+
+const (
+	// NATUnknown means not enough peers reported the address they see the satellite from
+	NATUnknown NATStatus = "unknown"
+	// NATPublic means peers see the satellite from one of its own addresses or its port mapping
+	NATPublic NATStatus = "public"
+	// NATBehind means peers see the satellite from an address it doesn't own
+	NATBehind NATStatus = "behind_nat"
+)
+
+// NATInfo is what the satellite knows about how it is reached
+type NATInfo struct {
+	Status     NATStatus `json:"status"`
+	Advertised string    `json:"advertised"`
+	// ObservedIP is the IP the quorum of peers see the satellite from
+	ObservedIP string `json:"observed_ip,omitempty"`
+	// Observations are the addresses the peers see the satellite from, keyed by peer ID
+	Observations map[string]string `json:"observations"`
+
+	Strategy     string `json:"strategy"`
+	Mapped       bool   `json:"mapped"`
+	MappingError string `json:"mapping_error,omitempty"`
+	// ExternalIP is the IP reported by the gateway of the port mapping
+	ExternalIP string `json:"external_ip,omitempty"`
+}
+
+type observation struct {
+	address string
+	ip      string
+	at      time.Time
+}
+
+type natManager struct {
+	sat *Satellite
+
+	status       NATStatus
+	observedIP   string
+	observations map[string]observation
+
+	mapped     bool
+	mappingErr string
+	externalIP net.IP
+
+	lock *sync.Mutex
+}
+
+func newNATManager(s *Satellite) *natManager {
+	n := &natManager{
+		sat:          s,
+		status:       NATUnknown,
+		observations: map[string]observation{},
+		lock:         &sync.Mutex{},
+	}
+
+	// Peers tell the satellite which address they see it from, the port is the one of the connection
+	// so it only matches the listening port of the satellite if the satellite accepted it
+	s.Event(PType_Request, nsObservedAddr, func(i *Inbound) {
+		defer i.EndReply()
+		if address := observedAddress(i.Peer); address != "" {
+			i.Reply(address)
+		}
+	})
+
+	s.OnPeerConnected(n.observe)
+	return n
+}
+
+// start advertises a usable address in place of an unspecified host and starts the port mapping strategy
+func (n *natManager) start() {
+	// noise formats the address of the s/kad ID without brackets, which breaks IPv6 hosts
+	host, port := n.sat.conf.Host, strconv.Itoa(int(n.sat.Node.ExternalPort()))
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = defaultLocalIP(ip != nil && ip.To4() == nil).String()
+	}
+	n.sat.setAdvertisedAddress(net.JoinHostPort(host, port))
+
+	if n.strategy() == NATNone {
+		return
+	}
+	if n.sat.conf.Transport != nil {
+		n.setMapping(nil, fmt.Errorf("port mapping only works with the TCP transport"))
+		return
+	}
+	go n.mapPort()
+}
+
+// strategy returns the port mapping strategy of the config, the deprecated DisableUPNP turns UPnP on
+func (n *natManager) strategy() string {
+	if n.sat.conf.NAT == NATNone && n.sat.conf.DisableUPNP {
+		return NATUPnP
+	}
+	return n.sat.conf.NAT
+}
+
+// mapPort maps the listening port on the gateway and renews it until the satellite closes
+func (n *natManager) mapPort() {
+	provider, err := newNATProvider(n.strategy())
+	if err != nil {
+		n.setMapping(nil, err)
+		return
+	}
+
+	internal, external := n.sat.Node.InternalPort(), n.sat.Node.ExternalPort()
+	for {
+		err := provider.AddMapping("tcp", external, internal, NATMappingLifetime)
+		var ip net.IP
+		if err == nil {
+			ip, err = provider.ExternalIP()
+		}
+		n.setMapping(ip, err)
+
+		select {
+		case <-n.sat.done:
+			if err := provider.DeleteMapping("tcp", external, internal); err != nil {
+				log.Debug("failed to remove port mapping: ", err)
+			}
+			return
+		case <-time.After(NATMappingLifetime / 2):
+		}
+	}
+}
+
+// newNATProvider finds the gateway of the strategy, the providers of noise panic if there's none
+func newNATProvider(strategy string) (provider nat.Provider, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			provider, err = nil, fmt.Errorf("%v", r)
+		}
+	}()
+
+	switch strategy {
+	case NATUPnP:
+		provider = nat.NewUPnP()
+	case NATPMP:
+		provider = nat.NewPMP()
+	default:
+		return nil, fmt.Errorf("unknown NAT strategy %q", strategy)
+	}
+
+	if provider == nil {
+		return nil, fmt.Errorf("no %v gateway found", strategy)
+	}
+	return provider, nil
+}
+
+func (n *natManager) setMapping(ip net.IP, err error) {
+	n.lock.Lock()
+	n.mapped = err == nil
+	n.externalIP = ip
+	n.mappingErr = ""
+	if err != nil {
+		n.mappingErr = err.Error()
+	}
+	n.classify()
+	n.lock.Unlock()
+
+	if err != nil {
+		log.Error("port mapping failed: ", err)
+		return
+	}
+	n.sat.setAdvertisedAddress(net.JoinHostPort(ip.String(), strconv.Itoa(int(n.sat.Node.ExternalPort()))))
+}
+
+// observe asks the peer which address it sees the satellite from
+func (n *natManager) observe(peerID string) {
+	peer, err := n.sat.WaitForPeer(peerID, ResponseStreamLifetime)
+	if err != nil {
+		return
+	}
+
+	rs, err := n.sat.Request(peer, nsObservedAddr, 0)
+	if err != nil {
+		log.Debug("failed to request observed address: ", err)
+		return
+	}
+
+	var address string
+	for in := range rs.Stream {
+		in.As(&address)
+	}
+	if address == "" {
+		return
+	}
+
+	host, _ := splitAddress(address)
+	if net.ParseIP(host) == nil {
+		return
+	}
+
+	n.lock.Lock()
+	n.observations[peerID] = observation{address: address, ip: host, at: time.Now()}
+	for len(n.observations) > ObservedAddressPeers {
+		oldest := peerID
+		for id, o := range n.observations {
+			if o.at.Before(n.observations[oldest].at) {
+				oldest = id
+			}
+		}
+		delete(n.observations, oldest)
+	}
+	correction := n.classify()
+	n.lock.Unlock()
+
+	log.Debugf("%v sees us from %v", peerID, address)
+	if correction != "" {
+		n.sat.setAdvertisedAddress(correction)
+	}
+}
+
+// classify decides the NAT status from the observations, n.lock should be held.
+// Returns the address the satellite should advertise instead, empty if the current one is fine.
+func (n *natManager) classify() string {
+	counts := map[string]int{}
+	for _, o := range n.observations {
+		counts[o.ip]++
+	}
+
+	best, most := "", 0
+	for ip, count := range counts {
+		if count > most || (count == most && ip < best) {
+			best, most = ip, count
+		}
+	}
+
+	if most < ObservedAddressQuorum {
+		n.status = NATUnknown
+		n.observedIP = ""
+		return ""
+	}
+
+	n.observedIP = best
+	ip := net.ParseIP(best)
+	if isLocalIP(ip) || (n.mapped && ip.Equal(n.externalIP)) {
+		n.status = NATPublic
+	} else {
+		n.status = NATBehind
+	}
+
+	// The gateway knows the external address better than the peers
+	if n.mapped {
+		return ""
+	}
+
+	// Behind a NAT the peers can only reach the satellite through the address they see,
+	// the listening port is kept in case it is forwarded
+	host, port := splitAddress(n.sat.AdvertisedAddress())
+	advertised := net.ParseIP(host)
+	if n.status == NATBehind || (advertised != nil && advertised.IsLoopback() && !ip.IsLoopback()) {
+		if !ip.Equal(advertised) {
+			return net.JoinHostPort(best, port)
+		}
+	}
+	return ""
+}
+
+func (n *natManager) info() NATInfo {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	info := NATInfo{
+		Status:       n.status,
+		Advertised:   n.sat.AdvertisedAddress(),
+		ObservedIP:   n.observedIP,
+		Observations: map[string]string{},
+		Strategy:     n.strategy(),
+		Mapped:       n.mapped,
+		MappingError: n.mappingErr,
+	}
+	if n.externalIP != nil {
+		info.ExternalIP = n.externalIP.String()
+	}
+	for id, o := range n.observations {
+		info.Observations[id] = o.address
+	}
+	return info
+}
+
+// NATInfo returns the NAT status of the satellite and the addresses it is seen from
+func (s *Satellite) NATInfo() NATInfo {
+	return s.nat.info()
+}
+
+// AdvertisedAddress returns the address the satellite gives out to its peers in its s/kad ID
+func (s *Satellite) AdvertisedAddress() string {
+	return idAddress(protocol.NodeID(s.Node).(skademlia.ID))
+}
+
+// setAdvertisedAddress replaces the s/kad ID of the satellite with one carrying the address,
+// the peers that connect from now on get the new address.
+func (s *Satellite) setAdvertisedAddress(address string) {
+	old := protocol.NodeID(s.Node).(skademlia.ID)
+	if idAddress(old) == address {
+		return
+	}
+
+	keys := s.Node.Keys.(*skademlia.Keypair)
+	id := skademlia.NewID(address, keys.PublicKey(), keys.Nonce)
+
+	table := skademlia.Table(s.Node)
+	table.Delete(old)
+	if err := table.Update(id); err != nil {
+		log.Error("failed to update own s/kad ID: ", err)
+	}
+	protocol.SetNodeID(s.Node, id)
+	log.Infof("Advertising %v to remote satellites", address)
+}
+
+func splitAddress(address string) (host, port string) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", ""
+	}
+	return host, port
+}
+
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultLocalIP returns the first non loopback IP of the interfaces in the family, preferring public ones
+func defaultLocalIP(ipv6 bool) net.IP {
+	fallback := net.IPv4(127, 0, 0, 1)
+	if ipv6 {
+		fallback = net.IPv6loopback
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return fallback
+	}
+
+	var private net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || !ipNet.IP.IsGlobalUnicast() || (ipNet.IP.To4() == nil) != ipv6 {
+			continue
+		}
+		if !nat.IsPrivateIP(ipNet.IP) {
+			return ipNet.IP
+		}
+		if private == nil {
+			private = ipNet.IP
+		}
+	}
+
+	if private != nil {
+		return private
+	}
+	return fallback
+}
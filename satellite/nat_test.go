@@ -0,0 +1,80 @@
+package satellite_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nokusukun/particles/config"
+	"github.com/nokusukun/particles/satellite"
+	"github.com/nokusukun/particles/satellite/satellitetest"
+)
+
+// TestObservedAddressQuorum connects a satellite behind a NAT to public ones, it only trusts the address
+// they see it from once `ObservedAddressQuorum` of them agree.
+func TestObservedAddressQuorum(t *testing.T) {
+	c, err := satellitetest.StartInMemory(3, satellitetest.None)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	n := c.AddBehindNAT(c.NewNAT("198.51.100.7", false))
+	_, port, _ := net.SplitHostPort(c.Sat(n).AdvertisedAddress())
+
+	if err := c.Connect(n, 0); err != nil {
+		t.Fatal(err)
+	}
+	err = satellitetest.WaitUntil(5*time.Second, func() bool { return len(c.Sat(n).NATInfo().Observations) == 1 })
+	if err != nil {
+		t.Fatal("the peer never reported the observed address: ", err)
+	}
+	if info := c.Sat(n).NATInfo(); info.Status != satellite.NATUnknown || info.ObservedIP != "" {
+		t.Errorf("a single observation decided the status: %+v", info)
+	}
+
+	for i := 1; i < 3; i++ {
+		if err := c.Connect(n, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = satellitetest.WaitUntil(5*time.Second, func() bool { return c.Sat(n).NATInfo().Status == satellite.NATBehind })
+	if err != nil {
+		t.Fatalf("the quorum didn't classify the satellite: %+v", c.Sat(n).NATInfo())
+	}
+
+	info := c.Sat(n).NATInfo()
+	if info.ObservedIP != "198.51.100.7" {
+		t.Errorf("observed %v instead of the NAT", info.ObservedIP)
+	}
+	// The listening port is kept in case it gets forwarded
+	if want := net.JoinHostPort("198.51.100.7", port); info.Advertised != want {
+		t.Errorf("advertising %v instead of %v", info.Advertised, want)
+	}
+
+	err = satellitetest.WaitUntil(5*time.Second, func() bool { return len(c.Sat(0).NATInfo().Observations) == 1 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := c.Sat(0).NATInfo(); info.Status != satellite.NATUnknown {
+		t.Errorf("a public satellite seen by a single peer is %v", info.Status)
+	}
+}
+
+// TestDisableUPNPAlias sets the deprecated DisableUPNP, which turns UPnP on unless NAT picks a strategy
+func TestDisableUPNPAlias(t *testing.T) {
+	c, err := satellitetest.StartInMemory(0, satellitetest.None)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	legacy := c.AddWith(func(conf *config.Satellite) { conf.DisableUPNP = true })
+	both := c.AddWith(func(conf *config.Satellite) { conf.DisableUPNP, conf.NAT = true, satellite.NATPMP })
+	if strategy := c.Sat(legacy).NATInfo().Strategy; strategy != satellite.NATUPnP {
+		t.Errorf("DisableUPNP picked %q", strategy)
+	}
+	if strategy := c.Sat(both).NATInfo().Strategy; strategy != satellite.NATPMP {
+		t.Errorf("DisableUPNP overrode NAT with %q", strategy)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"time"
 
+	"github.com/nokusukun/particles/keys"
 	"github.com/perlin-network/noise"
 	"github.com/perlin-network/noise/payload"
 )
@@ -30,8 +31,34 @@ type Packet struct {
 	Namespace  string      `json:"ns"`
 	Payload    interface{} `json:"c"`
 	Timestamp  int64       `json:"ts"`
+	// Origin is the hex encoded ID of the satellite that created the packet, only set
+	// on packets that gets relayed through more than one hop.
+	Origin string `json:"o,omitempty"`
+	// TTL is the amount of hops left for a flooded packet, it is not part of the return tag
+	// since it changes on every hop.
+	TTL int `json:"ttl,omitempty"`
+	// Nonce makes the return tag of requests with the same content sent within the same second unique.
+	// Legacy peers which don't send a compression offer get requests without one, they'd leave it out of the tag.
+	Nonce string `json:"n,omitempty"`
+	// MessageID marks a message sent by `Satellite.SendReliable`, the receiver acknowledges it and drops its retries
+	MessageID string `json:"mid,omitempty"`
+	// Trace is the span of the operation that sent the packet, it is not part of the return tag
+	// since replies carry the span of the replying handler.
+	Trace *SpanContext `json:"tr,omitempty"`
+	// Capability authorizes a request to a namespace the ACL guards, it is not part of the return tag
+	// since it's only checked by the receiver.
+	Capability *keys.Capability `json:"cap,omitempty"`
+	// Sealed replaces the payload of a packet encrypted for its recipient, see `Satellite.SendSealed`
+	Sealed *SealedBox `json:"sl,omitempty"`
 
 	_retTag string
+	// codec compresses the packet in Packet.Write, set by the satellite to the codec negotiated with the peer
+	codec *codec
+	// stats counts the bytes saved by compressing the packet, set by the satellite sending it
+	stats *CompressionStats
+	// rawSize and compressedSize are set by Packet.Read if the packet arrived compressed
+	rawSize        int
+	compressedSize int
 }
 
 func (p Packet) ReturnTag() string {
@@ -39,6 +66,10 @@ func (p Packet) ReturnTag() string {
 		p.Timestamp = time.Now().Unix()
 	}
 	if p._retTag == "" {
+		p.TTL = 0
+		p.Trace = nil
+		p.Capability = nil
+		p.Payload = normalizePayload(p.Payload)
 		b, err := json.Marshal(p)
 		if err != nil {
 			log.Error("failed to generate return tag: ", err, p)
@@ -59,6 +90,16 @@ func (p Packet) Read(reader payload.Reader) (noise.Message, error) {
 		return nil, err
 	}
 
+	raw, err := decompressPacket(b)
+	if err != nil {
+		log.Error("failed to read packet ", err)
+		return nil, err
+	}
+	if len(raw) != len(b) {
+		p.rawSize, p.compressedSize = len(raw), len(b)
+	}
+	b = raw
+
 	err = json.Unmarshal(b, &p)
 	if err != nil {
 		log.Error("failed to unmarshal packet ", err)
@@ -78,6 +119,21 @@ func (p Packet) Write() []byte {
 	}
 	// return b
 	return payload.NewWriter(nil).
-		WriteBytes(b).
+		WriteBytes(compressPacket(p.codec, p.stats, b)).
 		Bytes()
 }
+
+// normalizePayload returns the payload the way a remote peer decodes it, struct payloads otherwise
+// generate a different return tag on both sides since their fields are marshalled in declaration order.
+func normalizePayload(payload interface{}) interface{} {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return payload
+	}
+
+	var normalized interface{}
+	if err := json.Unmarshal(b, &normalized); err != nil {
+		return payload
+	}
+	return normalized
+}
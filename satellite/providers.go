@@ -0,0 +1,450 @@
+package satellite
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/perlin-network/noise"
+	"github.com/perlin-network/noise/skademlia"
+)
+
+var (
+	// ProviderRecordLifetime is how long a provider announcement is kept by the satellites
+	// closest to the namespace, it gets renewed every `ProviderRepublishInterval`
+	ProviderRecordLifetime    = 30 * time.Minute
+	ProviderRepublishInterval = 10 * time.Minute
+	// ProviderMaxRecordLifetime is the longest a stored provider record can live, records expiring later are refused
+	ProviderMaxRecordLifetime = 24 * time.Hour
+	// ProviderMaxRecords is the most provider records the satellite stores
+	ProviderMaxRecords = 10000
+	// ProviderMaxRecordsPerPeer is the most provider records a single peer can store on the satellite
+	ProviderMaxRecordsPerPeer = 500
+)
+
+const (
+	nsProviderAdd  = "__INTERNAL_PROVIDER_ADD"
+	nsProviderFind = "__INTERNAL_PROVIDER_FIND"
+)
+
+// ProviderRecord announces that a satellite serves a namespace
+type ProviderRecord struct {
+	Namespace string `json:"ns"`
+	ID        string `json:"id"`
+	Address   string `json:"addr"`
+	Nonce     []byte `json:"nonce"`
+	Expires   int64  `json:"exp"`
+	Signature []byte `json:"sig"`
+}
+
+func (r *ProviderRecord) Expired() bool {
+	return time.Now().Unix() > r.Expires
+}
+
+func (r *ProviderRecord) signingBytes() []byte {
+	return []byte(fmt.Sprintf("%v\x00%v\x00%v\x00%x\x00%v", r.Namespace, r.ID, r.Address, r.Nonce, r.Expires))
+}
+
+// skadID rebuilds the s/kad ID of the provider, which is used to dial it
+func (r *ProviderRecord) skadID() (skademlia.ID, error) {
+	pub, err := hex.DecodeString(r.ID)
+	if err != nil {
+		return skademlia.ID{}, err
+	}
+	return skademlia.NewID(r.Address, pub, r.Nonce), nil
+}
+
+type providerStore struct {
+	sat *Satellite
+
+	// records are the providers announced to this satellite, by namespace then provider ID
+	records map[string]map[string]*ProviderRecord
+	// provided are the namespaces this satellite serves
+	provided map[string]bool
+	// owners are the peers that stored the records by namespace and provider ID, perPeer counts their records
+	owners  map[providerSlot]string
+	perPeer map[string]int
+
+	lock *sync.RWMutex
+}
+
+func newProviderStore(s *Satellite) *providerStore {
+	p := &providerStore{
+		sat:      s,
+		records:  map[string]map[string]*ProviderRecord{},
+		provided: map[string]bool{},
+		owners:   map[providerSlot]string{},
+		perPeer:  map[string]int{},
+		lock:     &sync.RWMutex{},
+	}
+
+	s.Event(PType_Request, nsProviderAdd, func(i *Inbound) {
+		defer i.EndReply()
+		rec := i.As(&ProviderRecord{}).(*ProviderRecord)
+		if err := p.add(rec, i.PeerID()); err != nil {
+			log.Debugf("refused provider record from %v: %v", i.PeerID(), err)
+			i.Reply(err.Error())
+			return
+		}
+		i.Reply("")
+	})
+
+	s.Event(PType_Request, nsProviderFind, func(i *Inbound) {
+		defer i.EndReply()
+		var namespace string
+		i.As(&namespace)
+		for _, rec := range p.local(namespace) {
+			i.Reply(rec)
+		}
+	})
+
+	go p.maintain()
+	return p
+}
+
+func (p *providerStore) verify(rec *ProviderRecord) error {
+	if rec.Expired() {
+		return fmt.Errorf("provider record for %v has expired", rec.Namespace)
+	}
+	if time.Unix(rec.Expires, 0).After(time.Now().Add(ProviderMaxRecordLifetime)) {
+		return fmt.Errorf("provider record for %v lives longer than %v", rec.Namespace, ProviderMaxRecordLifetime)
+	}
+
+	pub, err := hex.DecodeString(rec.ID)
+	if err != nil {
+		return fmt.Errorf("invalid provider id: %v", err)
+	}
+
+	if err := p.sat.Node.Keys.Verify(pub, rec.signingBytes(), rec.Signature); err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	return nil
+}
+
+// providerSlot is where a provider record is kept, a provider has one record per namespace
+type providerSlot struct {
+	namespace, id string
+}
+
+// add stores the provider record, replacing the previous record of the provider. `from` is the peer that
+// asked to store it, empty for the records of the satellite itself which aren't limited.
+func (p *providerStore) add(rec *ProviderRecord, from string) error {
+	if err := p.verify(rec); err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	slot := providerSlot{rec.Namespace, rec.ID}
+	if from != "" {
+		if err := p.admit(slot, from); err != nil {
+			return err
+		}
+	}
+
+	p.setOwner(slot, from)
+	if _, exists := p.records[rec.Namespace]; !exists {
+		p.records[rec.Namespace] = map[string]*ProviderRecord{}
+	}
+	p.records[rec.Namespace][rec.ID] = rec
+	return nil
+}
+
+// admit checks that the peer can store another provider record in the slot, the lock has to be held
+func (p *providerStore) admit(slot providerSlot, from string) error {
+	if p.owners[slot] == from {
+		return nil
+	}
+
+	_, replacing := p.records[slot.namespace][slot.id]
+	full := func() bool {
+		return p.perPeer[from] >= ProviderMaxRecordsPerPeer || (!replacing && p.count() >= ProviderMaxRecords)
+	}
+	if full() {
+		p.removeExpired()
+	}
+
+	if p.perPeer[from] >= ProviderMaxRecordsPerPeer {
+		return fmt.Errorf("peer already stores %v provider records", p.perPeer[from])
+	}
+	if !replacing && p.count() >= ProviderMaxRecords {
+		return fmt.Errorf("provider store is full")
+	}
+	return nil
+}
+
+// setOwner moves the record in the slot to the peer, the lock has to be held
+func (p *providerStore) setOwner(slot providerSlot, from string) {
+	if previous, exists := p.owners[slot]; exists {
+		p.perPeer[previous]--
+		if p.perPeer[previous] <= 0 {
+			delete(p.perPeer, previous)
+		}
+		delete(p.owners, slot)
+	}
+	if from != "" {
+		p.owners[slot] = from
+		p.perPeer[from]++
+	}
+}
+
+// count returns the amount of stored provider records, the lock has to be held
+func (p *providerStore) count() int {
+	count := 0
+	for _, providers := range p.records {
+		count += len(providers)
+	}
+	return count
+}
+
+// removeExpired drops the expired provider records, the lock has to be held
+func (p *providerStore) removeExpired() {
+	for namespace, providers := range p.records {
+		for id, rec := range providers {
+			if rec.Expired() {
+				p.setOwner(providerSlot{namespace, id}, "")
+				delete(providers, id)
+			}
+		}
+		if len(providers) == 0 {
+			delete(p.records, namespace)
+		}
+	}
+}
+
+func (p *providerStore) local(namespace string) []*ProviderRecord {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	var records []*ProviderRecord
+	for _, rec := range p.records[namespace] {
+		if !rec.Expired() {
+			records = append(records, rec)
+		}
+	}
+	return records
+}
+
+func (p *providerStore) maintain() {
+	ticker := time.NewTicker(ProviderRepublishInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.sat.done:
+			return
+		case <-ticker.C:
+		}
+
+		p.lock.Lock()
+		p.removeExpired()
+
+		var namespaces []string
+		for namespace := range p.provided {
+			namespaces = append(namespaces, namespace)
+		}
+		p.lock.Unlock()
+
+		for _, namespace := range namespaces {
+			log.Debugf("renewing provider record for %v", namespace)
+			if err := p.announce(namespace); err != nil {
+				log.Error("failed to renew provider record: ", err)
+			}
+		}
+	}
+}
+
+// announce signs a provider record for the namespace and sends it to the satellites closest to it
+func (p *providerStore) announce(namespace string) error {
+	keys, ok := p.sat.Node.Keys.(*skademlia.Keypair)
+	if !ok {
+		return fmt.Errorf("satellite keys are not s/kad keys")
+	}
+
+	rec := &ProviderRecord{
+		Namespace: namespace,
+		ID:        p.sat.ID(),
+		Address:   p.sat.AdvertisedAddress(),
+		Nonce:     keys.Nonce,
+		Expires:   time.Now().Add(ProviderRecordLifetime).Unix(),
+	}
+
+	var err error
+	rec.Signature, err = p.sat.Node.Keys.Sign(rec.signingBytes())
+	if err != nil {
+		return fmt.Errorf("failed to sign provider record: %v", err)
+	}
+
+	if err := p.add(rec, ""); err != nil {
+		return err
+	}
+
+	ids := skademlia.FindNode(p.sat.Node, keyID(providerKey(namespace)), DHTReplication, 8)
+
+	var wait sync.WaitGroup
+	var lock sync.Mutex
+	stored := 0
+	for _, id := range ids {
+		wait.Add(1)
+		go func(id skademlia.ID) {
+			defer wait.Done()
+			if err := p.sendAdd(id, rec); err != nil {
+				log.Debugf("failed to announce %v to %v: %v", namespace, hex.EncodeToString(id.PublicKey()), err)
+				return
+			}
+			lock.Lock()
+			stored++
+			lock.Unlock()
+		}(id)
+	}
+	wait.Wait()
+
+	log.Debugf("provider record for %v stored on %v/%v satellites", namespace, stored, len(ids))
+	if stored == 0 && len(ids) > 0 {
+		return fmt.Errorf("failed to announce %v to any of the %v closest satellites", namespace, len(ids))
+	}
+	return nil
+}
+
+func (p *providerStore) sendAdd(id skademlia.ID, rec *ProviderRecord) error {
+	peer, err := p.sat.dialID(id)
+	if err != nil {
+		return err
+	}
+
+	rs, err := p.sat.Request(peer, nsProviderAdd, rec)
+	if err != nil {
+		return err
+	}
+
+	for in := range rs.Stream {
+		if reason, ok := in.Payload.(string); ok && reason != "" {
+			return fmt.Errorf("remote refused: %v", reason)
+		}
+	}
+
+	if end := <-rs.Done; end != StreamEndOK {
+		return fmt.Errorf("provider request ended with %v", end)
+	}
+	return nil
+}
+
+func (p *providerStore) sendFind(id skademlia.ID, namespace string) []*ProviderRecord {
+	peer, err := p.sat.dialID(id)
+	if err != nil {
+		return nil
+	}
+
+	rs, err := p.sat.Request(peer, nsProviderFind, namespace)
+	if err != nil {
+		return nil
+	}
+
+	var records []*ProviderRecord
+	for in := range rs.Stream {
+		records = append(records, in.As(&ProviderRecord{}).(*ProviderRecord))
+	}
+	return records
+}
+
+// find collects the valid provider records of the namespace from the satellites closest to it
+func (p *providerStore) find(namespace string) []*ProviderRecord {
+	found := map[string]*ProviderRecord{}
+	var lock sync.Mutex
+	consider := func(rec *ProviderRecord) {
+		if rec.Namespace != namespace || p.verify(rec) != nil {
+			return
+		}
+		if old, exists := found[rec.ID]; !exists || rec.Expires > old.Expires {
+			found[rec.ID] = rec
+		}
+	}
+
+	for _, rec := range p.local(namespace) {
+		consider(rec)
+	}
+
+	var wait sync.WaitGroup
+	for _, id := range skademlia.FindNode(p.sat.Node, keyID(providerKey(namespace)), DHTReplication, 8) {
+		wait.Add(1)
+		go func(id skademlia.ID) {
+			defer wait.Done()
+			records := p.sendFind(id, namespace)
+			lock.Lock()
+			for _, rec := range records {
+				consider(rec)
+			}
+			lock.Unlock()
+		}(id)
+	}
+	wait.Wait()
+
+	var records []*ProviderRecord
+	for _, rec := range found {
+		records = append(records, rec)
+	}
+	return records
+}
+
+// Provide announces to the satellites closest to the namespace that this satellite serves it,
+// the announcement is renewed until `Satellite.Unprovide` gets called.
+func (s *Satellite) Provide(namespace string) error {
+	s.providers.lock.Lock()
+	s.providers.provided[namespace] = true
+	s.providers.lock.Unlock()
+
+	return s.providers.announce(namespace)
+}
+
+// Unprovide stops renewing the provider record of the namespace, satellites will keep
+// returning this satellite as a provider until the record expires.
+func (s *Satellite) Unprovide(namespace string) {
+	s.providers.lock.Lock()
+	defer s.providers.lock.Unlock()
+	delete(s.providers.provided, namespace)
+}
+
+// FindProviders returns the peers serving the namespace, providers that aren't connected yet get dialed.
+// Providers that can't be dialed are left out.
+func (s *Satellite) FindProviders(namespace string) ([]*noise.Peer, error) {
+	records := s.providers.find(namespace)
+
+	var peers []*noise.Peer
+	var lock sync.Mutex
+	var wait sync.WaitGroup
+	for _, rec := range records {
+		if rec.ID == s.ID() {
+			continue
+		}
+
+		id, err := rec.skadID()
+		if err != nil {
+			continue
+		}
+
+		wait.Add(1)
+		go func(id skademlia.ID) {
+			defer wait.Done()
+			peer, err := s.dialID(id)
+			if err != nil {
+				log.Debugf("failed to dial provider %v: %v", hex.EncodeToString(id.PublicKey()), err)
+				return
+			}
+			lock.Lock()
+			peers = append(peers, peer)
+			lock.Unlock()
+		}(id)
+	}
+	wait.Wait()
+
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no providers found for %v", namespace)
+	}
+	return peers, nil
+}
+
+// providerKey is the key the provider records of a namespace are stored under
+func providerKey(namespace string) string {
+	return "/providers/" + namespace
+}
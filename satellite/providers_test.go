@@ -0,0 +1,79 @@
+package satellite_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nokusukun/particles/satellite"
+	"github.com/nokusukun/particles/satellite/satellitetest"
+)
+
+// TestParallelProviders announces and looks up providers from several goroutines, run it with -race
+func TestParallelProviders(t *testing.T) {
+	c, err := satellitetest.StartInMemory(4, satellitetest.FullMesh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var wait sync.WaitGroup
+	for n := 1; n < 4; n++ {
+		wait.Add(1)
+		go func(n int) {
+			defer wait.Done()
+			if err := c.Sat(n).Provide(fmt.Sprintf("svc-%v", n)); err != nil {
+				t.Errorf("provide svc-%v: %v", n, err)
+			}
+		}(n)
+	}
+	wait.Wait()
+
+	for n := 1; n < 4; n++ {
+		for lookup := 0; lookup < 3; lookup++ {
+			wait.Add(1)
+			go func(n int) {
+				defer wait.Done()
+				peers, err := c.Sat(0).FindProviders(fmt.Sprintf("svc-%v", n))
+				if err != nil {
+					t.Errorf("find svc-%v: %v", n, err)
+					return
+				}
+				if len(peers) != 1 || satellite.GetPeerID(peers[0]) != c.ID(n) {
+					t.Errorf("svc-%v is provided by %v, found %v peers", n, c.ID(n), len(peers))
+				}
+			}(n)
+		}
+	}
+	wait.Wait()
+}
+
+func TestProviderLimits(t *testing.T) {
+	c, err := satellitetest.StartInMemory(2, satellitetest.Line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	defer func(perPeer int) { satellite.ProviderMaxRecordsPerPeer = perPeer }(satellite.ProviderMaxRecordsPerPeer)
+	satellite.ProviderMaxRecordsPerPeer = 2
+
+	for n := 0; n < 2; n++ {
+		if err := c.Sat(0).Provide(fmt.Sprintf("limit-%v", n)); err != nil {
+			t.Fatalf("provide limit-%v: %v", n, err)
+		}
+	}
+	if err := c.Sat(0).Provide("limit-0"); err != nil {
+		t.Errorf("renewing a provider record of the peer was refused: %v", err)
+	}
+	if err := c.Sat(0).Provide("limit-2"); err == nil {
+		t.Error("peer stored more provider records than ProviderMaxRecordsPerPeer")
+	}
+
+	defer func(lifetime time.Duration) { satellite.ProviderRecordLifetime = lifetime }(satellite.ProviderRecordLifetime)
+	satellite.ProviderRecordLifetime = 2 * satellite.ProviderMaxRecordLifetime
+	if err := c.Sat(1).Provide("forever"); err == nil {
+		t.Error("provider record living longer than ProviderMaxRecordLifetime was stored")
+	}
+}
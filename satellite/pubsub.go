@@ -0,0 +1,515 @@
+package satellite
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mrand "math/rand"
+	"sync"
+	"time"
+
+	"github.com/perlin-network/noise"
+)
+
+var (
+	// PubSubMeshDegree is the amount of subscribed peers kept in a topic mesh
+	PubSubMeshDegree = 6
+	// PubSubMaxHops is the amount of times a publication gets relayed before being dropped
+	PubSubMaxHops = 16
+	// PubSubSeenLifetime is how long a message ID is kept in the seen cache
+	PubSubSeenLifetime = 2 * time.Minute
+	// PubSubSeenCacheSize is the most message IDs kept in the seen cache, the oldest ones get dropped first
+	PubSubSeenCacheSize = 10000
+	// PubSubHeartbeat is the interval where the topic meshes gets rebalanced
+	PubSubHeartbeat = 1 * time.Second
+	// PubSubDiscoveryInterval is how often subscribers of a topic with a mesh below `PubSubMeshDegree`
+	// look for other subscribers through the provider records of the topic and dial them
+	PubSubDiscoveryInterval = 30 * time.Second
+	SubscriptionBuffer      = 100
+)
+
+const (
+	nsPubSubSubscriptions = "__INTERNAL_SUBS"
+	nsPubSubPublish       = "__INTERNAL_PUBLISH"
+	nsPubSubTopic         = "__INTERNAL_TOPIC/"
+)
+
+// Subscription receives the publications of a topic through `Subscription.Stream`.
+// The stream closes after `Subscription.Cancel` gets called.
+// Publications can't be replied to, `Inbound.PeerID` returns the publisher and `Inbound.Peer` is nil
+// since the publication usually arrives through other subscribers.
+type Subscription struct {
+	Topic  string
+	Stream chan *Inbound
+
+	ps *pubSub
+}
+
+// Cancel removes the subscription, announcing the change to the connected peers if
+// it was the last subscription for the topic.
+func (sub *Subscription) Cancel() {
+	sub.ps.unsubscribe(sub)
+}
+
+// publication is the envelope that gets relayed through the topic meshes
+type publication struct {
+	ID     string      `json:"id"`
+	Topic  string      `json:"t"`
+	Origin string      `json:"o"`
+	Hops   int         `json:"h"`
+	Data   interface{} `json:"d"`
+}
+
+type pubSub struct {
+	sat *Satellite
+
+	// subs are the local subscriptions
+	subs map[string][]*Subscription
+	// peerTopics are the topics each connected peer is subscribed to
+	peerTopics map[string]map[string]bool
+	// mesh are the subscribed peers a publication gets forwarded to
+	mesh map[string]map[string]bool
+	// seen is the message ID cache, used to stop publications from looping
+	seen map[string]time.Time
+	// seenOrder are the IDs of seen in the order they were seen
+	seenOrder []string
+
+	lock *sync.RWMutex
+}
+
+func newPubSub(s *Satellite) *pubSub {
+	ps := &pubSub{
+		sat:        s,
+		subs:       map[string][]*Subscription{},
+		peerTopics: map[string]map[string]bool{},
+		mesh:       map[string]map[string]bool{},
+		seen:       map[string]time.Time{},
+		lock:       &sync.RWMutex{},
+	}
+
+	s.Event(PType_Internal, nsPubSubSubscriptions, func(i *Inbound) {
+		id := i.PeerID()
+		if id == "" {
+			return
+		}
+		var topics []string
+		i.As(&topics)
+		ps.setPeerTopics(id, topics)
+	})
+
+	s.Event(PType_Internal, nsPubSubPublish, func(i *Inbound) {
+		pub := i.As(&publication{}).(*publication)
+		if pub.Hops < 0 || pub.Hops > PubSubMaxHops {
+			log.Debugf("publication %v from %v has an invalid hop count %v", pub.ID, i.PeerID(), pub.Hops)
+			ps.sat.metrics.inboundDropped(DropInvalid)
+			return
+		}
+		ps.handle(i.Peer, pub)
+	})
+
+	// The intervals are read here so changing them only affects satellites built afterwards
+	go ps.heartbeat(PubSubHeartbeat, PubSubDiscoveryInterval)
+	return ps
+}
+
+// Subscribe starts receiving publications for the specified topic
+func (s *Satellite) Subscribe(topic string) *Subscription {
+	return s.pubsub.subscribe(topic)
+}
+
+// Publish sends a value to every subscriber of the topic in the network, the value also
+// gets delivered to the local subscriptions of the topic.
+func (s *Satellite) Publish(topic string, value interface{}) error {
+	return s.pubsub.publish(topic, value)
+}
+
+// Topics returns the topics the satellite is subscribed to
+func (s *Satellite) Topics() []string {
+	return s.pubsub.topics()
+}
+
+// TopicPeers returns the IDs of the connected peers subscribed to the topic
+func (s *Satellite) TopicPeers(topic string) []string {
+	s.pubsub.lock.RLock()
+	defer s.pubsub.lock.RUnlock()
+
+	var ids []string
+	for id, topics := range s.pubsub.peerTopics {
+		if topics[topic] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (ps *pubSub) subscribe(topic string) *Subscription {
+	sub := &Subscription{
+		Topic:  topic,
+		Stream: make(chan *Inbound, SubscriptionBuffer),
+		ps:     ps,
+	}
+
+	ps.lock.Lock()
+	_, existing := ps.subs[topic]
+	ps.subs[topic] = append(ps.subs[topic], sub)
+	ps.lock.Unlock()
+
+	log.Verbose("Subscribed to topic: ", topic)
+	if !existing {
+		ps.rebalance(topic)
+		ps.announce()
+		go ps.discover(topic)
+	}
+	return sub
+}
+
+func (ps *pubSub) unsubscribe(sub *Subscription) {
+	ps.lock.Lock()
+	var remaining []*Subscription
+	found := false
+	for _, s := range ps.subs[sub.Topic] {
+		if s == sub {
+			found = true
+			continue
+		}
+		remaining = append(remaining, s)
+	}
+
+	if !found {
+		ps.lock.Unlock()
+		return
+	}
+
+	if len(remaining) == 0 {
+		delete(ps.subs, sub.Topic)
+	} else {
+		ps.subs[sub.Topic] = remaining
+	}
+	close(sub.Stream)
+	ps.lock.Unlock()
+
+	log.Verbose("Unsubscribed from topic: ", sub.Topic)
+	if len(remaining) == 0 {
+		ps.sat.Unprovide(nsPubSubTopic + sub.Topic)
+		ps.announce()
+	}
+}
+
+func (ps *pubSub) topics() []string {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	var topics []string
+	for topic := range ps.subs {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// announce sends the local subscription set to every connected peer
+func (ps *pubSub) announce() {
+	msg := Packet{
+		PacketType: PType_Internal,
+		Namespace:  nsPubSubSubscriptions,
+		Payload:    ps.topics(),
+	}
+
+	for _, peer := range ps.sat.connectedPeers() {
+		ps.sat.sendPacketAsync(peer, msg)
+	}
+}
+
+// announceTo sends the local subscription set to a newly connected peer
+func (ps *pubSub) announceTo(peer *noise.Peer) {
+	err := ps.sat.sendPacket(peer, Packet{
+		PacketType: PType_Internal,
+		Namespace:  nsPubSubSubscriptions,
+		Payload:    ps.topics(),
+	})
+
+	if err != nil {
+		log.Error("failed to send subscriptions to ", GetPeerID(peer))
+	}
+}
+
+func (ps *pubSub) setPeerTopics(id string, topics []string) {
+	log.Debugf("%v is subscribed to %v", id, topics)
+	set := map[string]bool{}
+	for _, topic := range topics {
+		set[topic] = true
+	}
+
+	ps.lock.Lock()
+	ps.peerTopics[id] = set
+	ps.lock.Unlock()
+
+	ps.rebalanceAll()
+}
+
+func (ps *pubSub) removePeer(id string) {
+	ps.lock.Lock()
+	delete(ps.peerTopics, id)
+	for _, members := range ps.mesh {
+		delete(members, id)
+	}
+	ps.lock.Unlock()
+
+	ps.rebalanceAll()
+}
+
+// rebalance drops peers that are no longer subscribed to the topic from the mesh and
+// grafts new subscribed peers until the mesh reaches `PubSubMeshDegree`
+func (ps *pubSub) rebalance(topic string) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	members, exists := ps.mesh[topic]
+	if !exists {
+		members = map[string]bool{}
+		ps.mesh[topic] = members
+	}
+
+	for id := range members {
+		if !ps.peerTopics[id][topic] {
+			delete(members, id)
+		}
+	}
+
+	var candidates []string
+	for id, topics := range ps.peerTopics {
+		if topics[topic] && !members[id] {
+			candidates = append(candidates, id)
+		}
+	}
+
+	mrand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+
+	for _, id := range candidates {
+		if len(members) >= PubSubMeshDegree {
+			break
+		}
+		members[id] = true
+	}
+}
+
+func (ps *pubSub) rebalanceAll() {
+	ps.lock.RLock()
+	topics := map[string]bool{}
+	for topic := range ps.subs {
+		topics[topic] = true
+	}
+	for _, peerTopics := range ps.peerTopics {
+		for topic := range peerTopics {
+			topics[topic] = true
+		}
+	}
+	ps.lock.RUnlock()
+
+	for topic := range topics {
+		ps.rebalance(topic)
+	}
+}
+
+func (ps *pubSub) heartbeat(interval, discoveryInterval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	discovery := time.NewTicker(discoveryInterval)
+	defer discovery.Stop()
+	for {
+		select {
+		case <-ps.sat.done:
+			return
+		case <-discovery.C:
+			for _, topic := range ps.topics() {
+				go ps.discover(topic)
+			}
+			continue
+		case <-ticker.C:
+		}
+
+		ps.rebalanceAll()
+
+		ps.lock.Lock()
+		for len(ps.seenOrder) > 0 && time.Since(ps.seen[ps.seenOrder[0]]) > PubSubSeenLifetime {
+			ps.forgetOldest()
+		}
+		ps.lock.Unlock()
+	}
+}
+
+// markSeen returns true if the message ID has already been seen
+func (ps *pubSub) markSeen(id string) bool {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	if _, seen := ps.seen[id]; seen {
+		return true
+	}
+	ps.seen[id] = time.Now()
+	ps.seenOrder = append(ps.seenOrder, id)
+	for len(ps.seenOrder) > PubSubSeenCacheSize {
+		ps.forgetOldest()
+	}
+	return false
+}
+
+// forgetOldest removes the oldest message ID from the seen cache, the lock has to be held
+func (ps *pubSub) forgetOldest() {
+	delete(ps.seen, ps.seenOrder[0])
+	ps.seenOrder = ps.seenOrder[1:]
+}
+
+func (ps *pubSub) subscribed(topic string) bool {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	return len(ps.subs[topic]) > 0
+}
+
+func (ps *pubSub) publish(topic string, value interface{}) error {
+	id, err := newMessageID()
+	if err != nil {
+		return fmt.Errorf("failed to generate message id: %v", err)
+	}
+
+	pub := &publication{
+		ID:     id,
+		Topic:  topic,
+		Origin: ps.sat.ID(),
+		Data:   value,
+	}
+
+	log.Debugf("publishing %v to %v", pub.ID, topic)
+	ps.handle(nil, pub)
+	return nil
+}
+
+// handle delivers the publication to the local subscribers and forwards it to the topic mesh,
+// `from` is nil if the publication originated from this satellite
+func (ps *pubSub) handle(from *noise.Peer, pub *publication) {
+	if ps.markSeen(pub.ID) {
+		log.Debugf("publication %v already seen, disposing", pub.ID)
+		ps.sat.metrics.inboundDropped(DropDuplicate)
+		return
+	}
+
+	ps.deliver(pub)
+
+	// Only subscribers relay publications, a peer that isn't one shouldn't have been sent it
+	if from != nil && !ps.subscribed(pub.Topic) {
+		log.Debugf("publication %v for %v isn't relayed, not subscribed", pub.ID, pub.Topic)
+		return
+	}
+
+	if pub.Hops >= PubSubMaxHops {
+		log.Debugf("publication %v reached the hop limit", pub.ID)
+		return
+	}
+
+	exclude := map[string]bool{pub.Origin: true}
+	if from != nil {
+		exclude[GetPeerID(from)] = true
+	}
+
+	forward := *pub
+	forward.Hops++
+	msg := Packet{
+		PacketType: PType_Internal,
+		Namespace:  nsPubSubPublish,
+		Payload:    forward,
+	}
+
+	for _, peer := range ps.forwardTargets(pub.Topic, exclude) {
+		ps.sat.sendPacketAsync(peer, msg)
+	}
+}
+
+// forwardTargets returns the connected mesh peers of the topic, publications only travel between subscribers
+func (ps *pubSub) forwardTargets(topic string, exclude map[string]bool) []*noise.Peer {
+	peers := ps.sat.connectedPeers()
+
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	var targets []*noise.Peer
+	for id := range ps.mesh[topic] {
+		if peer, connected := peers[id]; connected && !exclude[id] {
+			targets = append(targets, peer)
+		}
+	}
+	return targets
+}
+
+func (ps *pubSub) deliver(pub *publication) {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	for _, sub := range ps.subs[pub.Topic] {
+		// The peer is left out, it's only the subscriber that relayed the publication
+		in := &Inbound{
+			sat: ps.sat,
+			Message: Packet{
+				PacketType: PType_Broadcast,
+				Namespace:  pub.Topic,
+				Payload:    pub.Data,
+				Origin:     pub.Origin,
+			},
+			Payload: pub.Data,
+		}
+
+		select {
+		case sub.Stream <- in:
+		default:
+			log.Errorf("subscription buffer for %v is full, dropping %v", pub.Topic, pub.ID)
+		}
+	}
+}
+
+// discover announces the satellite as a subscriber of the topic and dials the subscribers it finds
+// until the mesh of the topic is full. Subscribers aren't necessarily neighbours, without this
+// two subscribers separated by satellites that aren't subscribed would never exchange publications.
+func (ps *pubSub) discover(topic string) {
+	namespace := nsPubSubTopic + topic
+	if !ps.subscribed(topic) {
+		return
+	}
+	if err := ps.sat.Provide(namespace); err != nil {
+		log.Debugf("failed to announce the subscription to %v: %v", topic, err)
+	}
+
+	ps.lock.RLock()
+	need := PubSubMeshDegree - len(ps.mesh[topic])
+	ps.lock.RUnlock()
+	if need <= 0 {
+		return
+	}
+
+	connected := ps.sat.connectedPeers()
+	for _, rec := range ps.sat.providers.find(namespace) {
+		if need <= 0 {
+			break
+		}
+		if _, exists := connected[rec.ID]; exists || rec.ID == ps.sat.ID() {
+			continue
+		}
+
+		id, err := rec.skadID()
+		if err != nil {
+			continue
+		}
+		if _, err := ps.sat.dialID(id); err != nil {
+			log.Debugf("failed to dial %v subscriber %v: %v", topic, rec.ID, err)
+			continue
+		}
+		need--
+	}
+}
+
+func newMessageID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,101 @@
+package satellite_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nokusukun/particles/satellite"
+	"github.com/nokusukun/particles/satellite/satellitetest"
+)
+
+// publishUntil publishes from satellite i until the subscription receives a publication, subscription
+// sets and meshes are exchanged in the background so the first publications can miss.
+func publishUntil(t *testing.T, c *satellitetest.Cluster, i int, sub *satellite.Subscription, value interface{}) *satellite.Inbound {
+	var in *satellite.Inbound
+	err := satellitetest.WaitUntil(10*time.Second, func() bool {
+		if err := c.Sat(i).Publish(sub.Topic, value); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case in = <-sub.Stream:
+			return true
+		case <-time.After(200 * time.Millisecond):
+			return false
+		}
+	})
+	if err != nil {
+		t.Fatalf("publication never reached the subscriber: %v", err)
+	}
+	return in
+}
+
+func TestPublishAcrossSubscribers(t *testing.T) {
+	c, err := satellitetest.StartInMemory(4, satellitetest.Line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var subs []*satellite.Subscription
+	for i := 0; i < 4; i++ {
+		subs = append(subs, c.Sat(i).Subscribe("news"))
+	}
+
+	in := publishUntil(t, c, 0, subs[3], "hello")
+	if in.Payload != "hello" || in.PeerID() != c.ID(0) {
+		t.Errorf("received %v from %v", in.Payload, in.PeerID())
+	}
+
+	local, err := satellitetest.WaitFor(subs[0].Stream, time.Second)
+	if err != nil {
+		t.Fatal("the publisher didn't receive its own publication: ", err)
+	}
+	// Publications can't be replied to, this used to send to a nil peer
+	local.Reply("nope")
+	local.EndReply()
+}
+
+func TestPublishCancel(t *testing.T) {
+	c, err := satellitetest.StartInMemory(2, satellitetest.Line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	sub := c.Sat(1).Subscribe("news")
+	publishUntil(t, c, 0, sub, "hello")
+
+	sub.Cancel()
+	if err := satellitetest.WaitUntil(5*time.Second, func() bool { return len(c.Sat(0).TopicPeers("news")) == 0 }); err != nil {
+		t.Fatal("the unsubscription never reached the peer: ", err)
+	}
+	if _, open := <-sub.Stream; open {
+		t.Error("the stream of a cancelled subscription is still open")
+	}
+}
+
+// TestMeshDiscovery subscribes the ends of a line whose middle isn't subscribed, the subscribers have to
+// find each other to exchange publications.
+func TestMeshDiscovery(t *testing.T) {
+	defer func(interval time.Duration) { satellite.PubSubDiscoveryInterval = interval }(satellite.PubSubDiscoveryInterval)
+	satellite.PubSubDiscoveryInterval = 500 * time.Millisecond
+
+	c, err := satellitetest.StartInMemory(3, satellitetest.Line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	first := c.Sat(0).Subscribe("news")
+	last := c.Sat(2).Subscribe("news")
+
+	in := publishUntil(t, c, 0, last, "hello")
+	if in.PeerID() != c.ID(0) {
+		t.Errorf("publication came from %v instead of the publisher", in.PeerID())
+	}
+	publishUntil(t, c, 2, first, "hello back")
+
+	if !c.Connected(0, 2) {
+		t.Error("the subscribers didn't connect to each other")
+	}
+}
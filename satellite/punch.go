@@ -0,0 +1,212 @@
+package satellite
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/perlin-network/noise"
+)
+
+var (
+	// PunchTimeout is how long DialPunch keeps dialing the addresses of the target before falling back to a relay
+	PunchTimeout = 5 * time.Second
+	// PunchInterval is the wait between the rounds of dials
+	PunchInterval = 250 * time.Millisecond
+	// PunchMaxAddresses caps the addresses exchanged for a punch, a target only probes that many
+	PunchMaxAddresses = 4
+)
+
+const (
+	nsPunchConnect = "__INTERNAL_PUNCH_CONNECT"
+	nsPunchSync    = "__INTERNAL_PUNCH_SYNC"
+)
+
+// punchRequest asks the rendezvous to introduce the sender to Peer, the rendezvous forwards it to Peer
+// with the addresses of the sender
+type punchRequest struct {
+	Peer      string   `json:"p"`
+	Addresses []string `json:"a"`
+}
+
+// punchReply carries the addresses of the other end, or the reason the introduction failed
+type punchReply struct {
+	Addresses []string `json:"a"`
+	Error     string   `json:"e,omitempty"`
+}
+
+func (s *Satellite) registerPunchEvents() {
+	// Introduces the sender to the requested peer, both of them have to be connected to the satellite
+	s.Event(PType_Request, nsPunchConnect, func(i *Inbound) {
+		defer i.EndReply()
+		req := punchRequest{}
+		i.As(&req)
+
+		addresses, err := s.introduce(i, req)
+		if err != nil {
+			log.Debugf("failed to introduce %v to %v: %v", i.PeerID(), req.Peer, err)
+			i.Reply(punchReply{Error: err.Error()})
+			return
+		}
+		i.Reply(punchReply{Addresses: addresses})
+	})
+
+	// A peer wants to connect to the satellite, dialing it opens our NAT for its connection even if
+	// the dial itself gets dropped by the NAT of the peer. Only the satellites we dialed ourselves act as
+	// our rendezvous, anyone else could make us probe addresses of their choosing.
+	s.Event(PType_Request, nsPunchSync, func(i *Inbound) {
+		defer i.EndReply()
+		if !dialed(i.Peer) {
+			log.Debugf("refused punch sync from %v, it's not a rendezvous we dialed", i.PeerID())
+			i.Reply(punchReply{Error: "not a rendezvous of the satellite"})
+			return
+		}
+
+		req := punchRequest{}
+		i.As(&req)
+
+		for _, address := range punchCandidates("", req.Addresses) {
+			go func(address string) {
+				if _, err := s.Node.Dial(address); err != nil {
+					log.Debugf("punch probe to %v failed: %v", address, err)
+				}
+			}(address)
+		}
+		i.Reply(punchReply{Addresses: s.AdvertisedAddresses()})
+	})
+}
+
+// introduce exchanges the addresses of the sender and the requested peer, returning the addresses of the peer.
+// The addresses the satellite sees them from go first, they're the ones their NATs map.
+func (s *Satellite) introduce(i *Inbound, req punchRequest) ([]string, error) {
+	s.pMap.RLock()
+	target, connected := s.Peers[req.Peer]
+	s.pMap.RUnlock()
+	if !connected {
+		return nil, fmt.Errorf("%v is not connected to the rendezvous", req.Peer)
+	}
+
+	sync := punchRequest{Peer: i.PeerID(), Addresses: punchCandidates(observedAddress(i.Peer), req.Addresses)}
+	rs, err := s.RequestTraced(i.Trace, target, nsPunchSync, sync)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := punchReply{}
+	for in := range rs.Stream {
+		in.As(&reply)
+	}
+	if end := <-rs.Done; end != StreamEndOK {
+		return nil, fmt.Errorf("sync request ended with %v", end)
+	}
+	if reply.Error != "" {
+		return nil, errors.New(reply.Error)
+	}
+	return punchCandidates(observedAddress(target), reply.Addresses), nil
+}
+
+// DialPunch connects to the target through the NATs in between, both the satellite and the target have to be
+// connected to the rendezvous. The rendezvous exchanges the addresses it sees them from, the target dials the
+// satellite to open its NAT and the satellite dials the target until one of them gets through.
+// If punching fails the target is dialed through a circuit relayed by the rendezvous, see `Satellite.DialVia`.
+func (s *Satellite) DialPunch(rendezvousID, targetID string) (*noise.Peer, error) {
+	if targetID == s.ID() {
+		return nil, fmt.Errorf("attempted to dial self")
+	}
+
+	s.pMap.RLock()
+	peer, exists := s.Peers[targetID]
+	s.pMap.RUnlock()
+	if exists {
+		return peer, nil
+	}
+
+	peer, err := s.punch(rendezvousID, targetID)
+	if err == nil {
+		return peer, nil
+	}
+
+	log.Infof("hole punching to %v failed, falling back to a relay: %v", targetID, err)
+	peer, relayErr := s.DialVia(rendezvousID, targetID)
+	if relayErr != nil {
+		return nil, fmt.Errorf("hole punching failed: %v, relaying failed: %v", err, relayErr)
+	}
+	return peer, nil
+}
+
+func (s *Satellite) punch(rendezvousID, targetID string) (*noise.Peer, error) {
+	rendezvous, err := s.PeerByID(rendezvousID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach rendezvous: %v", err)
+	}
+
+	rs, err := s.Request(rendezvous, nsPunchConnect, punchRequest{Peer: targetID, Addresses: s.AdvertisedAddresses()})
+	if err != nil {
+		return nil, err
+	}
+
+	reply := punchReply{}
+	for in := range rs.Stream {
+		in.As(&reply)
+	}
+	if end := <-rs.Done; end != StreamEndOK {
+		return nil, fmt.Errorf("rendezvous request ended with %v", end)
+	}
+	if reply.Error != "" {
+		return nil, fmt.Errorf("rendezvous refused: %v", reply.Error)
+	}
+
+	deadline := time.Now().Add(PunchTimeout)
+	for time.Now().Before(deadline) {
+		for _, address := range reply.Addresses {
+			if _, err := s.Node.Dial(address); err != nil {
+				log.Debugf("punch to %v failed: %v", address, err)
+				continue
+			}
+
+			// The address might belong to someone else, only the target counts
+			if peer, err := s.WaitForPeer(targetID, time.Until(deadline)); err == nil {
+				log.Infof("punched through to %v at %v", targetID, address)
+				return peer, nil
+			}
+		}
+
+		// The target might have gotten through to us in the meantime
+		if peer, err := s.WaitForPeer(targetID, PunchInterval); err == nil {
+			return peer, nil
+		}
+	}
+	return nil, fmt.Errorf("no address of %v could be reached", targetID)
+}
+
+// observedAddress returns the address the peer is connected from, empty for circuits
+func observedAddress(peer *noise.Peer) string {
+	ip := peer.RemoteIP()
+	if ip == nil {
+		return ""
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(peer.RemotePort())))
+}
+
+// punchCandidates returns the observed address followed by the announced ones, without duplicates or
+// anything that isn't a host and port, capped at `PunchMaxAddresses`
+func punchCandidates(observed string, announced []string) []string {
+	var candidates []string
+	seen := map[string]bool{}
+	for _, address := range append([]string{observed}, announced...) {
+		if len(candidates) == PunchMaxAddresses {
+			break
+		}
+		if seen[address] {
+			continue
+		}
+		seen[address] = true
+		if _, _, err := parseListenAddress(address); err != nil {
+			continue
+		}
+		candidates = append(candidates, address)
+	}
+	return candidates
+}
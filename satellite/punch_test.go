@@ -0,0 +1,43 @@
+package satellite_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nokusukun/particles/satellite/satellitetest"
+)
+
+// TestPunchBetweenNATs connects two satellites behind NATs through a public rendezvous, they end up
+// connected directly instead of through a circuit relayed by the rendezvous.
+func TestPunchBetweenNATs(t *testing.T) {
+	c, err := satellitetest.StartInMemory(0, satellitetest.None)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	r := c.AddRelay()
+	a := c.AddBehindNAT(c.NewNAT("198.51.100.1", false))
+	b := c.AddBehindNAT(c.NewNAT("198.51.100.2", false))
+	for _, n := range []int{a, b} {
+		if err := c.Connect(n, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	peer, err := c.Sat(a).DialPunch(c.ID(r), c.ID(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.RemoteIP() == nil || peer.RemoteIP().String() != "198.51.100.2" {
+		t.Errorf("connected through %v instead of the NAT of the target", peer.RemoteIP())
+	}
+	if n := c.Sat(r).RelayedCircuits(); n != 0 {
+		t.Errorf("the rendezvous relays %v circuits", n)
+	}
+
+	err = satellitetest.WaitUntil(5*time.Second, func() bool { return c.Connected(a, b) })
+	if err != nil {
+		t.Fatal("the target never registered the punched connection: ", err)
+	}
+}
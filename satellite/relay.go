@@ -0,0 +1,431 @@
+package satellite
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/perlin-network/noise"
+	"github.com/perlin-network/noise/skademlia"
+)
+
+var (
+	// RelayMaxCircuits is the amount of circuits a relay forwards at the same time if the config doesn't set it
+	RelayMaxCircuits = 64
+	// RelayOpenTimeout is how long DialVia waits for the circuit and the handshake over it
+	RelayOpenTimeout = 10 * time.Second
+	// RelayFrameSize is the most bytes a single frame carries
+	RelayFrameSize = 16 << 10
+	// RelayQueue is the amount of frames a relay holds for each end of a circuit, the circuit gets closed
+	// if a peer keeps sending faster than the relay is allowed to forward.
+	RelayQueue = 256
+)
+
+const (
+	nsRelayOpen    = "__INTERNAL_RELAY_OPEN"
+	nsRelayConnect = "__INTERNAL_RELAY_CONNECT"
+	nsRelayData    = "__INTERNAL_RELAY_DATA"
+	nsRelayClose   = "__INTERNAL_RELAY_CLOSE"
+)
+
+// relayFrame carries the bytes of a circuit, a frame without data closes the circuit
+type relayFrame struct {
+	Circuit string `json:"c"`
+	Data    []byte `json:"d,omitempty"`
+}
+
+// relayOpen asks the relay for a circuit to Peer, the relay forwards it to Peer with the ID of the initiator
+type relayOpen struct {
+	Circuit string `json:"c"`
+	Peer    string `json:"p"`
+}
+
+// relayedCircuit is a circuit the satellite forwards frames for, queues[i] holds the frames going to ends[i]
+type relayedCircuit struct {
+	id     string
+	ends   [2]*noise.Peer
+	ids    [2]string
+	queues [2]chan []byte
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// other returns the index of the end the frames of the peer go to, -1 if the peer isn't part of the circuit
+func (c *relayedCircuit) other(peerID string) int {
+	switch peerID {
+	case c.ids[0]:
+		return 1
+	case c.ids[1]:
+		return 0
+	}
+	return -1
+}
+
+type relayService struct {
+	sat       *Satellite
+	transport *circuitTransport
+
+	circuits map[string]*relayedCircuit
+	limiter  *rateLimiter
+
+	lock *sync.Mutex
+}
+
+func newRelayService(s *Satellite, t *circuitTransport) *relayService {
+	r := &relayService{
+		sat:       s,
+		transport: t,
+		circuits:  map[string]*relayedCircuit{},
+		limiter:   newRateLimiter(s.conf.RelayBandwidth),
+		lock:      &sync.Mutex{},
+	}
+
+	// Match the accepted circuits with their peers so they can be disconnected once the circuit closes
+	s.Node.OnPeerConnected(func(node *noise.Node, peer *noise.Peer) error {
+		if conn := t.takeAccepted(); conn != nil {
+			conn.setPeer(peer)
+		}
+		return nil
+	})
+
+	s.Event(PType_Request, nsRelayOpen, func(i *Inbound) {
+		defer i.EndReply()
+		req := relayOpen{}
+		i.As(&req)
+		if err := r.open(i, req); err != nil {
+			log.Debugf("refused circuit from %v to %v: %v", i.PeerID(), req.Peer, err)
+			i.Reply(err.Error())
+			return
+		}
+		i.Reply("")
+	})
+
+	s.Event(PType_Request, nsRelayConnect, func(i *Inbound) {
+		defer i.EndReply()
+		req := relayOpen{}
+		i.As(&req)
+
+		conn := newCircuitConn(s, i.Peer, req.Circuit, req.Peer)
+		t.register(conn)
+		select {
+		case t.accept <- conn:
+			log.Debugf("accepted circuit from %v through %v", req.Peer, i.PeerID())
+			i.Reply("")
+		case <-time.After(RelayOpenTimeout):
+			conn.shut()
+			i.Reply("timed out accepting the circuit")
+		case <-s.done:
+		}
+	})
+
+	return r
+}
+
+func (r *relayService) maxCircuits() int {
+	if r.sat.conf.RelayMaxCircuits > 0 {
+		return r.sat.conf.RelayMaxCircuits
+	}
+	return RelayMaxCircuits
+}
+
+// open sets up a circuit from the peer of the inbound to the requested peer, which has to be connected to the relay
+func (r *relayService) open(i *Inbound, req relayOpen) error {
+	if !r.sat.conf.Relay {
+		return fmt.Errorf("satellite is not a relay")
+	}
+	if req.Circuit == "" || req.Peer == i.PeerID() {
+		return fmt.Errorf("invalid circuit")
+	}
+
+	r.sat.pMap.RLock()
+	target, connected := r.sat.Peers[req.Peer]
+	r.sat.pMap.RUnlock()
+	if !connected {
+		return fmt.Errorf("%v is not connected to the relay", req.Peer)
+	}
+
+	c := &relayedCircuit{
+		id:     req.Circuit,
+		ends:   [2]*noise.Peer{i.Peer, target},
+		ids:    [2]string{i.PeerID(), req.Peer},
+		queues: [2]chan []byte{make(chan []byte, RelayQueue), make(chan []byte, RelayQueue)},
+		done:   make(chan struct{}),
+	}
+
+	// The circuit is registered before the target hears of it, the target starts its handshake right away
+	r.lock.Lock()
+	if len(r.circuits) >= r.maxCircuits() {
+		r.lock.Unlock()
+		return fmt.Errorf("relay is at its limit of %v circuits", r.maxCircuits())
+	}
+	if _, exists := r.circuits[c.id]; exists {
+		r.lock.Unlock()
+		return fmt.Errorf("circuit %v already exists", c.id)
+	}
+	r.circuits[c.id] = c
+	r.lock.Unlock()
+
+	go r.forward(c, 0)
+	go r.forward(c, 1)
+
+	rs, err := r.sat.RequestTraced(i.Trace, target, nsRelayConnect, relayOpen{Circuit: c.id, Peer: i.PeerID()})
+	if err == nil {
+		err = awaitRelayReply(rs)
+	}
+	if err != nil {
+		r.closeCircuit(c, false)
+		return fmt.Errorf("%v refused the circuit: %v", req.Peer, err)
+	}
+
+	log.Infof("relaying circuit %v between %v and %v", c.id, c.ids[0], c.ids[1])
+	return nil
+}
+
+// forward sends the queued frames to an end of the circuit, within the bandwidth of the relay
+func (r *relayService) forward(c *relayedCircuit, end int) {
+	for {
+		var data []byte
+		select {
+		case data = <-c.queues[end]:
+		case <-c.done:
+			return
+		}
+
+		if !r.limiter.wait(len(data), c.done) {
+			return
+		}
+
+		err := r.sat.sendPacket(c.ends[end], Packet{
+			PacketType: PType_Internal,
+			Namespace:  nsRelayData,
+			Payload:    relayFrame{Circuit: c.id, Data: data},
+		})
+		if err != nil {
+			log.Debugf("failed to forward circuit %v to %v: %v", c.id, c.ids[end], err)
+			r.closeCircuit(c, true)
+			return
+		}
+	}
+}
+
+// closeCircuit stops relaying the circuit, notifying the ends lets them disconnect the peers running over it
+func (r *relayService) closeCircuit(c *relayedCircuit, notify bool) {
+	c.closeOnce.Do(func() {
+		close(c.done)
+
+		r.lock.Lock()
+		if r.circuits[c.id] == c {
+			delete(r.circuits, c.id)
+		}
+		r.lock.Unlock()
+
+		if !notify {
+			return
+		}
+		log.Debugf("closing circuit %v", c.id)
+		for _, peer := range c.ends {
+			r.sat.sendPacketAsync(peer, Packet{
+				PacketType: PType_Internal,
+				Namespace:  nsRelayClose,
+				Payload:    relayFrame{Circuit: c.id},
+			})
+		}
+	})
+}
+
+// intercept handles the frames of the circuits as they're received so they stay in order.
+// Returns true if the inbound has been consumed and shouldn't be queued for the events.
+func (r *relayService) intercept(in *Inbound) bool {
+	if in.Message.PacketType != PType_Internal || (in.Message.Namespace != nsRelayData && in.Message.Namespace != nsRelayClose) {
+		return false
+	}
+
+	frame := relayFrame{}
+	in.As(&frame)
+	closing := in.Message.Namespace == nsRelayClose
+
+	// Frames of a circuit the satellite relays
+	r.lock.Lock()
+	c, relayed := r.circuits[frame.Circuit]
+	r.lock.Unlock()
+	if relayed {
+		end := c.other(in.PeerID())
+		if end < 0 {
+			log.Debugf("%v sent a frame for circuit %v it isn't part of", in.PeerID(), frame.Circuit)
+			return true
+		}
+		if closing {
+			r.closeCircuit(c, true)
+			return true
+		}
+
+		select {
+		case c.queues[end] <- frame.Data:
+		default:
+			log.Debugf("circuit %v is sending faster than it gets relayed, closing", c.id)
+			r.closeCircuit(c, true)
+		}
+		return true
+	}
+
+	// Frames of a circuit ending at the satellite
+	conn := r.transport.endpoint(circuitAddr{relay: in.PeerID(), circuit: frame.Circuit})
+	if conn == nil {
+		return true
+	}
+	if closing {
+		conn.remoteClosed()
+		return true
+	}
+	conn.in.write(frame.Data)
+	return true
+}
+
+// removePeer closes the circuits the disconnected peer was part of, or relayed
+func (r *relayService) removePeer(id string) {
+	r.lock.Lock()
+	var closing []*relayedCircuit
+	for _, c := range r.circuits {
+		if c.other(id) >= 0 {
+			closing = append(closing, c)
+		}
+	}
+	r.lock.Unlock()
+
+	for _, c := range closing {
+		r.closeCircuit(c, true)
+	}
+
+	r.transport.lock.Lock()
+	var ended []*circuitConn
+	for _, conn := range r.transport.endpoints {
+		if conn.addr.relay == id {
+			ended = append(ended, conn)
+		}
+	}
+	r.transport.lock.Unlock()
+
+	for _, conn := range ended {
+		conn.remoteClosed()
+	}
+}
+
+// RelayedCircuits returns the amount of circuits the satellite is relaying
+func (s *Satellite) RelayedCircuits() int {
+	s.relay.lock.Lock()
+	defer s.relay.lock.Unlock()
+	return len(s.relay.circuits)
+}
+
+// DialVia connects to the target through a circuit relayed by the relay, for targets that can't be dialed
+// directly such as peers behind a NAT. Both the target and the relay have to be connected to the relay,
+// which needs to have relaying enabled. The returned peer works like any other peer, the noise handshake
+// runs over the circuit so the relay can't read or alter the packets.
+// If the target is already connected its current connection is returned.
+func (s *Satellite) DialVia(relayID, targetID string) (*noise.Peer, error) {
+	if targetID == s.ID() {
+		return nil, fmt.Errorf("attempted to dial self")
+	}
+
+	s.pMap.RLock()
+	peer, exists := s.Peers[targetID]
+	s.pMap.RUnlock()
+	if exists {
+		return peer, nil
+	}
+
+	relay, err := s.PeerByID(relayID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach relay: %v", err)
+	}
+
+	conn := newCircuitConn(s, relay, randomHex(16), targetID)
+	s.relay.transport.register(conn)
+
+	rs, err := s.Request(relay, nsRelayOpen, relayOpen{Circuit: conn.addr.circuit, Peer: targetID})
+	if err == nil {
+		err = awaitRelayReply(rs)
+	}
+	if err != nil {
+		conn.shut()
+		return nil, fmt.Errorf("relay %v failed to open circuit: %v", relayID, err)
+	}
+
+	peer, err = s.Node.Dial(conn.addr.String())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.setPeer(peer)
+
+	skademlia.WaitUntilAuthenticated(peer)
+	return s.WaitForPeer(targetID, RelayOpenTimeout)
+}
+
+// awaitRelayReply waits for the reply of a circuit request, the remote replies with the reason if it refuses
+func awaitRelayReply(rs *ResponseStream) error {
+	var reason string
+	for in := range rs.Stream {
+		if r, ok := in.Payload.(string); ok && r != "" {
+			reason = r
+		}
+	}
+
+	if end := <-rs.Done; end != StreamEndOK {
+		return fmt.Errorf("request ended with %v", end)
+	}
+	if reason != "" {
+		return errors.New(reason)
+	}
+	return nil
+}
+
+// rateLimiter is a token bucket shared by every circuit of the relay, a rate of 0 doesn't limit anything
+type rateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+
+	lock *sync.Mutex
+}
+
+func newRateLimiter(bytesPerSecond int) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+		lock:   &sync.Mutex{},
+	}
+}
+
+// wait takes n bytes from the bucket, waiting until they're available. Returns false if done got closed first.
+func (l *rateLimiter) wait(n int, done <-chan struct{}) bool {
+	if l.rate <= 0 {
+		return true
+	}
+
+	l.lock.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	// The bucket goes negative so the waiting frames queue up behind each other
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.lock.Unlock()
+
+	if deficit <= 0 {
+		return true
+	}
+
+	select {
+	case <-time.After(time.Duration(deficit / l.rate * float64(time.Second))):
+		return true
+	case <-done:
+		return false
+	}
+}
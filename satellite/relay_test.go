@@ -0,0 +1,57 @@
+package satellite_test
+
+import (
+	"testing"
+
+	"github.com/nokusukun/particles/satellite"
+	"github.com/nokusukun/particles/satellite/satellitetest"
+)
+
+// TestRelayedRequest sends a request to a satellite behind a NAT through a circuit of the relay both are connected to
+func TestRelayedRequest(t *testing.T) {
+	c, err := satellitetest.StartInMemory(0, satellitetest.None)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	r := c.AddRelay()
+	a := c.AddBehindNAT(c.NewNAT("198.51.100.1", false))
+	b := c.AddBehindNAT(c.NewNAT("198.51.100.2", false))
+	for _, i := range []int{a, b} {
+		if err := c.Connect(i, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.Sat(b).Event(satellite.PType_Request, "whoami", func(i *satellite.Inbound) {
+		i.Reply(i.PeerID())
+		i.EndReply()
+	})
+
+	// The NAT of b drops connections it didn't ask for
+	if _, err := c.Sat(a).Node.Dial(c.Sat(b).AdvertisedAddress()); err == nil {
+		t.Fatal("dialed a satellite behind a NAT directly")
+	}
+
+	peer, err := c.Sat(a).DialVia(c.ID(r), c.ID(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := c.Sat(r).RelayedCircuits(); n != 1 {
+		t.Errorf("relay forwards %v circuits", n)
+	}
+
+	rs, err := c.Sat(a).Request(peer, "whoami", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replies []interface{}
+	for in := range rs.Stream {
+		replies = append(replies, in.Payload)
+	}
+	// The handshake runs over the circuit, b sees a and not the relay
+	if len(replies) != 1 || replies[0] != c.ID(a) {
+		t.Errorf("request over the circuit got %v", replies)
+	}
+}
@@ -0,0 +1,217 @@
+package satellite
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// ReliableAttempts is the amount of times SendReliable sends a message before giving up
+	ReliableAttempts = 5
+	// ReliableAckTimeout is how long SendReliable waits for the ack of an attempt
+	ReliableAckTimeout = 5 * time.Second
+	// ReliableBackoff is the wait before the second attempt, it doubles on every attempt after that
+	ReliableBackoff = 500 * time.Millisecond
+	// ReliableSeenLifetime is how long a received message ID is remembered to drop its retries
+	ReliableSeenLifetime = 10 * time.Minute
+)
+
+const (
+	nsAck = "__INTERNAL_ACK"
+)
+
+// ErrNotAcknowledged is returned by SendReliable if none of the attempts got acknowledged
+var ErrNotAcknowledged = errors.New("message was not acknowledged")
+
+// reliableAck is sent back once the handler of a reliable message returns
+type reliableAck struct {
+	ID    string `json:"id"`
+	Error string `json:"error,omitempty"`
+}
+
+// handledMessage is a reliable message that has been received, done is false while its handler runs
+type handledMessage struct {
+	done     bool
+	err      string
+	received time.Time
+}
+
+type reliableMessenger struct {
+	sat *Satellite
+
+	pending map[string]chan reliableAck
+	seen    map[string]*handledMessage
+
+	lock *sync.Mutex
+}
+
+func newReliableMessenger(s *Satellite) *reliableMessenger {
+	r := &reliableMessenger{
+		sat:     s,
+		pending: map[string]chan reliableAck{},
+		seen:    map[string]*handledMessage{},
+		lock:    &sync.Mutex{},
+	}
+
+	s.Event(PType_Internal, nsAck, func(i *Inbound) {
+		ack := reliableAck{}
+		i.As(&ack)
+
+		r.lock.Lock()
+		ch, exists := r.pending[ack.ID]
+		r.lock.Unlock()
+		if !exists {
+			return
+		}
+
+		select {
+		case ch <- ack:
+		default:
+		}
+	})
+
+	go r.prune()
+	return r
+}
+
+func (r *reliableMessenger) prune() {
+	ticker := time.NewTicker(ReliableSeenLifetime / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.sat.done:
+			return
+		case <-ticker.C:
+		}
+
+		r.lock.Lock()
+		now := time.Now()
+		for key, msg := range r.seen {
+			if msg.done && now.Sub(msg.received) > ReliableSeenLifetime {
+				delete(r.seen, key)
+			}
+		}
+		r.lock.Unlock()
+	}
+}
+
+// SendReliable sends a message packet to the peer and waits until the handler of the peer returns.
+// The message is sent again with an increasing backoff if it doesn't get acknowledged, dialing the peer
+// again if it got disconnected. Retries are dropped by the peer so the handler only runs once.
+func (s *Satellite) SendReliable(peerID string, namespace string, value interface{}) error {
+	id, err := newMessageID()
+	if err != nil {
+		return fmt.Errorf("failed to generate message id: %v", err)
+	}
+
+	acks := make(chan reliableAck, 1)
+	s.reliable.lock.Lock()
+	s.reliable.pending[id] = acks
+	s.reliable.lock.Unlock()
+	defer func() {
+		s.reliable.lock.Lock()
+		delete(s.reliable.pending, id)
+		s.reliable.lock.Unlock()
+	}()
+
+	msg := Packet{
+		PacketType: PType_Message,
+		Namespace:  namespace,
+		Payload:    value,
+		MessageID:  id,
+	}
+
+	backoff := ReliableBackoff
+	for attempt := 1; attempt <= ReliableAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-time.After(backoff):
+			case <-s.done:
+				return fmt.Errorf("satellite closed while sending %v", id)
+			}
+			backoff *= 2
+		}
+
+		peer, err := s.PeerByID(peerID)
+		if err != nil {
+			log.Debugf("attempt %v of %v: %v", attempt, id, err)
+			continue
+		}
+
+		if err := s.sendPacket(peer, msg); err != nil {
+			log.Debugf("attempt %v of %v: %v", attempt, id, err)
+			continue
+		}
+
+		select {
+		case ack := <-acks:
+			if ack.Error != "" {
+				return fmt.Errorf("peer failed to handle %v: %v", namespace, ack.Error)
+			}
+			return nil
+		case <-time.After(ReliableAckTimeout):
+			log.Debugf("attempt %v of %v timed out", attempt, id)
+		case <-s.done:
+			return fmt.Errorf("satellite closed while sending %v", id)
+		}
+	}
+
+	return ErrNotAcknowledged
+}
+
+// intercept drops the retries of reliable messages, acknowledging them again if their handler already returned.
+// Returns true if the inbound has been consumed and shouldn't be dispatched to the events.
+func (r *reliableMessenger) intercept(in *Inbound) bool {
+	if in.Message.MessageID == "" || in.Message.PacketType != PType_Message {
+		return false
+	}
+
+	key := in.PeerID() + "/" + in.Message.MessageID
+	r.lock.Lock()
+	msg, seen := r.seen[key]
+	if !seen {
+		r.seen[key] = &handledMessage{received: time.Now()}
+	}
+	r.lock.Unlock()
+
+	if !seen {
+		return false
+	}
+
+	log.Debugf("reliable message %v already received, disposing", in.Message.MessageID)
+	r.sat.metrics.inboundDropped(DropDuplicate)
+	if msg.done {
+		r.ack(in, msg.err)
+	}
+	return true
+}
+
+// complete acknowledges a reliable message once its handler returned, an empty error means it got handled
+func (r *reliableMessenger) complete(in *Inbound, handlerErr string) {
+	if in.Message.MessageID == "" || in.Message.PacketType != PType_Message {
+		return
+	}
+
+	r.lock.Lock()
+	if msg, exists := r.seen[in.PeerID()+"/"+in.Message.MessageID]; exists {
+		msg.done = true
+		msg.err = handlerErr
+	}
+	r.lock.Unlock()
+
+	r.ack(in, handlerErr)
+}
+
+func (r *reliableMessenger) ack(in *Inbound, handlerErr string) {
+	err := in.send(Packet{
+		PacketType: PType_Internal,
+		Namespace:  nsAck,
+		Payload:    reliableAck{ID: in.Message.MessageID, Error: handlerErr},
+	})
+
+	if err != nil {
+		log.Debugf("failed to acknowledge %v: %v", in.Message.MessageID, err)
+	}
+}
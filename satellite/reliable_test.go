@@ -0,0 +1,133 @@
+package satellite_test
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nokusukun/particles/satellite"
+	"github.com/nokusukun/particles/satellite/satellitetest"
+)
+
+func TestReliableAck(t *testing.T) {
+	c, err := satellitetest.StartInMemory(2, satellitetest.Line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var handled int32
+	c.Sat(1).Event(satellite.PType_Message, "hello", func(i *satellite.Inbound) {
+		atomic.AddInt32(&handled, 1)
+	})
+
+	if err := c.Sat(0).SendReliable(c.ID(1), "hello", "world"); err != nil {
+		t.Fatal(err)
+	}
+	// The ack only gets sent once the handler returned
+	if n := atomic.LoadInt32(&handled); n != 1 {
+		t.Errorf("handler ran %v times", n)
+	}
+
+	err = c.Sat(0).SendReliable(c.ID(1), "nobody", "world")
+	if err == nil || !strings.Contains(err.Error(), "not implemented") {
+		t.Errorf("message without a handler returned %v", err)
+	}
+}
+
+// TestReliableRetry delays the ack past the first attempts, the retries back off and get dropped
+// by the peer until the handler returns.
+func TestReliableRetry(t *testing.T) {
+	defer func(attempts int, timeout, backoff time.Duration) {
+		satellite.ReliableAttempts, satellite.ReliableAckTimeout, satellite.ReliableBackoff = attempts, timeout, backoff
+	}(satellite.ReliableAttempts, satellite.ReliableAckTimeout, satellite.ReliableBackoff)
+	satellite.ReliableAttempts = 3
+	satellite.ReliableAckTimeout = 50 * time.Millisecond
+	satellite.ReliableBackoff = 100 * time.Millisecond
+
+	c, err := satellitetest.StartInMemory(2, satellitetest.Line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var handled int32
+	release := make(chan struct{})
+	c.Sat(1).Event(satellite.PType_Message, "slow", func(i *satellite.Inbound) {
+		atomic.AddInt32(&handled, 1)
+		<-release
+	})
+
+	// Attempts at 0, 150 and 400ms with a 50ms ack timeout each
+	start := time.Now()
+	if err := c.Sat(0).SendReliable(c.ID(1), "slow", nil); err != satellite.ErrNotAcknowledged {
+		t.Errorf("unacknowledged message returned %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 450*time.Millisecond {
+		t.Errorf("gave up after %v, the retries didn't back off", elapsed)
+	}
+
+	// The retries of a message still being handled don't get acked, the ack follows once it returns
+	done := make(chan error)
+	go func() {
+		done <- c.Sat(0).SendReliable(c.ID(1), "slow", nil)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("message acknowledged during a retry returned %v", err)
+	}
+
+	if n := atomic.LoadInt32(&handled); n != 2 {
+		t.Errorf("handler ran %v times for 2 messages", n)
+	}
+}
+
+// TestReliableDuplicateAfterReconnect sends a reliable message again over a new connection,
+// the peer acknowledges it without running the handler again.
+func TestReliableDuplicateAfterReconnect(t *testing.T) {
+	c, err := satellitetest.StartInMemory(2, satellitetest.Line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var handled int32
+	c.Sat(1).Event(satellite.PType_Message, "hello", func(i *satellite.Inbound) {
+		atomic.AddInt32(&handled, 1)
+	})
+	acks := c.Capture(0, satellite.PType_Internal, "__INTERNAL_ACK")
+
+	msg := satellite.Packet{
+		PacketType: satellite.PType_Message,
+		Namespace:  "hello",
+		Payload:    "world",
+		MessageID:  "duplicate",
+	}
+	send := func() {
+		peer, err := c.Sat(0).WaitForPeer(c.ID(1), time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := peer.SendMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := satellitetest.WaitFor(acks, 2*time.Second); err != nil {
+			t.Fatal("message wasn't acknowledged: ", err)
+		}
+	}
+
+	send()
+	if err := c.Partition(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Heal(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	send()
+
+	if n := atomic.LoadInt32(&handled); n != 1 {
+		t.Errorf("handler ran %v times", n)
+	}
+}
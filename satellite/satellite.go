@@ -4,6 +4,7 @@ import (
 	"encoding/base32"
 	"encoding/hex"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,7 +12,7 @@ import (
 	"github.com/perlin-network/noise"
 	"github.com/perlin-network/noise/cipher/aead"
 	"github.com/perlin-network/noise/handshake/ecdh"
-	"github.com/perlin-network/noise/nat"
+	"github.com/perlin-network/noise/payload"
 	"github.com/perlin-network/noise/protocol"
 	"github.com/perlin-network/noise/skademlia"
 
@@ -41,18 +42,60 @@ type Satellite struct {
 	Events           map[string]SatEvent
 
 	bans []string
+	// connectHooks run whenever a peer finishes connecting
+	connectHooks []func(peerID string)
+
+	pubsub    *pubSub
+	flood     *floodRouter
+	dht       *dhtStore
+	providers *providerStore
+	metrics   *Metrics
+	tracer    *tracer
+	reliable  *reliableMessenger
+	relay     *relayService
+	nat       *natManager
+	listen    *listenTransport
+	acl       *aclGuard
+	handovers *handoverBook
+
+	// compression counts the bytes compression saved, see `Satellite.CompressionStats`
+	compression *CompressionStats
+
+	conf *config.Satellite
+	// clock is the real time unless the config sets another clock
+	clock config.Clock
+	// done gets closed when the satellite shuts down, stopping the background goroutines
+	done chan struct{}
 
 	pMap *sync.RWMutex
+	// eLock guards Events, requests register their response events from any goroutine
+	eLock *sync.RWMutex
+	// dialLock makes lookups by ID run one at a time, s/kad dials the peers it queries
+	// and parallel lookups would open duplicate connections to them
+	dialLock *sync.Mutex
+}
+
+// ID returns the hex encoded s/kad public key of the satellite
+func (s *Satellite) ID() string {
+	return hex.EncodeToString(protocol.NodeID(s.Node).(skademlia.ID).PublicKey())
 }
 
 func (s *Satellite) BanPeer(peer *noise.Peer) {
+	s.BanID(GetPeerID(peer))
+}
+
+// BanID bans the hex encoded peer ID, banned peers gets disconnected whenever they connect
+func (s *Satellite) BanID(id string) {
 	s.pMap.Lock()
 	defer s.pMap.Unlock()
-	s.bans = append(s.bans, GetPeerID(peer))
+	s.bans = append(s.bans, id)
 }
 
 func (s *Satellite) UnbanPeer(peer *noise.Peer) {
-	id := GetPeerID(peer)
+	s.UnbanID(GetPeerID(peer))
+}
+
+func (s *Satellite) UnbanID(id string) {
 	var nb []string
 	for _, ban := range s.bans {
 		if id == ban {
@@ -82,15 +125,87 @@ func (s *Satellite) SetPeer(id string, peer *noise.Peer) {
 	s.Peers[id] = peer
 }
 
+// connectedPeers returns a snapshot of the connected peers
+func (s *Satellite) connectedPeers() map[string]*noise.Peer {
+	s.pMap.RLock()
+	defer s.pMap.RUnlock()
+
+	peers := make(map[string]*noise.Peer, len(s.Peers))
+	for id, peer := range s.Peers {
+		peers[id] = peer
+	}
+	return peers
+}
+
+// HasPeer returns true if the peer with the hex encoded ID is connected to the satellite
+func (s *Satellite) HasPeer(id string) bool {
+	s.pMap.RLock()
+	defer s.pMap.RUnlock()
+	_, exists := s.Peers[id]
+	return exists
+}
+
+// OnPeerConnected runs the function with the hex encoded ID of every peer that finishes connecting
+func (s *Satellite) OnPeerConnected(f func(peerID string)) {
+	s.pMap.Lock()
+	defer s.pMap.Unlock()
+	s.connectHooks = append(s.connectHooks, f)
+}
+
+func (s *Satellite) peerConnected(id string) {
+	s.pMap.RLock()
+	hooks := s.connectHooks
+	s.pMap.RUnlock()
+
+	for _, hook := range hooks {
+		go hook(id)
+	}
+}
+
+// WaitForPeer waits until the peer finishes connecting to the satellite
+func (s *Satellite) WaitForPeer(id string, timeout time.Duration) (*noise.Peer, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		s.pMap.RLock()
+		peer, exists := s.Peers[id]
+		s.pMap.RUnlock()
+
+		if exists {
+			return peer, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for %v to connect", id)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
 func (s *Satellite) Event(eventType PType, namespace string, f SatEvent) {
 	eventSig := fmt.Sprintf("%v/%v", eventType, namespace)
 	log.Verbose("Registering Event Signature: ", eventSig)
+	s.eLock.Lock()
+	defer s.eLock.Unlock()
 	s.Events[eventSig] = f
 }
 
+// event returns the handler of the event signature
+func (s *Satellite) event(eventSig string) (SatEvent, bool) {
+	s.eLock.RLock()
+	defer s.eLock.RUnlock()
+	ev, exists := s.Events[eventSig]
+	return ev, exists
+}
+
+func (s *Satellite) hasEvent(eventType PType, namespace string) bool {
+	_, exists := s.event(fmt.Sprintf("%v/%v", eventType, namespace))
+	return exists
+}
+
 func (s *Satellite) RemoveEvent(eventType PType, namespace string) {
 	eventSig := fmt.Sprintf("%v/%v", eventType, namespace)
 	log.Verbose("Removing Event Signature: ", eventSig)
+	s.eLock.Lock()
+	defer s.eLock.Unlock()
 	delete(s.Events, eventSig)
 }
 
@@ -100,35 +215,72 @@ func BuildNetwork(config *config.Satellite, keys *skademlia.Keypair) *Satellite
 	params.Keys = keys
 	params.Port = uint16(config.Port)
 	params.Host = config.Host
-	if config.DisableUPNP {
-		log.Info("UPnP Disabled")
-		params.NAT = nat.NewUPnP()
+	params.Transport = newTCPTransport()
+	if config.Transport != nil {
+		params.Transport = config.Transport
 	}
+	listen := newListenTransport(params.Transport, config.Listen)
+	circuits := newCircuitTransport(listen)
+	params.Transport = circuits
 
 	node, err := noise.NewNode(params)
 	if err != nil {
 		panic(err)
 	}
 
+	acl, err := newACLGuard(config.ACL)
+	if err != nil {
+		panic(err)
+	}
+
 	satPlug := NewInboundProcessor()
 	sat := &Satellite{Node: node, InboundProcessor: satPlug}
 	sat.bans = []string{}
 	sat.pMap = &sync.RWMutex{}
+	sat.eLock = &sync.RWMutex{}
+	sat.dialLock = &sync.Mutex{}
 	sat.Peers = map[string]*noise.Peer{}
 	sat.Events = map[string]SatEvent{}
+	sat.conf = config
+	sat.clock = config.Clock
+	if sat.clock == nil {
+		sat.clock = realClock{}
+	}
+	sat.done = make(chan struct{})
+	sat.pubsub = newPubSub(sat)
+	sat.flood = newFloodRouter(sat)
+	sat.dht = newDHTStore(sat)
+	sat.providers = newProviderStore(sat)
+	sat.metrics = newMetrics(sat)
+	sat.compression = &CompressionStats{}
+	sat.tracer = newTracer()
+	sat.reliable = newReliableMessenger(sat)
+	sat.relay = newRelayService(sat, circuits)
+	sat.nat = newNATManager(sat)
+	sat.listen = listen
+	sat.acl = acl
+	sat.handovers = newHandoverBook(sat)
+	sat.registerPunchEvents()
+	sat.registerLookupEvents()
+	sat.announceAddresses()
 
-	protocol.New().
+	handshake := protocol.New().
 		Register(ecdh.New()).
-		Register(aead.New()).
+		Register(aead.New())
+	if len(config.SwarmKey) != 0 {
+		handshake.Register(newSwarmBlock(sat, config.SwarmKey))
+	}
+	handshake.
 		Register(skademlia.New()).
 		Register(satPlug).
 		Enforce(node)
 
+	// The s/kad ID exists once the protocol is enforced
+	sat.nat.start()
+
 	go node.Listen()
 
-	//extIP, err := params.NAT.ExternalIP()
-	log.Infof("Listening for remote satellites on port %v.", node.ExternalAddress())
-	//log.Infof("NAT External IP: %v:%v", extIP.String(), node.ExternalPort())
+	log.Infof("Listening for remote satellites on %v.", strings.Join(sat.ListenAddresses(), ", "))
 	log.Infof("s/kad ID: %v", base32.StdEncoding.EncodeToString(protocol.NodeID(node).(skademlia.ID).PublicKey()))
 
 	// Makes sure that everything else gets initialized before the plug starts processing events
@@ -137,6 +289,86 @@ func BuildNetwork(config *config.Satellite, keys *skademlia.Keypair) *Satellite
 	return sat
 }
 
+// realClock tells the real time
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// idAddress returns the address an s/kad ID is reachable from
+func idAddress(id skademlia.ID) string {
+	address, err := payload.NewReader(id.Write()).ReadString()
+	if err != nil {
+		return ""
+	}
+	return address
+}
+
+// sendPacket sends the packet to the peer, every packet the satellite sends goes through
+// sendPacket, sendPacketAsync or broadcastPacket so they get counted.
+func (s *Satellite) sendPacket(peer *noise.Peer, msg Packet) error {
+	s.metrics.packetSent(msg)
+	msg.codec, msg.stats = peerCodec(peer), s.compression
+	return peer.SendMessage(msg)
+}
+
+func (s *Satellite) sendPacketAsync(peer *noise.Peer, msg Packet) <-chan error {
+	s.metrics.packetSent(msg)
+	msg.codec, msg.stats = peerCodec(peer), s.compression
+	return peer.SendMessageAsync(msg)
+}
+
+// broadcastPacket sends the packet to the s/kad peers closest to the satellite, like `skademlia.Broadcast`
+func (s *Satellite) broadcastPacket(msg Packet) (errs []error) {
+	var errorChannels []<-chan error
+	for _, peer := range s.closestPeers() {
+		errorChannels = append(errorChannels, s.sendPacketAsync(peer, msg))
+	}
+
+	for _, ch := range errorChannels {
+		if err := <-ch; err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return
+}
+
+// closestPeers returns the connected peers closest to the satellite, the ones broadcasts get sent to
+func (s *Satellite) closestPeers() []*noise.Peer {
+	var peers []*noise.Peer
+	for _, peerID := range skademlia.FindClosestPeers(skademlia.Table(s.Node), protocol.NodeID(s.Node).Hash(), skademlia.BucketSize()) {
+		if peer := protocol.Peer(s.Node, peerID); peer != nil {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// Done returns a channel that gets closed once the satellite shuts down
+func (s *Satellite) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close disconnects every peer, stops listening and stops the background goroutines of the satellite
+func (s *Satellite) Close() {
+	select {
+	case <-s.done:
+		return
+	default:
+		close(s.done)
+	}
+
+	for _, peer := range s.connectedPeers() {
+		peer.Disconnect()
+	}
+	s.Node.Kill()
+}
+
 func GetPeerID(peer *noise.Peer) string {
 	//return base32.StdEncoding.EncodeToString(protocol.PeerID(peer).(skademlia.ID).PublicKey())
 	return hex.EncodeToString(protocol.PeerID(peer).(skademlia.ID).PublicKey())
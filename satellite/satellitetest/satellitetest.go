@@ -0,0 +1,302 @@
+// Package satellitetest starts clusters of satellites on the loopback interface for testing.
+//
+// Satellites in a cluster don't bootstrap to the s/kad network on their own, they only connect
+// to the peers that the topology or the test dials, which keeps the shape of the network predictable.
+package satellitetest
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/perlin-network/noise/skademlia"
+
+	"github.com/nokusukun/particles/config"
+	"github.com/nokusukun/particles/satellite"
+)
+
+var (
+	// ConnectTimeout is how long Connect waits for both satellites to register each other
+	ConnectTimeout = 5 * time.Second
+)
+
+type Topology int
+
+const (
+	// None leaves the satellites unconnected
+	None Topology = iota
+	// Line connects every satellite to the next one
+	Line
+	// Star connects every satellite to the first one
+	Star
+	// FullMesh connects every satellite to each other
+	FullMesh
+)
+
+func (t Topology) String() string {
+	switch t {
+	case None:
+		return "none"
+	case Line:
+		return "line"
+	case Star:
+		return "star"
+	case FullMesh:
+		return "full mesh"
+	}
+	return fmt.Sprintf("topology(%d)", int(t))
+}
+
+// Links returns the pairs of satellite indexes the topology connects for n satellites
+func (t Topology) Links(n int) [][2]int {
+	var links [][2]int
+	switch t {
+	case Line:
+		for i := 0; i+1 < n; i++ {
+			links = append(links, [2]int{i, i + 1})
+		}
+	case Star:
+		for i := 1; i < n; i++ {
+			links = append(links, [2]int{0, i})
+		}
+	case FullMesh:
+		for i := 0; i < n; i++ {
+			for j := i + 1; j < n; j++ {
+				links = append(links, [2]int{i, j})
+			}
+		}
+	}
+	return links
+}
+
+type Cluster struct {
+	Satellites []*satellite.Satellite
+	Keys       []*skademlia.Keypair
+
+	// transport is shared by the satellites of an in-memory cluster, nil for TCP
+	transport *satellite.MemoryTransport
+
+	lock *sync.Mutex
+}
+
+// Start starts n satellites on the loopback interface and connects them in the specified topology,
+// it returns after every link has authenticated on both ends.
+func Start(n int, topology Topology) (*Cluster, error) {
+	return start(&Cluster{lock: &sync.Mutex{}}, n, topology)
+}
+
+// StartInMemory works like Start but the satellites talk through a `satellite.MemoryTransport`
+// instead of sockets, which lets a single process run a lot more of them.
+func StartInMemory(n int, topology Topology) (*Cluster, error) {
+	return start(&Cluster{lock: &sync.Mutex{}, transport: satellite.NewMemoryTransport()}, n, topology)
+}
+
+func start(c *Cluster, n int, topology Topology) (*Cluster, error) {
+	for i := 0; i < n; i++ {
+		c.Add()
+	}
+
+	for _, link := range topology.Links(n) {
+		if err := c.Connect(link[0], link[1]); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("failed to build %v: %v", topology, err)
+		}
+	}
+
+	return c, nil
+}
+
+// Add starts a new unconnected satellite with freshly generated keys, returning its index
+func (c *Cluster) Add() int {
+	return c.add(func(conf *config.Satellite) {})
+}
+
+// AddWith works like Add but the config can be changed before the satellite gets built
+func (c *Cluster) AddWith(configure func(conf *config.Satellite)) int {
+	return c.add(configure)
+}
+
+// AddRelay works like Add but the satellite relays circuits for its peers, see `Satellite.DialVia`
+func (c *Cluster) AddRelay() int {
+	return c.add(func(conf *config.Satellite) {
+		conf.Relay = true
+	})
+}
+
+// NewNAT creates a simulated NAT with the external IP for the satellites of an in-memory cluster,
+// a symmetric NAT maps every destination to another port which defeats hole punching.
+func (c *Cluster) NewNAT(ip string, symmetric bool) *satellite.MemoryNAT {
+	if c.transport == nil {
+		panic("simulated NATs only work in clusters started with StartInMemory")
+	}
+	return c.transport.NewNAT(ip, symmetric)
+}
+
+// AddBehindNAT works like Add but the satellite listens on a private host behind the NAT,
+// only satellites it dialed can reach it.
+func (c *Cluster) AddBehindNAT(nat *satellite.MemoryNAT) int {
+	return c.add(func(conf *config.Satellite) {
+		conf.Host = "10.0.0.1"
+		conf.Transport = nat.Transport()
+	})
+}
+
+func (c *Cluster) add(configure func(conf *config.Satellite)) int {
+	keys := skademlia.RandomKeys()
+	conf := &config.Satellite{
+		Host:             "127.0.0.1",
+		Port:             0,
+		DisableBootstrap: true,
+	}
+	if c.transport != nil {
+		conf.Transport = c.transport
+	}
+	configure(conf)
+	sat := satellite.BuildNetwork(conf, keys)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Satellites = append(c.Satellites, sat)
+	c.Keys = append(c.Keys, keys)
+	return len(c.Satellites) - 1
+}
+
+// Sat returns the satellite at index i
+func (c *Cluster) Sat(i int) *satellite.Satellite {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.Satellites[i]
+}
+
+// ID returns the hex encoded ID of the satellite at index i
+func (c *Cluster) ID(i int) string {
+	return c.Sat(i).ID()
+}
+
+// Connected returns true if both satellites have each other as a connected peer
+func (c *Cluster) Connected(i, j int) bool {
+	a, b := c.Sat(i), c.Sat(j)
+	return a.HasPeer(b.ID()) && b.HasPeer(a.ID())
+}
+
+// Connect dials satellite j from satellite i and waits until both ends have registered each other
+func (c *Cluster) Connect(i, j int) error {
+	a, b := c.Sat(i), c.Sat(j)
+
+	peer, err := a.Node.Dial(b.Node.ExternalAddress())
+	if err != nil {
+		return fmt.Errorf("failed to dial %v from %v: %v", j, i, err)
+	}
+	skademlia.WaitUntilAuthenticated(peer)
+
+	if _, err := a.WaitForPeer(b.ID(), ConnectTimeout); err != nil {
+		return fmt.Errorf("%v never registered %v: %v", i, j, err)
+	}
+	if _, err := b.WaitForPeer(a.ID(), ConnectTimeout); err != nil {
+		return fmt.Errorf("%v never registered %v: %v", j, i, err)
+	}
+	return nil
+}
+
+// Partition cuts the link between two satellites, both ends ban each other so they
+// don't get reconnected by lookups until `Cluster.Heal` gets called.
+func (c *Cluster) Partition(i, j int) error {
+	a, b := c.Sat(i), c.Sat(j)
+	a.BanID(b.ID())
+	b.BanID(a.ID())
+
+	if peer, err := a.WaitForPeer(b.ID(), 0); err == nil {
+		peer.Disconnect()
+	}
+	if peer, err := b.WaitForPeer(a.ID(), 0); err == nil {
+		peer.Disconnect()
+	}
+
+	return WaitUntil(ConnectTimeout, func() bool {
+		return !a.HasPeer(b.ID()) && !b.HasPeer(a.ID())
+	})
+}
+
+// Heal lifts the bans of a partitioned link and connects the satellites again
+func (c *Cluster) Heal(i, j int) error {
+	a, b := c.Sat(i), c.Sat(j)
+	a.UnbanID(b.ID())
+	b.UnbanID(a.ID())
+	return c.Connect(i, j)
+}
+
+// Isolate partitions the satellite from every satellite it is connected to
+func (c *Cluster) Isolate(i int) error {
+	for j := range c.satellites() {
+		if j == i || !c.Connected(i, j) {
+			continue
+		}
+		if err := c.Partition(i, j); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Capture registers an event on satellite i that sends every inbound it receives into the returned channel.
+// Capturing replaces the event previously registered for the same packet type and namespace.
+func (c *Cluster) Capture(i int, eventType satellite.PType, namespace string) <-chan *satellite.Inbound {
+	ch := make(chan *satellite.Inbound, 100)
+	c.Sat(i).Event(eventType, namespace, func(in *satellite.Inbound) {
+		select {
+		case ch <- in:
+		default:
+		}
+	})
+	return ch
+}
+
+// Close shuts down every satellite of the cluster
+func (c *Cluster) Close() {
+	for _, sat := range c.satellites() {
+		sat.Close()
+	}
+}
+
+// satellites returns a copy of the satellites so they can be iterated while others get added
+func (c *Cluster) satellites() []*satellite.Satellite {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]*satellite.Satellite(nil), c.Satellites...)
+}
+
+// WaitFor waits for an inbound from a captured event
+func WaitFor(ch <-chan *satellite.Inbound, timeout time.Duration) (*satellite.Inbound, error) {
+	select {
+	case in := <-ch:
+		return in, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("timed out after %v waiting for an inbound", timeout)
+	}
+}
+
+// Collect gathers the inbounds of a captured event until the timeout runs out
+func Collect(ch <-chan *satellite.Inbound, timeout time.Duration) []*satellite.Inbound {
+	var inbounds []*satellite.Inbound
+	deadline := time.After(timeout)
+	for {
+		select {
+		case in := <-ch:
+			inbounds = append(inbounds, in)
+		case <-deadline:
+			return inbounds
+		}
+	}
+}
+
+// WaitUntil polls the condition until it returns true or the timeout runs out
+func WaitUntil(timeout time.Duration, condition func() bool) error {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("condition not met after %v", timeout)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return nil
+}
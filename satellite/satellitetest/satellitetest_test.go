@@ -0,0 +1,191 @@
+package satellitetest_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nokusukun/particles/satellite"
+	"github.com/nokusukun/particles/satellite/satellitetest"
+)
+
+func TestTopologyLinks(t *testing.T) {
+	tests := []struct {
+		topology satellitetest.Topology
+		n        int
+		links    int
+	}{
+		{satellitetest.None, 4, 0},
+		{satellitetest.Line, 4, 3},
+		{satellitetest.Star, 4, 3},
+		{satellitetest.FullMesh, 4, 6},
+		{satellitetest.Line, 1, 0},
+	}
+
+	for _, test := range tests {
+		if links := test.topology.Links(test.n); len(links) != test.links {
+			t.Errorf("%v of %v has %v links, expected %v", test.topology, test.n, len(links), test.links)
+		}
+	}
+}
+
+func TestStart(t *testing.T) {
+	for _, topology := range []satellitetest.Topology{satellitetest.Line, satellitetest.Star} {
+		c, err := satellitetest.StartInMemory(4, topology)
+		if err != nil {
+			t.Fatalf("%v: %v", topology, err)
+		}
+
+		for _, link := range topology.Links(4) {
+			if !c.Connected(link[0], link[1]) {
+				t.Errorf("%v: %v and %v aren't connected", topology, link[0], link[1])
+			}
+		}
+		if c.Connected(1, 3) {
+			t.Errorf("%v: 1 and 3 got connected without a link", topology)
+		}
+		c.Close()
+	}
+}
+
+func TestRequest(t *testing.T) {
+	c, err := satellitetest.StartInMemory(2, satellitetest.Line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Sat(1).Event(satellite.PType_Request, "echo", func(i *satellite.Inbound) {
+		i.Reply(i.Payload)
+		i.EndReply()
+	})
+
+	peer, err := c.Sat(0).WaitForPeer(c.ID(1), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := c.Sat(0).Request(peer, "echo", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replies []interface{}
+	for in := range rs.Stream {
+		replies = append(replies, in.Payload)
+	}
+	if len(replies) != 1 || replies[0] != "hello" {
+		t.Errorf("expected a single hello, got %v", replies)
+	}
+}
+
+func TestSeek(t *testing.T) {
+	c, err := satellitetest.StartInMemory(3, satellitetest.Star)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Sat(2).Event(satellite.PType_Seek, "whois", func(i *satellite.Inbound) {
+		i.Reply("2")
+		i.EndReply()
+	})
+
+	rs, err := c.Sat(0).Seek("whois", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case in := <-rs.Stream:
+		if in.Payload != "2" || in.PeerID() != c.ID(2) {
+			t.Errorf("seek answered by %v with %v", in.PeerID(), in.Payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("seek never got answered")
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	c, err := satellitetest.StartInMemory(3, satellitetest.Star)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	captured := []<-chan *satellite.Inbound{
+		c.Capture(1, satellite.PType_Broadcast, "news"),
+		c.Capture(2, satellite.PType_Broadcast, "news"),
+	}
+	if errs := c.Sat(0).Broadcast("news", "extra"); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	for n, ch := range captured {
+		in, err := satellitetest.WaitFor(ch, 5*time.Second)
+		if err != nil {
+			t.Fatalf("satellite %v: %v", n+1, err)
+		}
+		if in.Payload != "extra" || in.PeerID() != c.ID(0) {
+			t.Errorf("satellite %v received %v from %v", n+1, in.Payload, in.PeerID())
+		}
+	}
+}
+
+func TestPartitionHeal(t *testing.T) {
+	c, err := satellitetest.StartInMemory(3, satellitetest.FullMesh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Partition(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if c.Connected(0, 1) || !c.Connected(0, 2) || !c.Connected(1, 2) {
+		t.Fatal("partition cut the wrong links")
+	}
+	if err := c.Connect(0, 1); err == nil {
+		t.Error("partitioned satellites reconnected before healing")
+	}
+
+	if err := c.Heal(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Connected(0, 1) {
+		t.Error("healed satellites aren't connected")
+	}
+}
+
+// TestIsolateWhileClosing isolates and closes the cluster at the same time, run it with -race.
+func TestIsolateWhileClosing(t *testing.T) {
+	c, err := satellitetest.StartInMemory(4, satellitetest.Star)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wait sync.WaitGroup
+	wait.Add(2)
+	go func() {
+		defer wait.Done()
+		c.Isolate(0)
+	}()
+	go func() {
+		defer wait.Done()
+		c.Close()
+	}()
+	wait.Wait()
+}
+
+func TestWaitFor(t *testing.T) {
+	ch := make(chan *satellite.Inbound, 1)
+	if _, err := satellitetest.WaitFor(ch, 50*time.Millisecond); err == nil {
+		t.Error("WaitFor returned without an inbound")
+	}
+
+	ch <- &satellite.Inbound{}
+	if _, err := satellitetest.WaitFor(ch, 50*time.Millisecond); err != nil {
+		t.Error(err)
+	}
+
+	if err := satellitetest.WaitUntil(50*time.Millisecond, func() bool { return false }); err == nil {
+		t.Error("WaitUntil returned for a condition that is never met")
+	}
+}
@@ -0,0 +1,193 @@
+package satellite
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+
+	"github.com/perlin-network/noise/skademlia"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// curve25519P is the prime of the field of curve25519 and edwards25519
+var curve25519P, _ = new(big.Int).SetString("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffed", 16)
+
+// SealedBox is a payload encrypted for a single satellite, only the recipient can open it.
+// It's a NaCl box between the keys of the sender and the recipient converted to curve25519,
+// so it also proves who the sender is.
+type SealedBox struct {
+	Nonce []byte `json:"n"`
+	Box   []byte `json:"b"`
+}
+
+// sealedContent is what gets sealed, the namespace keeps the box from being replayed under another one
+type sealedContent struct {
+	Namespace string      `json:"ns"`
+	Value     interface{} `json:"v"`
+}
+
+// SendSealed sends a message packet to the peer with the value encrypted to its public key, relays and
+// flooding peers only see the box. The value appears as the payload of the `Inbound` of the recipient.
+func (s *Satellite) SendSealed(recipientID string, namespace string, value interface{}) error {
+	peer, err := s.PeerByID(recipientID)
+	if err != nil {
+		return err
+	}
+
+	// The peer is the newest key of the identity, the box has to open with it
+	sealed, err := s.seal(s.Successor(recipientID), namespace, value)
+	if err != nil {
+		return err
+	}
+
+	return s.sendPacket(peer, Packet{
+		PacketType: PType_Message,
+		Namespace:  namespace,
+		Sealed:     sealed,
+	})
+}
+
+// ReplySealed works like `Inbound.Reply` but seals the value to the satellite that sent the request or seek,
+// the origin of a flooded seek rather than the peer that relayed it. An origin that got handed over is sealed to its newest key.
+func (i *Inbound) ReplySealed(value interface{}) error {
+	recipient := i.Message.Origin
+	if recipient == "" {
+		recipient = i.PeerID()
+	}
+	recipient = i.sat.Successor(recipient)
+
+	tag := i.Message.ReturnTag()
+	sealed, err := i.sat.seal(recipient, tag, value)
+	if err != nil {
+		return err
+	}
+
+	err = i.send(Packet{
+		PacketType: PType_Response,
+		Namespace:  tag,
+		Origin:     i.replyOrigin(),
+		Sealed:     sealed,
+		Trace:      i.Trace.ref(),
+	})
+	if err != nil {
+		return err
+	}
+	i.totalReplies++
+	return nil
+}
+
+// seal encrypts the value for the recipient with the key of the satellite
+func (s *Satellite) seal(recipientID string, namespace string, value interface{}) (*SealedBox, error) {
+	pub, err := hex.DecodeString(recipientID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient %v: %v", recipientID, err)
+	}
+	peerKey, err := curvePublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(sealedContent{Namespace: namespace, Value: value})
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	return &SealedBox{
+		Nonce: nonce[:],
+		Box:   box.Seal(nil, b, &nonce, peerKey, s.curvePrivateKey()),
+	}, nil
+}
+
+// unseal opens the sealed payload of the inbound in place. The sender is the origin of the packet if
+// it has one, the box doesn't open if the origin is forged.
+func (s *Satellite) unseal(in *Inbound) error {
+	msg := in.Message
+	if len(msg.Sealed.Nonce) != 24 {
+		return fmt.Errorf("invalid nonce")
+	}
+
+	sender := msg.Origin
+	if sender == "" {
+		sender = in.PeerID()
+	}
+	pub, err := hex.DecodeString(sender)
+	if err != nil {
+		return fmt.Errorf("invalid sender %v: %v", sender, err)
+	}
+	peerKey, err := curvePublicKey(pub)
+	if err != nil {
+		return err
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], msg.Sealed.Nonce)
+	b, ok := box.Open(nil, msg.Sealed.Box, &nonce, peerKey, s.curvePrivateKey())
+	if !ok {
+		return fmt.Errorf("box doesn't open")
+	}
+
+	var content sealedContent
+	if err := json.Unmarshal(b, &content); err != nil {
+		return err
+	}
+	if content.Namespace != msg.Namespace {
+		return fmt.Errorf("box is sealed for %v", content.Namespace)
+	}
+
+	in.Payload = content.Value
+	in.Sealed = true
+	return nil
+}
+
+// curvePrivateKey converts the ed25519 private key of the satellite to curve25519, it's the hashed and
+// clamped seed which ed25519 signs with as well
+func (s *Satellite) curvePrivateKey() *[32]byte {
+	seed := s.Node.Keys.(*skademlia.Keypair).PrivateKey()[:32]
+	h := sha512.Sum512(seed)
+	h[0] &= 248
+	h[31] &= 127
+	h[31] |= 64
+
+	var key [32]byte
+	copy(key[:], h[:32])
+	return &key
+}
+
+// curvePublicKey converts an ed25519 public key to curve25519, u = (1 + y) / (1 - y)
+func curvePublicKey(pub []byte) (*[32]byte, error) {
+	if len(pub) != 32 {
+		return nil, fmt.Errorf("public key should be 32 bytes, got %v", len(pub))
+	}
+
+	y := new(big.Int).SetBytes(reverse(pub))
+	y.SetBit(y, 255, 0)
+
+	denominator := new(big.Int).Sub(big.NewInt(1), y)
+	denominator.Mod(denominator, curve25519P)
+	if denominator.ModInverse(denominator, curve25519P) == nil {
+		return nil, fmt.Errorf("invalid public key")
+	}
+	u := new(big.Int).Add(big.NewInt(1), y)
+	u.Mul(u, denominator)
+	u.Mod(u, curve25519P)
+
+	var key [32]byte
+	b := u.Bytes()
+	copy(key[:], reverse(b))
+	return &key, nil
+}
+
+// reverse returns a reversed copy of the bytes, keys are little endian and big.Int is big endian
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
@@ -0,0 +1,178 @@
+package satellite_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+
+	"github.com/nokusukun/particles/keys"
+	"github.com/nokusukun/particles/satellite"
+	"github.com/nokusukun/particles/satellite/satellitetest"
+)
+
+// TestCurveKeys converts the ed25519 keys of a satellite to curve25519, the public key matches the private one
+func TestCurveKeys(t *testing.T) {
+	c, err := satellitetest.StartInMemory(3, satellitetest.None)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := range c.Satellites {
+		pub, err := satellite.CurvePublicKey(c.Keys[i].PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var derived [32]byte
+		curve25519.ScalarBaseMult(&derived, c.Sat(i).CurvePrivateKey())
+		if !bytes.Equal(pub[:], derived[:]) {
+			t.Errorf("the converted public key of %v doesn't belong to its converted private key", i)
+		}
+	}
+
+	if _, err := satellite.CurvePublicKey([]byte("short")); err == nil {
+		t.Error("converted a truncated public key")
+	}
+}
+
+// TestSendSealed seals a message between two satellites, the recipient gets the value back
+func TestSendSealed(t *testing.T) {
+	c, err := satellitetest.StartInMemory(2, satellitetest.Line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type secret struct {
+		Code string
+	}
+	secrets := c.Capture(1, satellite.PType_Message, "secret")
+	if err := c.Sat(0).SendSealed(c.ID(1), "secret", secret{"1234"}); err != nil {
+		t.Fatal(err)
+	}
+	in, err := satellitetest.WaitFor(secrets, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got secret
+	in.As(&got)
+	if !in.Sealed || got.Code != "1234" {
+		t.Errorf("received %+v, sealed: %v", got, in.Sealed)
+	}
+	if in.Message.Payload != nil {
+		t.Errorf("the packet carried the value in the clear: %v", in.Message.Payload)
+	}
+}
+
+// TestUnsealableDropped sends boxes that don't open, they get dropped before reaching the event
+func TestUnsealableDropped(t *testing.T) {
+	c, err := satellitetest.StartInMemory(3, satellitetest.Star)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	secrets := c.Capture(1, satellite.PType_Message, "secret")
+
+	// Sealed to another satellite, then sealed to the recipient under another namespace
+	misdirected, err := c.Sat(0).Seal(c.ID(2), "secret", "not for 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := c.Sat(0).Seal(c.ID(1), "other", "not for this namespace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, box := range []*satellite.SealedBox{misdirected, replayed, {Nonce: make([]byte, 24), Box: []byte("garbage")}} {
+		err := c.Sat(0).SendPacket(c.ID(1), satellite.Packet{PacketType: satellite.PType_Message, Namespace: "secret", Sealed: box})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = satellitetest.WaitUntil(5*time.Second, func() bool {
+		return metric(t, c.Sat(1), `particles_inbounds_dropped_total{reason="unsealable"}`) == 3
+	})
+	if err != nil {
+		t.Fatal("the boxes never got dropped: ", err)
+	}
+	if in, err := satellitetest.WaitFor(secrets, 100*time.Millisecond); err == nil {
+		t.Errorf("an unsealable box reached the event: %v", in.Payload)
+	}
+}
+
+// TestReplySealedToFloodOrigin replies sealed to a seek flooded through a line, the reply gets sealed to the
+// origin of the seek and opened with the origin of the reply instead of the satellites relaying them.
+func TestReplySealedToFloodOrigin(t *testing.T) {
+	c, err := satellitetest.StartInMemory(3, satellitetest.Line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Sat(2).Event(satellite.PType_Seek, "whois", func(i *satellite.Inbound) {
+		defer i.EndReply()
+		if i.Message.Origin != c.ID(0) {
+			t.Errorf("the seek came from %v instead of %v", i.Message.Origin, c.ID(0))
+		}
+		if err := i.ReplySealed("2"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	rs, err := c.Sat(0).SeekFlood("whois", nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case in := <-rs.Stream:
+		if !in.Sealed || in.Payload != "2" {
+			t.Errorf("received %v, sealed: %v", in.Payload, in.Sealed)
+		}
+		if in.Message.Origin != c.ID(2) {
+			t.Errorf("the reply came from %v instead of %v", in.Message.Origin, c.ID(2))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the sealed reply never came back")
+	}
+}
+
+// TestSendSealedToRotatedKey hands the identity of a satellite over to a new key, messages sealed to
+// the old ID get sealed to the new key they're delivered to.
+func TestSendSealedToRotatedKey(t *testing.T) {
+	c, err := satellitetest.StartInMemory(2, satellitetest.Line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	rotated := c.Add()
+	if err := c.Connect(rotated, 0); err != nil {
+		t.Fatal(err)
+	}
+	h, err := keys.SignHandover(c.Keys[1], c.Keys[rotated], time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Sat(rotated).AnnounceHandover(h); err != nil {
+		t.Fatal(err)
+	}
+	err = satellitetest.WaitUntil(5*time.Second, func() bool { return c.Sat(0).Successor(c.ID(1)) == c.ID(rotated) })
+	if err != nil {
+		t.Fatal("the handover never reached the sender: ", err)
+	}
+
+	secrets := c.Capture(rotated, satellite.PType_Message, "secret")
+	if err := c.Sat(0).SendSealed(c.ID(1), "secret", "for the new key"); err != nil {
+		t.Fatal(err)
+	}
+	in, err := satellitetest.WaitFor(secrets, 5*time.Second)
+	if err != nil {
+		t.Fatal("the sealed message never reached the new key: ", err)
+	}
+	if !in.Sealed || in.Payload != "for the new key" {
+		t.Errorf("received %v, sealed: %v", in.Payload, in.Sealed)
+	}
+}
@@ -0,0 +1,178 @@
+package sim
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clock is a virtual clock, time only moves forward when the scheduled functions get run.
+// The satellites of a network tell the time with it, see `config.Satellite.Clock`.
+type Clock struct {
+	// activity counts the calls made to the clock, the network waits for it to stop changing
+	// before it moves the clock forward. It comes first to stay aligned for the atomic operations.
+	activity uint64
+
+	epoch time.Time
+	now   time.Duration
+	seq   uint64
+	queue timerQueue
+
+	lock *sync.Mutex
+}
+
+// Timer is a function scheduled on the virtual clock
+type Timer struct {
+	clock   *Clock
+	at      time.Duration
+	seq     uint64
+	f       func()
+	stopped bool
+}
+
+// Stop prevents the timer from running, stopping a timer that already ran does nothing
+func (t *Timer) Stop() {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	t.stopped = true
+}
+
+func NewClock(epoch time.Time) *Clock {
+	return &Clock{epoch: epoch, lock: &sync.Mutex{}}
+}
+
+// Elapsed returns the virtual time elapsed since the start of the simulation
+func (c *Clock) Elapsed() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// Now returns the virtual wall clock time
+func (c *Clock) Now() time.Time {
+	atomic.AddUint64(&c.activity, 1)
+	return c.epoch.Add(c.Elapsed())
+}
+
+// After sends the virtual wall clock time on the returned channel once the virtual duration d passes
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.AfterFunc(d, func() {
+		ch <- c.epoch.Add(c.Elapsed())
+	})
+	return ch
+}
+
+// AfterFunc schedules f to run after the virtual duration d
+func (c *Clock) AfterFunc(d time.Duration, f func()) *Timer {
+	if d < 0 {
+		d = 0
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.schedule(c.now+d, f)
+}
+
+// at schedules f to run at the virtual time, or right away if it has already passed
+func (c *Clock) at(at time.Duration, f func()) *Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if at < c.now {
+		at = c.now
+	}
+	return c.schedule(at, f)
+}
+
+// schedule adds the timer to the queue, c.lock should be held
+func (c *Clock) schedule(at time.Duration, f func()) *Timer {
+	atomic.AddUint64(&c.activity, 1)
+	c.seq++
+	t := &Timer{clock: c, at: at, seq: c.seq, f: f}
+	heap.Push(&c.queue, t)
+	return t
+}
+
+// Pending returns the amount of scheduled functions, including stopped timers that haven't been discarded yet
+func (c *Clock) Pending() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.queue)
+}
+
+// Step advances the clock to the next scheduled function and runs it, returns false if nothing is scheduled
+func (c *Clock) Step() bool {
+	c.lock.Lock()
+	for len(c.queue) > 0 {
+		t := heap.Pop(&c.queue).(*Timer)
+		if t.stopped {
+			continue
+		}
+		c.now = t.at
+		c.lock.Unlock()
+
+		atomic.AddUint64(&c.activity, 1)
+		t.f()
+		return true
+	}
+	c.lock.Unlock()
+	return false
+}
+
+// Run runs every scheduled function, including the ones scheduled while running, until nothing is left
+func (c *Clock) Run() {
+	for c.Step() {
+	}
+}
+
+// RunFor runs the functions scheduled within the virtual duration d, then moves the clock to its end
+func (c *Clock) RunFor(d time.Duration) {
+	c.lock.Lock()
+	end := c.now + d
+	c.lock.Unlock()
+
+	for c.next(end) {
+		c.Step()
+	}
+
+	c.lock.Lock()
+	c.now = end
+	c.lock.Unlock()
+}
+
+// next returns true if a function is scheduled before the virtual time
+func (c *Clock) next(before time.Duration) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.queue) > 0 && c.queue[0].at <= before
+}
+
+func (c *Clock) changes() uint64 {
+	return atomic.LoadUint64(&c.activity)
+}
+
+// timerQueue orders the timers by their schedule, timers scheduled at the same time run in the order they were added
+type timerQueue []*Timer
+
+func (q timerQueue) Len() int { return len(q) }
+
+func (q timerQueue) Less(i, j int) bool {
+	if q[i].at == q[j].at {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].at < q[j].at
+}
+
+func (q timerQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *timerQueue) Push(x interface{}) {
+	*q = append(*q, x.(*Timer))
+}
+
+func (q *timerQueue) Pop() interface{} {
+	old := *q
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return t
+}
@@ -0,0 +1,90 @@
+package sim
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Distribution samples the latency of a packet
+type Distribution interface {
+	Sample(r *rand.Rand) time.Duration
+}
+
+// Constant delays every packet by the same duration
+type Constant time.Duration
+
+func (c Constant) Sample(r *rand.Rand) time.Duration {
+	return time.Duration(c)
+}
+
+// Uniform delays packets between Min and Max
+type Uniform struct {
+	Min, Max time.Duration
+}
+
+func (u Uniform) Sample(r *rand.Rand) time.Duration {
+	if u.Max <= u.Min {
+		return u.Min
+	}
+	return u.Min + time.Duration(r.Int63n(int64(u.Max-u.Min)))
+}
+
+// Normal delays packets around Mean, samples below zero are clamped to zero
+type Normal struct {
+	Mean, StdDev time.Duration
+}
+
+func (n Normal) Sample(r *rand.Rand) time.Duration {
+	d := n.Mean + time.Duration(r.NormFloat64()*float64(n.StdDev))
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// Exponential delays packets by an exponentially distributed duration, which gives a long tail of slow packets
+type Exponential struct {
+	Mean time.Duration
+}
+
+func (e Exponential) Sample(r *rand.Rand) time.Duration {
+	return time.Duration(r.ExpFloat64() * float64(e.Mean))
+}
+
+// Loss decides whether a packet gets lost, lost packets get retransmitted like they do over TCP
+type Loss interface {
+	Drop(r *rand.Rand) bool
+}
+
+// Bernoulli drops every packet independently with the probability
+type Bernoulli float64
+
+func (b Bernoulli) Drop(r *rand.Rand) bool {
+	return b > 0 && r.Float64() < float64(b)
+}
+
+// GilbertElliott drops packets in bursts, the network moves between a good and a bad state,
+// each state dropping packets with its own probability.
+type GilbertElliott struct {
+	// GoodToBad and BadToGood are the probabilities of switching state on every packet
+	GoodToBad, BadToGood float64
+	// GoodLoss and BadLoss are the probabilities of dropping a packet in each state
+	GoodLoss, BadLoss float64
+
+	bad bool
+}
+
+func (g *GilbertElliott) Drop(r *rand.Rand) bool {
+	if g.bad {
+		if r.Float64() < g.BadToGood {
+			g.bad = false
+		}
+	} else if r.Float64() < g.GoodToBad {
+		g.bad = true
+	}
+
+	if g.bad {
+		return r.Float64() < g.BadLoss
+	}
+	return r.Float64() < g.GoodLoss
+}
@@ -0,0 +1,355 @@
+// Package sim runs satellites on a simulated network with a virtual clock, which lets us look at broadcast
+// reach, seek latency and DHT lookups on more satellites than real sockets allow on a single machine.
+//
+// The simulated satellites are real `satellite.Satellite`s talking through a `satellite.MemoryTransport`,
+// every packet they write travels through a link that delays it on the virtual clock by a sampled latency.
+// Their response streams and flood routers tell the time with the same clock, so timeouts and expiries happen
+// in virtual time. The clock only moves forward once the satellites settle, when every packet delivered so far
+// has been read and nothing touched the clock for `Network.Settle` of real time.
+//
+// Loss works like it does on the TCP connections of the satellites, a lost packet gets retransmitted after
+// `Network.Retransmit` and the packets written after it on the same connection wait for it.
+package sim
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/perlin-network/noise/protocol"
+	"github.com/perlin-network/noise/skademlia"
+
+	"github.com/nokusukun/particles/config"
+	"github.com/nokusukun/particles/roggy"
+	"github.com/nokusukun/particles/satellite"
+)
+
+var log = roggy.Printer("Simulator")
+
+var (
+	// ConnectTimeout is how long of real time Connect waits for both satellites to register each other
+	ConnectTimeout = 5 * time.Second
+	// MaxRetransmits is the most a packet gets lost before it goes through anyway
+	MaxRetransmits = 15
+	// maxSettleTries is how many quiet periods of `Network.Settle` the network waits for the
+	// delivered packets to be read before it moves the clock forward anyway
+	maxSettleTries = 100
+)
+
+type Network struct {
+	Clock *Clock
+	Nodes []*Node
+
+	// Latency is sampled for every packet sent
+	Latency Distribution
+	// Loss decides which packets get lost, each loss delays the packet by Retransmit
+	Loss       Loss
+	Retransmit time.Duration
+	// Settle is how long of real time the satellites have to stay quiet before the clock moves forward,
+	// raise it if the satellites take longer to handle a packet
+	Settle time.Duration
+
+	// Sent, Lost and Delivered count every packet of the simulation including the handshakes,
+	// a packet lost several times is counted once for every loss
+	Sent      int
+	Lost      int
+	Delivered int
+
+	transport *satellite.MemoryTransport
+	byHex     map[string]*Node
+	reports   map[int]*Report
+	// running is the amount of operations waiting on the satellites
+	running int
+	// watched are the packet types and namespaces every satellite records the arrivals of
+	watched map[event]bool
+
+	rand *rand.Rand
+	lock *sync.Mutex
+}
+
+// NewNetwork creates an empty network, the seed drives the latency and the loss of the packets
+func NewNetwork(seed int64, latency Distribution, loss Loss) *Network {
+	if latency == nil {
+		latency = Constant(0)
+	}
+	if loss == nil {
+		loss = Bernoulli(0)
+	}
+
+	n := &Network{
+		Clock:      NewClock(time.Now()),
+		Latency:    latency,
+		Loss:       loss,
+		Retransmit: 200 * time.Millisecond,
+		Settle:     time.Millisecond,
+		transport:  satellite.NewMemoryTransport(),
+		byHex:      map[string]*Node{},
+		reports:    map[int]*Report{},
+		watched:    map[event]bool{},
+		rand:       rand.New(rand.NewSource(seed)),
+		lock:       &sync.Mutex{},
+	}
+	n.transport.NewLink = func(from, to net.Addr) satellite.MemoryLink {
+		return &link{net: n}
+	}
+	return n
+}
+
+// AddNodes starts count satellites on the network, the satellites don't know each other
+// until they get connected or the network gets bootstrapped.
+func (n *Network) AddNodes(count int) []*Node {
+	var added []*Node
+	for i := 0; i < count; i++ {
+		sat := satellite.BuildNetwork(&config.Satellite{
+			Host:             "127.0.0.1",
+			DisableBootstrap: true,
+			Transport:        n.transport,
+			Clock:            n.Clock,
+		}, skademlia.RandomKeys())
+
+		node := newNode(n, len(n.Nodes), sat)
+		n.lock.Lock()
+		n.Nodes = append(n.Nodes, node)
+		n.byHex[node.ID] = node
+		watched := make([]event, 0, len(n.watched))
+		for ev := range n.watched {
+			watched = append(watched, ev)
+		}
+		n.lock.Unlock()
+
+		for _, ev := range watched {
+			node.tap(ev)
+		}
+		added = append(added, node)
+	}
+	return added
+}
+
+// Connect dials b from a and runs the clock until both satellites have registered each other
+func (n *Network) Connect(a, b *Node) error {
+	var err error
+	n.await(func() {
+		err = n.connect(a, b)
+	})
+	return err
+}
+
+func (n *Network) connect(a, b *Node) error {
+	if a.Sat.HasPeer(b.ID) {
+		return nil
+	}
+	if _, err := a.Sat.Node.Dial(b.Sat.Node.ExternalAddress()); err != nil {
+		return fmt.Errorf("failed to dial %v from %v: %v", b, a, err)
+	}
+
+	deadline := time.Now().Add(ConnectTimeout)
+	for !a.Sat.HasPeer(b.ID) || !b.Sat.HasPeer(a.ID) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%v and %v never registered each other", a, b)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
+// Bootstrap joins the satellites to the network one after another the way a new satellite joins: it connects
+// to a random satellite that joined before it, then looks itself up through s/kad which connects it to the
+// satellites closest to it. Full buckets keep the satellites they got first, like they do on a real network.
+func (n *Network) Bootstrap() {
+	for i := 1; i < len(n.Nodes); i++ {
+		node, known := n.Nodes[i], n.Nodes[n.intn(i)]
+		if !node.Online || !known.Online {
+			continue
+		}
+		if err := n.Connect(node, known); err != nil {
+			log.Error(err)
+			continue
+		}
+		n.await(func() {
+			n.lookupSelf(node)
+		})
+	}
+	log.Infof("bootstrapped %v satellites", len(n.Nodes))
+}
+
+// lookupSelf looks the satellite up through s/kad. The lookup waits forever on peers that drop the connection
+// before authenticating, it's given up on after `ConnectTimeout` of real time.
+func (n *Network) lookupSelf(node *Node) {
+	done := make(chan struct{})
+	go func() {
+		skademlia.FindNode(node.Sat.Node, protocol.NodeID(node.Sat.Node).(skademlia.ID), skademlia.BucketSize(), 8)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(ConnectTimeout):
+		log.Debugf("%v gave up on looking itself up", node)
+	}
+}
+
+// FailRandom shuts down the fraction of the online satellites, returning them
+func (n *Network) FailRandom(fraction float64) []*Node {
+	var failed []*Node
+	online := n.Online()
+	count := int(float64(len(online)) * fraction)
+
+	n.lock.Lock()
+	perm := n.rand.Perm(len(online))[:count]
+	n.lock.Unlock()
+
+	for _, i := range perm {
+		online[i].fail()
+		failed = append(failed, online[i])
+	}
+	return failed
+}
+
+// Online returns the satellites that are online
+func (n *Network) Online() []*Node {
+	var online []*Node
+	for _, node := range n.Nodes {
+		if node.Online {
+			online = append(online, node)
+		}
+	}
+	return online
+}
+
+// Run runs the simulation until every operation has finished and nothing is left on the clock
+func (n *Network) Run() {
+	n.drive(func() bool {
+		n.lock.Lock()
+		defer n.lock.Unlock()
+		return n.running == 0 && n.Clock.Pending() == 0
+	})
+}
+
+// Close shuts down every satellite of the network
+func (n *Network) Close() {
+	for _, node := range n.Online() {
+		node.fail()
+	}
+}
+
+// drive moves the clock forward every time the satellites settle, until finished returns true.
+// Operations can wait on the real time as well, the clock idles while nothing is scheduled on it.
+func (n *Network) drive(finished func() bool) {
+	for {
+		n.settle()
+		if finished() {
+			return
+		}
+		if !n.Clock.Step() {
+			time.Sleep(n.Settle)
+		}
+	}
+}
+
+// settle waits until every packet delivered so far has been read and nothing touched the clock for `Network.Settle`
+func (n *Network) settle() {
+	for tries := 0; ; tries++ {
+		changes := n.Clock.changes()
+		time.Sleep(n.Settle)
+		if n.Clock.changes() != changes {
+			continue
+		}
+		if n.transport.Pending() == 0 || tries >= maxSettleTries {
+			return
+		}
+	}
+}
+
+// await runs the functions in parallel and drives the clock until every one of them returns
+func (n *Network) await(fs ...func()) {
+	var lock sync.Mutex
+	left := len(fs)
+	for _, f := range fs {
+		go func(f func()) {
+			f()
+			lock.Lock()
+			left--
+			lock.Unlock()
+		}(f)
+	}
+
+	n.drive(func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return left == 0
+	})
+}
+
+// track runs the operation in the background, Run waits for it to return
+func (n *Network) track(f func()) {
+	n.lock.Lock()
+	n.running++
+	n.lock.Unlock()
+
+	go func() {
+		defer func() {
+			n.lock.Lock()
+			n.running--
+			n.lock.Unlock()
+		}()
+		f()
+	}()
+}
+
+// watch makes every satellite record the arrivals of the packet type and namespace
+func (n *Network) watch(eventType satellite.PType, namespace string) {
+	ev := event{eventType, namespace}
+	n.lock.Lock()
+	watched := n.watched[ev]
+	n.watched[ev] = true
+	nodes := append([]*Node(nil), n.Nodes...)
+	n.lock.Unlock()
+	if watched {
+		return
+	}
+
+	for _, node := range nodes {
+		node.tap(ev)
+	}
+}
+
+func (n *Network) intn(max int) int {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.rand.Intn(max)
+}
+
+// link delays the packets written to one direction of a connection on the virtual clock,
+// they arrive in the order they were written like they do over TCP
+type link struct {
+	net *Network
+	// last is when the last packet written arrives
+	last time.Duration
+}
+
+func (l *link) Send(p []byte, deliver func()) {
+	n := l.net
+	n.lock.Lock()
+	n.Sent++
+	delay := n.Latency.Sample(n.rand)
+	for losses := 0; losses < MaxRetransmits && n.Loss.Drop(n.rand); losses++ {
+		n.Lost++
+		delay += n.Retransmit
+	}
+
+	at := n.Clock.Elapsed() + delay
+	if at < l.last {
+		at = l.last
+	}
+	l.last = at
+	n.lock.Unlock()
+
+	n.Clock.at(at, func() {
+		n.lock.Lock()
+		n.Delivered++
+		n.lock.Unlock()
+		deliver()
+	})
+}
@@ -0,0 +1,199 @@
+package sim
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/nokusukun/particles/satellite"
+)
+
+// envelope wraps the payload of an operation so the satellites it reaches can tell which operation arrived,
+// the taps unwrap it before the events see the inbound
+type envelope struct {
+	Op    int         `json:"sim_op"`
+	Value interface{} `json:"sim_value"`
+}
+
+// event is the packet type and namespace of an event
+type event struct {
+	eventType satellite.PType
+	namespace string
+}
+
+// Node is a simulated satellite
+type Node struct {
+	Index int
+	Sat   *satellite.Satellite
+	// ID is the hex encoded ID of the satellite
+	ID     string
+	Online bool
+
+	net *Network
+	// events are registered through the node, they run behind the tap that records the arrivals
+	events map[event]satellite.SatEvent
+	tapped map[event]bool
+	lock   *sync.Mutex
+}
+
+func newNode(net *Network, index int, sat *satellite.Satellite) *Node {
+	return &Node{
+		Index:  index,
+		Sat:    sat,
+		ID:     sat.ID(),
+		Online: true,
+		net:    net,
+		events: map[event]satellite.SatEvent{},
+		tapped: map[event]bool{},
+		lock:   &sync.Mutex{},
+	}
+}
+
+func (n *Node) String() string {
+	return fmt.Sprintf("sim(%v, %v)", n.Index, n.ID[:8])
+}
+
+// Peers returns the satellites connected to the satellite
+func (n *Node) Peers() []*Node {
+	var peers []*Node
+	for _, node := range n.net.Nodes {
+		if n.Sat.HasPeer(node.ID) {
+			peers = append(peers, node)
+		}
+	}
+	return peers
+}
+
+// Event registers the event on the satellite, the payloads of the operations reach it unwrapped
+func (n *Node) Event(eventType satellite.PType, namespace string, f satellite.SatEvent) {
+	ev := event{eventType, namespace}
+	n.lock.Lock()
+	n.events[ev] = f
+	n.lock.Unlock()
+	n.tap(ev)
+}
+
+// RemoveEvent removes the event, the satellite keeps recording the arrivals of the operations
+func (n *Node) RemoveEvent(eventType satellite.PType, namespace string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.events, event{eventType, namespace})
+}
+
+// tap registers the event on the satellite, the inbounds carrying an operation get recorded
+// as arrivals of the operation before they're handed to the event registered through the node
+func (n *Node) tap(ev event) {
+	n.lock.Lock()
+	tapped := n.tapped[ev]
+	n.tapped[ev] = true
+	n.lock.Unlock()
+	if tapped {
+		return
+	}
+
+	n.Sat.Event(ev.eventType, ev.namespace, func(in *satellite.Inbound) {
+		if env, ok := in.Payload.(map[string]interface{}); ok {
+			if op, ok := env["sim_op"].(float64); ok {
+				in.Payload = env["sim_value"]
+				n.net.arrive(int(op), n, in.Message)
+			}
+		}
+
+		n.lock.Lock()
+		f, exists := n.events[ev]
+		n.lock.Unlock()
+		if exists {
+			f(in)
+		}
+	})
+}
+
+func (n *Node) fail() {
+	n.Online = false
+	n.Sat.Close()
+}
+
+// Broadcast sends a broadcast to the closest peers of the satellite through `Satellite.Broadcast`
+func (n *Node) Broadcast(namespace string, value interface{}) *Report {
+	op := n.net.newReport("broadcast", n, namespace, 0)
+	n.net.watch(satellite.PType_Broadcast, namespace)
+	n.Sat.Broadcast(namespace, op.wrap(value))
+	return op
+}
+
+// BroadcastFlood floods the broadcast through the network with `Satellite.BroadcastFlood`
+func (n *Node) BroadcastFlood(namespace string, value interface{}, ttl int) *Report {
+	op := n.net.newReport("flood", n, namespace, ttl)
+	n.net.watch(satellite.PType_Broadcast, namespace)
+	n.Sat.BroadcastFlood(namespace, op.wrap(value), ttl)
+	return op
+}
+
+// Seek sends a seek to the closest peers with `Satellite.Seek`, or floods it through the network with
+// `Satellite.SeekFlood` if ttl is above 0. The responses are recorded until the response stream ends.
+func (n *Node) Seek(namespace string, value interface{}, ttl int) *Report {
+	op := n.net.newReport("seek", n, namespace, ttl)
+	n.net.watch(satellite.PType_Seek, namespace)
+
+	var rs *satellite.ResponseStream
+	var err error
+	if ttl > 0 {
+		rs, err = n.Sat.SeekFlood(namespace, op.wrap(value), ttl)
+	} else {
+		rs, err = n.Sat.Seek(namespace, op.wrap(value))
+	}
+	if err != nil {
+		log.Debugf("%v failed to seek %v: %v", n, namespace, err)
+		op.finish(satellite.StreamEndError)
+		return op
+	}
+
+	n.net.track(func() {
+		op.stream(rs)
+	})
+	return op
+}
+
+// Request sends a request to the satellite with `Satellite.RequestByID`, the report ends with the response stream
+func (n *Node) Request(to *Node, namespace string, value interface{}) *Report {
+	op := n.net.newReport("request", n, namespace, 0)
+	op.Reachable = 1
+	n.net.watch(satellite.PType_Request, namespace)
+
+	n.net.track(func() {
+		rs, err := n.Sat.RequestByID(to.ID, namespace, op.wrap(value))
+		if err != nil {
+			log.Debugf("%v failed to request %v from %v: %v", n, namespace, to, err)
+			op.finish(satellite.StreamEndError)
+			return
+		}
+		op.stream(rs)
+	})
+	return op
+}
+
+// Put stores the value in the DHT with `Satellite.Put`, the report ends once the record is stored
+func (n *Node) Put(key string, value interface{}) *Report {
+	op := n.net.newReport("put", n, key, 0)
+	op.Reachable = 1
+
+	n.net.track(func() {
+		err := n.Sat.Put(key, value)
+		if err != nil {
+			log.Debugf("%v failed to put %v: %v", n, key, err)
+		}
+		op.complete(err == nil)
+	})
+	return op
+}
+
+// Get looks up the key in the DHT with `Satellite.Get`
+func (n *Node) Get(key string) *Report {
+	op := n.net.newReport("get", n, key, 0)
+	op.Reachable = 1
+
+	n.net.track(func() {
+		_, err := n.Sat.Get(key)
+		op.complete(err == nil)
+	})
+	return op
+}
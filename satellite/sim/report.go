@@ -0,0 +1,307 @@
+package sim
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nokusukun/particles/satellite"
+)
+
+// Arrival is a packet of an operation reaching a satellite, or a response reaching the origin
+type Arrival struct {
+	Node    int
+	Hops    int
+	Latency time.Duration
+}
+
+// Report records what happened to a single operation of the simulation
+type Report struct {
+	Operation string
+	Namespace string
+	Origin    int
+	Started   time.Duration
+
+	// Reachable is the amount of satellites the operation should reach, every online satellite
+	// besides the origin for broadcasts and seeks.
+	Reachable int
+	// Arrivals has the first arrival of the packet on every satellite it reached, by satellite index.
+	// DHT operations arrive on their origin with 0 hops once the record is stored or found.
+	Arrivals map[int]Arrival
+	// Responses has the first response of every responding satellite in order of arrival,
+	// their hops count the way to the responder and back.
+	Responses []Arrival
+
+	// Found is set by DHT operations that stored or found the record
+	Found bool
+
+	// Done is set once the response stream of the operation ends, End says how
+	Done     bool
+	End      satellite.CStreamReturn
+	Finished time.Duration
+
+	id  int
+	ttl int
+	net *Network
+	// responders are the hex encoded IDs of the satellites that responded
+	responders map[string]bool
+}
+
+func (n *Network) newReport(operation string, origin *Node, namespace string, ttl int) *Report {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	r := &Report{
+		Operation:  operation,
+		Namespace:  namespace,
+		Origin:     origin.Index,
+		Started:    n.Clock.Elapsed(),
+		Reachable:  len(n.Online()) - 1,
+		Arrivals:   map[int]Arrival{},
+		id:         len(n.reports) + 1,
+		ttl:        ttl,
+		net:        n,
+		responders: map[string]bool{},
+	}
+	n.reports[r.id] = r
+	return r
+}
+
+// wrap puts the value in an envelope that lets the satellites it reaches record its arrival
+func (r *Report) wrap(value interface{}) envelope {
+	return envelope{Op: r.id, Value: value}
+}
+
+// arrive records the packet of the operation reaching the satellite, flooded packets count
+// their hops from the TTL left when they arrived
+func (n *Network) arrive(id int, node *Node, msg satellite.Packet) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	r, exists := n.reports[id]
+	if !exists {
+		return
+	}
+	if _, arrived := r.Arrivals[node.Index]; arrived || node.Index == r.Origin {
+		return
+	}
+
+	hops := 1
+	if msg.TTL > 0 {
+		hops = r.ttl - msg.TTL + 1
+	}
+	r.Arrivals[node.Index] = Arrival{Node: node.Index, Hops: hops, Latency: n.Clock.Elapsed() - r.Started}
+}
+
+// stream records the responses of the response stream until it ends
+func (r *Report) stream(rs *satellite.ResponseStream) {
+	for in := range rs.Stream {
+		// Responses to flooded packets carry the ID of the responder, they come through the relaying peer
+		responder := in.Message.Origin
+		if responder == "" {
+			responder = in.PeerID()
+		}
+		r.respond(responder)
+	}
+	r.finish(<-rs.Done)
+}
+
+func (r *Report) respond(responder string) {
+	n := r.net
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if r.responders[responder] {
+		return
+	}
+	r.responders[responder] = true
+
+	index, hops := -1, 0
+	if node, exists := n.byHex[responder]; exists {
+		index = node.Index
+		hops = 2 * r.Arrivals[index].Hops
+	}
+	r.Responses = append(r.Responses, Arrival{Node: index, Hops: hops, Latency: n.Clock.Elapsed() - r.Started})
+}
+
+// complete ends a DHT operation, it arrives on its origin if the record was stored or found
+func (r *Report) complete(found bool) {
+	n := r.net
+	n.lock.Lock()
+	r.Found = found
+	if found {
+		r.Arrivals[r.Origin] = Arrival{Node: r.Origin, Latency: n.Clock.Elapsed() - r.Started}
+	}
+	n.lock.Unlock()
+
+	if found {
+		r.finish(satellite.StreamEndOK)
+	} else {
+		r.finish(satellite.StreamEndError)
+	}
+}
+
+func (r *Report) finish(end satellite.CStreamReturn) {
+	n := r.net
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if r.Done {
+		return
+	}
+	r.Done = true
+	r.End = end
+	r.Finished = n.Clock.Elapsed()
+}
+
+// DeliveryRatio is the fraction of the reachable satellites the operation reached
+func (r *Report) DeliveryRatio() float64 {
+	if r.Reachable <= 0 {
+		return 0
+	}
+	return float64(len(r.Arrivals)) / float64(r.Reachable)
+}
+
+// HopCounts returns the amount of satellites reached in each amount of hops
+func (r *Report) HopCounts() map[int]int {
+	counts := map[int]int{}
+	for _, a := range r.Arrivals {
+		counts[a.Hops]++
+	}
+	return counts
+}
+
+func (r *Report) arrivals() []Arrival {
+	var arrivals []Arrival
+	for _, a := range r.Arrivals {
+		arrivals = append(arrivals, a)
+	}
+	return arrivals
+}
+
+func (r *Report) String() string {
+	s := fmt.Sprintf("%v %v from %v: reached %v/%v (%.1f%%)",
+		r.Operation, r.Namespace, r.Origin, len(r.Arrivals), r.Reachable, r.DeliveryRatio()*100)
+
+	if len(r.Arrivals) > 0 {
+		arrivals := r.arrivals()
+		s += fmt.Sprintf(", hops mean %.2f max %v, latency p50 %v p99 %v",
+			meanHops(arrivals), maxHops(arrivals), percentile(arrivals, 0.5), percentile(arrivals, 0.99))
+	}
+	if len(r.Responses) > 0 {
+		s += fmt.Sprintf(", %v responses (first after %v)", len(r.Responses), r.Responses[0].Latency)
+	}
+	if r.Operation == "put" || r.Operation == "get" {
+		s += fmt.Sprintf(", found %v", r.Found)
+	}
+	return s
+}
+
+// Summary aggregates the reports of several operations
+type Summary struct {
+	Operations int
+	// MeanDeliveryRatio and MinDeliveryRatio are taken over the operations
+	MeanDeliveryRatio float64
+	MinDeliveryRatio  float64
+	// Hops and Latency are taken over every arrival of every operation
+	HopCounts  map[int]int
+	MeanHops   float64
+	MaxHops    int
+	LatencyP50 time.Duration
+	LatencyP99 time.Duration
+	// ResponseRatio is the fraction of operations that got at least a response
+	ResponseRatio float64
+	// FoundRatio is the fraction of DHT operations that stored or found the record
+	FoundRatio float64
+}
+
+func Summarize(reports []*Report) Summary {
+	s := Summary{Operations: len(reports), HopCounts: map[int]int{}, MinDeliveryRatio: 1}
+	if len(reports) == 0 {
+		s.MinDeliveryRatio = 0
+		return s
+	}
+
+	var arrivals []Arrival
+	responded, found := 0, 0
+	for _, r := range reports {
+		ratio := r.DeliveryRatio()
+		s.MeanDeliveryRatio += ratio
+		if ratio < s.MinDeliveryRatio {
+			s.MinDeliveryRatio = ratio
+		}
+		for hops, count := range r.HopCounts() {
+			s.HopCounts[hops] += count
+		}
+		arrivals = append(arrivals, r.arrivals()...)
+
+		if len(r.Responses) > 0 {
+			responded++
+		}
+		if r.Found {
+			found++
+		}
+	}
+
+	count := float64(len(reports))
+	s.MeanDeliveryRatio /= count
+	s.ResponseRatio = float64(responded) / count
+	s.FoundRatio = float64(found) / count
+	s.MeanHops = meanHops(arrivals)
+	s.MaxHops = maxHops(arrivals)
+	s.LatencyP50 = percentile(arrivals, 0.5)
+	s.LatencyP99 = percentile(arrivals, 0.99)
+	return s
+}
+
+func (s Summary) String() string {
+	var hops []int
+	for h := range s.HopCounts {
+		hops = append(hops, h)
+	}
+	sort.Ints(hops)
+
+	var histogram []string
+	for _, h := range hops {
+		histogram = append(histogram, fmt.Sprintf("%v:%v", h, s.HopCounts[h]))
+	}
+
+	return fmt.Sprintf("%v operations: delivery mean %.1f%% min %.1f%%, hops mean %.2f max %v [%v], "+
+		"latency p50 %v p99 %v, responded %.1f%%, found %.1f%%",
+		s.Operations, s.MeanDeliveryRatio*100, s.MinDeliveryRatio*100, s.MeanHops, s.MaxHops,
+		strings.Join(histogram, " "), s.LatencyP50, s.LatencyP99, s.ResponseRatio*100, s.FoundRatio*100)
+}
+
+func meanHops(arrivals []Arrival) float64 {
+	if len(arrivals) == 0 {
+		return 0
+	}
+	total := 0
+	for _, a := range arrivals {
+		total += a.Hops
+	}
+	return float64(total) / float64(len(arrivals))
+}
+
+func maxHops(arrivals []Arrival) int {
+	max := 0
+	for _, a := range arrivals {
+		if a.Hops > max {
+			max = a.Hops
+		}
+	}
+	return max
+}
+
+func percentile(arrivals []Arrival, p float64) time.Duration {
+	if len(arrivals) == 0 {
+		return 0
+	}
+	latencies := make([]time.Duration, len(arrivals))
+	for i, a := range arrivals {
+		latencies[i] = a.Latency
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies[int(p*float64(len(latencies)-1))]
+}
@@ -0,0 +1,143 @@
+package sim_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nokusukun/particles/satellite"
+	"github.com/nokusukun/particles/satellite/sim"
+)
+
+// line starts n satellites connected one after another
+func line(t *testing.T, net *sim.Network, n int) []*sim.Node {
+	nodes := net.AddNodes(n)
+	for i := 0; i+1 < n; i++ {
+		if err := net.Connect(nodes[i], nodes[i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return nodes
+}
+
+// arrived checks the arrivals took the hops, each hop taking at least the latency. A satellite slower
+// than `Network.Settle` to handle a packet lets the clock move on before it sends the next one.
+func arrived(t *testing.T, arrivals []sim.Arrival, want map[int]int, latency time.Duration) {
+	t.Helper()
+	if len(arrivals) != len(want) {
+		t.Errorf("arrived on %v instead of %v", arrivals, want)
+	}
+	for _, a := range arrivals {
+		if hops, exists := want[a.Node]; !exists || a.Hops != hops || a.Latency < time.Duration(hops)*latency {
+			t.Errorf("arrived on %v after %v hops and %v, expected %v hops", a.Node, a.Hops, a.Latency, want[a.Node])
+		}
+	}
+}
+
+// TestFloodReach floods a broadcast through a line, it reaches the satellites within the TTL one latency per hop
+func TestFloodReach(t *testing.T) {
+	const latency = 10 * time.Millisecond
+	net := sim.NewNetwork(1, sim.Constant(latency), nil)
+	defer net.Close()
+	nodes := line(t, net, 5)
+
+	received := make(chan interface{}, 10)
+	nodes[2].Event(satellite.PType_Broadcast, "reach", func(in *satellite.Inbound) {
+		received <- in.Payload
+	})
+
+	report := nodes[0].BroadcastFlood("reach", "hello", 2)
+	net.Run()
+
+	var arrivals []sim.Arrival
+	for _, a := range report.Arrivals {
+		arrivals = append(arrivals, a)
+	}
+	arrived(t, arrivals, map[int]int{1: 1, 2: 2}, latency)
+	if len(received) != 1 || <-received != "hello" {
+		t.Error("the event didn't receive the unwrapped broadcast")
+	}
+}
+
+// TestFloodedSeek floods a seek through a line, the responses get routed back until the stream times out in virtual time
+func TestFloodedSeek(t *testing.T) {
+	const latency = 10 * time.Millisecond
+	net := sim.NewNetwork(1, sim.Constant(latency), nil)
+	defer net.Close()
+	nodes := line(t, net, 4)
+
+	for _, node := range nodes[2:] {
+		node := node
+		node.Event(satellite.PType_Seek, "seek", func(in *satellite.Inbound) {
+			in.Reply(node.Index)
+			in.EndReply()
+		})
+	}
+
+	report := nodes[0].Seek("seek", nil, 3)
+	net.Run()
+
+	arrived(t, report.Responses, map[int]int{2: 4, 3: 6}, latency)
+	if report.End != satellite.StreamEndTimeout || report.Finished-report.Started < satellite.SeekStreamLifetime {
+		t.Errorf("the stream ended with %v after %v", report.End, report.Finished-report.Started)
+	}
+}
+
+// TestRequest requests from a satellite that replies and from one that doesn't, the second request times out
+func TestRequest(t *testing.T) {
+	net := sim.NewNetwork(1, sim.Constant(10*time.Millisecond), nil)
+	defer net.Close()
+	nodes := line(t, net, 3)
+
+	nodes[1].Event(satellite.PType_Request, "ping", func(in *satellite.Inbound) {
+		in.Reply(in.Payload)
+		in.EndReply()
+	})
+
+	replied := nodes[0].Request(nodes[1], "ping", 1)
+	silent := nodes[1].Request(nodes[2], "ping", 2)
+	net.Run()
+
+	if len(replied.Responses) != 1 || replied.End != satellite.StreamEndOK {
+		t.Errorf("the request got %v and ended with %v", replied.Responses, replied.End)
+	}
+	if silent.End != satellite.StreamEndTimeout || silent.Finished-silent.Started < satellite.ResponseStreamLifetime {
+		t.Errorf("the unanswered request ended with %v after %v", silent.End, silent.Finished-silent.Started)
+	}
+}
+
+// TestLoss floods a broadcast over a lossy network, the lost packets get retransmitted so it still reaches everyone
+func TestLoss(t *testing.T) {
+	net := sim.NewNetwork(1, sim.Constant(10*time.Millisecond), sim.Bernoulli(0.3))
+	defer net.Close()
+	line(t, net, 6)
+
+	report := net.Nodes[0].BroadcastFlood("loss", nil, 5)
+	net.Run()
+
+	if report.DeliveryRatio() != 1 {
+		t.Errorf("the flood reached %v", report.Arrivals)
+	}
+	if net.Lost == 0 {
+		t.Error("no packet got lost")
+	}
+}
+
+// TestDHT stores a record on a bootstrapped network and finds it from another satellite
+func TestDHT(t *testing.T) {
+	net := sim.NewNetwork(1, sim.Uniform{Min: 5 * time.Millisecond, Max: 50 * time.Millisecond}, nil)
+	defer net.Close()
+	net.AddNodes(12)
+	net.Bootstrap()
+
+	put := net.Nodes[0].Put("sim", "value")
+	net.Run()
+	get := net.Nodes[11].Get("sim")
+	net.Run()
+
+	if !put.Found || !get.Found {
+		t.Errorf("put stored %v, get found %v", put.Found, get.Found)
+	}
+	if summary := sim.Summarize([]*sim.Report{put, get}); summary.FoundRatio != 1 {
+		t.Errorf("summarized %v", summary)
+	}
+}
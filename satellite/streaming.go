@@ -3,11 +3,10 @@ package satellite
 import (
 	"fmt"
 	"sync"
-	"time"
 
 	"github.com/perlin-network/noise"
-	"github.com/perlin-network/noise/skademlia"
 
+	"github.com/nokusukun/particles/keys"
 	"github.com/nokusukun/particles/roggy"
 )
 
@@ -27,6 +26,10 @@ type ResponseStream struct {
 	// Done is a channel which returns an int if the ResponseStream ended. It doesn't say if the ResponseStream
 	//      ended with an error or failed mid way though
 	Done chan CStreamReturn
+	// Trace is the span of the request, the remote handlers are traced under it
+	Trace SpanContext
+	// Error is the reason the remote peer gave for refusing the request, the stream ends with StreamEndError
+	Error string
 
 	// lets the timeout goroutine know that the request has been peacefully responded with
 	timeoutStop chan CStreamReturn
@@ -51,6 +54,9 @@ type ResponseStream struct {
 	closing    bool
 	terminated bool
 	onClose    func(stream *ResponseStream)
+	// end is how the ResponseStream ended, set right before onClose runs
+	end  CStreamReturn
+	span *Span
 }
 
 func (s *ResponseStream) ingestPID(message *Packet) {
@@ -62,6 +68,8 @@ func (s *ResponseStream) ingestPID(message *Packet) {
 }
 
 func (s *ResponseStream) hasPID(newPid string) bool {
+	s.pidLock.RLock()
+	defer s.pidLock.RUnlock()
 	for _, pid := range s.packetIDs {
 		if pid == newPid {
 			return true
@@ -72,15 +80,38 @@ func (s *ResponseStream) hasPID(newPid string) bool {
 
 // Assembles the request, registering the receiver events and whatnot
 // NOTE: DO NOT EVER MODIFY THE RETURNED MESSAGE
-func (s *Satellite) assembleRequest(packetType PType, namespace string, value interface{}, isBroadcast bool) (Packet, *ResponseStream, error) {
+// A ttl above 0 marks the request as a flooded packet which gets relayed by the remote peers
+// The request is traced under the parent span, or as a new trace if the parent isn't valid
+// The nonce is left out for requests reaching legacy peers, see `isLegacy`
+func (s *Satellite) assembleRequest(parent SpanContext, packetType PType, namespace string, value interface{}, isBroadcast bool, ttl int, nonce bool) (Packet, *ResponseStream, error) {
 	msg := Packet{
 		PacketType: packetType,
 		Namespace:  namespace,
 		Payload:    value,
+		Timestamp:  s.clock.Now().Unix(),
 	}
 
+	if nonce {
+		id, err := newMessageID()
+		if err != nil {
+			return msg, nil, fmt.Errorf("failed to generate nonce: %v", err)
+		}
+		msg.Nonce = id
+	}
+
+	if ttl > 0 {
+		msg.Origin = s.ID()
+		msg.TTL = ttl
+	}
+
+	span := s.StartSpan(fmt.Sprintf("%v %v", ptypeLabel(packetType), namespace), parent)
+	span.SetAttribute("namespace", namespace)
+	msg.Trace = span.Context().ref()
+
 	rs := &ResponseStream{
 		Tag:            msg.ReturnTag(),
+		Trace:          span.Context(),
+		span:           span,
 		Stream:         make(chan *Inbound, ResponseStreamBuffer),
 		Done:           make(chan CStreamReturn, 1),
 		timeoutStop:    make(chan CStreamReturn, 1),
@@ -93,6 +124,11 @@ func (s *Satellite) assembleRequest(packetType PType, namespace string, value in
 		onClose: func(stream *ResponseStream) {
 			s.RemoveEvent(PType_ResponseEnd, msg.ReturnTag())
 			s.RemoveEvent(PType_Response, msg.ReturnTag())
+			s.RemoveEvent(PType_Error, msg.ReturnTag())
+			s.metrics.streamEnded(packetType, stream.end)
+			stream.span.SetAttribute("outcome", streamEndLabel(stream.end))
+			stream.span.SetAttribute("responses", fmt.Sprint(stream.packetCount))
+			stream.span.Finish()
 		},
 	}
 
@@ -109,15 +145,21 @@ func (s *Satellite) assembleRequest(packetType PType, namespace string, value in
 
 			// Send data to the response stream
 			rs.Stream <- i
+			// Responses and the ResponseEnd packet are handled concurrently, the counts are checked
+			// under the lock so only one of them signals the end of the stream
+			rs.pidLock.Lock()
 			rs.packetCount++
+			allArrived := !isBroadcast && rs.endPacketCount != -1 && rs.endPacketCount == rs.packetCount
+			rs.pidLock.Unlock()
 			rs.ingestPID(&i.Message)
 			// check if the respondEnd count has arrived and that if this is the last response
-			if !isBroadcast && rs.endPacketCount != -1 && rs.endPacketCount == rs.packetCount {
+			if allArrived {
 				log.Debugf("All of the %v packets have arrived", msg.ReturnTag())
-				rs.hasEnded <- 1
+				rs.hasEnded <- StreamEndOK
 			}
 		} else {
 			log.Error("received response on a closing response stream: %v", msg.ReturnTag())
+			s.metrics.inboundDropped(DropClosedStream)
 		}
 	})
 
@@ -127,6 +169,19 @@ func (s *Satellite) assembleRequest(packetType PType, namespace string, value in
 		rs.close()
 	})
 
+	// A seek goes to several peers, one of them refusing it doesn't end the stream
+	s.Event(PType_Error, msg.ReturnTag(), func(i *Inbound) {
+		reason, _ := i.Payload.(string)
+		if isBroadcast {
+			log.Debugf("%v refused seek %v: %v", i.PeerID(), namespace, reason)
+			return
+		}
+		log.Errorf("Request %v refused by the remote peer: %v", namespace, reason)
+		rs.Error = reason
+		rs.hasEnded <- StreamEndError
+		rs.close()
+	})
+
 	return msg, rs, nil
 }
 
@@ -138,6 +193,7 @@ func (r *ResponseStream) close() {
 		// Wait for all of the expected packets to arrive
 		// send int to hasEnded if you want to close whenever
 		endType := <-r.hasEnded
+		r.end = endType
 
 		// Run the onClose function
 		r.onClose(r)
@@ -168,22 +224,50 @@ func (s *Satellite) Broadcast(namespace string, value interface{}) []error {
 }
 
 func (s *Satellite) bcast(namespace string, value interface{}, async bool) []error {
+	span := s.StartSpan("broadcast "+namespace, SpanContext{})
+	span.SetAttribute("namespace", namespace)
 	msg := Packet{
 		PacketType: PType_Broadcast,
 		Namespace:  namespace,
 		Payload:    value,
+		Trace:      span.Context().ref(),
 	}
 	log.Debugf("broadcasting message: %v as %v", msg, msg.ReturnTag())
 	if !async {
-		return skademlia.Broadcast(s.Node, msg)
+		errs := s.broadcastPacket(msg)
+		span.SetAttribute("errors", fmt.Sprint(len(errs)))
+		span.Finish()
+		return errs
 	}
 
-	skademlia.BroadcastAsync(s.Node, msg)
+	go func() {
+		errs := s.broadcastPacket(msg)
+		span.SetAttribute("errors", fmt.Sprint(len(errs)))
+		span.Finish()
+	}()
 	return nil
 }
 
 func (s *Satellite) Seek(namespace string, value interface{}) (*ResponseStream, error) {
-	msg, responseStream, err := s.assembleRequest(PType_Seek, namespace, value, true)
+	return s.seek(SpanContext{}, namespace, value, 0)
+}
+
+// SeekTraced works like `Satellite.Seek` but traces the seek under the parent span,
+// such as the `Inbound.Trace` of the handler it is sent from
+func (s *Satellite) SeekTraced(parent SpanContext, namespace string, value interface{}) (*ResponseStream, error) {
+	return s.seek(parent, namespace, value, 0)
+}
+
+func (s *Satellite) seek(parent SpanContext, namespace string, value interface{}, ttl int) (*ResponseStream, error) {
+	// Flooded seeks carry their origin which legacy peers don't relay either, they always get a nonce
+	nonce := ttl > 0
+	if !nonce {
+		nonce = true
+		for _, peer := range s.closestPeers() {
+			nonce = nonce && !isLegacy(peer)
+		}
+	}
+	msg, responseStream, err := s.assembleRequest(parent, PType_Seek, namespace, value, true, ttl, nonce)
 	if err != nil {
 		return nil, err
 	}
@@ -194,7 +278,13 @@ func (s *Satellite) Seek(namespace string, value interface{}) (*ResponseStream,
 
 	log.Debugf("SEEK: %v", msg.ReturnTag())
 	// Send the request packet to the remote peer
-	errs := skademlia.Broadcast(s.Node, msg)
+	var errs []error
+	if ttl > 0 {
+		s.flood.markSeen(msg.ReturnTag())
+		errs = s.flood.send(msg, nil)
+	} else {
+		errs = s.broadcastPacket(msg)
+	}
 	if len(errs) != 0 {
 		log.Debug("Ending broadcast prematurely")
 		responseStream.hasEnded <- StreamEndError
@@ -207,7 +297,7 @@ func (s *Satellite) Seek(namespace string, value interface{}) (*ResponseStream,
 		select {
 		case <-responseStream.timeoutStop:
 			return
-		case <-time.After(SeekStreamLifetime):
+		case <-s.clock.After(SeekStreamLifetime):
 			log.Debug("Ending seek stream by timeout")
 			responseStream.hasEnded <- StreamEndTimeout
 			responseStream.close()
@@ -222,18 +312,39 @@ func (s *Satellite) Seek(namespace string, value interface{}) (*ResponseStream,
 // Receiving a value from the `ResponseStream.Done` channel also indicates the same thing as a closing `Stream` channel.
 //      A response stream may close for other reasons such as the global timeout indicated by `ResponseStreamLifetime`
 func (s *Satellite) Request(peer *noise.Peer, namespace string, value interface{}) (*ResponseStream, error) {
-	msg, responseStream, err := s.assembleRequest(PType_Request, namespace, value, false)
+	return s.request(SpanContext{}, peer, namespace, value, nil)
+}
+
+// RequestTraced works like `Satellite.Request` but traces the request under the parent span,
+// such as the `Inbound.Trace` of the handler it is sent from
+func (s *Satellite) RequestTraced(parent SpanContext, peer *noise.Peer, namespace string, value interface{}) (*ResponseStream, error) {
+	return s.request(parent, peer, namespace, value, nil)
+}
+
+// RequestWithCapability works like `Satellite.Request` but attaches the capability to the request,
+// granting access to a namespace the ACL of the peer guards. See `keys.IssueCapability`.
+func (s *Satellite) RequestWithCapability(peer *noise.Peer, namespace string, value interface{}, capability *keys.Capability) (*ResponseStream, error) {
+	return s.request(SpanContext{}, peer, namespace, value, capability)
+}
+
+func (s *Satellite) request(parent SpanContext, peer *noise.Peer, namespace string, value interface{}, capability *keys.Capability) (*ResponseStream, error) {
+	msg, responseStream, err := s.assembleRequest(parent, PType_Request, namespace, value, false, 0, !isLegacy(peer))
 	if err != nil {
 		return nil, err
 	}
+	msg.Capability = capability
+	responseStream.span.SetAttribute("peer", GetPeerID(peer))
 
 	// Dispatch an event listener to end the responseStream after the remote peer is done with responding.
 	s.Event(PType_ResponseEnd, msg.ReturnTag(), func(i *Inbound) {
+		responseStream.pidLock.Lock()
 		log.Debugf("Ending request stream by remote, expected/arrived packets: %v/%v", i.Payload, responseStream.packetCount)
 		responseStream.endPacketCount = int(i.Payload.(float64))
+		allArrived := responseStream.endPacketCount == responseStream.packetCount
+		responseStream.pidLock.Unlock()
 
 		// Check if all of the packets have arrived
-		if responseStream.endPacketCount == responseStream.packetCount {
+		if allArrived {
 			log.Debugf(roggy.Clr("All of the %v packets have arrived", 2), msg.ReturnTag())
 			responseStream.hasEnded <- StreamEndOK
 		}
@@ -242,7 +353,7 @@ func (s *Satellite) Request(peer *noise.Peer, namespace string, value interface{
 	})
 
 	// Send the request packet to the remote peer
-	err = peer.SendMessage(msg)
+	err = s.sendPacket(peer, msg)
 	if err != nil {
 		log.Debug("Ending request stream by error")
 		responseStream.hasEnded <- StreamEndError
@@ -255,7 +366,7 @@ func (s *Satellite) Request(peer *noise.Peer, namespace string, value interface{
 		select {
 		case <-responseStream.timeoutStop:
 			return
-		case <-time.After(ResponseStreamLifetime):
+		case <-s.clock.After(ResponseStreamLifetime):
 			log.Debug("Ending request stream by timeout")
 			responseStream.hasEnded <- StreamEndTimeout
 			responseStream.close()
@@ -0,0 +1,57 @@
+package satellite_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nokusukun/particles/satellite"
+	"github.com/nokusukun/particles/satellite/satellitetest"
+)
+
+// TestParallelRequests registers the response events of many requests at once while the
+// inbound processor dispatches their responses, run it with -race.
+func TestParallelRequests(t *testing.T) {
+	c, err := satellitetest.StartInMemory(2, satellitetest.Line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Sat(1).Event(satellite.PType_Request, "echo", func(i *satellite.Inbound) {
+		i.Reply(i.Payload)
+		i.EndReply()
+	})
+	peer, err := c.Sat(0).WaitForPeer(c.ID(1), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wait sync.WaitGroup
+	errs := make(chan error, 32)
+	for n := 0; n < 32; n++ {
+		wait.Add(1)
+		go func(n int) {
+			defer wait.Done()
+			rs, err := c.Sat(0).Request(peer, "echo", n)
+			if err != nil {
+				errs <- err
+				return
+			}
+			var replies []interface{}
+			for in := range rs.Stream {
+				replies = append(replies, in.Payload)
+			}
+			if len(replies) != 1 || replies[0] != float64(n) {
+				errs <- fmt.Errorf("request %v got %v", n, replies)
+			}
+		}(n)
+	}
+	wait.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,128 @@
+package satellite
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"github.com/perlin-network/noise"
+	"github.com/perlin-network/noise/payload"
+	"github.com/perlin-network/noise/protocol"
+)
+
+var (
+	_ protocol.Block = (*swarmBlock)(nil)
+	_ noise.Message  = (*swarmHandshake)(nil)
+
+	// SwarmHandshakeTimeout is how long a peer has to prove it knows the swarm key
+	SwarmHandshakeTimeout = 10 * time.Second
+)
+
+const swarmNonceSize = 32
+
+// swarmHandshake carries the nonce of a peer, then its proof of the swarm key over the nonces of both ends
+type swarmHandshake struct {
+	Nonce []byte
+	Proof []byte
+}
+
+func (h swarmHandshake) Read(reader payload.Reader) (noise.Message, error) {
+	nonce, err := reader.ReadBytes()
+	if err != nil {
+		return nil, err
+	}
+	proof, err := reader.ReadBytes()
+	if err != nil {
+		return nil, err
+	}
+	return swarmHandshake{Nonce: nonce, Proof: proof}, nil
+}
+
+func (h swarmHandshake) Write() []byte {
+	return payload.NewWriter(nil).WriteBytes(h.Nonce).WriteBytes(h.Proof).Bytes()
+}
+
+// swarmBlock rejects the peers that don't know the pre-shared key of a private network. It runs after the
+// session is encrypted and before s/kad, so peers outside the network never reach the routing table or the satellite.
+type swarmBlock struct {
+	sat    *Satellite
+	key    []byte
+	opcode noise.Opcode
+	// timeout is SwarmHandshakeTimeout when the block got created
+	timeout time.Duration
+}
+
+func newSwarmBlock(sat *Satellite, key []byte) *swarmBlock {
+	return &swarmBlock{sat: sat, key: key, timeout: SwarmHandshakeTimeout}
+}
+
+func (b *swarmBlock) OnRegister(p *protocol.Protocol, node *noise.Node) {
+	b.opcode = noise.RegisterMessage(noise.NextAvailableOpcode(), (*swarmHandshake)(nil))
+}
+
+func (b *swarmBlock) OnBegin(p *protocol.Protocol, peer *noise.Peer) error {
+	if err := b.handshake(peer); err != nil {
+		log.Debugf("rejected %v from the private network: %v", peer.RemoteIP(), err)
+		b.sat.metrics.connectionRejected()
+		return protocol.DisconnectPeer
+	}
+	return nil
+}
+
+func (b *swarmBlock) OnEnd(p *protocol.Protocol, peer *noise.Peer) error {
+	return nil
+}
+
+// handshake exchanges nonces with the peer then proves the key over both of them. The proofs are bound to
+// the session key and ordered by whose nonce goes first, so one can't be replayed or reflected back.
+func (b *swarmBlock) handshake(peer *noise.Peer) error {
+	nonce := make([]byte, swarmNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	if err := peer.SendMessage(swarmHandshake{Nonce: nonce}); err != nil {
+		return fmt.Errorf("failed to send nonce: %v", err)
+	}
+	theirs, err := b.receive(peer)
+	if err != nil {
+		return err
+	}
+	if len(theirs.Nonce) != swarmNonceSize || bytes.Equal(theirs.Nonce, nonce) {
+		return fmt.Errorf("invalid nonce")
+	}
+
+	session := protocol.LoadSharedKey(peer)
+	if err := peer.SendMessage(swarmHandshake{Proof: b.proof(session, theirs.Nonce, nonce)}); err != nil {
+		return fmt.Errorf("failed to send proof: %v", err)
+	}
+	res, err := b.receive(peer)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(res.Proof, b.proof(session, nonce, theirs.Nonce)) {
+		return fmt.Errorf("peer doesn't know the swarm key")
+	}
+	return nil
+}
+
+func (b *swarmBlock) receive(peer *noise.Peer) (swarmHandshake, error) {
+	select {
+	case msg := <-peer.Receive(b.opcode):
+		return msg.(swarmHandshake), nil
+	case <-time.After(b.timeout):
+		return swarmHandshake{}, fmt.Errorf("timed out waiting for the swarm handshake")
+	}
+}
+
+// proof is the HMAC of the session key and the nonces under the swarm key, the nonce of the verifier goes first
+func (b *swarmBlock) proof(session, verifier, prover []byte) []byte {
+	mac := hmac.New(sha256.New, b.key)
+	mac.Write(session)
+	mac.Write(verifier)
+	mac.Write(prover)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,57 @@
+package satellite_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nokusukun/particles/config"
+	"github.com/nokusukun/particles/keys"
+	"github.com/nokusukun/particles/satellite"
+	"github.com/nokusukun/particles/satellite/satellitetest"
+)
+
+// TestSwarmHandshake only lets the satellites that know the swarm key into the private network,
+// the others get disconnected and counted as rejected.
+func TestSwarmHandshake(t *testing.T) {
+	c, err := satellitetest.StartInMemory(1, satellitetest.None)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	withKey := func(key []byte) func(conf *config.Satellite) {
+		return func(conf *config.Satellite) { conf.SwarmKey = key }
+	}
+	// Satellites keep the handshake timeout they're built with
+	timeout := satellite.SwarmHandshakeTimeout
+	satellite.SwarmHandshakeTimeout = 500 * time.Millisecond
+	key := generateSwarmKey(t)
+	a := c.AddWith(withKey(key))
+	b := c.AddWith(withKey(key))
+	stranger := c.AddWith(withKey(generateSwarmKey(t)))
+	satellite.SwarmHandshakeTimeout = timeout
+
+	if err := c.Connect(a, b); err != nil {
+		t.Fatal("satellites with the same key didn't connect: ", err)
+	}
+
+	for n, outsider := range []int{stranger, 0} {
+		c.Sat(outsider).Node.Dial(c.Sat(a).Node.ExternalAddress())
+
+		err := satellitetest.WaitUntil(5*time.Second, func() bool { return metric(t, c.Sat(a), "particles_rejected_connections_total") == n+1 })
+		if err != nil {
+			t.Fatalf("%v never got rejected: %v", outsider, err)
+		}
+		if c.Sat(a).HasPeer(c.ID(outsider)) || c.Sat(outsider).HasPeer(c.ID(a)) {
+			t.Errorf("%v got into the private network", outsider)
+		}
+	}
+}
+
+func generateSwarmKey(t *testing.T) []byte {
+	key, err := keys.GenerateSwarmKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
@@ -0,0 +1,128 @@
+package satellite
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/perlin-network/noise/transport"
+)
+
+var (
+	_ transport.Layer = (*tcpTransport)(nil)
+
+	// TCPDialTimeout is how long dialing a TCP address can take
+	TCPDialTimeout = 3 * time.Second
+)
+
+// tcpTransport works like the TCP transport of noise, except that connections get dialed from the listening port.
+// NATs that keep the port of an endpoint then map every connection of the satellite to the same external address,
+// which is the address its peers observe and what hole punching dials.
+type tcpTransport struct {
+	// listening are the addresses of the listeners, connections get dialed from the port of the same IP family
+	listening []*net.TCPAddr
+	lock      *sync.Mutex
+}
+
+func newTCPTransport() *tcpTransport {
+	return &tcpTransport{lock: &sync.Mutex{}}
+}
+
+func (t *tcpTransport) String() string {
+	return "tcp"
+}
+
+// Listen listens on the host only, an unspecified IPv4 host doesn't cover IPv6 and the other way around.
+// The listener shares its port with the dialed connections, so the port is claimed without sharing first:
+// listening on a port another process holds fails with "address in use" even if it shares it too.
+func (t *tcpTransport) Listen(host string, port uint16) (net.Listener, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("unable to parse host as IP: %s", host)
+	}
+
+	network := "tcp4"
+	if ip.To4() == nil {
+		network = "tcp6"
+	}
+
+	probe, err := net.Listen(network, net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, err
+	}
+	address := probe.Addr().String()
+	listener := probe
+	if reusePortSupported {
+		probe.Close()
+		lc := net.ListenConfig{Control: reusePort}
+		if listener, err = lc.Listen(context.Background(), network, address); err != nil {
+			return nil, err
+		}
+	}
+
+	t.lock.Lock()
+	t.listening = append(t.listening, listener.Addr().(*net.TCPAddr))
+	t.lock.Unlock()
+	return listener, nil
+}
+
+// Dial dials from the listening port, falling back to any port if it's taken by a connection to the same address
+func (t *tcpTransport) Dial(address string) (net.Conn, error) {
+	if port := t.localPort(address); port != 0 && reusePortSupported {
+		dialer := net.Dialer{
+			Timeout:   TCPDialTimeout,
+			LocalAddr: &net.TCPAddr{Port: int(port)},
+			Control:   reusePort,
+		}
+		conn, err := dialer.Dial("tcp", address)
+		if err == nil || !isAddressInUse(err) {
+			return conn, err
+		}
+		log.Debugf("listening port is in use for %v, dialing from another port", address)
+	}
+
+	return net.DialTimeout("tcp", address, TCPDialTimeout)
+}
+
+// localPort returns the port of the first listener in the IP family of the address, 0 if there's none
+func (t *tcpTransport) localPort(address string) uint16 {
+	host, _ := splitAddress(address)
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return 0
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, addr := range t.listening {
+		if (addr.IP.To4() == nil) == (ip.To4() == nil) {
+			return uint16(addr.Port)
+		}
+	}
+	return 0
+}
+
+func (t *tcpTransport) IP(address net.Addr) net.IP {
+	return address.(*net.TCPAddr).IP
+}
+
+func (t *tcpTransport) Port(address net.Addr) uint16 {
+	return uint16(address.(*net.TCPAddr).Port)
+}
+
+func isAddressInUse(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return false
+	}
+	sysErr, ok := opErr.Err.(*os.SyscallError)
+	if !ok {
+		return false
+	}
+	return sysErr.Err == syscall.EADDRINUSE || sysErr.Err == syscall.EADDRNOTAVAIL
+}
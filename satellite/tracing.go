@@ -0,0 +1,207 @@
+package satellite
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"sync"
+	"time"
+)
+
+// SpanContext identifies a span, packets carry the span of the operation that sent them so the
+// work of the remote satellites can be linked back to it.
+type SpanContext struct {
+	TraceID string `json:"t"`
+	SpanID  string `json:"s"`
+}
+
+func (c SpanContext) IsValid() bool {
+	return c.TraceID != "" && c.SpanID != ""
+}
+
+// ref returns a reference to the context for a packet, nil if there's nothing to carry
+func (c SpanContext) ref() *SpanContext {
+	if !c.IsValid() {
+		return nil
+	}
+	return &c
+}
+
+// Span is a timed operation of a trace, spans get sent to the exporters of the satellite once they're finished.
+// A span isn't safe to be modified concurrently. Spans started while the satellite has no exporters aren't
+// recorded, their context is the one of their parent so the trace still goes through the satellite.
+type Span struct {
+	TraceID    string            `json:"trace_id"`
+	SpanID     string            `json:"span_id"`
+	ParentID   string            `json:"parent_id,omitempty"`
+	Name       string            `json:"name"`
+	Satellite  string            `json:"satellite"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+
+	// tracer is nil if the span isn't recorded
+	tracer   *tracer
+	finished bool
+}
+
+func (s *Span) Context() SpanContext {
+	return SpanContext{TraceID: s.TraceID, SpanID: s.SpanID}
+}
+
+func (s *Span) SetAttribute(key, value string) {
+	if s.tracer == nil {
+		return
+	}
+	s.Attributes[key] = value
+}
+
+// Finish ends the span and sends it to the exporters, only the first call does anything
+func (s *Span) Finish() {
+	if s.finished || s.tracer == nil {
+		return
+	}
+	s.finished = true
+	s.End = time.Now()
+	s.tracer.export(s)
+}
+
+// SpanExporter receives every finished span of a satellite
+type SpanExporter interface {
+	ExportSpan(span *Span) error
+}
+
+// SpanExporterFunc lets a plain function be used as a SpanExporter
+type SpanExporterFunc func(span *Span) error
+
+func (f SpanExporterFunc) ExportSpan(span *Span) error {
+	return f(span)
+}
+
+type tracer struct {
+	exporters []SpanExporter
+
+	lock *sync.RWMutex
+}
+
+func newTracer() *tracer {
+	return &tracer{lock: &sync.RWMutex{}}
+}
+
+// recording returns true if there's an exporter to send the spans to
+func (t *tracer) recording() bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return len(t.exporters) > 0
+}
+
+func (t *tracer) export(span *Span) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	for _, exporter := range t.exporters {
+		if err := exporter.ExportSpan(span); err != nil {
+			log.Error("failed to export span: ", err)
+		}
+	}
+}
+
+// AddSpanExporter adds an exporter which receives the spans of the satellite
+func (s *Satellite) AddSpanExporter(exporter SpanExporter) {
+	s.tracer.lock.Lock()
+	defer s.tracer.lock.Unlock()
+	s.tracer.exporters = append(s.tracer.exporters, exporter)
+}
+
+// StartSpan starts a span under the parent, a new trace is started if the parent isn't valid.
+// Spans of handlers are started from `Inbound.Trace`.
+func (s *Satellite) StartSpan(name string, parent SpanContext) *Span {
+	if !s.tracer.recording() {
+		return &Span{TraceID: parent.TraceID, SpanID: parent.SpanID, Name: name}
+	}
+
+	span := &Span{
+		TraceID:    parent.TraceID,
+		ParentID:   parent.SpanID,
+		SpanID:     randomHex(8),
+		Name:       name,
+		Satellite:  s.ID(),
+		Start:      time.Now(),
+		Attributes: map[string]string{},
+		tracer:     s.tracer,
+	}
+
+	if !parent.IsValid() {
+		span.TraceID = randomHex(16)
+		span.ParentID = ""
+	}
+	return span
+}
+
+// tracesHandler returns true if handling the packet gets its own span, stream packets are part of the request span
+// and the internal packets are only traced if they're part of a trace.
+func tracesHandler(msg Packet) bool {
+	switch msg.PacketType {
+	case PType_Response, PType_ResponseEnd, PType_NotImplemented, PType_Error:
+		return false
+	case PType_Internal:
+		return msg.Trace != nil
+	}
+	return true
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		log.Error("failed to generate random ID: ", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// JSONFileExporter appends every span as a line of JSON to a file, which can be merged with the files
+// of the other satellites to follow a trace across the network.
+type JSONFileExporter struct {
+	file   *os.File
+	writer *bufio.Writer
+
+	lock *sync.Mutex
+}
+
+func NewJSONFileExporter(path string) (*JSONFileExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JSONFileExporter{
+		file:   file,
+		writer: bufio.NewWriter(file),
+		lock:   &sync.Mutex{},
+	}, nil
+}
+
+func (e *JSONFileExporter) ExportSpan(span *Span) error {
+	b, err := json.Marshal(span)
+	if err != nil {
+		return err
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if _, err := e.writer.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return e.writer.Flush()
+}
+
+func (e *JSONFileExporter) Close() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if err := e.writer.Flush(); err != nil {
+		return err
+	}
+	return e.file.Close()
+}
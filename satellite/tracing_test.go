@@ -0,0 +1,253 @@
+package satellite_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nokusukun/particles/satellite"
+	"github.com/nokusukun/particles/satellite/satellitetest"
+)
+
+// spanRecorder collects the finished spans of satellites
+type spanRecorder struct {
+	spans []*satellite.Span
+	lock  sync.Mutex
+}
+
+func record(sats ...*satellite.Satellite) *spanRecorder {
+	r := &spanRecorder{}
+	for _, sat := range sats {
+		sat.AddSpanExporter(satellite.SpanExporterFunc(func(span *satellite.Span) error {
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			r.spans = append(r.spans, span)
+			return nil
+		}))
+	}
+	return r
+}
+
+// wait returns the spans named name once there are count of them
+func (r *spanRecorder) wait(t *testing.T, name string, count int) []*satellite.Span {
+	t.Helper()
+	var found []*satellite.Span
+	err := satellitetest.WaitUntil(5*time.Second, func() bool {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		found = nil
+		for _, span := range r.spans {
+			if span.Name == name {
+				found = append(found, span)
+			}
+		}
+		return len(found) >= count
+	})
+	if err != nil {
+		t.Fatalf("got %v spans named %v instead of %v", len(found), name, count)
+	}
+	return found
+}
+
+// childOf checks that the spans continue the trace under the parent span
+func childOf(t *testing.T, parent satellite.SpanContext, spans ...*satellite.Span) {
+	t.Helper()
+	for _, span := range spans {
+		if span.TraceID != parent.TraceID || span.ParentID != parent.SpanID {
+			t.Errorf("%v on %v is in trace %v under %v, expected trace %v under %v",
+				span.Name, span.Satellite, span.TraceID, span.ParentID, parent.TraceID, parent.SpanID)
+		}
+	}
+}
+
+// TestTraceRequest traces a request, the handler runs under the request span and its replies carry the handler span
+func TestTraceRequest(t *testing.T) {
+	c, err := satellitetest.StartInMemory(2, satellitetest.Line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	spans := record(c.Sat(0), c.Sat(1))
+
+	c.Sat(1).Event(satellite.PType_Request, "echo", func(i *satellite.Inbound) {
+		i.Reply(i.Payload)
+		i.EndReply()
+	})
+	peer, err := c.Sat(0).WaitForPeer(c.ID(1), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := c.Sat(0).Request(peer, "echo", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replies []*satellite.Inbound
+	for in := range rs.Stream {
+		replies = append(replies, in)
+	}
+
+	request := spans.wait(t, "request echo", 1)[0]
+	handler := spans.wait(t, "handle request echo", 1)[0]
+	if request.Context() != rs.Trace || request.ParentID != "" || request.Satellite != c.ID(0) {
+		t.Errorf("the request span %+v doesn't match the stream trace %v", request, rs.Trace)
+	}
+	childOf(t, request.Context(), handler)
+	if handler.Satellite != c.ID(1) || handler.Attributes["replies"] != "1" {
+		t.Errorf("the handler span is %+v", handler)
+	}
+	if len(replies) != 1 || replies[0].Trace != handler.Context() {
+		t.Errorf("the replies don't carry the handler span %v", handler.Context())
+	}
+}
+
+// TestTraceSeek traces a seek, the handlers of every peer run under the seek span
+func TestTraceSeek(t *testing.T) {
+	c, err := satellitetest.StartInMemory(3, satellitetest.Star)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	spans := record(c.Sat(0), c.Sat(1), c.Sat(2))
+
+	for n := 1; n < 3; n++ {
+		c.Sat(n).Event(satellite.PType_Seek, "find", func(i *satellite.Inbound) {
+			i.Reply(true)
+			i.EndReply()
+		})
+	}
+	// The seek span only finishes once the stream times out, the handlers get traced under its context
+	rs, err := c.Sat(0).Seek("find", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	childOf(t, rs.Trace, spans.wait(t, "handle seek find", 2)...)
+}
+
+// TestTraceFlood floods a broadcast through a line, the satellite in the middle has no exporters
+// and records nothing but the trace still reaches the end of the line.
+func TestTraceFlood(t *testing.T) {
+	c, err := satellitetest.StartInMemory(3, satellitetest.Line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	spans := record(c.Sat(0), c.Sat(2))
+
+	handled := c.Capture(1, satellite.PType_Broadcast, "news")
+	c.Capture(2, satellite.PType_Broadcast, "news")
+	if errs := c.Sat(0).BroadcastFlood("news", "hello", 2); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	broadcast := spans.wait(t, "broadcast news", 1)[0]
+	handlers := spans.wait(t, "handle broadcast news", 1)
+	childOf(t, broadcast.Context(), handlers...)
+	if len(handlers) != 1 || handlers[0].Satellite != c.ID(2) {
+		t.Errorf("the handlers were traced on %v", handlers)
+	}
+
+	in, err := satellitetest.WaitFor(handled, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.Trace != broadcast.Context() {
+		t.Errorf("the untraced satellite handled the broadcast in %v instead of its trace", in.Trace)
+	}
+}
+
+// TestUntracedSpan starts spans on a satellite without exporters, they keep the context of their parent
+func TestUntracedSpan(t *testing.T) {
+	c, err := satellitetest.StartInMemory(1, satellitetest.None)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	parent := satellite.SpanContext{TraceID: "trace", SpanID: "span"}
+	span := c.Sat(0).StartSpan("untraced", parent)
+	span.SetAttribute("key", "value")
+	span.Finish()
+	if span.Context() != parent {
+		t.Errorf("the untraced span has the context %v", span.Context())
+	}
+	if root := c.Sat(0).StartSpan("untraced", satellite.SpanContext{}); root.Context().IsValid() {
+		t.Errorf("the untraced span started the trace %v", root.Context())
+	}
+}
+
+// TestJSONFileExporter appends finished spans to a file as JSON lines, opening the file again keeps appending
+func TestJSONFileExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spans.json")
+
+	c, err := satellitetest.StartInMemory(1, satellitetest.None)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Every satellite appends to the file through its own exporter
+	var started []*satellite.Span
+	for n, name := range []string{"first", "second"} {
+		if n > 0 {
+			c.Add()
+		}
+		exporter, err := satellite.NewJSONFileExporter(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Sat(n).AddSpanExporter(exporter)
+
+		parent := satellite.SpanContext{}
+		if len(started) > 0 {
+			parent = started[0].Context()
+		}
+		span := c.Sat(n).StartSpan(name, parent)
+		span.SetAttribute("name", name)
+		span.Finish()
+		started = append(started, span)
+
+		if err := exporter.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var exported []map[string]interface{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("%q isn't JSON: %v", scanner.Text(), err)
+		}
+		exported = append(exported, line)
+	}
+	if len(exported) != 2 {
+		t.Fatalf("exported %v", exported)
+	}
+	for i, line := range exported {
+		span := started[i]
+		attributes, _ := line["attributes"].(map[string]interface{})
+		if line["name"] != span.Name || line["trace_id"] != span.TraceID || line["span_id"] != span.SpanID ||
+			line["satellite"] != c.ID(i) || attributes["name"] != span.Name {
+			t.Errorf("exported %v for %+v", line, span)
+		}
+	}
+	if exported[1]["parent_id"] != started[0].SpanID || exported[0]["parent_id"] != nil {
+		t.Errorf("the parents of the exported spans are %v and %v", exported[0]["parent_id"], exported[1]["parent_id"])
+	}
+}